@@ -0,0 +1,128 @@
+// Package aiff reads and writes AIFF and AIFF-C files, describing their samples with
+// pcm_convertor.StreamInfo.
+package aiff
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/ZhangJYd/pcm_convertor/format"
+	"github.com/ZhangJYd/pcm_convertor/model"
+)
+
+// aifcVersion is the timestamp of the AIFF-C version the FVER chunk names.
+const aifcVersion = 0xa2805140
+
+// unknownSize marks the sizes of a stream whose length was not known when the header
+// was written.
+const unknownSize = 0xffffffff
+
+// maxComm bounds the COMM chunk, which is read into memory whole. Real ones take at
+// most a few hundred bytes.
+const maxComm = 1 << 16
+
+var be = binary.BigEndian
+
+// compression describes an AIFF-C compression type.
+type compression struct {
+	id    string
+	name  string
+	order binary.ByteOrder
+	// linear is set for PCM, whose format the sample size decides.
+	linear bool
+	f      format.PcmFormat
+}
+
+var compressions = []compression{
+	{"NONE", "not compressed", binary.BigEndian, true, 0},
+	{"twos", "big-endian", binary.BigEndian, true, 0},
+	{"sowt", "little-endian", binary.LittleEndian, true, 0},
+	{"fl32", "32-bit floating point", binary.BigEndian, false, format.F32},
+	{"FL32", "32-bit floating point", binary.BigEndian, false, format.F32},
+	{"fl64", "64-bit floating point", binary.BigEndian, false, format.F64},
+	{"FL64", "64-bit floating point", binary.BigEndian, false, format.F64},
+	{"ulaw", "\xb5Law 2:1", binary.BigEndian, false, format.ULaw},
+	{"ULAW", "\xb5Law 2:1", binary.BigEndian, false, format.ULaw},
+	{"alaw", "ALaw 2:1", binary.BigEndian, false, format.ALaw},
+	{"ALAW", "ALaw 2:1", binary.BigEndian, false, format.ALaw},
+}
+
+// streamFormat maps an AIFF-C compression type and sample size onto a format and byte order.
+func streamFormat(id string, bits int) (format.PcmFormat, binary.ByteOrder, error) {
+	for _, c := range compressions {
+		if c.id != id {
+			continue
+		}
+		if !c.linear {
+			return c.f, c.order, nil
+		}
+		switch (bits + 7) / 8 {
+		case 1:
+			return format.U8, c.order, nil
+		case 2:
+			return format.S16, c.order, nil
+		case 3:
+			return format.S24, c.order, nil
+		case 4:
+			return format.S32, c.order, nil
+		}
+	}
+	return 0, nil, model.ErrInvalidFormat
+}
+
+// compressionFor picks the compression type that stores f with the least work. Plain
+// AIFF is used for big-endian linear PCM, which is when it returns nil.
+func compressionFor(f format.PcmFormat, order binary.ByteOrder) *compression {
+	var id string
+	switch f {
+	case format.F32:
+		id = "fl32"
+	case format.F64:
+		id = "fl64"
+	case format.ULaw:
+		id = "ulaw"
+	case format.ALaw:
+		id = "alaw"
+	default:
+		if order != binary.LittleEndian || f.FrameSize() == 1 {
+			return nil
+		}
+		id = "sowt"
+	}
+	for i := range compressions {
+		if compressions[i].id == id {
+			return &compressions[i]
+		}
+	}
+	return nil
+}
+
+// decodeExtended decodes the 80-bit IEEE 754 extended number AIFF stores sample rates in.
+func decodeExtended(b []byte) float64 {
+	exponent := int(be.Uint16(b[0:]) & 0x7fff)
+	mantissa := be.Uint64(b[2:])
+	if exponent == 0 && mantissa == 0 {
+		return 0
+	}
+	v := math.Ldexp(float64(mantissa), exponent-16383-63)
+	if b[0]&0x80 != 0 {
+		v = -v
+	}
+	return v
+}
+
+// encodeExtended encodes a positive integer as an 80-bit extended number.
+func encodeExtended(v uint64) []byte {
+	b := make([]byte, 10)
+	if v == 0 {
+		return b
+	}
+	shift := 0
+	for v&(1<<63) == 0 {
+		v <<= 1
+		shift++
+	}
+	be.PutUint16(b[0:], uint16(16383+63-shift))
+	be.PutUint64(b[2:], v)
+	return b
+}
@@ -0,0 +1,236 @@
+package aiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/ZhangJYd/pcm_convertor"
+	"github.com/ZhangJYd/pcm_convertor/format"
+	"github.com/ZhangJYd/pcm_convertor/model"
+	"github.com/ZhangJYd/pcm_convertor/resample"
+)
+
+func samples(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func TestExtended(t *testing.T) {
+	want := []byte{0x40, 0x0e, 0xac, 0x44, 0, 0, 0, 0, 0, 0}
+	if got := encodeExtended(44100); !bytes.Equal(got, want) {
+		t.Errorf("44100 encodes to %x, want %x", got, want)
+	}
+	for _, rate := range []uint64{1, 8000, 11025, 22050, 44100, 48000, 96000, 192000, 352800} {
+		if got := decodeExtended(encodeExtended(rate)); got != float64(rate) {
+			t.Errorf("%d came back as %v", rate, got)
+		}
+	}
+	// 8000.5 Hz, a rate that is not a whole number.
+	if got := decodeExtended([]byte{0x40, 0x0b, 0xfa, 0x04, 0, 0, 0, 0, 0, 0}); got != 8000.5 {
+		t.Errorf("got %v, want 8000.5", got)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	f, err := ioutil.TempFile("", "aiff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	var testCases = []struct {
+		info pcm_convertor.StreamInfo
+		form string
+		// order is the byte order the Reader reports.
+		order binary.ByteOrder
+	}{
+		{pcm_convertor.StreamInfo{SampleRate: 44100, Format: format.S16, ByteOrder: binary.BigEndian, Channels: 2}, "AIFF", binary.BigEndian},
+		{pcm_convertor.StreamInfo{SampleRate: 8000, Format: format.U8, ByteOrder: binary.BigEndian, Channels: 1}, "AIFF", binary.BigEndian},
+		{pcm_convertor.StreamInfo{SampleRate: 96000, Format: format.S24, ByteOrder: binary.BigEndian, Channels: 3}, "AIFF", binary.BigEndian},
+		{pcm_convertor.StreamInfo{SampleRate: 48000, Format: format.S16, ByteOrder: binary.LittleEndian, Channels: 2}, "AIFC", binary.LittleEndian},
+		{pcm_convertor.StreamInfo{SampleRate: 48000, Format: format.S32, ByteOrder: binary.LittleEndian, Channels: 1}, "AIFC", binary.LittleEndian},
+		{pcm_convertor.StreamInfo{SampleRate: 22050, Format: format.F32, ByteOrder: binary.BigEndian, Channels: 1}, "AIFC", binary.BigEndian},
+		{pcm_convertor.StreamInfo{SampleRate: 22050, Format: format.F64, ByteOrder: binary.LittleEndian, Channels: 2}, "AIFC", binary.BigEndian},
+		{pcm_convertor.StreamInfo{SampleRate: 8000, Format: format.ULaw, ByteOrder: binary.BigEndian, Channels: 1}, "AIFC", binary.BigEndian},
+		{pcm_convertor.StreamInfo{SampleRate: 8000, Format: format.ALaw, ByteOrder: binary.BigEndian, Channels: 1}, "AIFC", binary.BigEndian},
+	}
+	for _, tc := range testCases {
+		name := tc.info.Format.String()
+		out, err := os.Create(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := NewWriter(out, tc.info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := samples(tc.info.Format.FrameSize() * tc.info.Channels * 51)
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		out.Close()
+
+		file, err := ioutil.ReadFile(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(file[8:12]) != tc.form {
+			t.Errorf("%s: written as %s, want %s", name, file[8:12], tc.form)
+		}
+		if size := binary.BigEndian.Uint32(file[4:]); int(size) != len(file)-8 {
+			t.Errorf("%s: FORM size %d for a %d byte file", name, size, len(file))
+		}
+		r, err := NewReader(bytes.NewReader(file))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		want := tc.info
+		want.ByteOrder = tc.order
+		if r.StreamInfo() != want {
+			t.Errorf("got %+v, want %+v", r.StreamInfo(), want)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.order != tc.info.ByteOrder {
+			got = format.SwapBytes(got, tc.info.Format.FrameSize())
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: samples differ", name)
+		}
+	}
+}
+
+func TestReadSigned8Bit(t *testing.T) {
+	comm := make([]byte, 18)
+	binary.BigEndian.PutUint16(comm[0:], 1)
+	binary.BigEndian.PutUint32(comm[2:], 3)
+	binary.BigEndian.PutUint16(comm[6:], 8)
+	copy(comm[8:], encodeExtended(11025))
+	file := []byte("FORM\x00\x00\x00\x00AIFF")
+	file = appendChunk(file, "COMM", comm)
+	file = appendChunk(file, "SSND", []byte{0, 0, 0, 0, 0, 0, 0, 0, 0x00, 0x7f, 0x80})
+
+	r, err := NewReader(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Signed 0, 127 and -128 as unsigned samples.
+	if !bytes.Equal(got, []byte{0x80, 0xff, 0x00}) {
+		t.Errorf("got %x", got)
+	}
+}
+
+func TestReadHugeComm(t *testing.T) {
+	file := append([]byte("FORM\x00\x00\x00\x00AIFFCOMM\xff\xff\xff\xf0"), make([]byte, 18)...)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := NewReader(bytes.NewReader(file)); err != model.ErrInvalidHeader {
+		t.Errorf("got %v", err)
+	}
+	runtime.ReadMemStats(&after)
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 1<<20 {
+		t.Errorf("allocated %d bytes", alloc)
+	}
+}
+
+func TestConvert24Bit(t *testing.T) {
+	s16 := pcm_convertor.StreamInfo{SampleRate: 48000, Format: format.S16, ByteOrder: binary.LittleEndian, Channels: 2}
+	s24 := pcm_convertor.StreamInfo{SampleRate: 48000, Format: format.S24, ByteOrder: binary.BigEndian, Channels: 2}
+	convert := func(in, out pcm_convertor.StreamInfo, data []byte) []byte {
+		c, err := pcm_convertor.NewConvertor(&in, &out, resample.MediumQ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		got, err := c.Process(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tail, err := c.Flush()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append(got, tail...)
+	}
+
+	data := samples(2 * 2 * 100)
+	buf := new(bytes.Buffer)
+	w, err := NewWriter(buf, s24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(convert(s16, s24, data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.StreamInfo() != s24 {
+		t.Errorf("got %+v, want %+v", r.StreamInfo(), s24)
+	}
+	file, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := convert(r.StreamInfo(), s16, file); !bytes.Equal(got, data) {
+		t.Error("samples differ after going through a 24-bit file")
+	}
+}
+
+// shortWriter takes n bytes and fails after that.
+type shortWriter struct {
+	n int
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		n := w.n
+		w.n = 0
+		return n, io.ErrShortWrite
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestShortWrite(t *testing.T) {
+	// Little-endian floats are swapped.
+	info := pcm_convertor.StreamInfo{SampleRate: 8000, Format: format.F32, ByteOrder: binary.LittleEndian, Channels: 1}
+	dst := &shortWriter{n: 1 << 10}
+	w, err := NewWriter(dst, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Four bytes go out and one is held back, then the held byte and two more do.
+	if n, err := w.Write([]byte{1, 2, 3, 4, 5}); n != 5 || err != nil {
+		t.Fatalf("got %d, %v", n, err)
+	}
+	dst.n = 3
+	if n, err := w.Write([]byte{6, 7, 8, 9, 10, 11, 12}); n != 2 || err != io.ErrShortWrite {
+		t.Errorf("got %d, %v", n, err)
+	}
+	if w.data != 7 {
+		t.Errorf("counted %d bytes", w.data)
+	}
+}
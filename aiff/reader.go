@@ -0,0 +1,139 @@
+package aiff
+
+import (
+	"io"
+	"io/ioutil"
+	"math"
+
+	"github.com/ZhangJYd/pcm_convertor"
+	"github.com/ZhangJYd/pcm_convertor/format"
+	"github.com/ZhangJYd/pcm_convertor/model"
+)
+
+// Reader reads the samples of an AIFF or AIFF-C stream, starting right after the header.
+type Reader struct {
+	r      io.Reader
+	info   pcm_convertor.StreamInfo
+	frames int64
+	// size is the length of the samples, -1 if the stream was written without knowing it.
+	size int64
+	left int64
+}
+
+// NewReader parses the header of the AIFF or AIFF-C stream in r up to the start of the
+// samples. The COMM chunk has to come before the SSND chunk, as it does in practice.
+func NewReader(r io.Reader) (*Reader, error) {
+	var hdr [12]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, model.ErrInvalidHeader
+	}
+	form := string(hdr[8:12])
+	if string(hdr[0:4]) != "FORM" || (form != "AIFF" && form != "AIFC") {
+		return nil, model.ErrInvalidHeader
+	}
+	ar := &Reader{r: r}
+	haveComm := false
+	for {
+		var chunk [8]byte
+		if _, err := io.ReadFull(r, chunk[:]); err != nil {
+			return nil, model.ErrInvalidHeader
+		}
+		id := string(chunk[0:4])
+		size := int64(be.Uint32(chunk[4:]))
+		switch id {
+		case "COMM":
+			if err := ar.readComm(r, size, form == "AIFC"); err != nil {
+				return nil, err
+			}
+			haveComm = true
+		case "SSND":
+			if !haveComm {
+				return nil, model.ErrInvalidHeader
+			}
+			var ssnd [8]byte
+			if _, err := io.ReadFull(r, ssnd[:]); err != nil {
+				return nil, model.ErrInvalidHeader
+			}
+			offset := int64(be.Uint32(ssnd[0:]))
+			if _, err := io.CopyN(ioutil.Discard, r, offset); err != nil {
+				return nil, model.ErrInvalidHeader
+			}
+			ar.size = size - 8 - offset
+			if size == unknownSize || ar.size < 0 {
+				ar.size = -1
+			}
+			ar.left = ar.size
+			return ar, nil
+		default:
+			if _, err := io.CopyN(ioutil.Discard, r, size+size%2); err != nil {
+				return nil, model.ErrInvalidHeader
+			}
+		}
+	}
+}
+
+func (ar *Reader) readComm(r io.Reader, size int64, aifc bool) error {
+	if size < 18 || (aifc && size < 22) || size > maxComm {
+		return model.ErrInvalidHeader
+	}
+	body := make([]byte, size+size%2)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return model.ErrInvalidHeader
+	}
+	channels := int(be.Uint16(body[0:]))
+	ar.frames = int64(be.Uint32(body[2:]))
+	bits := int(be.Uint16(body[6:]))
+	rate := decodeExtended(body[8:18])
+	if channels == 0 || rate < 1 || rate > math.MaxInt32 {
+		return model.ErrInvalidHeader
+	}
+	id := "NONE"
+	if aifc {
+		id = string(body[18:22])
+	}
+	f, order, err := streamFormat(id, bits)
+	if err != nil {
+		return err
+	}
+	ar.info = pcm_convertor.StreamInfo{
+		SampleRate: int(math.Round(rate)),
+		Format:     f,
+		ByteOrder:  order,
+		Channels:   channels,
+	}
+	return nil
+}
+
+// StreamInfo describes the samples of the stream.
+func (ar *Reader) StreamInfo() pcm_convertor.StreamInfo {
+	return ar.info
+}
+
+// DataSize returns the length of the samples in bytes, or -1 if the header doesn't say,
+// in which case the samples run to the end of the stream.
+func (ar *Reader) DataSize() int64 {
+	return ar.size
+}
+
+// Read reads the samples, returning io.EOF at the end of the SSND chunk.
+func (ar *Reader) Read(p []byte) (int, error) {
+	if ar.size >= 0 {
+		if ar.left == 0 {
+			return 0, io.EOF
+		}
+		if int64(len(p)) > ar.left {
+			p = p[:ar.left]
+		}
+	}
+	n, err := ar.r.Read(p)
+	if ar.size >= 0 {
+		ar.left -= int64(n)
+		if err == io.EOF && ar.left > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	if ar.info.Format == format.U8 {
+		copy(p, format.FlipSign(p[:n]))
+	}
+	return n, err
+}
@@ -0,0 +1,181 @@
+package aiff
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/ZhangJYd/pcm_convertor"
+	"github.com/ZhangJYd/pcm_convertor/format"
+	"github.com/ZhangJYd/pcm_convertor/model"
+)
+
+// Writer writes samples described by a StreamInfo as an AIFF stream. Big-endian linear
+// PCM is written as plain AIFF, everything else as AIFF-C; little-endian floats are
+// swapped, since AIFF-C has no compression type for them.
+//
+// When the destination is seekable, Close fills in the sizes of the header. Otherwise
+// they are marked unknown, which Reader takes as samples running to the end of the stream.
+type Writer struct {
+	w    io.Writer
+	ws   io.WriteSeeker
+	info pcm_convertor.StreamInfo
+	// swap puts samples in the byte order of the file, nil if they are in it already.
+	swap *format.Swapper
+	// start is the offset of the header in ws, the other offsets are of the sizes
+	// Close fills in.
+	start        int64
+	framesOffset int64
+	ssndOffset   int64
+	data         int64
+	closed       bool
+}
+
+// NewWriter writes the header for info to w.
+func NewWriter(w io.Writer, info pcm_convertor.StreamInfo) (*Writer, error) {
+	if info.SampleRate <= 0 {
+		return nil, model.ErrInvalidSampleRate
+	}
+	if info.Channels <= 0 || info.Channels > 0xffff {
+		return nil, model.ErrInvalidChannels
+	}
+	if _, coded := format.CodecOf(info.Format); coded || info.Format.FrameSize() < 0 {
+		return nil, model.ErrInvalidFormat
+	}
+	aw := &Writer{w: w, info: info}
+	if ws, ok := w.(io.WriteSeeker); ok {
+		if start, err := ws.Seek(0, io.SeekCurrent); err == nil {
+			aw.ws = ws
+			aw.start = start
+		}
+	}
+	if _, err := w.Write(aw.header()); err != nil {
+		return nil, err
+	}
+	return aw, nil
+}
+
+func (aw *Writer) header() []byte {
+	size := uint32(0)
+	if aw.ws == nil {
+		size = unknownSize
+	}
+	info := aw.info
+	c := compressionFor(info.Format, info.ByteOrder)
+	order := binary.ByteOrder(binary.BigEndian)
+	if c != nil {
+		order = c.order
+	}
+	if info.ByteOrder != order {
+		aw.swap = format.NewSwapper(info.Format)
+	}
+
+	comm := make([]byte, 18)
+	be.PutUint16(comm[0:], uint16(info.Channels))
+	be.PutUint32(comm[2:], size)
+	be.PutUint16(comm[6:], uint16(info.Format.FrameSize()*8))
+	copy(comm[8:], encodeExtended(uint64(info.SampleRate)))
+
+	hdr := []byte("FORM\x00\x00\x00\x00AIFF")
+	be.PutUint32(hdr[4:], size)
+	if c != nil {
+		copy(hdr[8:], "AIFC")
+		var fver [4]byte
+		be.PutUint32(fver[:], aifcVersion)
+		hdr = appendChunk(hdr, "FVER", fver[:])
+		comm = append(comm, c.id...)
+		comm = append(comm, byte(len(c.name)))
+		comm = append(comm, c.name...)
+		if len(c.name)%2 == 0 {
+			comm = append(comm, 0)
+		}
+	}
+	aw.framesOffset = int64(len(hdr)) + 8 + 2
+	hdr = appendChunk(hdr, "COMM", comm)
+	// The SSND chunk starts with an offset and block size of 0.
+	hdr = append(hdr, "SSND\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"...)
+	be.PutUint32(hdr[len(hdr)-12:], size)
+	aw.ssndOffset = int64(len(hdr)) - 12
+	return hdr
+}
+
+func appendChunk(dst []byte, id string, body []byte) []byte {
+	dst = append(dst, id...)
+	dst = append(dst, 0, 0, 0, 0)
+	be.PutUint32(dst[len(dst)-4:], uint32(len(body)))
+	dst = append(dst, body...)
+	if len(body)%2 == 1 {
+		dst = append(dst, 0)
+	}
+	return dst
+}
+
+// Write writes samples in the format given to NewWriter.
+func (aw *Writer) Write(p []byte) (int, error) {
+	if aw.closed {
+		return 0, model.ErrClosed
+	}
+	data := p
+	if aw.info.Format == format.U8 {
+		data = format.FlipSign(p)
+	}
+	held := 0
+	if aw.swap != nil {
+		held = aw.swap.Held()
+		data = aw.swap.Swap(data)
+	}
+	n, err := aw.w.Write(data)
+	aw.data += int64(n)
+	if err != nil {
+		// The bytes held back from the last call went out first.
+		if n -= held; n < 0 {
+			n = 0
+		}
+		return n, err
+	}
+	return len(p), nil
+}
+
+// Close pads the SSND chunk to an even length and fills in the sizes of the header if
+// the destination is seekable. It does not close the destination.
+func (aw *Writer) Close() error {
+	if aw.closed {
+		return model.ErrClosed
+	}
+	aw.closed = true
+	if aw.data%2 == 1 {
+		if _, err := aw.w.Write([]byte{0}); err != nil {
+			return err
+		}
+	}
+	if aw.ws == nil {
+		return nil
+	}
+	formSize := aw.ssndOffset + 12 + aw.data + aw.data%2 - 8
+	if formSize > 0xffffffff {
+		return model.ErrInvalidParameter
+	}
+	end, err := aw.ws.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	frames := aw.data / int64(aw.info.Format.FrameSize()*aw.info.Channels)
+	for _, p := range []struct {
+		offset int64
+		value  int64
+	}{
+		{4, formSize},
+		{aw.framesOffset, frames},
+		{aw.ssndOffset, aw.data + 8},
+	} {
+		if _, err := aw.ws.Seek(aw.start+p.offset, io.SeekStart); err != nil {
+			return err
+		}
+		var b [4]byte
+		be.PutUint32(b[:], uint32(p.value))
+		if _, err := aw.ws.Write(b[:]); err != nil {
+			return err
+		}
+	}
+	_, err = aw.ws.Seek(end, io.SeekStart)
+	return err
+}
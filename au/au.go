@@ -0,0 +1,43 @@
+// Package au reads and writes Sun/NeXT AU (.au, .snd) files, describing their samples
+// with pcm_convertor.StreamInfo.
+package au
+
+import (
+	"encoding/binary"
+
+	"github.com/ZhangJYd/pcm_convertor/format"
+	"github.com/ZhangJYd/pcm_convertor/model"
+)
+
+const magic = ".snd"
+
+// headerSize is the size of the fixed header; an annotation may follow it.
+const headerSize = 24
+
+// unknownSize is the data size of a stream whose length was not known when the header
+// was written.
+const unknownSize = 0xffffffff
+
+var be = binary.BigEndian
+
+// encodings maps the AU encoding numbers onto formats. AU samples are big-endian and
+// 8-bit linear ones are signed.
+var encodings = map[uint32]format.PcmFormat{
+	1:  format.ULaw,
+	2:  format.U8,
+	3:  format.S16,
+	4:  format.S24,
+	5:  format.S32,
+	6:  format.F32,
+	7:  format.F64,
+	27: format.ALaw,
+}
+
+func encodingOf(f format.PcmFormat) (uint32, error) {
+	for e, v := range encodings {
+		if v == f {
+			return e, nil
+		}
+	}
+	return 0, model.ErrInvalidFormat
+}
@@ -0,0 +1,190 @@
+package au
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/ZhangJYd/pcm_convertor"
+	"github.com/ZhangJYd/pcm_convertor/format"
+	"github.com/ZhangJYd/pcm_convertor/resample"
+)
+
+func samples(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func TestRoundTrip(t *testing.T) {
+	f, err := ioutil.TempFile("", "au")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	formats := []format.PcmFormat{format.U8, format.S16, format.S24, format.S32, format.F32, format.F64, format.ULaw, format.ALaw}
+	for _, pf := range formats {
+		for _, order := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
+			info := pcm_convertor.StreamInfo{SampleRate: 8000, Format: pf, ByteOrder: order, Channels: 2}
+			out, err := os.Create(f.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			w, err := NewWriter(out, info)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data := samples(pf.FrameSize() * 2 * 33)
+			if _, err := w.Write(data); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			out.Close()
+
+			file, err := ioutil.ReadFile(f.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := NewReader(bytes.NewReader(file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := info
+			want.ByteOrder = binary.BigEndian
+			if r.StreamInfo() != want || r.DataSize() != int64(len(data)) {
+				t.Errorf("got %+v with %d bytes, want %+v with %d", r.StreamInfo(), r.DataSize(), want, len(data))
+			}
+			got, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if order == binary.LittleEndian {
+				got = format.SwapBytes(got, pf.FrameSize())
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("%v %v: samples differ", pf.String(), order)
+			}
+		}
+	}
+}
+
+func TestReadStreamed(t *testing.T) {
+	// A streamed mu-law file with an annotation and no data size.
+	file := []byte(".snd\x00\x00\x00\x20\xff\xff\xff\xff\x00\x00\x00\x01\x00\x00\x1f\x40\x00\x00\x00\x01note\x00\x00\x00\x00")
+	file = append(file, 0xff, 0x7f, 0x00)
+	r, err := NewReader(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := pcm_convertor.StreamInfo{SampleRate: 8000, Format: format.ULaw, ByteOrder: binary.BigEndian, Channels: 1}
+	if r.StreamInfo() != want || r.DataSize() != -1 {
+		t.Errorf("got %+v with %d bytes", r.StreamInfo(), r.DataSize())
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(got, []byte{0xff, 0x7f, 0x00}) {
+		t.Errorf("got %x, %v", got, err)
+	}
+
+	buf := new(bytes.Buffer)
+	w, err := NewWriter(buf, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte{1, 2, 3})
+	w.Close()
+	if size := binary.BigEndian.Uint32(buf.Bytes()[8:]); size != unknownSize {
+		t.Errorf("got data size %#x for a stream", size)
+	}
+}
+
+func TestConvert24Bit(t *testing.T) {
+	s16 := pcm_convertor.StreamInfo{SampleRate: 8000, Format: format.S16, ByteOrder: binary.LittleEndian, Channels: 2}
+	s24 := pcm_convertor.StreamInfo{SampleRate: 8000, Format: format.S24, ByteOrder: binary.BigEndian, Channels: 2}
+	convert := func(in, out pcm_convertor.StreamInfo, data []byte) []byte {
+		c, err := pcm_convertor.NewConvertor(&in, &out, resample.MediumQ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		got, err := c.Process(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tail, err := c.Flush()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append(got, tail...)
+	}
+
+	data := samples(2 * 2 * 100)
+	buf := new(bytes.Buffer)
+	w, err := NewWriter(buf, s24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(convert(s16, s24, data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.StreamInfo() != s24 {
+		t.Errorf("got %+v, want %+v", r.StreamInfo(), s24)
+	}
+	file, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := convert(r.StreamInfo(), s16, file); !bytes.Equal(got, data) {
+		t.Error("samples differ after going through a 24-bit file")
+	}
+}
+
+// shortWriter takes n bytes and fails after that.
+type shortWriter struct {
+	n int
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		n := w.n
+		w.n = 0
+		return n, io.ErrShortWrite
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestShortWrite(t *testing.T) {
+	info := pcm_convertor.StreamInfo{SampleRate: 8000, Format: format.S16, ByteOrder: binary.LittleEndian, Channels: 1}
+	dst := &shortWriter{n: 1 << 10}
+	w, err := NewWriter(dst, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two bytes go out and one is held back, then the held byte and two more do.
+	if n, err := w.Write([]byte{1, 2, 3}); n != 3 || err != nil {
+		t.Fatalf("got %d, %v", n, err)
+	}
+	dst.n = 3
+	if n, err := w.Write([]byte{4, 5, 6, 7, 8}); n != 2 || err != io.ErrShortWrite {
+		t.Errorf("got %d, %v", n, err)
+	}
+	if w.data != 5 {
+		t.Errorf("counted %d bytes", w.data)
+	}
+}
@@ -0,0 +1,94 @@
+package au
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+
+	"github.com/ZhangJYd/pcm_convertor"
+	"github.com/ZhangJYd/pcm_convertor/format"
+	"github.com/ZhangJYd/pcm_convertor/model"
+)
+
+// Reader reads the samples of an AU stream, starting right after the header.
+type Reader struct {
+	r    io.Reader
+	info pcm_convertor.StreamInfo
+	// size is the length of the samples, -1 if the header doesn't give it.
+	size int64
+	left int64
+}
+
+// NewReader parses the header of the AU stream in r and skips its annotation.
+func NewReader(r io.Reader) (*Reader, error) {
+	var hdr [headerSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, model.ErrInvalidHeader
+	}
+	if string(hdr[0:4]) != magic {
+		return nil, model.ErrInvalidHeader
+	}
+	offset := int64(be.Uint32(hdr[4:]))
+	size := be.Uint32(hdr[8:])
+	f, ok := encodings[be.Uint32(hdr[12:])]
+	if !ok {
+		return nil, model.ErrInvalidFormat
+	}
+	rate := be.Uint32(hdr[16:])
+	channels := be.Uint32(hdr[20:])
+	if offset < headerSize || rate == 0 || rate > 1<<31-1 || channels == 0 || channels > 1<<16 {
+		return nil, model.ErrInvalidHeader
+	}
+	if _, err := io.CopyN(ioutil.Discard, r, offset-headerSize); err != nil {
+		return nil, model.ErrInvalidHeader
+	}
+	ar := &Reader{
+		r: r,
+		info: pcm_convertor.StreamInfo{
+			SampleRate: int(rate),
+			Format:     f,
+			ByteOrder:  binary.BigEndian,
+			Channels:   int(channels),
+		},
+		size: int64(size),
+	}
+	if size == unknownSize {
+		ar.size = -1
+	}
+	ar.left = ar.size
+	return ar, nil
+}
+
+// StreamInfo describes the samples of the stream.
+func (ar *Reader) StreamInfo() pcm_convertor.StreamInfo {
+	return ar.info
+}
+
+// DataSize returns the length of the samples in bytes, or -1 if the header doesn't say,
+// in which case the samples run to the end of the stream.
+func (ar *Reader) DataSize() int64 {
+	return ar.size
+}
+
+// Read reads the samples.
+func (ar *Reader) Read(p []byte) (int, error) {
+	if ar.size >= 0 {
+		if ar.left == 0 {
+			return 0, io.EOF
+		}
+		if int64(len(p)) > ar.left {
+			p = p[:ar.left]
+		}
+	}
+	n, err := ar.r.Read(p)
+	if ar.size >= 0 {
+		ar.left -= int64(n)
+		if err == io.EOF && ar.left > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	if ar.info.Format == format.U8 {
+		copy(p, format.FlipSign(p[:n]))
+	}
+	return n, err
+}
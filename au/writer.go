@@ -0,0 +1,115 @@
+package au
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/ZhangJYd/pcm_convertor"
+	"github.com/ZhangJYd/pcm_convertor/format"
+	"github.com/ZhangJYd/pcm_convertor/model"
+)
+
+// Writer writes samples described by a StreamInfo as an AU stream. Little-endian samples
+// are swapped to the big-endian order of AU.
+//
+// When the destination is seekable, Close fills in the data size. Otherwise it is left
+// unknown, which AU readers take as samples running to the end of the stream.
+type Writer struct {
+	w    io.Writer
+	ws   io.WriteSeeker
+	info pcm_convertor.StreamInfo
+	// swap turns little-endian samples big-endian, nil if they need no swapping.
+	swap *format.Swapper
+	// start is the offset of the header in ws.
+	start  int64
+	data   int64
+	closed bool
+}
+
+// NewWriter writes the header for info to w, followed by an empty annotation.
+func NewWriter(w io.Writer, info pcm_convertor.StreamInfo) (*Writer, error) {
+	if info.SampleRate <= 0 {
+		return nil, model.ErrInvalidSampleRate
+	}
+	if info.Channels <= 0 {
+		return nil, model.ErrInvalidChannels
+	}
+	encoding, err := encodingOf(info.Format)
+	if err != nil {
+		return nil, err
+	}
+	aw := &Writer{w: w, info: info}
+	if info.ByteOrder == binary.LittleEndian {
+		aw.swap = format.NewSwapper(info.Format)
+	}
+	if ws, ok := w.(io.WriteSeeker); ok {
+		if start, err := ws.Seek(0, io.SeekCurrent); err == nil {
+			aw.ws = ws
+			aw.start = start
+		}
+	}
+
+	hdr := make([]byte, headerSize+4)
+	copy(hdr, magic)
+	be.PutUint32(hdr[4:], uint32(len(hdr)))
+	be.PutUint32(hdr[8:], unknownSize)
+	be.PutUint32(hdr[12:], encoding)
+	be.PutUint32(hdr[16:], uint32(info.SampleRate))
+	be.PutUint32(hdr[20:], uint32(info.Channels))
+	if _, err := w.Write(hdr); err != nil {
+		return nil, err
+	}
+	return aw, nil
+}
+
+// Write writes samples in the format given to NewWriter.
+func (aw *Writer) Write(p []byte) (int, error) {
+	if aw.closed {
+		return 0, model.ErrClosed
+	}
+	data := p
+	if aw.info.Format == format.U8 {
+		data = format.FlipSign(p)
+	}
+	held := 0
+	if aw.swap != nil {
+		held = aw.swap.Held()
+		data = aw.swap.Swap(data)
+	}
+	n, err := aw.w.Write(data)
+	aw.data += int64(n)
+	if err != nil {
+		// The bytes held back from the last call went out first.
+		if n -= held; n < 0 {
+			n = 0
+		}
+		return n, err
+	}
+	return len(p), nil
+}
+
+// Close fills in the data size if the destination is seekable and the size fits in the
+// header. It does not close the destination.
+func (aw *Writer) Close() error {
+	if aw.closed {
+		return model.ErrClosed
+	}
+	aw.closed = true
+	if aw.ws == nil || aw.data >= unknownSize {
+		return nil
+	}
+	end, err := aw.ws.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := aw.ws.Seek(aw.start+8, io.SeekStart); err != nil {
+		return err
+	}
+	var b [4]byte
+	be.PutUint32(b[:], uint32(aw.data))
+	if _, err := aw.ws.Write(b[:]); err != nil {
+		return err
+	}
+	_, err = aw.ws.Seek(end, io.SeekStart)
+	return err
+}
@@ -3,6 +3,7 @@ package pcm_convertor
 import (
 	"bytes"
 	"encoding/binary"
+	"math"
 
 	"github.com/ZhangJYd/pcm_convertor/format"
 	"github.com/ZhangJYd/pcm_convertor/model"
@@ -74,6 +75,12 @@ func StereoToMono(data []byte, inFormat format.PcmFormat, channels int, order bi
 			if err != nil {
 				return nil, err
 			}
+		case format.ULaw, format.ALaw:
+			for j := 0; j < len(chunk); j++ {
+				sum += float64(format.G711ToInt16(chunk[j], inFormat))
+			}
+			sum = math.Max(math.Min(sum, math.MaxInt16), math.MinInt16)
+			mono.WriteByte(format.Int16ToG711(int16(sum), inFormat))
 		case format.S16:
 			for j := 0; j < len(chunk); {
 				n, err := format.BytesToInt16(chunk[j:j+inFormat.FrameSize()], order)
@@ -87,6 +94,20 @@ func StereoToMono(data []byte, inFormat format.PcmFormat, channels int, order bi
 			if err != nil {
 				return nil, err
 			}
+		case format.S24:
+			for j := 0; j < len(chunk); j += inFormat.FrameSize() {
+				b := chunk[j : j+3]
+				if order == binary.BigEndian {
+					b = []byte{b[2], b[1], b[0]}
+				}
+				sum += float64(int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8)
+			}
+			n := int32(sum)
+			if order == binary.BigEndian {
+				mono.Write([]byte{byte(n >> 16), byte(n >> 8), byte(n)})
+			} else {
+				mono.Write([]byte{byte(n), byte(n >> 8), byte(n >> 16)})
+			}
 		case format.S32:
 			for j := 0; j < len(chunk); {
 				n, err := format.BytesToInt32(chunk[j:j+inFormat.FrameSize()], order)
@@ -0,0 +1,143 @@
+package pcm_convertor
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"github.com/ZhangJYd/pcm_convertor/format"
+	"github.com/ZhangJYd/pcm_convertor/model"
+)
+
+// ProcessContext is Process for large buffers. It converts data a piece at a time and
+// stops when ctx is done, returning the output for the input converted until then
+// together with ctx.Err(). The rest of data is dropped.
+func (p *Convertor) ProcessContext(ctx context.Context, data []byte) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, model.ErrClosed
+	}
+	chunk := readFrames * p.in.Format.FrameSize() * p.in.Channels
+	var out []byte
+	for i := 0; i < len(data); i += chunk {
+		if err := ctx.Err(); err != nil {
+			return out, err
+		}
+		end := i + chunk
+		if end > len(data) {
+			end = len(data)
+		}
+		converted, err := p.process(data[i:end])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, converted...)
+	}
+	return out, nil
+}
+
+// Progress is reported by Copy after every chunk.
+type Progress struct {
+	// InBytes and InFrames count the input read so far.
+	InBytes  int64
+	InFrames int64
+	// OutBytes and OutFrames count the output written so far.
+	OutBytes  int64
+	OutFrames int64
+	// TotalBytes and TotalFrames are the size of the input, or -1 when it is not known.
+	TotalBytes  int64
+	TotalFrames int64
+}
+
+// Copy converts src with conv and writes the result to dst until the end of src, which
+// is followed by conv.Flush, or until ctx is done. progress, if not nil, is called after
+// every chunk. The size of src is known when it has a Len method like bytes.Reader or a
+// Stat method like os.File. Copy returns the number of bytes written to dst.
+func Copy(ctx context.Context, dst io.Writer, src io.Reader, conv *Convertor, progress func(Progress)) (int64, error) {
+	in, outInfo := conv.Info()
+	frameSize := int64(in.Format.FrameSize() * in.Channels)
+	p := Progress{TotalBytes: sourceSize(src), TotalFrames: -1}
+	if p.TotalBytes >= 0 {
+		p.TotalFrames = framesIn(p.TotalBytes, in)
+	}
+
+	buf := make([]byte, readFrames*frameSize)
+	for {
+		if err := ctx.Err(); err != nil {
+			return p.OutBytes, err
+		}
+		n, rerr := src.Read(buf)
+		if n > 0 {
+			out, err := conv.ProcessContext(ctx, buf[:n])
+			if err != nil && ctx.Err() == nil {
+				return p.OutBytes, err
+			}
+			// When ctx is done, out still holds the output converted before.
+			if _, werr := dst.Write(out); werr != nil {
+				return p.OutBytes, werr
+			}
+			p.InBytes += int64(n)
+			p.InFrames = framesIn(p.InBytes, in)
+			p.OutBytes += int64(len(out))
+			p.OutFrames = framesIn(p.OutBytes, outInfo)
+			if progress != nil {
+				progress(p)
+			}
+			if err != nil {
+				return p.OutBytes, err
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return p.OutBytes, rerr
+		}
+	}
+
+	tail, err := conv.Flush()
+	if err != nil {
+		return p.OutBytes, err
+	}
+	if _, err = dst.Write(tail); err != nil {
+		return p.OutBytes, err
+	}
+	p.OutBytes += int64(len(tail))
+	p.OutFrames = framesIn(p.OutBytes, outInfo)
+	if progress != nil {
+		progress(p)
+	}
+	return p.OutBytes, nil
+}
+
+// framesIn returns the number of frames in n bytes of a stream, counting the samples
+// of every block for codecs.
+func framesIn(n int64, info StreamInfo) int64 {
+	frames := n / int64(info.Format.FrameSize()*info.Channels)
+	if c, ok := format.CodecOf(info.Format); ok {
+		frames *= int64(c.BlockSamples)
+	}
+	return frames
+}
+
+// sourceSize returns the number of bytes left in src, or -1 if it can't tell.
+func sourceSize(src io.Reader) int64 {
+	switch s := src.(type) {
+	case interface{ Len() int }:
+		return int64(s.Len())
+	case interface{ Stat() (os.FileInfo, error) }:
+		fi, err := s.Stat()
+		if err != nil || !fi.Mode().IsRegular() {
+			return -1
+		}
+		size := fi.Size()
+		if seeker, ok := src.(io.Seeker); ok {
+			if pos, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+				size -= pos
+			}
+		}
+		return size
+	}
+	return -1
+}
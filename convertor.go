@@ -2,18 +2,30 @@ package pcm_convertor
 
 import (
 	"encoding/binary"
+	"sync"
 
 	"github.com/ZhangJYd/pcm_convertor/format"
 	"github.com/ZhangJYd/pcm_convertor/model"
-	"github.com/ZhangJYd/pcm_convertor/resample"
 )
 
+// Convertor converts one stream. It is safe to call its methods from several goroutines:
+// the calls are serialized, and Close waits for a call in progress instead of freeing the
+// resampler underneath it. After Close every call returns model.ErrClosed, until Reset
+// sets the Convertor up again. The chunks of a stream still have to be handed to Process
+// in order, so a stream is normally owned by a single goroutine; use MultiConvertor to
+// spread many streams over a pool of workers.
 type Convertor struct {
+	mu     sync.Mutex
+	closed bool
+
 	out *StreamInfo
 	in  *StreamInfo
 
-	formatConvertor *format.Convertor
-	resampler       *resample.Resampler
+	opts    options
+	quality int
+	pipe    *pipeline
+	// carry holds a partial input frame left over from the previous Process call.
+	carry []byte
 }
 
 type StreamInfo struct {
@@ -23,56 +35,44 @@ type StreamInfo struct {
 	Channels   int
 }
 
-func NewConvertor(in, out *StreamInfo, resampleQuality int) (*Convertor, error) {
-	if in == nil || out == nil {
-		return nil, model.ErrInvalidParameter
-	}
-
-	if out.SampleRate <= 0 || in.SampleRate <= 0 {
-		return nil, model.ErrInvalidSampleRate
-	}
-	if out.Format.FrameSize() < 0 || in.Format.FrameSize() < 0 {
-		return nil, model.ErrInvalidFormat
-	}
-	if in.Channels <= 0 || out.Channels <= 0 {
-		return nil, model.ErrInvalidChannels
-	}
-
-	if in.Channels != out.Channels {
-		if in.Channels != 1 && out.Channels != 1 {
-			return nil, model.ErrChannelsConvert
-		}
-	}
-
-	formatConvertor, err := format.NewFormatConvertor(in.Format, out.Format, in.ByteOrder, out.ByteOrder)
+func NewConvertor(in, out *StreamInfo, resampleQuality int, opts ...Option) (*Convertor, error) {
+	o, err := newOptions(opts, 0)
 	if err != nil {
 		return nil, err
 	}
+	return newConvertor(in, out, resampleQuality, o)
+}
 
-	channels := out.Channels
-	if in.Channels < out.Channels {
-		channels = in.Channels
+func newConvertor(in, out *StreamInfo, resampleQuality int, o options) (*Convertor, error) {
+	if in == nil || out == nil {
+		return nil, model.ErrInvalidParameter
+	}
+	if err := validate(in, out); err != nil {
+		return nil, err
 	}
 
-	resampler, err := resample.NewResampler(in.SampleRate, out.SampleRate, channels, resampleQuality, out.Format)
+	b, err := buildPipeline(in, out, resampleQuality, o, nil)
 	if err != nil {
 		return nil, err
 	}
 
 	return &Convertor{
-		out:             out,
-		in:              in,
-		formatConvertor: formatConvertor,
-		resampler:       resampler,
+		out:     out,
+		in:      in,
+		opts:    o,
+		quality: resampleQuality,
+		pipe:    b,
 	}, nil
 }
 
-func (p *Convertor) Close() error {
-	return p.resampler.Close()
+func minChannels(in, out *StreamInfo) int {
+	if in.Channels < out.Channels {
+		return in.Channels
+	}
+	return out.Channels
 }
 
-func (p *Convertor) Reset(in, out *StreamInfo, resampleQuality int) error {
-	p.Close()
+func validate(in, out *StreamInfo) error {
 	if out.SampleRate <= 0 || in.SampleRate <= 0 {
 		return model.ErrInvalidSampleRate
 	}
@@ -88,107 +88,226 @@ func (p *Convertor) Reset(in, out *StreamInfo, resampleQuality int) error {
 			return model.ErrChannelsConvert
 		}
 	}
+	for _, info := range []*StreamInfo{in, out} {
+		if c, ok := format.CodecOf(info.Format); ok {
+			if info.SampleRate != c.SampleRate {
+				return model.ErrInvalidSampleRate
+			}
+			if info.Channels != 1 {
+				return model.ErrInvalidChannels
+			}
+		}
+	}
+	return nil
+}
 
-	formatConvertor, err := format.NewFormatConvertor(in.Format, out.Format, in.ByteOrder, out.ByteOrder)
-	if err != nil {
-		return err
+func (p *Convertor) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.close()
+}
+
+func (p *Convertor) close() error {
+	if p.closed {
+		return model.ErrClosed
 	}
+	p.closed = true
+	return p.pipe.closeExcept(nil)
+}
 
-	channels := out.Channels
-	if in.Channels < out.Channels {
-		channels = in.Channels
+// Plan returns the stages the Convertor runs the audio through, in order.
+func (p *Convertor) Plan() []PlanStep {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]PlanStep(nil), p.pipe.plan...)
+}
+
+// Info returns the input and output the Convertor is set up for, which Reset and
+// SetInput change.
+func (p *Convertor) Info() (in, out StreamInfo) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return *p.in, *p.out
+}
+
+// Flush returns the output the stages still hold at the end of a stream, mainly the
+// resampler. The Convertor can be used for a new stream afterwards.
+func (p *Convertor) Flush() ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, model.ErrClosed
+	}
+	p.carry = nil
+	return p.flushStages(len(p.pipe.stages))
+}
+
+// flushStages flushes the first n stages and runs what they held through the rest.
+func (p *Convertor) flushStages(n int) ([]byte, error) {
+	data := []byte{}
+	for i, s := range p.pipe.stages {
+		var err error
+		if len(data) > 0 {
+			if data, err = s.Process(data); err != nil {
+				return nil, err
+			}
+		}
+		if i >= n {
+			continue
+		}
+		tail, err := s.Flush()
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, tail...)
+	}
+	return data, nil
+}
+
+// ExpectedOutputFrames returns the number of output frames totalIn input frames convert to,
+// including the ones returned by Flush. The frames of a codec format are its blocks.
+func (p *Convertor) ExpectedOutputFrames(totalIn int64) int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := totalIn
+	if c, ok := format.CodecOf(p.in.Format); ok {
+		n *= int64(c.BlockSamples)
+	}
+	if p.pipe.resampler != nil {
+		n = p.pipe.resampler.ExpectedOutputFrames(n)
 	}
+	if c, ok := format.CodecOf(p.out.Format); ok {
+		n = (n + int64(c.BlockSamples) - 1) / int64(c.BlockSamples)
+	}
+	return n
+}
 
-	resampler, err := resample.NewResampler(in.SampleRate, out.SampleRate, channels, resampleQuality, out.Format)
+// Reset sets the Convertor up for a new stream from in to out, also after Close. If it
+// fails, the Convertor is left as it was. The resampler is kept, with its state cleared,
+// when only the formats, byte orders or channels change.
+func (p *Convertor) Reset(in, out *StreamInfo, resampleQuality int) error {
+	if in == nil || out == nil {
+		return model.ErrInvalidParameter
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := validate(in, out); err != nil {
+		return err
+	}
+
+	keep := p.pipe
+	if p.closed || resampleQuality != p.quality || !canKeep(in, out, resampleQuality, p.opts, keep) ||
+		keep.spec.in.Channels != minChannels(in, out) {
+		keep = nil
+	}
+	b, err := buildPipeline(in, out, resampleQuality, p.opts, keep)
 	if err != nil {
 		return err
 	}
+	if keep != nil {
+		if err := keep.resampler.Reset(); err != nil {
+			b.closeExcept(keep)
+			return err
+		}
+	}
+	if !p.closed {
+		p.pipe.closeExcept(b)
+	}
 	p.out = out
 	p.in = in
-	p.resampler = resampler
-	p.formatConvertor = formatConvertor
+	p.quality = resampleQuality
+	p.pipe = b
+	p.carry = nil
+	p.closed = false
 	return nil
 }
 
-func (p *Convertor) Process(data []byte) ([]byte, error) {
-	var err error
-	if p.out.Channels < p.in.Channels {
-		data, err = StereoToMono(data, p.in.Format, p.in.Channels, p.in.ByteOrder)
-		if err != nil {
-			return nil, err
-		}
+// SetInput switches the stream over to input described by in, for a source that changes
+// its format in the middle of a stream. The resampler and the stages after it carry on,
+// so the output continues without a gap. The stages before the resampler are flushed and
+// what they held is returned; a partial frame of the old input is dropped. When the new
+// input calls for a different resampler, e.g. F32 input after S16, the whole chain is
+// flushed and replaced instead. The input sample rate can't change this way.
+func (p *Convertor) SetInput(in *StreamInfo) ([]byte, error) {
+	if in == nil {
+		return nil, model.ErrInvalidParameter
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, model.ErrClosed
+	}
+	if err := validate(in, p.out); err != nil {
+		return nil, err
+	}
+	if in.SampleRate != p.in.SampleRate {
+		return nil, model.ErrInvalidSampleRate
 	}
 
-	if p.out.Format != p.in.Format || p.out.ByteOrder != p.in.ByteOrder {
-		data1, err := p.formatConvertor.Convert(data)
+	old := p.pipe
+	var keep *pipeline
+	if canKeep(in, p.out, p.quality, p.opts, old) {
+		keep = old
+	}
+	b, err := buildPipeline(in, p.out, p.quality, p.opts, keep)
+	if err != nil {
+		return nil, err
+	}
+	if keep == nil {
+		data, err := p.flushStages(len(old.stages))
 		if err != nil {
+			b.closeExcept(nil)
 			return nil, err
 		}
-		if p.out.SampleRate != p.in.SampleRate {
-			if p.out.ByteOrder == binary.LittleEndian {
-				data2, err := p.resampler.Process(data1)
-				if err != nil {
-					return nil, err
-				}
-				if p.out.Channels > p.in.Channels {
-					return MonoToStereo(data2, p.out.Format, p.out.Channels)
-				}
-				return data2, err
-			} else {
-				dataL, err := format.BigEndianLittleEndianConvert(data1, p.out.Format, binary.BigEndian, binary.LittleEndian)
-				if err != nil {
-					return nil, err
-				}
-				dataL1, err := p.resampler.Process(dataL)
-				if err != nil {
-					return nil, err
-				}
-				data2, err := format.BigEndianLittleEndianConvert(dataL1, p.out.Format, binary.LittleEndian, binary.BigEndian)
-				if err != nil {
-					return nil, err
-				}
-				if p.out.Channels > p.in.Channels {
-					return MonoToStereo(data2, p.out.Format, p.out.Channels)
-				}
-				return data2, err
-			}
-		}
-		if p.out.Channels > p.in.Channels {
-			return MonoToStereo(data1, p.out.Format, p.out.Channels)
-		}
-		return data1, err
+		old.closeExcept(nil)
+		p.in, p.pipe, p.carry = in, b, nil
+		return data, nil
 	}
-	if p.out.SampleRate != p.in.SampleRate {
-		if p.out.ByteOrder == binary.LittleEndian {
-			data2, err := p.resampler.Process(data)
-			if err != nil {
-				return nil, err
-			}
-			if p.out.Channels > p.in.Channels {
-				return MonoToStereo(data2, p.out.Format, p.out.Channels)
-			}
-			return data2, err
-		} else {
-			dataL, err := format.BigEndianLittleEndianConvert(data, p.out.Format, binary.BigEndian, binary.LittleEndian)
-			if err != nil {
-				return nil, err
-			}
-			dataL1, err := p.resampler.Process(dataL)
-			if err != nil {
-				return nil, err
-			}
-			data2, err := format.BigEndianLittleEndianConvert(dataL1, p.out.Format, binary.LittleEndian, binary.BigEndian)
-			if err != nil {
-				return nil, err
-			}
-			if p.out.Channels > p.in.Channels {
-				return MonoToStereo(data2, p.out.Format, p.out.Channels)
-			}
-			return data2, err
+
+	data, err := p.flushStages(old.at)
+	if err != nil {
+		b.closeExcept(keep)
+		return nil, err
+	}
+	// The new stages lead into the resampler, the old ones go on after it.
+	(&pipeline{stages: b.stages[b.at+1:]}).closeExcept(nil)
+	(&pipeline{stages: old.stages[:old.at]}).closeExcept(nil)
+	b.stages = append(b.stages[:b.at:b.at], old.stages[old.at:]...)
+	b.plan = append(b.plan[:b.at+1:b.at+1], old.plan[old.at+1:]...)
+	p.in, p.pipe, p.carry = in, b, nil
+	return data, nil
+}
+
+func (p *Convertor) Process(data []byte) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, model.ErrClosed
+	}
+	return p.process(data)
+}
+
+func (p *Convertor) process(data []byte) ([]byte, error) {
+	data = p.wholeFrames(data)
+	var err error
+	for _, s := range p.pipe.stages {
+		if len(data) == 0 {
+			return []byte{}, nil
+		}
+		if data, err = s.Process(data); err != nil {
+			return nil, err
 		}
 	}
-	if p.out.Channels > p.in.Channels {
-		return MonoToStereo(data, p.out.Format, p.out.Channels)
+	return data, nil
+}
+
+// wholeFrames prepends the partial frame kept from the previous call to data and keeps
+// back the partial frame at its end, so the output does not depend on how the input is chunked.
+func (p *Convertor) wholeFrames(data []byte) []byte {
+	if len(p.carry) > 0 {
+		data = append(p.carry, data...)
 	}
-	return data, err
+	fragment := len(data) % (p.in.Format.FrameSize() * p.in.Channels)
+	p.carry = append([]byte(nil), data[len(data)-fragment:]...)
+	return data[:len(data)-fragment]
 }
@@ -0,0 +1,127 @@
+package pcm_convertor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+	"testing/quick"
+
+	"github.com/ZhangJYd/pcm_convertor/format"
+	"github.com/ZhangJYd/pcm_convertor/resample"
+)
+
+var (
+	allFormats    = []format.PcmFormat{format.U8, format.S16, format.S24, format.S32, format.F32, format.F64, format.ULaw, format.ALaw}
+	allByteOrders = []binary.ByteOrder{binary.LittleEndian, binary.BigEndian}
+	allChannels   = [][2]int{{1, 1}, {1, 2}, {2, 1}}
+	allRates      = [][2]int{{16000, 16000}, {16000, 8000}, {8000, 48000}, {8000, 44100}}
+)
+
+// makeStream returns frames of a sine sweep encoded as f in the given byte order.
+func makeStream(f format.PcmFormat, order binary.ByteOrder, channels, frames int) []byte {
+	buf := new(bytes.Buffer)
+	for i := 0; i < frames*channels; i++ {
+		v := 0.8 * math.Sin(float64(i)*float64(i)/20000)
+		switch f {
+		case format.U8:
+			buf.WriteByte(uint8(128 + v*127))
+		case format.S16:
+			binary.Write(buf, order, int16(v*math.MaxInt16))
+		case format.S24:
+			s := int32(v * (1<<23 - 1))
+			if order == binary.BigEndian {
+				buf.Write([]byte{byte(s >> 16), byte(s >> 8), byte(s)})
+			} else {
+				buf.Write([]byte{byte(s), byte(s >> 8), byte(s >> 16)})
+			}
+		case format.S32:
+			binary.Write(buf, order, int32(v*math.MaxInt32))
+		case format.F32:
+			binary.Write(buf, order, float32(v))
+		case format.F64:
+			binary.Write(buf, order, v)
+		case format.ULaw, format.ALaw:
+			buf.WriteByte(format.Int16ToG711(int16(v*math.MaxInt16), f))
+		}
+	}
+	return buf.Bytes()
+}
+
+// convertChunked feeds data to a new Convertor in chunks of the given byte sizes,
+// used cyclically, and returns everything it produced including the flushed tail.
+func convertChunked(in, out *StreamInfo, data []byte, sizes []int) ([]byte, error) {
+	c, err := NewConvertor(in, out, resample.MediumQ)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	result := new(bytes.Buffer)
+	for i, n := 0, 0; i < len(data); n++ {
+		end := i + sizes[n%len(sizes)]
+		if end > len(data) {
+			end = len(data)
+		}
+		stream, err := c.Process(data[i:end])
+		if err != nil {
+			return nil, err
+		}
+		result.Write(stream)
+		i = end
+	}
+	tail, err := c.Flush()
+	if err != nil {
+		return nil, err
+	}
+	result.Write(tail)
+	return result.Bytes(), nil
+}
+
+func TestProcessChunkSizeInvariance(t *testing.T) {
+	const frames = 1500
+	for _, inF := range allFormats {
+		for _, outF := range allFormats {
+			for _, inOrder := range allByteOrders {
+				for _, outOrder := range allByteOrders {
+					for _, ch := range allChannels {
+						for _, rates := range allRates {
+							in := &StreamInfo{SampleRate: rates[0], Format: inF, ByteOrder: inOrder, Channels: ch[0]}
+							out := &StreamInfo{SampleRate: rates[1], Format: outF, ByteOrder: outOrder, Channels: ch[1]}
+							name := fmt.Sprintf("%v %v %d->%v %v %d %d->%d",
+								inF.String(), inOrder, ch[0], outF.String(), outOrder, ch[1], rates[0], rates[1])
+							data := makeStream(inF, inOrder, ch[0], frames)
+							want, err := convertChunked(in, out, data, []int{len(data)})
+							if err != nil {
+								t.Fatalf("%s: %v", name, err)
+							}
+							frameSize := inF.FrameSize() * ch[0]
+							for _, chunkFrames := range []int{128, 1000, 1} {
+								got, err := convertChunked(in, out, data, []int{chunkFrames * frameSize})
+								if err != nil {
+									t.Fatalf("%s, chunks of %d frames: %v", name, chunkFrames, err)
+								}
+								if !bytes.Equal(got, want) {
+									t.Fatalf("%s, chunks of %d frames: output differs from single call", name, chunkFrames)
+								}
+							}
+							split := func(sizes []uint16) bool {
+								chunks := []int{1}
+								for _, n := range sizes {
+									chunks = append(chunks, int(n)%(4*frameSize*128)+1)
+								}
+								got, err := convertChunked(in, out, data, chunks)
+								return err == nil && bytes.Equal(got, want)
+							}
+							config := &quick.Config{MaxCount: 3, Rand: rand.New(rand.NewSource(1))}
+							if err := quick.Check(split, config); err != nil {
+								t.Fatalf("%s: %v", name, err)
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+}
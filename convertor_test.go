@@ -1,13 +1,21 @@
 package pcm_convertor
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"os"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/ZhangJYd/pcm_convertor/format"
+	"github.com/ZhangJYd/pcm_convertor/model"
 	"github.com/ZhangJYd/pcm_convertor/resample"
 )
 
@@ -49,3 +57,933 @@ func TestProcessor(t *testing.T) {
 
 	nf.Write(data32bit)
 }
+
+func TestChunkedOutputLength(t *testing.T) {
+	data16k16bit, err := ioutil.ReadFile("16k_16bit_mono.pcm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inInfo := &StreamInfo{
+		SampleRate: 16000,
+		Format:     format.S16,
+		ByteOrder:  binary.LittleEndian,
+		Channels:   1,
+	}
+	outInfo := &StreamInfo{
+		SampleRate: 44100,
+		Format:     format.F32,
+		ByteOrder:  binary.LittleEndian,
+		Channels:   1,
+	}
+	convert := func(chunkFrames int) int {
+		c, err := NewConvertor(inInfo, outInfo, resample.Quick)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		chunk := chunkFrames * inInfo.Format.FrameSize()
+		total := 0
+		for i := 0; i < len(data16k16bit); i += chunk {
+			end := i + chunk
+			if end > len(data16k16bit) {
+				end = len(data16k16bit)
+			}
+			out, err := c.Process(data16k16bit[i:end])
+			if err != nil {
+				t.Fatal(err)
+			}
+			total += len(out)
+		}
+		tail, err := c.Flush()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return total + len(tail)
+	}
+
+	inFrames := int64(len(data16k16bit) / inInfo.Format.FrameSize())
+	want := int(inFrames*int64(outInfo.SampleRate)/int64(inInfo.SampleRate)) * outInfo.Format.FrameSize()
+	for _, chunkFrames := range []int{len(data16k16bit) / inInfo.Format.FrameSize(), 1000, 128} {
+		if got := convert(chunkFrames); got != want {
+			t.Errorf("chunk of %d frames: got %d bytes, want %d", chunkFrames, got, want)
+		}
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	data16k16bit, err := ioutil.ReadFile("16k_16bit_mono.pcm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inInfo := &StreamInfo{
+		SampleRate: 16000,
+		Format:     format.S16,
+		ByteOrder:  binary.LittleEndian,
+		Channels:   1,
+	}
+	for _, outInfo := range []*StreamInfo{
+		{SampleRate: 44100, Format: format.F32, ByteOrder: binary.BigEndian, Channels: 2},
+		{SampleRate: 8000, Format: format.S16, ByteOrder: binary.LittleEndian, Channels: 1},
+	} {
+		convert := func(c *Convertor, data []byte) []byte {
+			var out []byte
+			for i := 0; i < len(data); i += 1001 {
+				end := i + 1001
+				if end > len(data) {
+					end = len(data)
+				}
+				stream, err := c.Process(data[i:end])
+				if err != nil {
+					t.Fatal(err)
+				}
+				out = append(out, stream...)
+			}
+			return out
+		}
+		c, err := NewConvertor(inInfo, outInfo, resample.MediumQ, WithPureGoResampler())
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := convert(c, data16k16bit)
+		tail, err := c.Flush()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, tail...)
+
+		half := len(data16k16bit)/2 + 1
+		got := convert(c, data16k16bit[:half])
+		state, err := c.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+		c, err = NewConvertor(inInfo, outInfo, resample.MediumQ, WithPureGoResampler())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Restore(state); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, convert(c, data16k16bit[half:])...)
+		tail, err = c.Flush()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, tail...)
+		c.Close()
+		if !bytes.Equal(got, want) {
+			t.Errorf("%d Hz: resumed output differs from the uninterrupted one", outInfo.SampleRate)
+		}
+	}
+}
+
+func TestReaderWriter(t *testing.T) {
+	data16k16bit, err := ioutil.ReadFile("16k_16bit_mono.pcm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A trailing partial frame must not get in the way of the drain.
+	data16k16bit = append(data16k16bit, 0)
+	inInfo := &StreamInfo{
+		SampleRate: 16000,
+		Format:     format.S16,
+		ByteOrder:  binary.LittleEndian,
+		Channels:   1,
+	}
+	outInfo := &StreamInfo{
+		SampleRate: 22050,
+		Format:     format.S32,
+		ByteOrder:  binary.BigEndian,
+		Channels:   2,
+	}
+	want, err := convertChunked(inInfo, outInfo, data16k16bit, []int{len(data16k16bit)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewReader(iotest.OneByteReader(bytes.NewReader(data16k16bit)), inInfo, outInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(iotest.HalfReader(r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if !bytes.Equal(got, want) {
+		t.Errorf("Reader: got %d bytes, want %d", len(got), len(want))
+	}
+
+	buf := new(bytes.Buffer)
+	w, err := NewWriter(buf, inInfo, outInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.Copy(w, iotest.HalfReader(bytes.NewReader(data16k16bit))); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("Writer: got %d bytes, want %d", buf.Len(), len(want))
+	}
+}
+
+func TestPullConvertor(t *testing.T) {
+	data16k16bit, err := ioutil.ReadFile("16k_16bit_mono.pcm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inInfo := &StreamInfo{
+		SampleRate: 16000,
+		Format:     format.S16,
+		ByteOrder:  binary.LittleEndian,
+		Channels:   1,
+	}
+	outInfo := &StreamInfo{
+		SampleRate: 48000,
+		Format:     format.F32,
+		ByteOrder:  binary.LittleEndian,
+		Channels:   2,
+	}
+	want, err := convertChunked(inInfo, outInfo, data16k16bit, []int{len(data16k16bit)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const frames = 960
+	frameSize := outInfo.Format.FrameSize() * outInfo.Channels
+	p, err := NewPullConvertor(bytes.NewReader(data16k16bit), inInfo, outInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	var got []byte
+	dst := make([]byte, frames*frameSize)
+	for {
+		n, err := p.ReadFrames(dst, frames)
+		got = append(got, dst[:n*frameSize]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != frames {
+			t.Fatalf("got %d frames, want %d", n, frames)
+		}
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %d bytes, want %d", len(got), len(want))
+	}
+
+	available := data16k16bit[:400]
+	p, err = NewPullConvertor(SourceFunc(func(b []byte) (int, error) {
+		n := copy(b, available)
+		available = available[n:]
+		return n, nil
+	}), inInfo, outInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	n, err := p.ReadFrames(dst, frames)
+	if err != model.ErrUnderrun || n >= frames {
+		t.Errorf("got %d frames and %v, want underrun", n, err)
+	}
+}
+
+func TestPullConvertorSilence(t *testing.T) {
+	in := &StreamInfo{SampleRate: 8000, Format: format.U8, ByteOrder: binary.LittleEndian, Channels: 2}
+	out := &StreamInfo{SampleRate: 8000, Format: format.U8, ByteOrder: binary.LittleEndian, Channels: 1}
+	p, err := NewPullConvertor(bytes.NewReader(bytes.Repeat([]byte{0x90}, 200)), in, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	dst := make([]byte, 160)
+	n, err := p.ReadFrames(dst, 160)
+	if err != io.EOF || n != 100 {
+		t.Fatalf("got %d frames and %v, want 100 and EOF", n, err)
+	}
+	if !bytes.Equal(dst, append(bytes.Repeat([]byte{0x90}, 100), bytes.Repeat([]byte{0x80}, 60)...)) {
+		t.Errorf("got %x, want the samples followed by U8 silence", dst)
+	}
+}
+
+func TestFramer(t *testing.T) {
+	info := &StreamInfo{
+		SampleRate: 16000,
+		Format:     format.S16,
+		ByteOrder:  binary.LittleEndian,
+		Channels:   1,
+	}
+	f, err := NewFramer(info, 20*time.Millisecond, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.PacketSize() != 640 {
+		t.Fatalf("got packet size %d, want 640", f.PacketSize())
+	}
+	var packets []Packet
+	for _, n := range []int{100, 1000, 3, 200} {
+		packets = append(packets, f.Frame(make([]byte, n))...)
+	}
+	packets = append(packets, f.Flush()...)
+	if len(packets) != 3 {
+		t.Fatalf("got %d packets, want 3", len(packets))
+	}
+	for i, p := range packets {
+		if len(p.Data) != 640 || p.Offset != int64(i*320) {
+			t.Errorf("packet %d: got %d bytes at %d", i, len(p.Data), p.Offset)
+		}
+	}
+	if _, err = NewFramer(info, 10*time.Microsecond, false); err == nil {
+		t.Error("expected an error for a duration that is not a whole number of frames")
+	}
+
+	info.Format = format.ULaw
+	if f, err = NewFramer(info, 1*time.Millisecond, true); err != nil {
+		t.Fatal(err)
+	}
+	f.Frame([]byte{1, 2})
+	if packets := f.Flush(); len(packets) != 1 || !bytes.Equal(packets[0].Data, append([]byte{1, 2}, bytes.Repeat([]byte{0xff}, 14)...)) {
+		t.Errorf("got %v, want the samples followed by mu-law silence", packets)
+	}
+}
+
+func TestMultiConvertor(t *testing.T) {
+	data16k16bit, err := ioutil.ReadFile("16k_16bit_mono.pcm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inInfo := &StreamInfo{
+		SampleRate: 16000,
+		Format:     format.S16,
+		ByteOrder:  binary.LittleEndian,
+		Channels:   1,
+	}
+	outInfo := &StreamInfo{
+		SampleRate: 8000,
+		Format:     format.F32,
+		ByteOrder:  binary.LittleEndian,
+		Channels:   1,
+	}
+	want, err := convertChunked(inInfo, outInfo, data16k16bit, []int{4000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewMultiConvertor(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for n := 0; n < 8; n++ {
+		s, err := m.NewStream(inInfo, outInfo, resample.MediumQ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := new(bytes.Buffer)
+		for i := 0; i < len(data16k16bit); i += 4000 {
+			end := i + 4000
+			if end > len(data16k16bit) {
+				end = len(data16k16bit)
+			}
+			wg.Add(1)
+			err = s.ProcessAsync(data16k16bit[i:end], func(out []byte, err error) {
+				defer wg.Done()
+				if err != nil {
+					t.Error(err)
+				}
+				got.Write(out)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer s.Close()
+			tail, err := s.Flush()
+			if err != nil {
+				t.Error(err)
+			}
+			if !bytes.Equal(append(got.Bytes(), tail...), want) {
+				t.Error("stream output differs from a single Convertor")
+			}
+		}()
+	}
+	wg.Wait()
+	if err = m.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCloseDuringProcess(t *testing.T) {
+	inInfo := &StreamInfo{SampleRate: 16000, Format: format.S16, ByteOrder: binary.LittleEndian, Channels: 1}
+	outInfo := &StreamInfo{SampleRate: 44100, Format: format.S16, ByteOrder: binary.LittleEndian, Channels: 1}
+	c, err := NewConvertor(inInfo, outInfo, resample.Quick)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 3200)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if _, err := c.Process(data); err != nil {
+				if err != model.ErrClosed {
+					t.Error(err)
+				}
+				return
+			}
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err = c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if err = c.Close(); err != model.ErrClosed {
+		t.Errorf("second Close: got %v, want %v", err, model.ErrClosed)
+	}
+}
+
+func TestConvertReaderAt(t *testing.T) {
+	data16k16bit, err := ioutil.ReadFile("16k_16bit_mono.pcm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inInfo := &StreamInfo{
+		SampleRate: 16000,
+		Format:     format.S16,
+		ByteOrder:  binary.LittleEndian,
+		Channels:   1,
+	}
+	for _, outInfo := range []*StreamInfo{
+		{SampleRate: 44100, Format: format.F32, ByteOrder: binary.BigEndian, Channels: 1},
+		{SampleRate: 8000, Format: format.S16, ByteOrder: binary.LittleEndian, Channels: 2},
+	} {
+		c, err := NewConvertor(inInfo, outInfo, resample.MediumQ, WithPureGoResampler())
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := c.Process(data16k16bit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tail, err := c.Flush()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, tail...)
+		c.Close()
+
+		// Without WithPureGoResampler the segments are resampled in pure Go all the same.
+		for _, opts := range [][]Option{
+			{WithPureGoResampler(), WithSegmentDuration(time.Second), WithWorkers(3)},
+			{WithSegmentDuration(time.Second)},
+		} {
+			got := new(bytes.Buffer)
+			err = ConvertReaderAt(got, bytes.NewReader(data16k16bit), int64(len(data16k16bit)), inInfo, outInfo, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Bytes(), want) {
+				t.Errorf("%d Hz, %d options: got %d bytes, want %d bytes equal to a single pass",
+					outInfo.SampleRate, len(opts), got.Len(), len(want))
+			}
+		}
+	}
+}
+
+func TestOptionsThatDontApply(t *testing.T) {
+	in := &StreamInfo{SampleRate: 16000, Format: format.S16, ByteOrder: binary.LittleEndian, Channels: 1}
+	out := &StreamInfo{SampleRate: 8000, Format: format.S16, ByteOrder: binary.LittleEndian, Channels: 1}
+	for _, opt := range []Option{WithQuality(resample.HighQ), WithWorkers(2), WithSegmentDuration(time.Second)} {
+		if _, err := NewConvertor(in, out, resample.MediumQ, opt); err != model.ErrInvalidParameter {
+			t.Errorf("NewConvertor: got %v, want %v", err, model.ErrInvalidParameter)
+		}
+	}
+	for _, opt := range []Option{WithWorkers(2), WithSegmentDuration(time.Second)} {
+		if _, err := NewReader(bytes.NewReader(nil), in, out, opt); err != model.ErrInvalidParameter {
+			t.Errorf("NewReader: got %v, want %v", err, model.ErrInvalidParameter)
+		}
+	}
+	r, err := NewReader(bytes.NewReader(nil), in, out, WithQuality(resample.HighQ), WithPureGoResampler())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+}
+
+func TestCopyContext(t *testing.T) {
+	data16k16bit, err := ioutil.ReadFile("16k_16bit_mono.pcm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inInfo := &StreamInfo{
+		SampleRate: 16000,
+		Format:     format.S16,
+		ByteOrder:  binary.LittleEndian,
+		Channels:   1,
+	}
+	outInfo := &StreamInfo{
+		SampleRate: 22050,
+		Format:     format.S16,
+		ByteOrder:  binary.LittleEndian,
+		Channels:   1,
+	}
+	c, err := NewConvertor(inInfo, outInfo, resample.MediumQ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var last Progress
+	buf := new(bytes.Buffer)
+	n, err := Copy(context.Background(), buf, bytes.NewReader(data16k16bit), c, func(p Progress) {
+		last = p
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) || last.OutBytes != n || last.InBytes != int64(len(data16k16bit)) ||
+		last.TotalBytes != int64(len(data16k16bit)) || last.InFrames != last.TotalFrames || last.OutFrames != n/2 {
+		t.Errorf("unexpected final progress %+v after writing %d bytes", last, n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	buf.Reset()
+	n, err = Copy(ctx, buf, bytes.NewReader(data16k16bit), c, func(p Progress) {
+		last = p
+		if calls++; calls == 3 {
+			cancel()
+		}
+	})
+	if err != context.Canceled || calls != 3 {
+		t.Errorf("got %v after %d chunks, want %v after 3", err, calls, context.Canceled)
+	}
+	if n != int64(buf.Len()) || last.OutBytes != n {
+		t.Errorf("progress %+v after writing %d bytes, %d returned", last, buf.Len(), n)
+	}
+
+	// Codec streams count the samples of their blocks.
+	format.RegisterCodec(format.G726R16, format.Codec{SampleRate: 8000, BlockSamples: 8, BlockSize: 2})
+	if got := framesIn(10, StreamInfo{SampleRate: 8000, Format: format.G726R16, Channels: 1}); got != 40 {
+		t.Errorf("got %d frames in 5 blocks, want 40", got)
+	}
+}
+
+type gainStage struct {
+	gain float64
+}
+
+func (s *gainStage) Name() string {
+	return "gain"
+}
+
+func (s *gainStage) Process(data []byte) ([]byte, error) {
+	out := make([]byte, len(data))
+	for i := 0; i < len(data); i += 2 {
+		v := float64(int16(binary.LittleEndian.Uint16(data[i:]))) * s.gain
+		binary.LittleEndian.PutUint16(out[i:], uint16(int16(v)))
+	}
+	return out, nil
+}
+
+func (s *gainStage) Flush() ([]byte, error) {
+	return []byte{}, nil
+}
+
+func TestPlanWithStage(t *testing.T) {
+	inInfo := &StreamInfo{SampleRate: 16000, Format: format.S16, ByteOrder: binary.BigEndian, Channels: 1}
+	outInfo := &StreamInfo{SampleRate: 8000, Format: format.F32, ByteOrder: binary.BigEndian, Channels: 2}
+	var seen StreamInfo
+	c, err := NewConvertor(inInfo, outInfo, resample.MediumQ, WithStage(BeforeResample, func(info StreamInfo) (Stage, error) {
+		seen = info
+		return &gainStage{gain: 0.5}, nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if seen.Format != format.S16 || seen.ByteOrder != binary.LittleEndian || seen.SampleRate != 16000 {
+		t.Errorf("stage was created for %+v", seen)
+	}
+	var names []string
+	for _, step := range c.Plan() {
+		names = append(names, step.Name)
+	}
+	want := []string{"byte order", "gain", "resample integer", "format", "upmix"}
+	if fmt.Sprint(names) != fmt.Sprint(want) {
+		t.Errorf("got plan %v, want %v", names, want)
+	}
+
+	in := make([]byte, 3200)
+	for i := 0; i < len(in); i += 2 {
+		binary.BigEndian.PutUint16(in[i:], 20000)
+	}
+	out, err := c.Process(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Away from the start the resampler passes DC through.
+	if v := math.Float32frombits(binary.BigEndian.Uint32(out[len(out)/2:])); math.Abs(float64(v)-float64(10000<<16)/math.MaxInt32) > 0.01 {
+		t.Errorf("got %v after a gain of 0.5", v)
+	}
+}
+
+func TestPlanOrder(t *testing.T) {
+	var testCases = []struct {
+		in, out StreamInfo
+		quality int
+		want    []string
+	}{
+		{
+			StreamInfo{SampleRate: 16000, Format: format.S16, ByteOrder: binary.LittleEndian, Channels: 2},
+			StreamInfo{SampleRate: 44100, Format: format.F64, ByteOrder: binary.LittleEndian, Channels: 1},
+			resample.MediumQ,
+			[]string{"downmix", "resample soxr", "format"},
+		},
+		{
+			StreamInfo{SampleRate: 16000, Format: format.S16, ByteOrder: binary.LittleEndian, Channels: 1},
+			StreamInfo{SampleRate: 44100, Format: format.F32, ByteOrder: binary.LittleEndian, Channels: 1},
+			resample.MediumQ,
+			[]string{"resample soxr"},
+		},
+		{
+			StreamInfo{SampleRate: 8000, Format: format.U8, ByteOrder: binary.LittleEndian, Channels: 1},
+			StreamInfo{SampleRate: 44100, Format: format.U8, ByteOrder: binary.LittleEndian, Channels: 2},
+			resample.MediumQ,
+			[]string{"format", "resample soxr", "format", "upmix"},
+		},
+		{
+			StreamInfo{SampleRate: 16000, Format: format.S16, ByteOrder: binary.LittleEndian, Channels: 1},
+			StreamInfo{SampleRate: 16000, Format: format.S16, ByteOrder: binary.LittleEndian, Channels: 1},
+			resample.MediumQ,
+			nil,
+		},
+		{
+			StreamInfo{SampleRate: 16000, Format: format.S16, ByteOrder: binary.LittleEndian, Channels: 1},
+			StreamInfo{SampleRate: 8000, Format: format.S16, ByteOrder: binary.LittleEndian, Channels: 1},
+			resample.MediumQ,
+			[]string{"resample integer"},
+		},
+		{
+			// The integer resampler falls short of the stopband asked for.
+			StreamInfo{SampleRate: 16000, Format: format.S16, ByteOrder: binary.LittleEndian, Channels: 1},
+			StreamInfo{SampleRate: 8000, Format: format.S16, ByteOrder: binary.LittleEndian, Channels: 1},
+			resample.VeryHighQ,
+			[]string{"resample soxr"},
+		},
+	}
+	for _, tc := range testCases {
+		c, err := NewConvertor(&tc.in, &tc.out, tc.quality)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, step := range c.Plan() {
+			names = append(names, step.Name)
+		}
+		if fmt.Sprint(names) != fmt.Sprint(tc.want) {
+			t.Errorf("%+v -> %+v: got plan %v, want %v", tc.in, tc.out, names, tc.want)
+		}
+		c.Close()
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	src := StreamInfo{SampleRate: 44100, Format: format.S24, ByteOrder: binary.BigEndian, Channels: 2}
+	var testCases = []struct {
+		caps Capabilities
+		want StreamInfo
+	}{
+		{Capabilities{}, src},
+		{
+			Capabilities{SampleRates: []int{8000, 16000}, Formats: []format.PcmFormat{format.S16}, Channels: []int{1}, ByteOrders: []binary.ByteOrder{binary.LittleEndian}},
+			StreamInfo{SampleRate: 16000, Format: format.S16, ByteOrder: binary.LittleEndian, Channels: 1},
+		},
+		{
+			Capabilities{SampleRates: []int{8000, 48000, 96000}, Formats: []format.PcmFormat{format.S16, format.F64, format.F32}},
+			StreamInfo{SampleRate: 48000, Format: format.F32, ByteOrder: binary.BigEndian, Channels: 2},
+		},
+		{
+			Capabilities{MinSampleRate: 8000, MaxSampleRate: 32000, Channels: []int{1, 4}},
+			StreamInfo{SampleRate: 32000, Format: format.S24, ByteOrder: binary.BigEndian, Channels: 1},
+		},
+	}
+	for _, tc := range testCases {
+		got, err := tc.caps.Target(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("%+v: got %+v, want %+v", tc.caps, got, tc.want)
+		}
+		if !tc.caps.Accepts(got) {
+			t.Errorf("%+v does not accept %+v", tc.caps, got)
+		}
+	}
+
+	src = StreamInfo{SampleRate: 16000, Format: format.S16, ByteOrder: binary.LittleEndian, Channels: 1}
+	c, target, err := Negotiate(src, &Capabilities{SampleRates: []int{8000}, Formats: []format.PcmFormat{format.F32}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	out, err := c.Process(make([]byte, 3200))
+	if err != nil {
+		t.Fatal(err)
+	}
+	flushed, err := c.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(out) + len(flushed); n != 800*target.Format.FrameSize() {
+		t.Errorf("got %d bytes of %+v", n, target)
+	}
+
+	if _, err := (&Capabilities{Channels: []int{4}}).Target(StreamInfo{SampleRate: 8000, Format: format.S16, ByteOrder: binary.LittleEndian, Channels: 2}); err != model.ErrChannelsConvert {
+		t.Errorf("got %v, want %v", err, model.ErrChannelsConvert)
+	}
+}
+
+func TestResetTransactional(t *testing.T) {
+	in := &StreamInfo{SampleRate: 16000, Format: format.S16, ByteOrder: binary.LittleEndian, Channels: 1}
+	out := &StreamInfo{SampleRate: 8000, Format: format.S16, ByteOrder: binary.LittleEndian, Channels: 1}
+	c, err := NewConvertor(in, out, resample.MediumQ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := c.pipe.resampler
+
+	bad := &StreamInfo{SampleRate: 8000, Format: format.S16, ByteOrder: binary.LittleEndian, Channels: 0}
+	if err := c.Reset(in, bad, resample.MediumQ); err != model.ErrInvalidChannels {
+		t.Errorf("got %v, want %v", err, model.ErrInvalidChannels)
+	}
+	if _, err := c.Process(make([]byte, 320)); err != nil {
+		t.Errorf("Process after a failed Reset: %v", err)
+	}
+
+	in2 := &StreamInfo{SampleRate: 16000, Format: format.F32, ByteOrder: binary.BigEndian, Channels: 2}
+	stream := makeStream(in2.Format, in2.ByteOrder, in2.Channels, 1600)
+	var runs [2][]byte
+	for i := range runs {
+		// Leave data in the resampler, then start over.
+		if _, err := c.Process(stream[:len(stream)/2]); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Reset(in2, out, resample.MediumQ); err != nil {
+			t.Fatal(err)
+		}
+		got, err := c.Process(stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tail, err := c.Flush()
+		if err != nil {
+			t.Fatal(err)
+		}
+		runs[i] = append(got, tail...)
+	}
+	if c.pipe.resampler != r {
+		t.Error("resampler was not kept")
+	}
+	if !bytes.Equal(runs[0], runs[1]) || len(runs[0]) != 800*2 {
+		t.Error("kept resampler carried state into the new stream")
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+}
+
+func TestResetMatchesNew(t *testing.T) {
+	in := &StreamInfo{SampleRate: 16000, Format: format.S16, ByteOrder: binary.LittleEndian, Channels: 1}
+	out := &StreamInfo{SampleRate: 8000, Format: format.S16, ByteOrder: binary.LittleEndian, Channels: 1}
+	c, err := NewConvertor(in, out, resample.MediumQ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for _, f := range []format.PcmFormat{format.F32, format.F64} {
+		in := &StreamInfo{SampleRate: 16000, Format: f, ByteOrder: binary.LittleEndian, Channels: 1}
+		out := &StreamInfo{SampleRate: 8000, Format: f, ByteOrder: binary.LittleEndian, Channels: 1}
+		stream := makeStream(f, binary.LittleEndian, 1, 1600)
+		if err := c.Reset(in, out, resample.MediumQ); err != nil {
+			t.Fatal(err)
+		}
+		got, err := c.Process(stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tail, err := c.Flush()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := convertChunked(in, out, stream, []int{len(stream)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(append(got, tail...), want) {
+			t.Errorf("%s: output after Reset differs from a new Convertor", f.String())
+		}
+	}
+}
+
+func TestSetInput(t *testing.T) {
+	in := &StreamInfo{SampleRate: 16000, Format: format.S16, ByteOrder: binary.LittleEndian, Channels: 1}
+	out := &StreamInfo{SampleRate: 8000, Format: format.F32, ByteOrder: binary.LittleEndian, Channels: 1}
+	c, err := NewConvertor(in, out, resample.MediumQ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	s16 := make([]byte, 3200)
+	for i := 0; i < len(s16); i += 2 {
+		binary.LittleEndian.PutUint16(s16[i:], 16384)
+	}
+	s16be := make([]byte, 6400)
+	for i := 0; i < len(s16be); i += 2 {
+		binary.BigEndian.PutUint16(s16be[i:], 8192)
+	}
+	r := c.pipe.resampler
+	var res []byte
+	for _, step := range []func() ([]byte, error){
+		func() ([]byte, error) { return c.Process(s16) },
+		func() ([]byte, error) {
+			return c.SetInput(&StreamInfo{SampleRate: 16000, Format: format.S16, ByteOrder: binary.BigEndian, Channels: 2})
+		},
+		func() ([]byte, error) { return c.Process(s16be) },
+		c.Flush,
+	} {
+		data, err := step()
+		if err != nil {
+			t.Fatal(err)
+		}
+		res = append(res, data...)
+	}
+	if len(res) != 1600*4 {
+		t.Fatalf("got %d bytes, want %d", len(res), 1600*4)
+	}
+	// Downmixing adds the channels up, so the level stays at 0.5 across the switch.
+	for i := 100; i < 1500; i++ {
+		if v := math.Float32frombits(binary.LittleEndian.Uint32(res[i*4:])); math.Abs(float64(v)-0.5) > 0.01 {
+			t.Fatalf("frame %d is %v", i, v)
+		}
+	}
+	if c.pipe.resampler != r {
+		t.Error("resampler was not kept")
+	}
+
+	// The S16 resampler would cut F32 input down to 16 bits.
+	if _, err := c.SetInput(&StreamInfo{SampleRate: 16000, Format: format.F32, ByteOrder: binary.LittleEndian, Channels: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if c.pipe.resampler == r {
+		t.Error("S16 resampler was kept for F32 input")
+	}
+
+	if _, err := c.SetInput(&StreamInfo{SampleRate: 44100, Format: format.S16, ByteOrder: binary.LittleEndian, Channels: 1}); err != model.ErrInvalidSampleRate {
+		t.Errorf("got %v, want %v", err, model.ErrInvalidSampleRate)
+	}
+}
+
+// highByte is a codec for TestCodecFormat that keeps the high byte of every sample.
+type highByte struct{}
+
+func (highByte) Encode(dst []byte, src []int16) {
+	for i, s := range src {
+		dst[i] = byte(s >> 8)
+	}
+}
+
+func (highByte) Decode(dst []int16, src []byte) error {
+	for i, b := range src {
+		dst[i] = int16(int8(b)) << 8
+	}
+	return nil
+}
+
+func TestCodecFormat(t *testing.T) {
+	// The codec packages can't be imported here; G722 stands in for a format they register.
+	format.RegisterCodec(format.G722, format.Codec{
+		SampleRate:   8000,
+		BlockSamples: 4,
+		BlockSize:    4,
+		NewEncoder:   func() format.BlockEncoder { return highByte{} },
+		NewDecoder:   func() format.BlockDecoder { return highByte{} },
+	})
+	coded := &StreamInfo{SampleRate: 8000, Format: format.G722, Channels: 1}
+	wide := &StreamInfo{SampleRate: 16000, Format: format.F32, ByteOrder: binary.LittleEndian, Channels: 2}
+
+	c, err := NewConvertor(coded, coded, resample.HighQ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, step := range c.Plan() {
+		names = append(names, step.Name)
+	}
+	if got := fmt.Sprint(names); got != "[decode g722 encode g722]" {
+		t.Errorf("got plan %s", got)
+	}
+	if out, err := c.Process([]byte{1, 2, 3, 4, 5, 6}); err != nil || !bytes.Equal(out, []byte{1, 2, 3, 4}) {
+		t.Errorf("got %v, %v", out, err)
+	}
+
+	// Six samples make a block and a half; Flush pads the half with silence.
+	pcm := &StreamInfo{SampleRate: 8000, Format: format.S16, ByteOrder: binary.BigEndian, Channels: 1}
+	c, err = NewConvertor(pcm, coded, resample.HighQ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := c.Process([]byte{1, 0, 2, 0, 3, 0, 4, 0, 5, 0, 6, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tail, err := c.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := append(out, tail...); !bytes.Equal(got, []byte{1, 2, 3, 4, 5, 6, 0, 0}) {
+		t.Errorf("got %v", got)
+	}
+
+	c, err = NewConvertor(coded, wide, resample.HighQ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan := c.Plan(); plan[0].Out.Format != format.S16 || plan[len(plan)-1].Out != *wide {
+		t.Errorf("got plan %+v", plan)
+	}
+	if got := c.ExpectedOutputFrames(100); got != 800 {
+		t.Errorf("expected %d frames for 100 blocks", got)
+	}
+	if _, err := c.Snapshot(); err != model.ErrSnapshotUnsupported {
+		t.Errorf("Snapshot: got %v", err)
+	}
+
+	if _, err := NewConvertor(&StreamInfo{SampleRate: 16000, Format: format.G722, Channels: 1}, wide, resample.HighQ); err != model.ErrInvalidSampleRate {
+		t.Errorf("wrong rate: got %v", err)
+	}
+	if _, err := NewConvertor(wide, &StreamInfo{SampleRate: 8000, Format: format.G722, Channels: 2}, resample.HighQ); err != model.ErrInvalidChannels {
+		t.Errorf("stereo: got %v", err)
+	}
+	if _, err := NewFramer(coded, 20*time.Millisecond, false); err != model.ErrInvalidParameter {
+		t.Errorf("Framer: got %v", err)
+	}
+	if _, err := NewPullConvertor(bytes.NewReader(nil), coded, wide); err != model.ErrInvalidFormat {
+		t.Errorf("PullConvertor: got %v", err)
+	}
+	if err := ConvertReaderAt(ioutil.Discard, bytes.NewReader(nil), 0, wide, coded); err != model.ErrInvalidFormat {
+		t.Errorf("ConvertReaderAt: got %v", err)
+	}
+}
@@ -3,12 +3,14 @@ package main
 import (
 	"encoding/binary"
 	"fmt"
+	"io"
 	"log"
 	"os"
 
 	"github.com/ZhangJYd/pcm_convertor"
 	"github.com/ZhangJYd/pcm_convertor/format"
 	"github.com/ZhangJYd/pcm_convertor/resample"
+	"github.com/ZhangJYd/pcm_convertor/wav"
 )
 
 func main() {
@@ -23,7 +25,7 @@ func main() {
 	outInfo := &pcm_convertor.StreamInfo{
 		SampleRate: 32000,
 		Format:     format.F32,
-		ByteOrder:  binary.BigEndian,
+		ByteOrder:  binary.LittleEndian,
 		Channels:   3,
 	}
 	inInfo := &pcm_convertor.StreamInfo{
@@ -32,15 +34,15 @@ func main() {
 		ByteOrder:  binary.LittleEndian,
 		Channels:   1,
 	}
-	c, err := pcm_convertor.NewConvertor(inInfo, outInfo, resample.Quick)
+	r, err := pcm_convertor.NewReader(f, inInfo, outInfo, pcm_convertor.WithQuality(resample.Quick))
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	defer c.Close()
+	defer r.Close()
 	outF, err := os.Create(
-		fmt.Sprintf("%v_%v_%v_%vchannels.pcm",
-			outInfo.Format.String(), outInfo.SampleRate, outInfo.ByteOrder, outInfo.Channels),
+		fmt.Sprintf("%v_%v_%vchannels.wav",
+			outInfo.Format.String(), outInfo.SampleRate, outInfo.Channels),
 	)
 	if err != nil {
 		log.Println(err)
@@ -48,24 +50,15 @@ func main() {
 	}
 	defer outF.Close()
 
-	chuckSize := 128
-	chuck := make([]byte, inInfo.Format.FrameSize()*chuckSize)
-
-	for {
-		n, err := f.Read(chuck)
-		if err != nil || n < inInfo.Format.FrameSize()*chuckSize {
-			log.Println(err)
-			break
-		}
-		stream, err := c.Process(chuck)
-		if err != nil {
-			log.Println(err)
-			break
-		}
-		_, err = outF.Write(stream)
-		if err != nil {
-			log.Println(err)
-			break
-		}
+	w, err := wav.NewWriter(outF, *outInfo)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if _, err = io.Copy(w, r); err != nil {
+		log.Println(err)
+	}
+	if err = w.Close(); err != nil {
+		log.Println(err)
 	}
 }
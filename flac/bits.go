@@ -0,0 +1,174 @@
+package flac
+
+import (
+	"bufio"
+	"io"
+)
+
+// bitReader reads the big-endian bit fields of a FLAC stream and keeps the CRCs of
+// the bytes read since the last resetCRC.
+type bitReader struct {
+	r     *bufio.Reader
+	cache uint64
+	n     uint
+	crc8  uint8
+	crc16 uint16
+}
+
+func newBitReader(r io.Reader) *bitReader {
+	return &bitReader{r: bufio.NewReader(r)}
+}
+
+func (br *bitReader) readByte() (byte, error) {
+	b, err := br.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	br.crc8 = crc8Table[br.crc8^b]
+	br.crc16 = br.crc16<<8 ^ crc16Table[byte(br.crc16>>8)^b]
+	return b, nil
+}
+
+// readBits reads n <= 32 bits as an unsigned number.
+func (br *bitReader) readBits(n uint) (uint64, error) {
+	for br.n < n {
+		b, err := br.readByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		br.cache = br.cache<<8 | uint64(b)
+		br.n += 8
+	}
+	v := br.cache >> (br.n - n) & (1<<n - 1)
+	br.n -= n
+	return v, nil
+}
+
+// readSigned reads n bits as a two's complement number.
+func (br *bitReader) readSigned(n uint) (int64, error) {
+	if n == 0 {
+		return 0, nil
+	}
+	v, err := br.readBits(n)
+	if err != nil {
+		return 0, err
+	}
+	return int64(v<<(64-n)) >> (64 - n), nil
+}
+
+// readUnary counts the 0 bits before the next 1 bit.
+func (br *bitReader) readUnary() (uint64, error) {
+	var count uint64
+	for {
+		if br.n == 0 {
+			b, err := br.readByte()
+			if err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return 0, err
+			}
+			br.cache = uint64(b)
+			br.n = 8
+		}
+		bit := br.cache >> (br.n - 1) & 1
+		br.n--
+		if bit == 1 {
+			return count, nil
+		}
+		count++
+	}
+}
+
+// align drops the bits up to the next byte boundary.
+func (br *bitReader) align() {
+	br.n -= br.n % 8
+}
+
+func (br *bitReader) resetCRC() {
+	br.crc8 = 0
+	br.crc16 = 0
+}
+
+var (
+	crc8Table  [256]uint8
+	crc16Table [256]uint16
+)
+
+func init() {
+	// Polynomials x^8+x^2+x+1 and x^16+x^15+x^2+1, as FLAC uses them.
+	for i := 0; i < 256; i++ {
+		c8 := uint8(i)
+		c16 := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if c8&0x80 != 0 {
+				c8 = c8<<1 ^ 0x07
+			} else {
+				c8 <<= 1
+			}
+			if c16&0x8000 != 0 {
+				c16 = c16<<1 ^ 0x8005
+			} else {
+				c16 <<= 1
+			}
+		}
+		crc8Table[i] = c8
+		crc16Table[i] = c16
+	}
+}
+
+// bitWriter writes big-endian bit fields.
+type bitWriter struct {
+	buf   []byte
+	cache uint64
+	n     uint
+}
+
+// writeBits writes the low n <= 32 bits of v.
+func (bw *bitWriter) writeBits(v uint64, n uint) {
+	bw.cache = bw.cache<<n | v&(1<<n-1)
+	bw.n += n
+	for bw.n >= 8 {
+		bw.n -= 8
+		bw.buf = append(bw.buf, byte(bw.cache>>bw.n))
+	}
+}
+
+// writeSigned writes v as an n-bit two's complement number.
+func (bw *bitWriter) writeSigned(v int64, n uint) {
+	bw.writeBits(uint64(v), n)
+}
+
+// writeUnary writes n 0 bits followed by a 1 bit.
+func (bw *bitWriter) writeUnary(n uint64) {
+	for ; n >= 32; n -= 32 {
+		bw.writeBits(0, 32)
+	}
+	bw.writeBits(1, uint(n)+1)
+}
+
+// align pads the bits written with 0 bits up to the next byte boundary.
+func (bw *bitWriter) align() {
+	if bw.n%8 != 0 {
+		bw.writeBits(0, 8-bw.n%8)
+	}
+}
+
+func crc8(b []byte) uint8 {
+	var c uint8
+	for _, v := range b {
+		c = crc8Table[c^v]
+	}
+	return c
+}
+
+func crc16(b []byte) uint16 {
+	var c uint16
+	for _, v := range b {
+		c = c<<8 ^ crc16Table[byte(c>>8)^v]
+	}
+	return c
+}
@@ -0,0 +1,606 @@
+package flac
+
+import (
+	"math"
+	"math/bits"
+)
+
+// level holds the settings of a compression level.
+type level struct {
+	blockSize int
+	// stereo tries the decorrelated stereo channel assignments.
+	stereo         bool
+	lpcOrder       int
+	partitionOrder int
+	// exhaustive tries every LPC order instead of the estimated best one.
+	exhaustive bool
+}
+
+// levels follow the compression levels of the reference encoder.
+var levels = [...]level{
+	{1152, false, 0, 3, false},
+	{1152, true, 0, 3, false},
+	{1152, true, 0, 3, false},
+	{4096, false, 6, 4, false},
+	{4096, true, 8, 4, false},
+	{4096, true, 8, 5, false},
+	{4096, true, 8, 6, false},
+	{4096, true, 12, 6, false},
+	{4096, true, 12, 6, true},
+}
+
+// maxResidual bounds the residual so that Rice coding it stays within 31 bits.
+const maxResidual = 1 << 30
+
+// encoder encodes blocks of samples as frames.
+type encoder struct {
+	level
+	bps        int
+	sampleRate int
+	window     []float64
+}
+
+// subframe is an encoded channel of a frame.
+type subframe struct {
+	kind   int
+	wasted uint
+	bps    uint
+	// samples are the samples without the wasted bits; warm-up samples are taken
+	// from them, verbatim subframes consist of them.
+	samples   []int32
+	coefs     []int32
+	precision uint
+	shift     uint
+	residual  []int32
+	rice      rice
+	bits      int64
+}
+
+// rice is a partitioned Rice coding of a residual.
+type rice struct {
+	order  uint
+	params []uint
+	// wide selects 5-bit parameters.
+	wide bool
+	bits int64
+}
+
+// encodeFrame appends the frame of block number with the samples of each channel to bw.
+func (e *encoder) encodeFrame(bw *bitWriter, ch [][]int32, number uint64) {
+	start := len(bw.buf)
+	blockSize := len(ch[0])
+	assignment := len(ch) - 1
+	subframes := make([]*subframe, len(ch))
+	if len(ch) == 2 && e.stereo && e.bps < 32 {
+		assignment, subframes[0], subframes[1] = e.encodeStereo(ch[0], ch[1])
+	} else {
+		for c, samples := range ch {
+			subframes[c] = e.encodeSubframe(samples, uint(e.bps))
+		}
+	}
+
+	bw.writeBits(0xfff8, 16)
+	blockCode, blockBits := blockSizeCode(blockSize)
+	rateCode, rateBits, rate := sampleRateCode(e.sampleRate)
+	bw.writeBits(uint64(blockCode), 4)
+	bw.writeBits(uint64(rateCode), 4)
+	bw.writeBits(uint64(assignment), 4)
+	bw.writeBits(uint64(sampleSizeCode(e.bps)), 3)
+	bw.writeBits(0, 1)
+	writeCodedNumber(bw, number)
+	bw.writeBits(uint64(blockSize-1), blockBits)
+	bw.writeBits(uint64(rate), rateBits)
+	bw.writeBits(uint64(crc8(bw.buf[start:])), 8)
+
+	for _, sf := range subframes {
+		sf.write(bw)
+	}
+	bw.align()
+	bw.writeBits(uint64(crc16(bw.buf[start:])), 16)
+}
+
+// encodeStereo picks the channel assignment of a stereo frame whose channels are
+// estimated to compress best.
+func (e *encoder) encodeStereo(left, right []int32) (int, *subframe, *subframe) {
+	mid := make([]int32, len(left))
+	side := make([]int32, len(left))
+	for i := range left {
+		mid[i] = (left[i] + right[i]) >> 1
+		side[i] = left[i] - right[i]
+	}
+	l, r, m, s := estimate(left), estimate(right), estimate(mid), estimate(side)
+	bps := uint(e.bps)
+	switch minOf(l+r, l+s, s+r, m+s) {
+	case l + r:
+		return 1, e.encodeSubframe(left, bps), e.encodeSubframe(right, bps)
+	case l + s:
+		return 8, e.encodeSubframe(left, bps), e.encodeSubframe(side, bps+1)
+	case s + r:
+		return 9, e.encodeSubframe(side, bps+1), e.encodeSubframe(right, bps)
+	}
+	return 10, e.encodeSubframe(mid, bps), e.encodeSubframe(side, bps+1)
+}
+
+func minOf(v ...int64) int64 {
+	min := v[0]
+	for _, x := range v[1:] {
+		if x < min {
+			min = x
+		}
+	}
+	return min
+}
+
+// estimate is the sum of the absolute residual of the best fixed predictor, a measure
+// of how well samples compress.
+func estimate(samples []int32) int64 {
+	var sums [5]int64
+	for i := 4; i < len(samples); i++ {
+		s := samples[i-4 : i+1]
+		d0 := int64(s[4])
+		d1 := d0 - int64(s[3])
+		d2 := d1 - (int64(s[3]) - int64(s[2]))
+		d3 := d2 - (int64(s[3]) - 2*int64(s[2]) + int64(s[1]))
+		d4 := d3 - (int64(s[3]) - 3*int64(s[2]) + 3*int64(s[1]) - int64(s[0]))
+		for o, d := range [...]int64{d0, d1, d2, d3, d4} {
+			if d < 0 {
+				d = -d
+			}
+			sums[o] += d
+		}
+	}
+	return minOf(sums[:]...)
+}
+
+// encodeSubframe picks the smallest subframe for samples of bps bits.
+func (e *encoder) encodeSubframe(samples []int32, bps uint) *subframe {
+	constant := true
+	var or int32
+	for _, s := range samples {
+		constant = constant && s == samples[0]
+		or |= s
+	}
+	if constant {
+		return &subframe{kind: 0, bps: bps, samples: samples[:1], bits: 8 + int64(bps)}
+	}
+
+	v := &subframe{kind: 1, bps: bps, samples: samples}
+	if wasted := uint(bits.TrailingZeros32(uint32(or))); wasted > 0 {
+		v.wasted = wasted
+		v.bps -= wasted
+		v.samples = make([]int32, len(samples))
+		for i, s := range samples {
+			v.samples[i] = s >> wasted
+		}
+	}
+	header := 8 + int64(v.wasted)
+	v.bits = header + int64(len(samples))*int64(v.bps)
+
+	best := v
+	try := func(sf *subframe) {
+		if sf != nil && sf.bits < best.bits {
+			best = sf
+		}
+	}
+	for order := 0; order <= 4 && order < len(samples); order++ {
+		sf := e.predicted(v, 8+order, fixedCoefficients[order], 0, 0)
+		if sf != nil {
+			sf.bits += header + int64(order)*int64(v.bps)
+		}
+		try(sf)
+	}
+	if e.lpcOrder > 0 {
+		try(e.lpc(v, header))
+	}
+	return best
+}
+
+// predicted is the subframe of kind that predicts the samples of v with coefs, or nil if
+// the residual is out of range. Its bits are those of the residual and coefficients.
+func (e *encoder) predicted(v *subframe, kind int, coefs []int32, precision, shift uint) *subframe {
+	order := len(coefs)
+	samples := v.samples
+	residual := make([]int32, len(samples)-order)
+	for i := order; i < len(samples); i++ {
+		var sum int64
+		for j, c := range coefs {
+			sum += int64(c) * int64(samples[i-1-j])
+		}
+		r := int64(samples[i]) - sum>>shift
+		if r < -maxResidual || r >= maxResidual {
+			return nil
+		}
+		residual[i-order] = int32(r)
+	}
+	sf := &subframe{
+		kind:      kind,
+		wasted:    v.wasted,
+		bps:       v.bps,
+		samples:   samples,
+		coefs:     coefs,
+		precision: precision,
+		shift:     shift,
+		residual:  residual,
+		rice:      e.chooseRice(residual, len(samples), order),
+	}
+	sf.bits = sf.rice.bits
+	if kind >= 32 {
+		sf.bits += 4 + 5 + int64(order)*int64(precision)
+	}
+	return sf
+}
+
+// lpc is the best LPC subframe for the samples of v, or nil if there is none.
+func (e *encoder) lpc(v *subframe, header int64) *subframe {
+	n := len(v.samples)
+	maxOrder := e.lpcOrder
+	if maxOrder >= n {
+		maxOrder = n - 1
+	}
+	if maxOrder < 1 {
+		return nil
+	}
+	if len(e.window) != n {
+		e.window = tukey(n, 0.5)
+	}
+	autoc := make([]float64, maxOrder+1)
+	data := make([]float64, n)
+	for i, s := range v.samples {
+		data[i] = float64(s) * e.window[i]
+	}
+	for lag := range autoc {
+		var sum float64
+		for i := lag; i < n; i++ {
+			sum += data[i] * data[i-lag]
+		}
+		autoc[lag] = sum
+	}
+	coefs, errs := levinson(autoc)
+	if len(coefs) == 0 {
+		return nil
+	}
+
+	precision := coefficientPrecision(n)
+	orders := []int{bestOrder(errs, n, int(v.bps), precision)}
+	if e.exhaustive {
+		orders = orders[:0]
+		for order := 1; order <= len(coefs); order++ {
+			orders = append(orders, order)
+		}
+	}
+	var best *subframe
+	for _, order := range orders {
+		p := precision
+		// Keep the prediction within 32 bits, as decoders are allowed to compute it so.
+		if limit := 32 - int(v.bps) - (bits.Len(uint(order)) - 1); p > limit {
+			p = limit
+		}
+		if p < 5 {
+			continue
+		}
+		q, shift, ok := quantize(coefs[order-1], uint(p))
+		if !ok {
+			continue
+		}
+		sf := e.predicted(v, 31+order, q, uint(p), shift)
+		if sf == nil {
+			continue
+		}
+		sf.bits += header + int64(order)*int64(v.bps)
+		if best == nil || sf.bits < best.bits {
+			best = sf
+		}
+	}
+	return best
+}
+
+// tukey is a Tukey window of n points whose tapered part is p of it.
+func tukey(n int, p float64) []float64 {
+	w := make([]float64, n)
+	taper := int(p / 2 * float64(n-1))
+	for i := range w {
+		w[i] = 1
+		if i < taper {
+			w[i] = 0.5 - 0.5*math.Cos(math.Pi*float64(i)/float64(taper))
+		} else if j := n - 1 - i; j < taper {
+			w[i] = 0.5 - 0.5*math.Cos(math.Pi*float64(j)/float64(taper))
+		}
+	}
+	return w
+}
+
+// levinson solves the autocorrelation autoc for the predictor of each order and returns
+// them with their prediction errors. The coefficient j of a predictor applies to the
+// sample j+1 back.
+func levinson(autoc []float64) ([][]float64, []float64) {
+	e := autoc[0]
+	if e <= 0 {
+		return nil, nil
+	}
+	var coefs [][]float64
+	var errs []float64
+	a := []float64{}
+	for i := 1; i < len(autoc); i++ {
+		acc := autoc[i]
+		for j, c := range a {
+			acc -= c * autoc[i-1-j]
+		}
+		k := acc / e
+		next := make([]float64, i)
+		for j := range a {
+			next[j] = a[j] - k*a[i-2-j]
+		}
+		next[i-1] = k
+		a = next
+		e *= 1 - k*k
+		if e <= 0 {
+			break
+		}
+		coefs = append(coefs, a)
+		errs = append(errs, e)
+	}
+	return coefs, errs
+}
+
+// coefficientPrecision is the precision of the LPC coefficients for a block size.
+func coefficientPrecision(blockSize int) int {
+	switch {
+	case blockSize <= 192:
+		return 7
+	case blockSize <= 384:
+		return 8
+	case blockSize <= 576:
+		return 9
+	case blockSize <= 1152:
+		return 10
+	case blockSize <= 2304:
+		return 11
+	case blockSize <= 4608:
+		return 12
+	}
+	return 13
+}
+
+// bestOrder estimates the LPC order that gives the smallest subframe from the
+// prediction errors of each order.
+func bestOrder(errs []float64, n, bps, precision int) int {
+	best, bestBits := 1, math.Inf(1)
+	for i, e := range errs {
+		order := i + 1
+		perSample := 0.0
+		if e > 0 {
+			perSample = math.Max(0, 0.5*math.Log2(e*0.5/float64(n)))
+		}
+		total := perSample*float64(n-order) + float64(order*(bps+precision))
+		if total < bestBits {
+			best, bestBits = order, total
+		}
+	}
+	return best
+}
+
+// quantize turns the coefficients lp into integers of precision bits and the shift
+// they are scaled by.
+func quantize(lp []float64, precision uint) ([]int32, uint, bool) {
+	var cmax float64
+	for _, c := range lp {
+		cmax = math.Max(cmax, math.Abs(c))
+	}
+	if cmax <= 0 {
+		return nil, 0, false
+	}
+	max := int64(1)<<(precision-1) - 1
+	min := -max - 1
+	_, exp := math.Frexp(cmax)
+	shift := int(precision) - exp - 1
+	if shift < 0 {
+		return nil, 0, false
+	}
+	if shift > 15 {
+		shift = 15
+	}
+	q := make([]int32, len(lp))
+	var carry float64
+	for i, c := range lp {
+		carry += c * float64(int64(1)<<uint(shift))
+		v := int64(math.Round(carry))
+		if v > max {
+			v = max
+		} else if v < min {
+			v = min
+		}
+		carry -= float64(v)
+		q[i] = int32(v)
+	}
+	return q, uint(shift), true
+}
+
+// chooseRice picks the partition order and Rice parameters for the residual of a
+// block of blockSize samples predicted with order warm-up samples.
+func (e *encoder) chooseRice(residual []int32, blockSize, order int) rice {
+	maxOrder := uint(0)
+	for p := uint(1); p <= uint(e.partitionOrder); p++ {
+		if blockSize%(1<<p) != 0 || blockSize>>p < order {
+			break
+		}
+		maxOrder = p
+	}
+	// The sums of the zigzag coded residual of each partition at maxOrder; the lower
+	// orders merge neighbouring partitions.
+	sums := make([]uint64, 1<<maxOrder)
+	size := blockSize >> maxOrder
+	for i, r := range residual {
+		sums[(i+order)/size] += uint64(uint32(r<<1 ^ r>>31))
+	}
+
+	var best rice
+	for p := int(maxOrder); p >= 0; p-- {
+		if p < int(maxOrder) {
+			for j := range sums[:1<<uint(p)] {
+				sums[j] = sums[2*j] + sums[2*j+1]
+			}
+			sums = sums[:1<<uint(p)]
+		}
+		c := rice{order: uint(p), params: make([]uint, len(sums)), bits: 6}
+		size := blockSize >> uint(p)
+		for j, sum := range sums {
+			n := size
+			if j == 0 {
+				n -= order
+			}
+			param, bits := riceParam(sum, n)
+			c.params[j] = param
+			c.wide = c.wide || param > 14
+			c.bits += bits
+		}
+		paramBits := int64(4)
+		if c.wide {
+			paramBits = 5
+		}
+		c.bits += paramBits * int64(len(sums))
+		if best.params == nil || c.bits < best.bits {
+			best = c
+		}
+	}
+	return best
+}
+
+// riceParam picks the Rice parameter for n values summing to sum and estimates the
+// bits they take.
+func riceParam(sum uint64, n int) (uint, int64) {
+	if n == 0 {
+		return 0, 0
+	}
+	k := uint(0)
+	if mean := sum / uint64(n); mean > 0 {
+		k = uint(bits.Len64(mean)) - 1
+	}
+	cost := func(k uint) int64 {
+		return int64(n)*int64(k+1) + int64(sum>>k)
+	}
+	if k < 30 && cost(k+1) < cost(k) {
+		k++
+	}
+	if k > 30 {
+		k = 30
+	}
+	return k, cost(k)
+}
+
+func (sf *subframe) write(bw *bitWriter) {
+	bw.writeBits(uint64(sf.kind), 7)
+	if sf.wasted > 0 {
+		bw.writeBits(1, 1)
+		bw.writeUnary(uint64(sf.wasted - 1))
+	} else {
+		bw.writeBits(0, 1)
+	}
+	switch {
+	case sf.kind == 0:
+		bw.writeSigned(int64(sf.samples[0]), sf.bps)
+		return
+	case sf.kind == 1:
+		for _, s := range sf.samples {
+			bw.writeSigned(int64(s), sf.bps)
+		}
+		return
+	}
+	order := len(sf.coefs)
+	for _, s := range sf.samples[:order] {
+		bw.writeSigned(int64(s), sf.bps)
+	}
+	if sf.kind >= 32 {
+		bw.writeBits(uint64(sf.precision-1), 4)
+		bw.writeSigned(int64(sf.shift), 5)
+		for _, c := range sf.coefs {
+			bw.writeSigned(int64(c), sf.precision)
+		}
+	}
+	sf.writeResidual(bw, len(sf.samples), order)
+}
+
+func (sf *subframe) writeResidual(bw *bitWriter, blockSize, order int) {
+	paramBits := uint(4)
+	if sf.rice.wide {
+		bw.writeBits(1, 2)
+		paramBits = 5
+	} else {
+		bw.writeBits(0, 2)
+	}
+	bw.writeBits(uint64(sf.rice.order), 4)
+	size := blockSize >> sf.rice.order
+	residual := sf.residual
+	for j, k := range sf.rice.params {
+		n := size
+		if j == 0 {
+			n -= order
+		}
+		bw.writeBits(uint64(k), paramBits)
+		for _, r := range residual[:n] {
+			u := uint64(uint32(r<<1 ^ r>>31))
+			bw.writeUnary(u >> k)
+			bw.writeBits(u, k)
+		}
+		residual = residual[n:]
+	}
+}
+
+// blockSizeCode is the frame header code of a block size and the number of bits it
+// is stored with at the end of the header.
+func blockSizeCode(n int) (int, uint) {
+	switch {
+	case n == 192:
+		return 1, 0
+	case n == 576 || n == 1152 || n == 2304 || n == 4608:
+		return 2 + bits.Len(uint(n/576)) - 1, 0
+	case n >= 256 && n <= 32768 && n&(n-1) == 0:
+		return 8 + bits.Len(uint(n/256)) - 1, 0
+	case n <= 256:
+		return 6, 8
+	}
+	return 7, 16
+}
+
+// sampleRateCode is the frame header code of a sample rate and the number of bits and
+// value it is stored with at the end of the header.
+func sampleRateCode(rate int) (int, uint, int) {
+	for code, r := range sampleRates {
+		if r == rate && code > 0 {
+			return code, 0, 0
+		}
+	}
+	switch {
+	case rate%1000 == 0 && rate/1000 <= 0xff:
+		return 12, 8, rate / 1000
+	case rate <= 0xffff:
+		return 13, 16, rate
+	case rate%10 == 0 && rate/10 <= 0xffff:
+		return 14, 16, rate / 10
+	}
+	return 0, 0, 0
+}
+
+func sampleSizeCode(bps int) int {
+	for code, size := range sampleSizes {
+		if size == bps {
+			return code
+		}
+	}
+	return 0
+}
+
+// writeCodedNumber writes v in the UTF-8 style coding of frame numbers.
+func writeCodedNumber(bw *bitWriter, v uint64) {
+	if v < 0x80 {
+		bw.writeBits(v, 8)
+		return
+	}
+	n := uint(2)
+	for v >= 1<<(5*n+1) {
+		n++
+	}
+	bw.writeBits(0xff00>>n&0xff|v>>(6*(n-1)), 8)
+	for i := int(n) - 2; i >= 0; i-- {
+		bw.writeBits(0x80|v>>(6*uint(i))&0x3f, 8)
+	}
+}
@@ -0,0 +1,431 @@
+package flac
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/ZhangJYd/pcm_convertor"
+	"github.com/ZhangJYd/pcm_convertor/format"
+	"github.com/ZhangJYd/pcm_convertor/model"
+)
+
+// writeRice writes residual with a single partition and Rice parameter k.
+func writeRice(bw *bitWriter, residual []int32, k uint) {
+	bw.writeBits(0, 2)
+	bw.writeBits(0, 4)
+	bw.writeBits(uint64(k), 4)
+	for _, r := range residual {
+		u := uint64(r<<1 ^ r>>31)
+		for q := u >> k; q > 0; q-- {
+			bw.writeBits(0, 1)
+		}
+		bw.writeBits(1, 1)
+		bw.writeBits(u, k)
+	}
+}
+
+// frame builds a frame with a 16-bit block size and the sample rate and size of STREAMINFO.
+func frame(number, assignment, blockSize int, subframes func(bw *bitWriter)) []byte {
+	bw := &bitWriter{}
+	bw.writeBits(0xfff8, 16)
+	bw.writeBits(7, 4)
+	bw.writeBits(0, 4)
+	bw.writeBits(uint64(assignment), 4)
+	bw.writeBits(0, 4)
+	bw.writeBits(uint64(number), 8)
+	bw.writeBits(uint64(blockSize-1), 16)
+	bw.writeBits(uint64(crc8(bw.buf)), 8)
+	subframes(bw)
+	bw.align()
+	bw.writeBits(uint64(crc16(bw.buf)), 16)
+	return bw.buf
+}
+
+func verbatim(bw *bitWriter, samples []int32, bps uint) {
+	bw.writeBits(1<<1, 8)
+	for _, s := range samples {
+		bw.writeSigned(int64(s), bps)
+	}
+}
+
+// fixed writes a fixed subframe of order 2.
+func fixed(bw *bitWriter, samples []int32, bps uint) {
+	bw.writeBits(10<<1, 8)
+	bw.writeSigned(int64(samples[0]), bps)
+	bw.writeSigned(int64(samples[1]), bps)
+	residual := make([]int32, len(samples)-2)
+	for i := range residual {
+		residual[i] = samples[i+2] - 2*samples[i+1] + samples[i]
+	}
+	writeRice(bw, residual, 3)
+}
+
+// lpc writes an LPC subframe of order 1 with the coefficient 0.5.
+func lpc(bw *bitWriter, samples []int32, bps uint) {
+	bw.writeBits(32<<1, 8)
+	bw.writeSigned(int64(samples[0]), bps)
+	bw.writeBits(3, 4)
+	bw.writeSigned(1, 5)
+	bw.writeSigned(1, 4)
+	residual := make([]int32, len(samples)-1)
+	for i := range residual {
+		residual[i] = samples[i+1] - samples[i]>>1
+	}
+	writeRice(bw, residual, 4)
+}
+
+// stream builds a stream from STREAMINFO and frames, with the MD5 of the samples.
+func stream(rate, channels, bps int, samples [][]int32, frames ...[]byte) []byte {
+	sum := md5.New()
+	for i := range samples[0] {
+		for _, ch := range samples {
+			for b := 0; b < (bps+7)/8; b++ {
+				sum.Write([]byte{byte(ch[i] >> (8 * uint(b)))})
+			}
+		}
+	}
+	info := make([]byte, 34)
+	binary.BigEndian.PutUint16(info[0:], 4096)
+	binary.BigEndian.PutUint16(info[2:], 4096)
+	binary.BigEndian.PutUint64(info[10:], uint64(rate)<<44|uint64(channels-1)<<41|uint64(bps-1)<<36|uint64(len(samples[0])))
+	copy(info[18:], sum.Sum(nil))
+
+	out := []byte("fLaC")
+	out = append(out, 0x80, 0, 0, 34)
+	out = append(out, info...)
+	for _, f := range frames {
+		out = append(out, f...)
+	}
+	return out
+}
+
+func wave(n int, scale int32) []int32 {
+	s := make([]int32, n)
+	for i := range s {
+		s[i] = int32(i%50-25) * scale
+	}
+	return s
+}
+
+func TestDecodeMono(t *testing.T) {
+	samples := wave(300, 1000)
+	file := stream(16000, 1, 16, [][]int32{samples},
+		frame(0, 0, 100, func(bw *bitWriter) { verbatim(bw, samples[:100], 16) }),
+		frame(1, 0, 100, func(bw *bitWriter) { fixed(bw, samples[100:200], 16) }),
+		frame(2, 0, 100, func(bw *bitWriter) { lpc(bw, samples[200:], 16) }),
+	)
+	// An ID3v2 tag in front is skipped.
+	file = append([]byte("ID3\x04\x00\x00\x00\x00\x00\x03abc"), file...)
+
+	r, err := NewReader(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := pcm_convertor.StreamInfo{SampleRate: 16000, Format: format.S16, ByteOrder: binary.LittleEndian, Channels: 1}
+	if r.StreamInfo() != want || r.TotalFrames() != 300 || r.BitsPerSample() != 16 {
+		t.Errorf("got %+v, %d frames of %d bits", r.StreamInfo(), r.TotalFrames(), r.BitsPerSample())
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 600 {
+		t.Fatalf("got %d bytes", len(got))
+	}
+	for i, s := range samples {
+		if v := int16(binary.LittleEndian.Uint16(got[2*i:])); int32(v) != s {
+			t.Fatalf("sample %d: got %d, want %d", i, v, s)
+		}
+	}
+}
+
+func TestDecodeStereo(t *testing.T) {
+	left, right := wave(64, 3000), wave(64, -2000)
+	side := make([]int32, 64)
+	mid := make([]int32, 64)
+	for i := range left {
+		side[i] = left[i] - right[i]
+		mid[i] = (left[i] + right[i]) >> 1
+	}
+	samples := [][]int32{left, right}
+	file := stream(44100, 2, 24, samples,
+		// left/side, then mid/side.
+		frame(0, 8, 32, func(bw *bitWriter) {
+			fixed(bw, left[:32], 24)
+			verbatim(bw, side[:32], 25)
+		}),
+		frame(1, 10, 32, func(bw *bitWriter) {
+			lpc(bw, mid[32:], 24)
+			verbatim(bw, side[32:], 25)
+		}),
+	)
+	r, err := NewReader(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.StreamInfo().Format != format.S24 || r.StreamInfo().Channels != 2 {
+		t.Errorf("got %+v", r.StreamInfo())
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 64; i++ {
+		for c, ch := range samples {
+			b := got[(2*i+c)*3:]
+			v := int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8
+			if v != ch[i] {
+				t.Fatalf("frame %d channel %d: got %d, want %d", i, c, v, ch[i])
+			}
+		}
+	}
+}
+
+func TestDecodeScales(t *testing.T) {
+	samples := []int32{-2048, -1, 0, 2047}
+	file := stream(8000, 1, 12, [][]int32{samples},
+		frame(0, 0, 4, func(bw *bitWriter) { verbatim(bw, samples, 12) }),
+	)
+	r, err := NewReader(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []int16{-32768, -16, 0, 32752}
+	for i, w := range want {
+		if v := int16(binary.LittleEndian.Uint16(got[2*i:])); v != w {
+			t.Errorf("sample %d: got %d, want %d", i, v, w)
+		}
+	}
+}
+
+func TestWastedBits(t *testing.T) {
+	samples := []int32{400, 400, 400, 400}
+	file := stream(8000, 1, 16, [][]int32{samples},
+		frame(0, 0, 4, func(bw *bitWriter) {
+			// Constant 100 with 2 wasted bits, as unary 1.
+			bw.writeBits(0<<1|1, 8)
+			bw.writeBits(0b01, 2)
+			bw.writeSigned(100, 14)
+		}),
+	)
+	r, err := NewReader(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, []byte{0x90, 1, 0x90, 1, 0x90, 1, 0x90, 1}) {
+		t.Errorf("got %x", got)
+	}
+}
+
+func TestChecksums(t *testing.T) {
+	samples := wave(100, 100)
+	file := stream(16000, 1, 16, [][]int32{samples},
+		frame(0, 0, 100, func(bw *bitWriter) { verbatim(bw, samples, 16) }),
+	)
+
+	bad := append([]byte(nil), file...)
+	bad[len(bad)-10] ^= 1
+	r, err := NewReader(bytes.NewReader(bad))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(r); err != model.ErrChecksum {
+		t.Errorf("got %v for a corrupt frame", err)
+	}
+
+	bad = append([]byte(nil), file...)
+	bad[8+18] ^= 1
+	r, err = NewReader(bytes.NewReader(bad))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(r); err != model.ErrChecksum {
+		t.Errorf("got %v for a wrong MD5", err)
+	}
+
+	if _, err := NewReader(bytes.NewReader([]byte("RIFF"))); err != model.ErrInvalidHeader {
+		t.Errorf("got %v for a WAV file", err)
+	}
+}
+
+// signal is a tone with noise, a silent stretch and a stretch with wasted bits, scaled
+// to bps bits.
+func signal(n, channels, bps int, noise float64) [][]int32 {
+	rng := rand.New(rand.NewSource(1))
+	scale := float64(int64(1)<<uint(bps-1) - 1)
+	out := make([][]int32, channels)
+	for c := range out {
+		out[c] = make([]int32, n)
+		for i := range out[c] {
+			v := 0.6*math.Sin(2*math.Pi*float64(i)*440/16000+float64(c)) + noise*rng.NormFloat64()
+			s := int32(v * scale)
+			switch {
+			case i > n/3 && i < n/2:
+				s = 0
+			case i >= n/2 && i < 2*n/3:
+				s &^= 0xf
+			}
+			out[c][i] = s
+		}
+	}
+	return out
+}
+
+func encode(t *testing.T, w io.Writer, f format.PcmFormat, samples [][]int32, opts ...Option) {
+	info := pcm_convertor.StreamInfo{SampleRate: 16000, Format: f, ByteOrder: binary.LittleEndian, Channels: len(samples)}
+	fw, err := NewWriter(w, info, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := f.FrameSize()
+	var data []byte
+	for i := range samples[0] {
+		for _, ch := range samples {
+			s := ch[i]
+			if f == format.U8 {
+				s += 0x80
+			}
+			for b := 0; b < size; b++ {
+				data = append(data, byte(s>>(8*uint(b))))
+			}
+		}
+	}
+	// Write in pieces that split frames and samples.
+	for len(data) > 0 {
+		n := 1001
+		if n > len(data) {
+			n = len(data)
+		}
+		if _, err := fw.Write(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+		data = data[n:]
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// decode decodes file and returns its samples scaled back to bps bits.
+func decode(t *testing.T, file []byte, bps int) [][]int32 {
+	r, err := NewReader(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := r.StreamInfo()
+	size := info.Format.FrameSize()
+	n := len(got) / size / info.Channels
+	out := make([][]int32, info.Channels)
+	for c := range out {
+		out[c] = make([]int32, n)
+		for i := range out[c] {
+			b := got[(i*info.Channels+c)*size:]
+			var v uint32
+			for j := 0; j < size; j++ {
+				v |= uint32(b[j]) << (8 * uint(j+4-size))
+			}
+			out[c][i] = int32(v) >> uint(32-bps)
+		}
+	}
+	return out
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	f, err := ioutil.TempFile("", "flac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	for _, pf := range []format.PcmFormat{format.U8, format.S16, format.S24, format.S32} {
+		for _, channels := range []int{1, 2, 3} {
+			for _, opts := range [][]Option{
+				{WithCompressionLevel(0)},
+				nil,
+				{WithCompressionLevel(8), WithBlockSize(1000)},
+			} {
+				bps := pf.FrameSize() * 8
+				samples := signal(10000, channels, bps, 0.01)
+				if err := f.Truncate(0); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := f.Seek(0, io.SeekStart); err != nil {
+					t.Fatal(err)
+				}
+				encode(t, f, pf, samples, opts...)
+				file, err := ioutil.ReadFile(f.Name())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if total := binary.BigEndian.Uint64(file[18:]) & (1<<36 - 1); total != 10000 {
+					t.Errorf("%v x %d: STREAMINFO has %d frames", pf.String(), channels, total)
+				}
+				got := decode(t, file, bps)
+				for c := range samples {
+					for i := range samples[c] {
+						if got[c][i] != samples[c][i] {
+							t.Fatalf("%v x %d: channel %d sample %d: got %d, want %d", pf.String(), channels, c, i, got[c][i], samples[c][i])
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestEncodeStreaming(t *testing.T) {
+	samples := signal(5000, 2, 16, 0.01)
+	buf := new(bytes.Buffer)
+	encode(t, buf, format.S16, samples, WithBlockSize(192))
+	r, err := NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.TotalFrames() != 0 {
+		t.Errorf("got %d frames in a stream written without seeking", r.TotalFrames())
+	}
+	got := decode(t, buf.Bytes(), 16)
+	if len(got[0]) != 5000 || got[1][4999] != samples[1][4999] {
+		t.Errorf("got %d frames", len(got[0]))
+	}
+}
+
+func TestCompression(t *testing.T) {
+	samples := signal(16000, 1, 16, 0.0003)
+	for level := 0; level <= 8; level++ {
+		buf := new(bytes.Buffer)
+		encode(t, buf, format.S16, samples, WithCompressionLevel(level))
+		if raw := 2 * len(samples[0]); buf.Len() > raw/2 {
+			t.Errorf("level %d: %d bytes for %d bytes of samples", level, buf.Len(), raw)
+		}
+	}
+
+	info := pcm_convertor.StreamInfo{SampleRate: 16000, Format: format.F32, ByteOrder: binary.LittleEndian, Channels: 1}
+	if _, err := NewWriter(ioutil.Discard, info); err != model.ErrInvalidFormat {
+		t.Errorf("got %v for F32", err)
+	}
+	info.Format = format.S16
+	if _, err := NewWriter(ioutil.Discard, info, WithCompressionLevel(9)); err != model.ErrInvalidParameter {
+		t.Errorf("got %v for level 9", err)
+	}
+}
@@ -0,0 +1,563 @@
+// Package flac decodes and encodes FLAC streams in pure Go, describing their samples
+// with pcm_convertor.StreamInfo.
+package flac
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"hash"
+	"io"
+	"io/ioutil"
+
+	"github.com/ZhangJYd/pcm_convertor"
+	"github.com/ZhangJYd/pcm_convertor/format"
+	"github.com/ZhangJYd/pcm_convertor/model"
+)
+
+// streamInfo is the STREAMINFO metadata block.
+type streamInfo struct {
+	minBlock     int
+	maxBlock     int
+	sampleRate   int
+	channels     int
+	bps          int
+	totalSamples int64
+	md5          [16]byte
+}
+
+// Reader decodes a FLAC stream into little-endian S16, S24 or S32 samples, whichever
+// is the narrowest to hold the bits per sample of the stream. Samples of fewer bits are
+// scaled up to the full range of the format.
+type Reader struct {
+	br      *bitReader
+	si      streamInfo
+	info    pcm_convertor.StreamInfo
+	md5     hash.Hash
+	decoded int64
+	out     []byte
+	// samples are the decoded channels of the current frame.
+	samples [][]int32
+	err     error
+}
+
+// NewReader reads the metadata of the FLAC stream in r. An ID3v2 tag in front of the
+// stream is skipped.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := newBitReader(r)
+	var marker [4]byte
+	if _, err := io.ReadFull(br.r, marker[:]); err != nil {
+		return nil, model.ErrInvalidHeader
+	}
+	if string(marker[:3]) == "ID3" {
+		if err := skipID3(br.r, marker); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(br.r, marker[:]); err != nil {
+			return nil, model.ErrInvalidHeader
+		}
+	}
+	if string(marker[:]) != "fLaC" {
+		return nil, model.ErrInvalidHeader
+	}
+
+	fr := &Reader{br: br, md5: md5.New()}
+	haveInfo := false
+	for last := false; !last; {
+		var hdr [4]byte
+		if _, err := io.ReadFull(br.r, hdr[:]); err != nil {
+			return nil, model.ErrInvalidHeader
+		}
+		last = hdr[0]&0x80 != 0
+		size := int(hdr[1])<<16 | int(hdr[2])<<8 | int(hdr[3])
+		block := make([]byte, size)
+		if _, err := io.ReadFull(br.r, block); err != nil {
+			return nil, model.ErrInvalidHeader
+		}
+		if hdr[0]&0x7f == 0 {
+			if err := fr.si.parse(block); err != nil {
+				return nil, err
+			}
+			haveInfo = true
+		}
+	}
+	if !haveInfo {
+		return nil, model.ErrInvalidHeader
+	}
+	fr.info = pcm_convertor.StreamInfo{
+		SampleRate: fr.si.sampleRate,
+		Format:     outputFormat(fr.si.bps),
+		ByteOrder:  binary.LittleEndian,
+		Channels:   fr.si.channels,
+	}
+	return fr, nil
+}
+
+// skipID3 skips the rest of an ID3v2 tag whose first 4 bytes were read.
+func skipID3(r io.Reader, start [4]byte) error {
+	var hdr [6]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return model.ErrInvalidHeader
+	}
+	// Version, flags, then a 28-bit size in 7-bit bytes.
+	size := int64(hdr[2])<<21 | int64(hdr[3])<<14 | int64(hdr[4])<<7 | int64(hdr[5])
+	if hdr[1]&0x10 != 0 {
+		size += 10
+	}
+	if _, err := io.CopyN(ioutil.Discard, r, size); err != nil {
+		return model.ErrInvalidHeader
+	}
+	return nil
+}
+
+func (si *streamInfo) parse(b []byte) error {
+	if len(b) < 34 {
+		return model.ErrInvalidHeader
+	}
+	si.minBlock = int(binary.BigEndian.Uint16(b[0:]))
+	si.maxBlock = int(binary.BigEndian.Uint16(b[2:]))
+	v := binary.BigEndian.Uint64(b[10:])
+	si.sampleRate = int(v >> 44)
+	si.channels = int(v>>41&0x7) + 1
+	si.bps = int(v>>36&0x1f) + 1
+	si.totalSamples = int64(v & (1<<36 - 1))
+	copy(si.md5[:], b[18:34])
+	if si.sampleRate == 0 || si.bps < 4 {
+		return model.ErrInvalidHeader
+	}
+	return nil
+}
+
+func outputFormat(bps int) format.PcmFormat {
+	switch {
+	case bps <= 16:
+		return format.S16
+	case bps <= 24:
+		return format.S24
+	}
+	return format.S32
+}
+
+// StreamInfo describes the decoded samples.
+func (fr *Reader) StreamInfo() pcm_convertor.StreamInfo {
+	return fr.info
+}
+
+// BitsPerSample returns the bits per sample of the stream.
+func (fr *Reader) BitsPerSample() int {
+	return fr.si.bps
+}
+
+// TotalFrames returns the number of frames of the stream, 0 if it is unknown.
+func (fr *Reader) TotalFrames() int64 {
+	return fr.si.totalSamples
+}
+
+// Read reads decoded samples. At the end of the stream the MD5 signature of STREAMINFO
+// is checked; a mismatch, like a frame with a bad CRC, is reported as model.ErrChecksum.
+func (fr *Reader) Read(p []byte) (int, error) {
+	for len(fr.out) == 0 {
+		if fr.err != nil {
+			return 0, fr.err
+		}
+		fr.err = fr.decodeFrame()
+		if fr.err == io.EOF {
+			fr.err = fr.finish()
+		}
+	}
+	n := copy(p, fr.out)
+	fr.out = fr.out[n:]
+	return n, nil
+}
+
+func (fr *Reader) finish() error {
+	if fr.si.totalSamples != 0 && fr.decoded != fr.si.totalSamples {
+		return io.ErrUnexpectedEOF
+	}
+	if fr.si.md5 != [16]byte{} && !bytes.Equal(fr.md5.Sum(nil), fr.si.md5[:]) {
+		return model.ErrChecksum
+	}
+	return io.EOF
+}
+
+var sampleRates = [...]int{0, 88200, 176400, 192000, 8000, 16000, 22050, 24000, 32000, 44100, 48000, 96000}
+
+var sampleSizes = [...]int{0, 8, 12, 0, 16, 20, 24, 32}
+
+// decodeFrame decodes the next frame into fr.out.
+func (fr *Reader) decodeFrame() error {
+	br := fr.br
+	if fr.si.totalSamples != 0 && fr.decoded >= fr.si.totalSamples {
+		return io.EOF
+	}
+	br.resetCRC()
+	first, err := br.readByte()
+	if err != nil {
+		return err
+	}
+	second, err := br.readByte()
+	if err != nil || first != 0xff || second&0xfe != 0xf8 {
+		return model.ErrInvalidHeader
+	}
+	v, err := br.readBits(16)
+	if err != nil {
+		return err
+	}
+	blockCode, rateCode := int(v>>12), int(v>>8&0xf)
+	assignment, sizeCode := int(v>>4&0xf), int(v>>1&0x7)
+	if _, err := fr.readCodedNumber(); err != nil {
+		return err
+	}
+
+	blockSize := 0
+	switch {
+	case blockCode == 1:
+		blockSize = 192
+	case blockCode >= 2 && blockCode <= 5:
+		blockSize = 576 << (blockCode - 2)
+	case blockCode == 6:
+		n, err := br.readBits(8)
+		if err != nil {
+			return err
+		}
+		blockSize = int(n) + 1
+	case blockCode == 7:
+		n, err := br.readBits(16)
+		if err != nil {
+			return err
+		}
+		blockSize = int(n) + 1
+	case blockCode >= 8:
+		blockSize = 256 << (blockCode - 8)
+	default:
+		return model.ErrInvalidHeader
+	}
+	switch rateCode {
+	case 12:
+		_, err = br.readBits(8)
+	case 13, 14:
+		_, err = br.readBits(16)
+	case 15:
+		err = model.ErrInvalidHeader
+	}
+	if err != nil {
+		return err
+	}
+	bps := fr.si.bps
+	if sizeCode != 0 {
+		if bps = sampleSizes[sizeCode]; bps == 0 {
+			return model.ErrInvalidHeader
+		}
+	}
+	channels := assignment + 1
+	if assignment >= 8 {
+		channels = 2
+	}
+	if assignment > 10 || channels != fr.si.channels {
+		return model.ErrInvalidHeader
+	}
+	crc := br.crc8
+	if want, err := br.readBits(8); err != nil {
+		return err
+	} else if uint8(want) != crc {
+		return model.ErrChecksum
+	}
+
+	if len(fr.samples) != channels {
+		fr.samples = make([][]int32, channels)
+	}
+	for c := range fr.samples {
+		if cap(fr.samples[c]) < blockSize {
+			fr.samples[c] = make([]int32, blockSize)
+		}
+		fr.samples[c] = fr.samples[c][:blockSize]
+		// The side channel needs one more bit.
+		sbps := bps
+		if (assignment == 8 || assignment == 10) && c == 1 || assignment == 9 && c == 0 {
+			sbps++
+		}
+		if err := fr.decodeSubframe(fr.samples[c], sbps); err != nil {
+			return err
+		}
+	}
+	br.align()
+	crc16 := br.crc16
+	if want, err := br.readBits(16); err != nil {
+		return err
+	} else if uint16(want) != crc16 {
+		return model.ErrChecksum
+	}
+
+	decorrelate(fr.samples, assignment)
+	fr.emit(bps, blockSize)
+	return nil
+}
+
+// readCodedNumber reads the UTF-8 style frame or sample number of a frame header.
+func (fr *Reader) readCodedNumber() (uint64, error) {
+	b, err := fr.br.readBits(8)
+	if err != nil {
+		return 0, err
+	}
+	extra := 0
+	for mask := uint64(0x80); b&mask != 0 && mask > 1; mask >>= 1 {
+		extra++
+	}
+	if extra == 1 || extra > 7 {
+		return 0, model.ErrInvalidHeader
+	}
+	if extra == 0 {
+		return b, nil
+	}
+	v := b & (0xff >> (extra + 1))
+	for i := 1; i < extra; i++ {
+		c, err := fr.br.readBits(8)
+		if err != nil {
+			return 0, err
+		}
+		if c&0xc0 != 0x80 {
+			return 0, model.ErrInvalidHeader
+		}
+		v = v<<6 | c&0x3f
+	}
+	return v, nil
+}
+
+func (fr *Reader) decodeSubframe(out []int32, bps int) error {
+	br := fr.br
+	v, err := br.readBits(8)
+	if err != nil {
+		return err
+	}
+	if v&0x80 != 0 {
+		return model.ErrInvalidHeader
+	}
+	kind := int(v >> 1 & 0x3f)
+	wasted := 0
+	if v&1 != 0 {
+		n, err := br.readUnary()
+		if err != nil {
+			return err
+		}
+		wasted = int(n) + 1
+		bps -= wasted
+	}
+
+	switch {
+	case kind == 0:
+		s, err := br.readSigned(uint(bps))
+		if err != nil {
+			return err
+		}
+		for i := range out {
+			out[i] = int32(s)
+		}
+	case kind == 1:
+		for i := range out {
+			s, err := br.readSigned(uint(bps))
+			if err != nil {
+				return err
+			}
+			out[i] = int32(s)
+		}
+	case kind >= 8 && kind <= 12:
+		order := kind - 8
+		if err := fr.decodePredicted(out, bps, order, fixedCoefficients[order], 0); err != nil {
+			return err
+		}
+	case kind >= 32:
+		order := kind - 31
+		if err := fr.decodeLPC(out, bps, order); err != nil {
+			return err
+		}
+	default:
+		return model.ErrInvalidHeader
+	}
+	if wasted > 0 {
+		for i := range out {
+			out[i] <<= uint(wasted)
+		}
+	}
+	return nil
+}
+
+// fixedCoefficients are the predictors of the fixed subframes as LPC coefficients.
+var fixedCoefficients = [][]int32{
+	{},
+	{1},
+	{2, -1},
+	{3, -3, 1},
+	{4, -6, 4, -1},
+}
+
+func (fr *Reader) decodeLPC(out []int32, bps, order int) error {
+	br := fr.br
+	warmup := make([]int32, order)
+	for i := range warmup {
+		s, err := br.readSigned(uint(bps))
+		if err != nil {
+			return err
+		}
+		warmup[i] = int32(s)
+	}
+	p, err := br.readBits(4)
+	if err != nil {
+		return err
+	}
+	if p == 15 {
+		return model.ErrInvalidHeader
+	}
+	precision := uint(p) + 1
+	shift, err := br.readSigned(5)
+	if err != nil {
+		return err
+	}
+	if shift < 0 {
+		return model.ErrInvalidHeader
+	}
+	coefs := make([]int32, order)
+	for i := range coefs {
+		c, err := br.readSigned(precision)
+		if err != nil {
+			return err
+		}
+		coefs[i] = int32(c)
+	}
+	copy(out, warmup)
+	return fr.predict(out, order, coefs, uint(shift))
+}
+
+func (fr *Reader) decodePredicted(out []int32, bps, order int, coefs []int32, shift uint) error {
+	for i := 0; i < order; i++ {
+		s, err := fr.br.readSigned(uint(bps))
+		if err != nil {
+			return err
+		}
+		out[i] = int32(s)
+	}
+	return fr.predict(out, order, coefs, shift)
+}
+
+// predict reads the residual of out after its order warm-up samples and adds the
+// prediction to it.
+func (fr *Reader) predict(out []int32, order int, coefs []int32, shift uint) error {
+	if order > len(out) {
+		return model.ErrInvalidHeader
+	}
+	if err := fr.decodeResidual(out, order); err != nil {
+		return err
+	}
+	for i := order; i < len(out); i++ {
+		var sum int64
+		for j, c := range coefs {
+			sum += int64(c) * int64(out[i-1-j])
+		}
+		out[i] += int32(sum >> shift)
+	}
+	return nil
+}
+
+// decodeResidual reads the Rice coded residual into out[order:].
+func (fr *Reader) decodeResidual(out []int32, order int) error {
+	br := fr.br
+	v, err := br.readBits(6)
+	if err != nil {
+		return err
+	}
+	method, partitionOrder := v>>4, uint(v&0xf)
+	if method > 1 {
+		return model.ErrInvalidHeader
+	}
+	paramBits, escape := uint(4), uint64(15)
+	if method == 1 {
+		paramBits, escape = 5, 31
+	}
+	partitions := 1 << partitionOrder
+	if len(out)%partitions != 0 || len(out)>>partitionOrder < order {
+		return model.ErrInvalidHeader
+	}
+	i := order
+	for p := 0; p < partitions; p++ {
+		end := (p + 1) * (len(out) >> partitionOrder)
+		param, err := br.readBits(paramBits)
+		if err != nil {
+			return err
+		}
+		if param == escape {
+			n, err := br.readBits(5)
+			if err != nil {
+				return err
+			}
+			for ; i < end; i++ {
+				s, err := br.readSigned(uint(n))
+				if err != nil {
+					return err
+				}
+				out[i] = int32(s)
+			}
+			continue
+		}
+		for ; i < end; i++ {
+			q, err := br.readUnary()
+			if err != nil {
+				return err
+			}
+			r, err := br.readBits(uint(param))
+			if err != nil {
+				return err
+			}
+			u := q<<param | r
+			out[i] = int32(u>>1) ^ -int32(u&1)
+		}
+	}
+	return nil
+}
+
+// decorrelate undoes the stereo decorrelation of the channel assignment.
+func decorrelate(ch [][]int32, assignment int) {
+	switch assignment {
+	case 8:
+		// left, side
+		for i := range ch[0] {
+			ch[1][i] = ch[0][i] - ch[1][i]
+		}
+	case 9:
+		// side, right
+		for i := range ch[0] {
+			ch[0][i] += ch[1][i]
+		}
+	case 10:
+		// mid, side
+		for i := range ch[0] {
+			mid := ch[0][i]<<1 | ch[1][i]&1
+			side := ch[1][i]
+			ch[0][i] = (mid + side) >> 1
+			ch[1][i] = (mid - side) >> 1
+		}
+	}
+}
+
+// emit interleaves the samples of the frame into fr.out and adds them to the MD5 sum,
+// which is computed over samples of the stream bit depth.
+func (fr *Reader) emit(bps, blockSize int) {
+	size := fr.info.Format.FrameSize()
+	shift := uint(size*8 - bps)
+	md5Size := (bps + 7) / 8
+	out := make([]byte, 0, blockSize*len(fr.samples)*size)
+	sum := make([]byte, 0, blockSize*len(fr.samples)*md5Size)
+	for i := 0; i < blockSize; i++ {
+		for _, ch := range fr.samples {
+			s := ch[i]
+			for b := 0; b < md5Size; b++ {
+				sum = append(sum, byte(s>>(8*uint(b))))
+			}
+			s <<= shift
+			for b := 0; b < size; b++ {
+				out = append(out, byte(s>>(8*uint(b))))
+			}
+		}
+	}
+	fr.md5.Write(sum)
+	fr.out = out
+	fr.decoded += int64(blockSize)
+}
@@ -0,0 +1,237 @@
+package flac
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"hash"
+	"io"
+
+	"github.com/ZhangJYd/pcm_convertor"
+	"github.com/ZhangJYd/pcm_convertor/format"
+	"github.com/ZhangJYd/pcm_convertor/model"
+)
+
+// Option configures a Writer.
+type Option func(*options)
+
+type options struct {
+	level     int
+	blockSize int
+}
+
+// WithCompressionLevel sets the compression level from 0, the fastest, to 8, the
+// smallest, as with the reference encoder. The default is 5.
+func WithCompressionLevel(level int) Option {
+	return func(o *options) {
+		o.level = level
+	}
+}
+
+// WithBlockSize sets the number of frames per FLAC frame, from 16 to 65535. The default
+// depends on the compression level: 1152 up to level 2 and 4096 above.
+func WithBlockSize(n int) Option {
+	return func(o *options) {
+		o.blockSize = n
+	}
+}
+
+// Writer encodes U8, S16, S24 or S32 samples described by a StreamInfo as a FLAC stream.
+// Put it after a Convertor to store its output losslessly.
+//
+// When the destination is seekable, Close fills in the length, frame sizes and MD5
+// signature of STREAMINFO. Otherwise they are left unknown, which decoders accept.
+type Writer struct {
+	w    io.Writer
+	ws   io.WriteSeeker
+	info pcm_convertor.StreamInfo
+	enc  *encoder
+	// start is the offset of STREAMINFO in ws.
+	start     int64
+	blockSize int
+	md5       hash.Hash
+	// pending holds the input of an incomplete block.
+	pending  []byte
+	channels [][]int32
+	number   uint64
+	samples  int64
+	minFrame int
+	maxFrame int
+	closed   bool
+}
+
+// NewWriter writes the STREAMINFO header for info to w.
+func NewWriter(w io.Writer, info pcm_convertor.StreamInfo, opts ...Option) (*Writer, error) {
+	o := options{level: 5}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.level < 0 || o.level >= len(levels) {
+		return nil, model.ErrInvalidParameter
+	}
+	l := levels[o.level]
+	if o.blockSize != 0 {
+		l.blockSize = o.blockSize
+	}
+	if l.blockSize < 16 || l.blockSize > 0xffff {
+		return nil, model.ErrInvalidParameter
+	}
+	if info.SampleRate <= 0 || info.SampleRate >= 1<<20 {
+		return nil, model.ErrInvalidSampleRate
+	}
+	if info.Channels <= 0 || info.Channels > 8 {
+		return nil, model.ErrInvalidChannels
+	}
+	switch info.Format {
+	case format.U8, format.S16, format.S24, format.S32:
+	default:
+		return nil, model.ErrInvalidFormat
+	}
+
+	fw := &Writer{
+		w:         w,
+		info:      info,
+		enc:       &encoder{level: l, bps: info.Format.FrameSize() * 8, sampleRate: info.SampleRate},
+		blockSize: l.blockSize,
+		md5:       md5.New(),
+		channels:  make([][]int32, info.Channels),
+	}
+	if ws, ok := w.(io.WriteSeeker); ok {
+		if start, err := ws.Seek(0, io.SeekCurrent); err == nil {
+			fw.ws = ws
+			fw.start = start + 8
+		}
+	}
+	hdr := append([]byte("fLaC"), 0x80, 0, 0, 34)
+	if _, err := w.Write(append(hdr, fw.streamInfo()...)); err != nil {
+		return nil, err
+	}
+	return fw, nil
+}
+
+// streamInfo is the STREAMINFO block for what was written so far.
+func (fw *Writer) streamInfo() []byte {
+	b := make([]byte, 34)
+	binary.BigEndian.PutUint16(b[0:], uint16(fw.blockSize))
+	binary.BigEndian.PutUint16(b[2:], uint16(fw.blockSize))
+	putUint24(b[4:], fw.minFrame)
+	putUint24(b[7:], fw.maxFrame)
+	v := uint64(fw.info.SampleRate)<<44 | uint64(fw.info.Channels-1)<<41 | uint64(fw.enc.bps-1)<<36
+	if fw.samples < 1<<36 {
+		v |= uint64(fw.samples)
+	}
+	binary.BigEndian.PutUint64(b[10:], v)
+	if fw.samples > 0 {
+		copy(b[18:], fw.md5.Sum(nil))
+	}
+	return b
+}
+
+func putUint24(b []byte, v int) {
+	b[0], b[1], b[2] = byte(v>>16), byte(v>>8), byte(v)
+}
+
+// Write encodes samples in the format given to NewWriter. Samples are buffered until
+// they fill a block.
+func (fw *Writer) Write(p []byte) (int, error) {
+	if fw.closed {
+		return 0, model.ErrClosed
+	}
+	fw.pending = append(fw.pending, p...)
+	block := fw.blockSize * fw.info.Format.FrameSize() * fw.info.Channels
+	done := 0
+	for len(fw.pending)-done >= block {
+		if err := fw.writeBlock(fw.pending[done : done+block]); err != nil {
+			return 0, err
+		}
+		done += block
+	}
+	fw.pending = append(fw.pending[:0], fw.pending[done:]...)
+	return len(p), nil
+}
+
+// writeBlock encodes the whole frames in data as a FLAC frame.
+func (fw *Writer) writeBlock(data []byte) error {
+	size := fw.info.Format.FrameSize()
+	n := len(data) / size / fw.info.Channels
+	if n == 0 {
+		return nil
+	}
+	sum := make([]byte, 0, n*fw.info.Channels*size)
+	for c := range fw.channels {
+		if cap(fw.channels[c]) < n {
+			fw.channels[c] = make([]int32, n)
+		}
+		fw.channels[c] = fw.channels[c][:n]
+	}
+	for i := 0; i < n; i++ {
+		for c, ch := range fw.channels {
+			s := fw.sample(data[(i*fw.info.Channels+c)*size:])
+			ch[i] = s
+			for b := 0; b < size; b++ {
+				sum = append(sum, byte(s>>(8*uint(b))))
+			}
+		}
+	}
+	fw.md5.Write(sum)
+
+	bw := &bitWriter{}
+	fw.enc.encodeFrame(bw, fw.channels, fw.number)
+	if _, err := fw.w.Write(bw.buf); err != nil {
+		return err
+	}
+	fw.number++
+	fw.samples += int64(n)
+	if fw.minFrame == 0 || len(bw.buf) < fw.minFrame {
+		fw.minFrame = len(bw.buf)
+	}
+	if len(bw.buf) > fw.maxFrame {
+		fw.maxFrame = len(bw.buf)
+	}
+	return nil
+}
+
+// sample reads the sample at the start of b as a signed number.
+func (fw *Writer) sample(b []byte) int32 {
+	order := fw.info.ByteOrder
+	switch fw.info.Format {
+	case format.U8:
+		return int32(b[0]) - 0x80
+	case format.S16:
+		return int32(int16(order.Uint16(b)))
+	case format.S24:
+		if order == binary.BigEndian {
+			return int32(uint32(b[0])<<24|uint32(b[1])<<16|uint32(b[2])<<8) >> 8
+		}
+		return int32(uint32(b[2])<<24|uint32(b[1])<<16|uint32(b[0])<<8) >> 8
+	}
+	return int32(order.Uint32(b))
+}
+
+// Close encodes the samples buffered as a last, shorter frame and fills in STREAMINFO if
+// the destination is seekable. A trailing partial frame is dropped. It does not close
+// the destination.
+func (fw *Writer) Close() error {
+	if fw.closed {
+		return model.ErrClosed
+	}
+	fw.closed = true
+	if err := fw.writeBlock(fw.pending); err != nil {
+		return err
+	}
+	fw.pending = nil
+	if fw.ws == nil {
+		return nil
+	}
+	end, err := fw.ws.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := fw.ws.Seek(fw.start, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := fw.ws.Write(fw.streamInfo()); err != nil {
+		return err
+	}
+	_, err = fw.ws.Seek(end, io.SeekStart)
+	return err
+}
@@ -0,0 +1,36 @@
+package format
+
+// Codec describes a format coded in blocks to the Convertor. It codes mono S16 samples.
+type Codec struct {
+	SampleRate int
+	// BlockSamples samples are coded into a block of BlockSize bytes.
+	BlockSamples int
+	BlockSize    int
+	// NewEncoder and NewDecoder return a coder at the start of a stream.
+	NewEncoder func() BlockEncoder
+	NewDecoder func() BlockDecoder
+}
+
+// BlockEncoder encodes a block of samples from src into dst.
+type BlockEncoder interface {
+	Encode(dst []byte, src []int16)
+}
+
+// BlockDecoder decodes a block from src into the samples of dst.
+type BlockDecoder interface {
+	Decode(dst []int16, src []byte) error
+}
+
+var codecs = map[PcmFormat]Codec{}
+
+// RegisterCodec makes f usable as a format. It is meant to be called from the init
+// function of a codec package.
+func RegisterCodec(f PcmFormat, c Codec) {
+	codecs[f] = c
+}
+
+// CodecOf returns the codec registered for f, if f is coded in blocks.
+func CodecOf(f PcmFormat) (Codec, bool) {
+	c, ok := codecs[f]
+	return c, ok
+}
@@ -15,15 +15,17 @@ type Convertor struct {
 	outF         PcmFormat
 	inByteOrder  binary.ByteOrder
 	outByteOrder binary.ByteOrder
+	// cache holds a partial frame left over from the previous Convert call.
+	cache []byte
 }
 
 func (c *Convertor) Convert(data []byte) ([]byte, error) {
-	if len(data) < c.inF.FrameSize() {
-		return nil, model.ErrPcmLenError
-	}
-	if fragment := len(data) % c.inF.FrameSize(); fragment != 0 {
-		data = data[:len(data)-fragment]
+	if len(c.cache) > 0 {
+		data = append(c.cache, data...)
 	}
+	fragment := len(data) % c.inF.FrameSize()
+	c.cache = append([]byte(nil), data[len(data)-fragment:]...)
+	data = data[:len(data)-fragment]
 	buf := new(bytes.Buffer)
 	for i := 0; ; {
 		if i+c.inF.FrameSize() > len(data) {
@@ -48,10 +50,21 @@ func (c *Convertor) Convert(data []byte) ([]byte, error) {
 	}
 }
 
+// Reset drops the partial frame kept from previous Convert calls.
+func (c *Convertor) Reset() {
+	c.cache = nil
+}
+
 func NewFormatConvertor(inF, outF PcmFormat, inByteOrder, outByteOrder binary.ByteOrder) (*Convertor, error) {
 	if inF.FrameSize() <= 0 || outF.FrameSize() <= 0 {
 		return nil, model.ErrInvalidFormat
 	}
+	if _, ok := CodecOf(inF); ok {
+		return nil, model.ErrInvalidFormat
+	}
+	if _, ok := CodecOf(outF); ok {
+		return nil, model.ErrInvalidFormat
+	}
 	return &Convertor{
 		inF:          inF,
 		outF:         outF,
@@ -115,6 +128,12 @@ func BytesToFloat64(data []byte, byteOrder binary.ByteOrder) (float64, error) {
 	return 0, model.ErrInvalidByteOrder
 }
 
+func Int16ToBytes(data int16, byteOrder binary.ByteOrder) []byte {
+	b := make([]byte, 2)
+	byteOrder.PutUint16(b, uint16(data))
+	return b
+}
+
 func Float32ToBytes(data float32, byteOrder binary.ByteOrder) []byte {
 	buf := new(bytes.Buffer)
 	err := binary.Write(buf, byteOrder, data)
@@ -148,6 +167,23 @@ func ConvertFormatForFrame(inData []byte, outW io.Writer, inF, outF PcmFormat, o
 		return err
 	}
 
+	// G.711 samples go through S16.
+	if inF == ULaw || inF == ALaw {
+		return ConvertFormatForFrame(Int16ToBytes(G711ToInt16(inData[0], inF), order), outW, S16, outF, order)
+	}
+	if outF == ULaw || outF == ALaw {
+		buf := new(bytes.Buffer)
+		if err := ConvertFormatForFrame(inData, buf, inF, S16, order); err != nil {
+			return err
+		}
+		n, err := BytesToInt16(buf.Bytes(), order)
+		if err != nil {
+			return err
+		}
+		_, err = outW.Write([]byte{Int16ToG711(n, outF)})
+		return err
+	}
+
 	if inF == F64 {
 		f64, err := BytesToFloat64(inData, order)
 		if err != nil {
@@ -167,9 +203,7 @@ func ConvertFormatForFrame(inData []byte, outW io.Writer, inF, outF PcmFormat, o
 			return err
 		}
 		_, err = outW.Write(Float64ToBytes(float64(f32), order))
-		if err != nil {
-			return err
-		}
+		return err
 	}
 
 	if inF != F32 && outF != F32 {
@@ -232,32 +266,60 @@ func BigEndianLittleEndianConvert(data []byte, inF PcmFormat, inByteOrder, outBy
 	if len(data) < inF.FrameSize() {
 		return nil, model.ErrFrameSizeError
 	}
-	var err error
-	buf := new(bytes.Buffer)
-	for i := 0; i < len(data); {
-		var m interface{}
-		switch inF {
-		case U8:
-			return data, nil
-		case S16:
-			m, err = BytesToInt16(data[i:i+inF.FrameSize()], inByteOrder)
-		case S32:
-			m, err = BytesToInt32(data[i:i+inF.FrameSize()], inByteOrder)
-		case F32:
-			m, err = BytesToFloat32(data[i:i+inF.FrameSize()], inByteOrder)
-		case F64:
-			m, err = BytesToFloat64(data[i:i+inF.FrameSize()], inByteOrder)
-		default:
-			return nil, model.ErrInvalidFormat
-		}
-		if err != nil {
-			return nil, err
-		}
-		err = binary.Write(buf, outByteOrder, m)
-		if err != nil {
-			return nil, err
+	switch inF {
+	case U8, ULaw, ALaw:
+		return data, nil
+	case S16, S24, S32, F32, F64:
+		return SwapBytes(data, inF.FrameSize()), nil
+	}
+	return nil, model.ErrInvalidFormat
+}
+
+// SwapBytes reverses the bytes of every sample of size bytes in data.
+func SwapBytes(data []byte, size int) []byte {
+	out := make([]byte, len(data))
+	for i := 0; i+size <= len(data); i += size {
+		for j := 0; j < size; j++ {
+			out[i+j] = data[i+size-1-j]
 		}
-		i += inF.FrameSize()
 	}
-	return buf.Bytes(), nil
+	return out
+}
+
+// Swapper reverses the byte order of samples that come in pieces of any length, holding
+// a partial sample back until the rest of it arrives.
+type Swapper struct {
+	size     int
+	fragment []byte
+}
+
+// NewSwapper returns a Swapper for samples of format f, or nil if they are single bytes,
+// which have no byte order.
+func NewSwapper(f PcmFormat) *Swapper {
+	if f.FrameSize() <= 1 {
+		return nil
+	}
+	return &Swapper{size: f.FrameSize()}
+}
+
+// Swap returns the whole samples of the held back fragment followed by data, swapped.
+func (s *Swapper) Swap(data []byte) []byte {
+	data = append(s.fragment, data...)
+	whole := len(data) - len(data)%s.size
+	s.fragment = append([]byte(nil), data[whole:]...)
+	return SwapBytes(data[:whole], s.size)
+}
+
+// Held returns the number of bytes of a partial sample held back.
+func (s *Swapper) Held() int {
+	return len(s.fragment)
+}
+
+// FlipSign turns U8 samples into signed 8-bit ones, as AIFF and AU store them, and back.
+func FlipSign(data []byte) []byte {
+	out := make([]byte, len(data))
+	for i, b := range data {
+		out[i] = b ^ 0x80
+	}
+	return out
 }
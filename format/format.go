@@ -9,6 +9,26 @@ const (
 	S32
 	F32
 	F64
+	// ULaw and ALaw are G.711 companded 8-bit samples.
+	ULaw
+	ALaw
+	// G722, the G726 formats and the GSM formats are coded in blocks by the codec
+	// packages, which register them with RegisterCodec. A stream in one of them is mono,
+	// at the rate of the codec, and a frame of it is a block.
+	G722
+	// G726R16 to G726R40 are G.726 at 16 to 40 kbit/s with the codes packed as ITU-T
+	// X.420 does, the AAL2 ones with them packed as ITU-T I.366.2 does.
+	G726R16
+	G726R24
+	G726R32
+	G726R40
+	G726R16AAL2
+	G726R24AAL2
+	G726R32AAL2
+	G726R40AAL2
+	// GSM is GSM 06.10 in 33-byte frames, GSMWAV49 in 65-byte pairs of frames.
+	GSM
+	GSMWAV49
 )
 
 func (f *PcmFormat) FrameSize() int {
@@ -25,10 +45,28 @@ func (f *PcmFormat) FrameSize() int {
 		return 4
 	case F64:
 		return 8
+	case ULaw, ALaw:
+		return 1
+	}
+	if c, ok := CodecOf(*f); ok {
+		return c.BlockSize
 	}
 	return -1
 }
 
+// Silence returns the byte that, repeated, makes up silent samples of f.
+func (f *PcmFormat) Silence() byte {
+	switch *f {
+	case U8:
+		return 0x80
+	case ULaw:
+		return 0xff
+	case ALaw:
+		return 0xd5
+	}
+	return 0
+}
+
 func (f *PcmFormat) String() string {
 	switch *f {
 	case U8:
@@ -43,6 +81,32 @@ func (f *PcmFormat) String() string {
 		return "32-bit-float"
 	case F64:
 		return "64-bit-float"
+	case ULaw:
+		return "mu-law"
+	case ALaw:
+		return "a-law"
+	case G722:
+		return "g722"
+	case G726R16:
+		return "g726-16"
+	case G726R24:
+		return "g726-24"
+	case G726R32:
+		return "g726-32"
+	case G726R40:
+		return "g726-40"
+	case G726R16AAL2:
+		return "g726-16-aal2"
+	case G726R24AAL2:
+		return "g726-24-aal2"
+	case G726R32AAL2:
+		return "g726-32-aal2"
+	case G726R40AAL2:
+		return "g726-40-aal2"
+	case GSM:
+		return "gsm"
+	case GSMWAV49:
+		return "gsm-wav49"
 	}
 	return "unknown format"
 }
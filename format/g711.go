@@ -0,0 +1,94 @@
+package format
+
+// G711ToInt16 expands a G.711 sample of format f, ULaw or ALaw, to 16 bits.
+func G711ToInt16(b byte, f PcmFormat) int16 {
+	if f == ALaw {
+		return aLawToInt16(b)
+	}
+	return uLawToInt16(b)
+}
+
+// Int16ToG711 compands a 16-bit sample to G.711 format f, ULaw or ALaw.
+func Int16ToG711(n int16, f PcmFormat) byte {
+	if f == ALaw {
+		return int16ToALaw(n)
+	}
+	return int16ToULaw(n)
+}
+
+const (
+	uLawBias = 0x84
+	uLawClip = 32635
+)
+
+func uLawToInt16(b byte) int16 {
+	b = ^b
+	t := (int(b&0x0f) << 3) + uLawBias
+	t <<= (b & 0x70) >> 4
+	if b&0x80 != 0 {
+		return int16(uLawBias - t)
+	}
+	return int16(t - uLawBias)
+}
+
+func int16ToULaw(n int16) byte {
+	v := int(n)
+	sign := byte(0)
+	if v < 0 {
+		v = -v
+		sign = 0x80
+	}
+	if v > uLawClip {
+		v = uLawClip
+	}
+	v += uLawBias
+	exponent := byte(7)
+	for mask := 0x4000; v&mask == 0 && exponent > 0; mask >>= 1 {
+		exponent--
+	}
+	mantissa := byte(v>>(exponent+3)) & 0x0f
+	return ^(sign | exponent<<4 | mantissa)
+}
+
+func aLawToInt16(b byte) int16 {
+	b ^= 0x55
+	t := int(b&0x0f) << 4
+	exponent := (b & 0x70) >> 4
+	switch exponent {
+	case 0:
+		t += 8
+	case 1:
+		t += 0x108
+	default:
+		t += 0x108
+		t <<= exponent - 1
+	}
+	if b&0x80 != 0 {
+		return int16(t)
+	}
+	return int16(-t)
+}
+
+func int16ToALaw(n int16) byte {
+	v := int(n) >> 3
+	sign := byte(0x80)
+	if v < 0 {
+		v = -v - 1
+		sign = 0
+	}
+	var b byte
+	if v < 32 {
+		b = byte(v >> 1)
+	} else {
+		exponent := byte(1)
+		for m := v >> 5; m > 1 && exponent < 7; m >>= 1 {
+			exponent++
+		}
+		if v>>(exponent+4) > 1 {
+			b = 0x7f
+		} else {
+			b = exponent<<4 | byte(v>>exponent)&0x0f
+		}
+	}
+	return (sign | b) ^ 0x55
+}
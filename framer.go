@@ -0,0 +1,92 @@
+package pcm_convertor
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/ZhangJYd/pcm_convertor/model"
+)
+
+// Packet is a fixed-duration piece of audio produced by a Framer.
+type Packet struct {
+	// Offset is the index of the first frame of the packet in the stream.
+	Offset int64
+	Data   []byte
+}
+
+// Framer cuts a stream, typically the output of Convertor.Process, into packets of a
+// fixed duration such as the 10, 20 or 30 ms used by VoIP and streaming ASR.
+type Framer struct {
+	frameSize  int
+	packetSize int
+	padLast    bool
+	silence    byte
+	buf        []byte
+	offset     int64
+}
+
+// NewFramer creates a Framer for audio described by info. duration has to be a whole
+// number of frames at info.SampleRate. With padLast set, Flush fills the last packet up
+// with silence instead of returning it short.
+func NewFramer(info *StreamInfo, duration time.Duration, padLast bool) (*Framer, error) {
+	if info == nil || info.Format.FrameSize() < 0 || isCodec(info.Format) || info.Channels <= 0 {
+		return nil, model.ErrInvalidParameter
+	}
+	if info.SampleRate <= 0 {
+		return nil, model.ErrInvalidSampleRate
+	}
+	frames := int64(info.SampleRate) * int64(duration) / int64(time.Second)
+	if frames <= 0 || frames*int64(time.Second) != int64(info.SampleRate)*int64(duration) {
+		return nil, model.ErrInvalidParameter
+	}
+	frameSize := info.Format.FrameSize() * info.Channels
+	return &Framer{
+		frameSize:  frameSize,
+		packetSize: int(frames) * frameSize,
+		padLast:    padLast,
+		silence:    info.Format.Silence(),
+	}, nil
+}
+
+// PacketSize returns the size of a packet in bytes.
+func (f *Framer) PacketSize() int {
+	return f.packetSize
+}
+
+// Frame returns the packets completed by data. The rest is kept for the next call.
+func (f *Framer) Frame(data []byte) []Packet {
+	f.buf = append(f.buf, data...)
+	var packets []Packet
+	for len(f.buf) >= f.packetSize {
+		packets = append(packets, f.packet(f.buf[:f.packetSize]))
+		f.buf = f.buf[f.packetSize:]
+	}
+	// Move the leftover to the front so buf does not grow without bound.
+	f.buf = append([]byte(nil), f.buf...)
+	return packets
+}
+
+// Flush returns the last, partial packet at the end of a stream, if there is one,
+// and starts the timestamps over for a new stream.
+func (f *Framer) Flush() []Packet {
+	var packets []Packet
+	if len(f.buf) > 0 {
+		data := f.buf
+		if f.padLast {
+			data = append(data, bytes.Repeat([]byte{f.silence}, f.packetSize-len(data))...)
+		}
+		packets = append(packets, f.packet(data))
+	}
+	f.buf = nil
+	f.offset = 0
+	return packets
+}
+
+func (f *Framer) packet(data []byte) Packet {
+	p := Packet{
+		Offset: f.offset,
+		Data:   append([]byte(nil), data...),
+	}
+	f.offset += int64(len(data) / f.frameSize)
+	return p
+}
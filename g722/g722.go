@@ -0,0 +1,445 @@
+// Package g722 encodes and decodes ITU-T G.722 wideband audio, 16 kHz samples coded as
+// 64 kbit/s sub-band ADPCM. The arithmetic follows the fixed-point blocks of the
+// recommendation; it has not been checked against the ITU-T test sequences.
+//
+// Importing the package makes format.G722 usable in a Convertor.
+package g722
+
+import (
+	"encoding/binary"
+
+	"github.com/ZhangJYd/pcm_convertor"
+	"github.com/ZhangJYd/pcm_convertor/format"
+)
+
+// Info describes the samples G.722 carries: 16 kHz mono S16. Reader produces them in
+// little-endian order.
+var Info = pcm_convertor.StreamInfo{
+	SampleRate: 16000,
+	Format:     format.S16,
+	ByteOrder:  binary.LittleEndian,
+	Channels:   1,
+}
+
+func init() {
+	format.RegisterCodec(format.G722, format.Codec{
+		SampleRate:   Info.SampleRate,
+		BlockSamples: 2,
+		BlockSize:    1,
+		NewEncoder:   func() format.BlockEncoder { return blockEncoder{NewEncoder()} },
+		NewDecoder:   func() format.BlockDecoder { return blockDecoder{NewDecoder()} },
+	})
+}
+
+// blockEncoder and blockDecoder code the blocks of format.G722, a byte per pair of samples.
+type blockEncoder struct {
+	e *Encoder
+}
+
+func (b blockEncoder) Encode(dst []byte, src []int16) {
+	b.e.Encode(dst, src)
+}
+
+type blockDecoder struct {
+	d *Decoder
+}
+
+func (b blockDecoder) Decode(dst []int16, src []byte) error {
+	b.d.Decode(dst, src)
+	return nil
+}
+
+// qmf are the coefficients of the quadrature mirror filters, one half of the 24 taps.
+var qmf = [12]int{3, -11, 12, 32, -210, 951, 3876, -805, 362, -156, 53, -11}
+
+// q6 are the decision levels of the 6-bit lower band quantizer.
+var q6 = [32]int{
+	0, 35, 72, 110, 150, 190, 233, 276,
+	323, 370, 422, 473, 530, 587, 650, 714,
+	786, 858, 940, 1023, 1121, 1219, 1339, 1458,
+	1612, 1765, 1980, 2195, 2557, 2919, 0, 0,
+}
+
+// iln and ilp are the lower band codes of negative and positive differences by
+// quantizer interval.
+var (
+	iln = [32]int{
+		0, 63, 62, 31, 30, 29, 28, 27,
+		26, 25, 24, 23, 22, 21, 20, 19,
+		18, 17, 16, 15, 14, 13, 12, 11,
+		10, 9, 8, 7, 6, 5, 4, 0,
+	}
+	ilp = [32]int{
+		0, 61, 60, 59, 58, 57, 56, 55,
+		54, 53, 52, 51, 50, 49, 48, 47,
+		46, 45, 44, 43, 42, 41, 40, 39,
+		38, 37, 36, 35, 34, 33, 32, 0,
+	}
+)
+
+// qm6 and qm4 are the outputs of the inverse quantizers of the lower band, for the
+// 6-bit code and for its 4 most significant bits.
+var (
+	qm6 = [64]int{
+		-136, -136, -136, -136, -24808, -21904, -19008, -16704,
+		-14984, -13512, -12280, -11192, -10232, -9360, -8576, -7856,
+		-7192, -6576, -6000, -5456, -4944, -4464, -4008, -3576,
+		-3168, -2776, -2400, -2032, -1688, -1360, -1040, -728,
+		24808, 21904, 19008, 16704, 14984, 13512, 12280, 11192,
+		10232, 9360, 8576, 7856, 7192, 6576, 6000, 5456,
+		4944, 4464, 4008, 3576, 3168, 2776, 2400, 2032,
+		1688, 1360, 1040, 728, 432, 136, -432, -136,
+	}
+	qm4 = [16]int{
+		0, -20456, -12896, -8968, -6288, -4240, -2584, -1200,
+		20456, 12896, 8968, 6288, 4240, 2584, 1200, 0,
+	}
+)
+
+// wl and rl42 give the log scale factor multiplier of the lower band by 4-bit code.
+var (
+	wl   = [8]int{-60, -30, 58, 172, 334, 538, 1198, 3042}
+	rl42 = [16]int{0, 7, 6, 5, 4, 3, 2, 1, 7, 6, 5, 4, 3, 2, 1, 0}
+)
+
+// ilb is the antilog table of the scale factors.
+var ilb = [32]int{
+	2048, 2093, 2139, 2186, 2233, 2282, 2332, 2383,
+	2435, 2489, 2543, 2599, 2656, 2714, 2774, 2834,
+	2896, 2960, 3025, 3091, 3158, 3228, 3298, 3371,
+	3444, 3520, 3597, 3676, 3756, 3838, 3922, 4008,
+}
+
+// The tables of the 2-bit higher band quantizer.
+var (
+	ihn = [3]int{0, 1, 0}
+	ihp = [3]int{0, 3, 2}
+	qm2 = [4]int{-7408, -1616, 7408, 1616}
+	wh  = [3]int{0, -214, 798}
+	rh2 = [4]int{2, 1, 2, 1}
+)
+
+func saturate(v int) int {
+	if v > 32767 {
+		return 32767
+	}
+	if v < -32768 {
+		return -32768
+	}
+	return v
+}
+
+// band is the state of the ADPCM coder of a sub-band: its adaptive predictor and the
+// log scale factor of its quantizer.
+type band struct {
+	// s is the signal estimate, sp and sz its pole and zero parts.
+	s, sp, sz int
+	// r are the reconstructed signals, p the partial ones and a and ap the pole
+	// coefficients, newest first.
+	r, p, a, ap [3]int
+	// d are the quantized differences and b and bp the zero coefficients.
+	d, b, bp [7]int
+	nb, det  int
+}
+
+// adapt updates the scale factor with the multiplier w, limiting the log scale factor to
+// max and shifting the antilog by shift.
+func (b *band) adapt(w, max, shift int) {
+	nb := b.nb*127>>7 + w
+	if nb < 0 {
+		nb = 0
+	} else if nb > max {
+		nb = max
+	}
+	b.nb = nb
+	wd1 := nb >> 6 & 31
+	wd2 := shift - nb>>11
+	if wd2 < 0 {
+		b.det = ilb[wd1] << uint(-wd2) << 2
+	} else {
+		b.det = ilb[wd1] >> uint(wd2) << 2
+	}
+}
+
+// predict adapts the predictor to the quantized difference d and computes the next
+// signal estimate, block 4 of the recommendation.
+func (b *band) predict(d int) {
+	// RECONS and PARREC.
+	b.d[0] = d
+	b.r[0] = saturate(b.s + d)
+	b.p[0] = saturate(b.sz + d)
+
+	// UPPOL2.
+	var sg [7]int
+	for i := 0; i < 3; i++ {
+		sg[i] = b.p[i] >> 15
+	}
+	wd1 := saturate(b.a[1] << 2)
+	wd2 := wd1
+	if sg[0] == sg[1] {
+		wd2 = -wd1
+	}
+	if wd2 > 32767 {
+		wd2 = 32767
+	}
+	wd3 := wd2 >> 7
+	if sg[0] == sg[2] {
+		wd3 += 128
+	} else {
+		wd3 -= 128
+	}
+	wd3 += b.a[2] * 32512 >> 15
+	if wd3 > 12288 {
+		wd3 = 12288
+	} else if wd3 < -12288 {
+		wd3 = -12288
+	}
+	b.ap[2] = wd3
+
+	// UPPOL1.
+	wd1 = -192
+	if sg[0] == sg[1] {
+		wd1 = 192
+	}
+	b.ap[1] = saturate(wd1 + b.a[1]*32640>>15)
+	wd3 = saturate(15360 - b.ap[2])
+	if b.ap[1] > wd3 {
+		b.ap[1] = wd3
+	} else if b.ap[1] < -wd3 {
+		b.ap[1] = -wd3
+	}
+
+	// UPZERO.
+	wd1 = 128
+	if d == 0 {
+		wd1 = 0
+	}
+	sg[0] = d >> 15
+	for i := 1; i < 7; i++ {
+		sg[i] = b.d[i] >> 15
+		wd2 = -wd1
+		if sg[i] == sg[0] {
+			wd2 = wd1
+		}
+		b.bp[i] = saturate(wd2 + b.b[i]*32640>>15)
+	}
+
+	// DELAYZ and DELAYA.
+	for i := 6; i > 0; i-- {
+		b.d[i] = b.d[i-1]
+		b.b[i] = b.bp[i]
+	}
+	for i := 2; i > 0; i-- {
+		b.r[i] = b.r[i-1]
+		b.p[i] = b.p[i-1]
+		b.a[i] = b.ap[i]
+	}
+
+	// FILTEP, FILTEZ and PREDIC.
+	wd1 = b.a[1] * saturate(b.r[1]+b.r[1]) >> 15
+	wd2 = b.a[2] * saturate(b.r[2]+b.r[2]) >> 15
+	b.sp = saturate(wd1 + wd2)
+	b.sz = 0
+	for i := 6; i > 0; i-- {
+		b.sz += b.b[i] * saturate(b.d[i]+b.d[i]) >> 15
+	}
+	b.sz = saturate(b.sz)
+	b.s = saturate(b.sp + b.sz)
+}
+
+// coder is the state shared by the encoder and decoder.
+type coder struct {
+	// x holds the last 24 samples through the QMF.
+	x         [24]int
+	low, high band
+}
+
+func (c *coder) reset() {
+	*c = coder{}
+	c.low.det = 32
+	c.high.det = 8
+}
+
+// Encoder encodes 16 kHz samples as 64 kbit/s G.722, one byte per pair of samples. It
+// keeps the state of the codec between calls, so a stream is encoded by one Encoder,
+// in order.
+type Encoder struct {
+	coder
+	// pending holds the odd sample left over from the last call.
+	pending    int16
+	hasPending bool
+}
+
+// NewEncoder returns an Encoder at the start of a stream.
+func NewEncoder() *Encoder {
+	e := &Encoder{}
+	e.Reset()
+	return e
+}
+
+// Reset returns e to the start of a stream.
+func (e *Encoder) Reset() {
+	e.reset()
+	e.pending, e.hasPending = 0, false
+}
+
+// Encode encodes src into dst and returns the number of bytes written. An odd last
+// sample is kept and encoded with the first sample of the next call. dst must hold
+// (len(src)+1)/2 bytes.
+func (e *Encoder) Encode(dst []byte, src []int16) int {
+	n := 0
+	if e.hasPending && len(src) > 0 {
+		dst[n] = e.encodePair(e.pending, src[0])
+		n++
+		src = src[1:]
+		e.hasPending = false
+	}
+	for ; len(src) >= 2; src = src[2:] {
+		dst[n] = e.encodePair(src[0], src[1])
+		n++
+	}
+	if len(src) == 1 {
+		e.pending, e.hasPending = src[0], true
+	}
+	return n
+}
+
+// Flush encodes a sample kept by Encode, paired with silence, into dst and returns the
+// number of bytes written, 0 or 1.
+func (e *Encoder) Flush(dst []byte) int {
+	if !e.hasPending {
+		return 0
+	}
+	dst[0] = e.encodePair(e.pending, 0)
+	e.hasPending = false
+	return 1
+}
+
+// encodePair splits two samples into the lower and higher band with the transmit QMF
+// and encodes them.
+func (e *Encoder) encodePair(x0, x1 int16) byte {
+	copy(e.x[:22], e.x[2:])
+	e.x[22], e.x[23] = int(x0), int(x1)
+	var sumEven, sumOdd int
+	for i, c := range qmf {
+		sumOdd += e.x[2*i] * c
+		sumEven += e.x[2*i+1] * qmf[11-i]
+	}
+	return e.encodeBands((sumEven+sumOdd)>>14, (sumEven-sumOdd)>>14)
+}
+
+// encodeBands encodes a sample of each band: 6 bits for the lower band and 2 for the
+// higher one.
+func (e *Encoder) encodeBands(xlow, xhigh int) byte {
+	// Lower band: SUBTRA, QUANTL, INVQAL and LOGSCL.
+	b := &e.low
+	el := saturate(xlow - b.s)
+	wd := el
+	if el < 0 {
+		wd = -(el + 1)
+	}
+	i := 1
+	for ; i < 30; i++ {
+		if wd < q6[i]*b.det>>12 {
+			break
+		}
+	}
+	ilow := ilp[i]
+	if el < 0 {
+		ilow = iln[i]
+	}
+	ril := ilow >> 2
+	dlow := b.det * qm4[ril] >> 15
+	b.adapt(wl[rl42[ril]], 18432, 8)
+	b.predict(dlow)
+
+	// Higher band: SUBTRA, QUANTH, INVQAH and LOGSCH.
+	b = &e.high
+	eh := saturate(xhigh - b.s)
+	wd = eh
+	if eh < 0 {
+		wd = -(eh + 1)
+	}
+	mih := 1
+	if wd >= 564*b.det>>12 {
+		mih = 2
+	}
+	ihigh := ihp[mih]
+	if eh < 0 {
+		ihigh = ihn[mih]
+	}
+	dhigh := b.det * qm2[ihigh] >> 15
+	b.adapt(wh[rh2[ihigh]], 22528, 10)
+	b.predict(dhigh)
+
+	return byte(ihigh<<6 | ilow)
+}
+
+// Decoder decodes 64 kbit/s G.722 into 16 kHz samples, two per byte. It keeps the state
+// of the codec between calls, so a stream is decoded by one Decoder, in order.
+type Decoder struct {
+	coder
+}
+
+// NewDecoder returns a Decoder at the start of a stream.
+func NewDecoder() *Decoder {
+	d := &Decoder{}
+	d.Reset()
+	return d
+}
+
+// Reset returns d to the start of a stream.
+func (d *Decoder) Reset() {
+	d.reset()
+}
+
+// Decode decodes src into dst and returns the number of samples written. dst must
+// hold 2*len(src) samples.
+func (d *Decoder) Decode(dst []int16, src []byte) int {
+	for i, code := range src {
+		rlow, rhigh := d.decodeBands(code)
+		// Receive QMF.
+		copy(d.x[:22], d.x[2:])
+		d.x[22], d.x[23] = rlow+rhigh, rlow-rhigh
+		var out0, out1 int
+		for j, c := range qmf {
+			out1 += d.x[2*j] * c
+			out0 += d.x[2*j+1] * qmf[11-j]
+		}
+		dst[2*i] = int16(saturate(out0 >> 11))
+		dst[2*i+1] = int16(saturate(out1 >> 11))
+	}
+	return 2 * len(src)
+}
+
+// decodeBands decodes the reconstructed sample of each band from a code.
+func (d *Decoder) decodeBands(code byte) (int, int) {
+	// Lower band: INVQBL, RECONS, LIMIT, then INVQAL and LOGSCL to adapt.
+	b := &d.low
+	ilow := int(code & 0x3f)
+	rlow := limit(b.s + b.det*qm6[ilow]>>15)
+	ril := ilow >> 2
+	dlow := b.det * qm4[ril] >> 15
+	b.adapt(wl[rl42[ril]], 18432, 8)
+	b.predict(dlow)
+
+	// Higher band: INVQAH, RECONS, LIMIT and LOGSCH.
+	b = &d.high
+	ihigh := int(code >> 6)
+	dhigh := b.det * qm2[ihigh] >> 15
+	rhigh := limit(b.s + dhigh)
+	b.adapt(wh[rh2[ihigh]], 22528, 10)
+	b.predict(dhigh)
+	return rlow, rhigh
+}
+
+// limit limits a reconstructed band sample to 15 bits.
+func limit(v int) int {
+	if v > 16383 {
+		return 16383
+	}
+	if v < -16384 {
+		return -16384
+	}
+	return v
+}
@@ -0,0 +1,158 @@
+package g722
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+
+	"github.com/ZhangJYd/pcm_convertor"
+	"github.com/ZhangJYd/pcm_convertor/format"
+	"github.com/ZhangJYd/pcm_convertor/internal/codectest"
+	"github.com/ZhangJYd/pcm_convertor/resample"
+)
+
+// qmfDelay is the delay in samples of the transmit and receive QMFs together.
+const qmfDelay = 22
+
+// speech returns n samples of two tones, one in each band, with a changing level.
+func speech(n int) []int16 {
+	return codectest.Speech(n, 16000, 5200)
+}
+
+func encode(pcm []int16) []byte {
+	codes := make([]byte, (len(pcm)+1)/2)
+	enc := NewEncoder()
+	n := enc.Encode(codes, pcm)
+	enc.Flush(codes[n:])
+	return codes
+}
+
+func decode(codes []byte) []int16 {
+	out := make([]int16, 2*len(codes))
+	NewDecoder().Decode(out, codes)
+	return out
+}
+
+func TestRoundTrip(t *testing.T) {
+	pcm := speech(16000)
+	codes := make([]byte, len(pcm)/2)
+	if n := NewEncoder().Encode(codes, pcm); n != len(codes) {
+		t.Fatalf("got %d codes, want %d", n, len(codes))
+	}
+	if got := codectest.SNR(pcm, decode(codes), qmfDelay); got < 25 {
+		t.Errorf("SNR %.1f dB", got)
+	}
+}
+
+func TestSilence(t *testing.T) {
+	for i, s := range decode(encode(make([]int16, 200))) {
+		if s < -2 || s > 2 {
+			t.Fatalf("sample %d: got %d", i, s)
+		}
+	}
+}
+
+func TestState(t *testing.T) {
+	pcm := speech(4001)
+	want := encode(pcm)
+
+	// Chunks of odd sizes carry samples and codec state across calls.
+	enc := NewEncoder()
+	var got []byte
+	for i := 0; i < len(pcm); {
+		size := 1 + i%7
+		if i+size > len(pcm) {
+			size = len(pcm) - i
+		}
+		codes := make([]byte, (size+1)/2)
+		got = append(got, codes[:enc.Encode(codes, pcm[i:i+size])]...)
+		i += size
+	}
+	var last [1]byte
+	got = append(got, last[:enc.Flush(last[:])]...)
+	if !bytes.Equal(got, want) {
+		t.Fatal("codes depend on the chunk size")
+	}
+
+	all := decode(want)
+	dec := NewDecoder()
+	for i := 0; i < len(want); i += 3 {
+		end := i + 3
+		if end > len(want) {
+			end = len(want)
+		}
+		part := make([]int16, 2*(end-i))
+		dec.Decode(part, want[i:end])
+		for j, s := range part {
+			if s != all[2*i+j] {
+				t.Fatalf("sample %d: got %d, want %d", 2*i+j, s, all[2*i+j])
+			}
+		}
+	}
+
+	// The encoder tracks the decoder: both end in the same state.
+	if enc.low != dec.low || enc.high != dec.high {
+		t.Error("encoder and decoder states differ")
+	}
+}
+
+func TestReaderWriter(t *testing.T) {
+	pcm := speech(3201)
+	var buf bytes.Buffer
+	info := pcm_convertor.StreamInfo{SampleRate: 16000, Format: format.S16, ByteOrder: binary.BigEndian, Channels: 1}
+	w, err := NewWriter(&buf, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codectest.Write(t, w, codectest.Bytes(pcm, binary.BigEndian))
+	want := encode(pcm)
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Fatal("Writer output differs from Encoder")
+	}
+
+	r := NewReader(&buf)
+	if r.StreamInfo() != Info {
+		t.Errorf("got %+v", r.StreamInfo())
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codectest.EqualSamples(t, got, decode(want))
+
+	for _, bad := range []pcm_convertor.StreamInfo{
+		{SampleRate: 8000, Format: format.S16, ByteOrder: binary.LittleEndian, Channels: 1},
+		{SampleRate: 16000, Format: format.S16, ByteOrder: binary.LittleEndian, Channels: 2},
+		{SampleRate: 16000, Format: format.F32, ByteOrder: binary.LittleEndian, Channels: 1},
+	} {
+		if _, err := NewWriter(&buf, bad); err == nil {
+			t.Errorf("%+v: no error", bad)
+		}
+	}
+}
+
+func TestConvertor(t *testing.T) {
+	pcm := speech(3201)
+	codes := encode(pcm)
+	codectest.Convertor(t, format.G722, pcm, codes, decode(codes))
+
+	// Decoding to another rate resamples the decoded samples.
+	coded := pcm_convertor.StreamInfo{SampleRate: 16000, Format: format.G722, Channels: 1}
+	narrow := pcm_convertor.StreamInfo{SampleRate: 8000, Format: format.S16, ByteOrder: binary.LittleEndian, Channels: 1}
+	d, err := pcm_convertor.NewConvertor(&coded, &narrow, resample.HighQ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := d.Process(codes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tail, err := d.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frames, expected := int64(len(out)+len(tail))/2, d.ExpectedOutputFrames(int64(len(codes))); frames != expected {
+		t.Errorf("got %d frames, expected %d", frames, expected)
+	}
+}
@@ -0,0 +1,78 @@
+package g722
+
+import (
+	"io"
+
+	"github.com/ZhangJYd/pcm_convertor"
+	"github.com/ZhangJYd/pcm_convertor/format"
+	"github.com/ZhangJYd/pcm_convertor/model"
+)
+
+// Writer encodes samples described by Info, in either byte order, as a G.722 stream. Put
+// it after a Convertor whose output is 16 kHz mono S16.
+type Writer struct {
+	w    io.Writer
+	info pcm_convertor.StreamInfo
+	enc  *Encoder
+	// fragment holds the first byte of a sample split across writes.
+	fragment []byte
+	samples  []int16
+	codes    []byte
+	closed   bool
+}
+
+// NewWriter returns a Writer that encodes samples described by info to w.
+func NewWriter(w io.Writer, info pcm_convertor.StreamInfo) (*Writer, error) {
+	if info.SampleRate != Info.SampleRate {
+		return nil, model.ErrInvalidSampleRate
+	}
+	if info.Channels != 1 {
+		return nil, model.ErrInvalidChannels
+	}
+	if info.Format != format.S16 || info.ByteOrder == nil {
+		return nil, model.ErrInvalidFormat
+	}
+	return &Writer{w: w, info: info, enc: NewEncoder()}, nil
+}
+
+// Write encodes samples. A sample left unpaired is encoded with the first one of the
+// next write.
+func (gw *Writer) Write(p []byte) (int, error) {
+	if gw.closed {
+		return 0, model.ErrClosed
+	}
+	data := p
+	if len(gw.fragment) > 0 {
+		data = append(gw.fragment, p...)
+	}
+	whole := len(data) &^ 1
+	gw.samples = gw.samples[:0]
+	for i := 0; i < whole; i += 2 {
+		gw.samples = append(gw.samples, int16(gw.info.ByteOrder.Uint16(data[i:])))
+	}
+	gw.fragment = append(gw.fragment[:0], data[whole:]...)
+
+	if need := len(gw.samples)/2 + 1; cap(gw.codes) < need {
+		gw.codes = make([]byte, need)
+	}
+	n := gw.enc.Encode(gw.codes[:cap(gw.codes)], gw.samples)
+	if _, err := gw.w.Write(gw.codes[:n]); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close encodes a last unpaired sample with a silent one. A trailing partial sample is
+// dropped. It does not close the destination.
+func (gw *Writer) Close() error {
+	if gw.closed {
+		return model.ErrClosed
+	}
+	gw.closed = true
+	var code [1]byte
+	if n := gw.enc.Flush(code[:]); n > 0 {
+		_, err := gw.w.Write(code[:n])
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,624 @@
+// Package g726 encodes and decodes ITU-T G.726 ADPCM at 16, 24, 32 and 40 kbit/s,
+// which codes 8 kHz samples in 2 to 5 bits each. The arithmetic follows the 16-bit
+// fixed-point blocks of the recommendation; it has not been checked against the ITU-T
+// test sequences.
+//
+// Importing the package makes the format.G726 formats usable in a Convertor.
+package g726
+
+import (
+	"encoding/binary"
+
+	"github.com/ZhangJYd/pcm_convertor"
+	"github.com/ZhangJYd/pcm_convertor/format"
+	"github.com/ZhangJYd/pcm_convertor/model"
+)
+
+// Info describes the samples G.726 carries: 8 kHz mono S16. Reader produces them in
+// little-endian order.
+var Info = pcm_convertor.StreamInfo{
+	SampleRate: 8000,
+	Format:     format.S16,
+	ByteOrder:  binary.LittleEndian,
+	Channels:   1,
+}
+
+// Packing is the order in which codes are packed into bytes.
+type Packing int
+
+const (
+	// PackITU packs the first code into the least significant bits of a byte, as
+	// ITU-T X.420 and RTP (RFC 3551) do.
+	PackITU Packing = iota
+	// PackAAL2 packs the first code into the most significant bits of a byte, as
+	// ITU-T I.366.2 does for AAL2.
+	PackAAL2
+)
+
+func init() {
+	formats := [...][2]format.PcmFormat{
+		{format.G726R16, format.G726R16AAL2},
+		{format.G726R24, format.G726R24AAL2},
+		{format.G726R32, format.G726R32AAL2},
+		{format.G726R40, format.G726R40AAL2},
+	}
+	for i, f := range formats {
+		bitRate := 16000 + 8000*i
+		register(f[0], bitRate, PackITU)
+		register(f[1], bitRate, PackAAL2)
+	}
+}
+
+// register makes f the format of G.726 at bitRate packed by packing. A block is 8 codes,
+// which fill whole bytes at every rate.
+func register(f format.PcmFormat, bitRate int, packing Packing) {
+	format.RegisterCodec(f, format.Codec{
+		SampleRate:   Info.SampleRate,
+		BlockSamples: 8,
+		BlockSize:    bitRate / Info.SampleRate,
+		NewEncoder: func() format.BlockEncoder {
+			e, _ := NewEncoder(bitRate, packing)
+			return blockEncoder{e}
+		},
+		NewDecoder: func() format.BlockDecoder {
+			d, _ := NewDecoder(bitRate, packing)
+			return blockDecoder{d}
+		},
+	})
+}
+
+// blockEncoder and blockDecoder code the blocks of the G.726 formats.
+type blockEncoder struct {
+	e *Encoder
+}
+
+func (b blockEncoder) Encode(dst []byte, src []int16) {
+	b.e.Encode(dst, src)
+}
+
+type blockDecoder struct {
+	d *Decoder
+}
+
+func (b blockDecoder) Decode(dst []int16, src []byte) error {
+	b.d.Decode(dst, src)
+	return nil
+}
+
+// rate holds the quantizer tables of a bit rate, indexed by code.
+type rate struct {
+	bits int
+	// levels are the decision levels of the quantizer for positive differences.
+	levels []int
+	// dqln are the normalized log magnitudes of the reconstructed differences, wi the
+	// scale factor multipliers and fi the rates of change of the adaptation speed.
+	dqln, wi, fi []int
+}
+
+var rates = map[int]*rate{
+	16000: {
+		bits:   2,
+		levels: []int{261},
+		dqln:   []int{116, 365, 365, 116},
+		wi:     []int{-704, 14048, 14048, -704},
+		fi:     []int{0, 0xe00, 0xe00, 0},
+	},
+	24000: {
+		bits:   3,
+		levels: []int{8, 218, 331},
+		dqln:   []int{-2048, 135, 273, 373, 373, 273, 135, -2048},
+		wi:     []int{-128, 960, 4384, 18624, 18624, 4384, 960, -128},
+		fi:     []int{0, 0x200, 0x400, 0xe00, 0xe00, 0x400, 0x200, 0},
+	},
+	32000: {
+		bits:   4,
+		levels: []int{-124, 80, 178, 246, 300, 349, 400},
+		dqln: []int{
+			-2048, 4, 135, 213, 273, 323, 373, 425,
+			425, 373, 323, 273, 213, 135, 4, -2048,
+		},
+		wi: []int{
+			-384, 576, 1312, 2048, 3584, 6336, 11360, 35904,
+			35904, 11360, 6336, 3584, 2048, 1312, 576, -384,
+		},
+		fi: []int{
+			0, 0, 0, 0x200, 0x200, 0x200, 0x600, 0xe00,
+			0xe00, 0x600, 0x200, 0x200, 0x200, 0, 0, 0,
+		},
+	},
+	40000: {
+		bits:   5,
+		levels: []int{-122, -16, 68, 139, 198, 250, 298, 339, 378, 413, 445, 475, 502, 528, 553},
+		dqln: []int{
+			-2048, -66, 28, 104, 169, 224, 274, 318,
+			358, 395, 429, 459, 488, 514, 539, 566,
+			566, 539, 514, 488, 459, 429, 395, 358,
+			318, 274, 224, 169, 104, 28, -66, -2048,
+		},
+		wi: []int{
+			448, 448, 768, 1248, 1280, 1312, 1856, 3200,
+			4512, 5728, 7008, 8960, 11456, 14080, 16928, 22272,
+			22272, 16928, 14080, 11456, 8960, 7008, 5728, 4512,
+			3200, 1856, 1312, 1280, 1248, 768, 448, 448,
+		},
+		fi: []int{
+			0, 0, 0, 0, 0, 0x200, 0x200, 0x200,
+			0x200, 0x200, 0x400, 0x600, 0x800, 0xa00, 0xc00, 0xc00,
+			0xc00, 0xc00, 0xa00, 0x800, 0x600, 0x400, 0x200, 0x200,
+			0x200, 0x200, 0x200, 0, 0, 0, 0, 0,
+		},
+	},
+}
+
+func rateOf(bitRate int) (*rate, error) {
+	r, ok := rates[bitRate]
+	if !ok {
+		return nil, model.ErrInvalidParameter
+	}
+	return r, nil
+}
+
+var power2 = [15]int{1, 2, 4, 8, 0x10, 0x20, 0x40, 0x80, 0x100, 0x200, 0x400, 0x800, 0x1000, 0x2000, 0x4000}
+
+// quan returns the index of the first entry of table above v.
+func quan(v int, table []int) int {
+	for i, t := range table {
+		if v < t {
+			return i
+		}
+	}
+	return len(table)
+}
+
+// s16 truncates v to the 16 bits the recommendation computes in.
+func s16(v int) int {
+	return int(int16(v))
+}
+
+// fmult multiplies a predictor coefficient by a value in the 4-bit exponent, 6-bit
+// mantissa floating point form of the recommendation.
+func fmult(an, srn int) int {
+	anmag := -an & 0x1fff
+	if an > 0 {
+		anmag = an
+	}
+	anexp := quan(anmag, power2[:]) - 6
+	anmant := 32
+	if anmag != 0 {
+		if anexp >= 0 {
+			anmant = anmag >> uint(anexp)
+		} else {
+			anmant = anmag << uint(-anexp)
+		}
+	}
+	wanexp := anexp + (srn >> 6 & 0xf) - 13
+	wanmant := (anmant*(srn&0x3f) + 0x30) >> 4
+	var v int
+	if wanexp >= 0 {
+		v = wanmant << uint(wanexp) & 0x7fff
+	} else {
+		v = wanmant >> uint(-wanexp)
+	}
+	if an^srn < 0 {
+		return -v
+	}
+	return v
+}
+
+// float converts v to the floating point form of fmult; negative values have their
+// sign in bit 10.
+func float(v int) int {
+	mag := v
+	if v < 0 {
+		mag = -v
+	}
+	if mag == 0 {
+		return 0x20
+	}
+	exp := quan(mag, power2[:])
+	f := exp<<6 + mag<<6>>uint(exp)
+	if v < 0 {
+		f -= 0x400
+	}
+	return f
+}
+
+// coder is the state of the adaptive quantizer and predictor shared by the encoder and
+// decoder.
+type coder struct {
+	rate *rate
+	// yl and yu are the slow and fast step size scale factors, ap the speed control.
+	yl       int
+	yu       int
+	dms, dml int
+	ap       int
+	// a and b are the pole and zero coefficients and sr and dq the reconstructed
+	// signals and differences in floating point form, newest first.
+	a, pk, sr [2]int
+	b, dq     [6]int
+	// td is set while the signal may be from a modem.
+	td bool
+}
+
+func (c *coder) reset() {
+	*c = coder{rate: c.rate, yl: 34816, yu: 544}
+	c.sr = [2]int{32, 32}
+	c.dq = [6]int{32, 32, 32, 32, 32, 32}
+}
+
+// estimate returns the signal estimate and its part from the zeros.
+func (c *coder) estimate() (se, sez int) {
+	sezi := 0
+	for i := range c.b {
+		sezi += fmult(c.b[i]>>2, c.dq[i])
+	}
+	sezi = s16(sezi)
+	sei := s16(sezi + fmult(c.a[1]>>2, c.sr[1]) + fmult(c.a[0]>>2, c.sr[0]))
+	return sei >> 1, sezi >> 1
+}
+
+// stepSize mixes the slow and fast scale factors by the speed control.
+func (c *coder) stepSize() int {
+	if c.ap >= 256 {
+		return c.yu
+	}
+	y := c.yl >> 6
+	dif := c.yu - y
+	al := c.ap >> 2
+	if dif > 0 {
+		y += dif * al >> 6
+	} else if dif < 0 {
+		y += (dif*al + 0x3f) >> 6
+	}
+	return y
+}
+
+// quantize returns the code of the difference d for step size y.
+func (c *coder) quantize(d, y int) int {
+	dqm := d
+	if d < 0 {
+		dqm = -d
+	}
+	exp := quan(dqm>>1, power2[:])
+	mant := dqm << 7 >> uint(exp) & 0x7f
+	dln := s16(exp<<7 + mant - y>>2)
+	levels := c.rate.levels
+	i := quan(dln, levels)
+	switch {
+	case d < 0:
+		return 2*len(levels) + 1 - i
+	case i == 0 && c.rate.bits != 2:
+		// There is no code for zero but at 16 kbit/s; use the smallest negative one.
+		return 2*len(levels) + 1
+	}
+	return i
+}
+
+// reconstruct returns the quantized difference of code i for step size y, in sign and
+// magnitude form.
+func (c *coder) reconstruct(i, y int) int {
+	sign := i&(1<<uint(c.rate.bits-1)) != 0
+	dql := s16(c.rate.dqln[i] + y>>2)
+	if dql < 0 {
+		if sign {
+			return -0x8000
+		}
+		return 0
+	}
+	dex := dql >> 7 & 15
+	dqt := 128 + dql&127
+	dq := dqt << 7 >> uint(14-dex)
+	if sign {
+		return dq - 0x8000
+	}
+	return dq
+}
+
+// step runs a sample through the coder: it reconstructs the signal from the code i for
+// the estimate se and adapts the state. It returns the reconstructed signal.
+func (c *coder) step(i, se, sez, y int) int {
+	dq := c.reconstruct(i, y)
+	var sr int
+	if dq < 0 {
+		sr = s16(se - dq&0x3fff)
+	} else {
+		sr = s16(se + dq)
+	}
+	dqsez := s16(sr + sez - se)
+	c.update(y, c.rate.wi[i], c.rate.fi[i], dq, sr, dqsez)
+	return sr
+}
+
+// update adapts the quantizer and predictor.
+func (c *coder) update(y, wi, fi, dq, sr, dqsez int) {
+	pk0 := 0
+	if dqsez < 0 {
+		pk0 = 1
+	}
+	mag := dq & 0x7fff
+
+	// TRANS: a large difference after a tone marks a transition.
+	ylint := c.yl >> 15
+	ylfrac := c.yl >> 10 & 0x1f
+	thr2 := 31 << 10
+	if ylint <= 9 {
+		thr2 = (32 + ylfrac) << uint(ylint)
+	}
+	dqthr := (thr2 + thr2>>1) >> 1
+	tr := c.td && mag > dqthr
+
+	// FUNCTW, FILTD, LIMB and FILTE: the scale factors.
+	c.yu = y + (wi-y)>>5
+	if c.yu < 544 {
+		c.yu = 544
+	} else if c.yu > 5120 {
+		c.yu = 5120
+	}
+	c.yl += c.yu + (-c.yl)>>6
+
+	a2p := 0
+	if tr {
+		c.a = [2]int{}
+		c.b = [6]int{}
+	} else {
+		// UPA2 and LIMC.
+		pks1 := pk0 ^ c.pk[0]
+		a2p = s16(c.a[1] - c.a[1]>>7)
+		if dqsez != 0 {
+			fa1 := -c.a[0]
+			if pks1 != 0 {
+				fa1 = c.a[0]
+			}
+			switch {
+			case fa1 < -8191:
+				a2p -= 0x100
+			case fa1 > 8191:
+				a2p += 0xff
+			default:
+				a2p += fa1 >> 5
+			}
+			if pk0^c.pk[1] != 0 {
+				switch {
+				case a2p <= -12160:
+					a2p = -12288
+				case a2p >= 12416:
+					a2p = 12288
+				default:
+					a2p -= 0x80
+				}
+			} else {
+				switch {
+				case a2p <= -12416:
+					a2p = -12288
+				case a2p >= 12160:
+					a2p = 12288
+				default:
+					a2p += 0x80
+				}
+			}
+		}
+		c.a[1] = a2p
+
+		// UPA1 and LIMD.
+		c.a[0] -= c.a[0] >> 8
+		if dqsez != 0 {
+			if pks1 == 0 {
+				c.a[0] += 192
+			} else {
+				c.a[0] -= 192
+			}
+		}
+		a1ul := 15360 - a2p
+		if c.a[0] < -a1ul {
+			c.a[0] = -a1ul
+		} else if c.a[0] > a1ul {
+			c.a[0] = a1ul
+		}
+
+		// UPB.
+		for i := range c.b {
+			if c.rate.bits == 5 {
+				c.b[i] -= c.b[i] >> 9
+			} else {
+				c.b[i] -= c.b[i] >> 8
+			}
+			if mag != 0 {
+				if s16(dq)^c.dq[i] >= 0 {
+					c.b[i] += 128
+				} else {
+					c.b[i] -= 128
+				}
+			}
+		}
+	}
+
+	// FLOAT A, FLOAT B and the delays.
+	copy(c.dq[1:], c.dq[:5])
+	switch {
+	case mag == 0 && dq >= 0:
+		c.dq[0] = 0x20
+	case mag == 0:
+		c.dq[0] = s16(0xfc20)
+	case dq >= 0:
+		c.dq[0] = float(mag)
+	default:
+		c.dq[0] = float(-mag)
+	}
+	c.sr[1] = c.sr[0]
+	if sr > -32768 {
+		c.sr[0] = float(sr)
+	} else {
+		c.sr[0] = s16(0xfc20)
+	}
+	c.pk[1], c.pk[0] = c.pk[0], pk0
+
+	// TONE: a small correlation marks a possible modem signal.
+	c.td = !tr && a2p < -11776
+
+	// FILTA, FILTB and SUBTC: the adaptation speed.
+	c.dms += (fi - c.dms) >> 5
+	c.dml += (fi<<2 - c.dml) >> 7
+	switch {
+	case tr:
+		c.ap = 256
+	case y < 1536, c.td, abs(c.dms<<2-c.dml) >= c.dml>>3:
+		c.ap += (0x200 - c.ap) >> 4
+	default:
+		c.ap += (-c.ap) >> 4
+	}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// packer packs codes into bytes, or unpacks them, in the bit order of a Packing.
+type packer struct {
+	packing Packing
+	// acc holds n bits not yet packed or unpacked.
+	acc uint
+	n   int
+}
+
+// Encoder encodes 8 kHz samples as G.726 codes packed into bytes. It keeps the state of
+// the codec and the bits of an unfinished byte between calls, so a stream is encoded by
+// one Encoder, in order.
+type Encoder struct {
+	coder
+	packer
+}
+
+// NewEncoder returns an Encoder at the start of a stream at bitRate, one of 16000,
+// 24000, 32000 and 40000, that packs codes by packing.
+func NewEncoder(bitRate int, packing Packing) (*Encoder, error) {
+	r, err := rateOf(bitRate)
+	if err != nil {
+		return nil, err
+	}
+	e := &Encoder{coder: coder{rate: r}, packer: packer{packing: packing}}
+	e.Reset()
+	return e, nil
+}
+
+// Reset returns e to the start of a stream.
+func (e *Encoder) Reset() {
+	e.reset()
+	e.acc, e.n = 0, 0
+}
+
+// Encode encodes src into dst and returns the number of bytes written. The bits of an
+// unfinished byte are kept and packed with the codes of the next call. dst must hold
+// (len(src)*bits+7)/8 bytes, where bits is the size of a code.
+func (e *Encoder) Encode(dst []byte, src []int16) int {
+	bits := e.rate.bits
+	n := 0
+	for _, s := range src {
+		se, sez := e.estimate()
+		y := e.stepSize()
+		i := e.quantize(s16(int(s)>>2-se), y)
+		e.step(i, se, sez, y)
+
+		if e.packing == PackAAL2 {
+			e.acc = e.acc<<uint(bits) | uint(i)
+		} else {
+			e.acc |= uint(i) << uint(e.n)
+		}
+		for e.n += bits; e.n >= 8; e.n -= 8 {
+			if e.packing == PackAAL2 {
+				dst[n] = byte(e.acc >> uint(e.n-8))
+			} else {
+				dst[n] = byte(e.acc)
+				e.acc >>= 8
+			}
+			n++
+		}
+		e.acc &= 1<<uint(e.n) - 1
+	}
+	return n
+}
+
+// Flush writes the bits of an unfinished byte, padded with zeros, into dst and returns
+// the number of bytes written, 0 or 1.
+func (e *Encoder) Flush(dst []byte) int {
+	if e.n == 0 {
+		return 0
+	}
+	if e.packing == PackAAL2 {
+		dst[0] = byte(e.acc << uint(8-e.n))
+	} else {
+		dst[0] = byte(e.acc)
+	}
+	e.acc, e.n = 0, 0
+	return 1
+}
+
+// Decoder decodes G.726 codes packed into bytes into 8 kHz samples. It keeps the state
+// of the codec and the bits of an unfinished code between calls, so a stream is decoded
+// by one Decoder, in order.
+type Decoder struct {
+	coder
+	packer
+}
+
+// NewDecoder returns a Decoder at the start of a stream at bitRate, one of 16000,
+// 24000, 32000 and 40000, that unpacks codes by packing.
+func NewDecoder(bitRate int, packing Packing) (*Decoder, error) {
+	r, err := rateOf(bitRate)
+	if err != nil {
+		return nil, err
+	}
+	d := &Decoder{coder: coder{rate: r}, packer: packer{packing: packing}}
+	d.Reset()
+	return d, nil
+}
+
+// Reset returns d to the start of a stream.
+func (d *Decoder) Reset() {
+	d.reset()
+	d.acc, d.n = 0, 0
+}
+
+// Decode decodes src into dst and returns the number of samples written. The bits of an
+// unfinished code are kept and decoded with the next call. dst must hold
+// (len(src)*8+bits-1)/bits samples, where bits is the size of a code.
+func (d *Decoder) Decode(dst []int16, src []byte) int {
+	bits := uint(d.rate.bits)
+	mask := uint(1)<<bits - 1
+	n := 0
+	for _, b := range src {
+		if d.packing == PackAAL2 {
+			d.acc = d.acc<<8 | uint(b)
+		} else {
+			d.acc |= uint(b) << uint(d.n)
+		}
+		for d.n += 8; d.n >= int(bits); n++ {
+			d.n -= int(bits)
+			var i uint
+			if d.packing == PackAAL2 {
+				i = d.acc >> uint(d.n) & mask
+			} else {
+				i = d.acc & mask
+				d.acc >>= bits
+			}
+			se, sez := d.estimate()
+			y := d.stepSize()
+			dst[n] = int16(clamp(d.step(int(i), se, sez, y) << 2))
+		}
+		d.acc &= 1<<uint(d.n) - 1
+	}
+	return n
+}
+
+// clamp limits v to 16 bits.
+func clamp(v int) int {
+	if v > 32767 {
+		return 32767
+	}
+	if v < -32768 {
+		return -32768
+	}
+	return v
+}
@@ -0,0 +1,230 @@
+package g726
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+
+	"github.com/ZhangJYd/pcm_convertor"
+	"github.com/ZhangJYd/pcm_convertor/format"
+	"github.com/ZhangJYd/pcm_convertor/internal/codectest"
+	"github.com/ZhangJYd/pcm_convertor/model"
+)
+
+var bitRates = []int{16000, 24000, 32000, 40000}
+
+// speech returns n samples of two tones with a changing level.
+func speech(n int) []int16 {
+	return codectest.Speech(n, 8000, 1700)
+}
+
+func encode(t *testing.T, bitRate int, packing Packing, pcm []int16) []byte {
+	enc, err := NewEncoder(bitRate, packing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes := make([]byte, (len(pcm)*enc.rate.bits+7)/8)
+	n := enc.Encode(codes, pcm)
+	n += enc.Flush(codes[n:])
+	return codes[:n]
+}
+
+func decode(t *testing.T, bitRate int, packing Packing, codes []byte) []int16 {
+	dec, err := NewDecoder(bitRate, packing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make([]int16, (len(codes)*8+dec.rate.bits-1)/dec.rate.bits)
+	return out[:dec.Decode(out, codes)]
+}
+
+func TestRoundTrip(t *testing.T) {
+	pcm := speech(8000)
+	for _, c := range []struct {
+		bitRate int
+		snr     float64
+	}{
+		{16000, 14},
+		{24000, 20},
+		{32000, 25},
+		{40000, 28},
+	} {
+		for _, packing := range []Packing{PackITU, PackAAL2} {
+			codes := encode(t, c.bitRate, packing, pcm)
+			if want := len(pcm) * c.bitRate / 8000 / 8; len(codes) != want {
+				t.Fatalf("%d: got %d bytes, want %d", c.bitRate, len(codes), want)
+			}
+			if got := codectest.SNR(pcm, decode(t, c.bitRate, packing, codes), 0); got < c.snr {
+				t.Errorf("%d: SNR %.1f dB", c.bitRate, got)
+			}
+		}
+	}
+	if _, err := NewEncoder(48000, PackITU); err != model.ErrInvalidParameter {
+		t.Errorf("got %v", err)
+	}
+	if _, err := NewDecoder(0, PackITU); err != model.ErrInvalidParameter {
+		t.Errorf("got %v", err)
+	}
+}
+
+// unpack returns the codes of bits each in data, read from the least significant bit
+// of each byte up.
+func unpack(data []byte, bits int) []uint {
+	var codes []uint
+	for i := 0; i+bits <= 8*len(data); i += bits {
+		var code uint
+		for j := 0; j < bits; j++ {
+			code |= uint(data[(i+j)/8]>>uint((i+j)%8)&1) << uint(j)
+		}
+		codes = append(codes, code)
+	}
+	return codes
+}
+
+func TestPacking(t *testing.T) {
+	pcm := speech(800)
+	for _, bitRate := range bitRates {
+		itu := encode(t, bitRate, PackITU, pcm)
+		aal2 := encode(t, bitRate, PackAAL2, pcm)
+		bits := rates[bitRate].bits
+		// Reversing the bits of every byte turns one order into the other, with the bits
+		// of every code reversed too.
+		reversed := make([]byte, len(aal2))
+		for i, b := range aal2 {
+			for j := uint(0); j < 8; j++ {
+				reversed[i] |= b >> j & 1 << (7 - j)
+			}
+		}
+		want := unpack(itu, bits)
+		for i, code := range unpack(reversed, bits) {
+			var c uint
+			for j := 0; j < bits; j++ {
+				c |= code >> uint(j) & 1 << uint(bits-1-j)
+			}
+			if c != want[i] {
+				t.Fatalf("%d: code %d: got %d, want %d", bitRate, i, c, want[i])
+			}
+		}
+		if bitRate == 32000 && itu[0] != aal2[0]<<4|aal2[0]>>4 {
+			t.Errorf("got %#x and %#x", itu[0], aal2[0])
+		}
+	}
+}
+
+func TestState(t *testing.T) {
+	pcm := speech(4001)
+	for _, bitRate := range bitRates {
+		want := encode(t, bitRate, PackAAL2, pcm)
+
+		// Chunks of odd sizes carry bits and codec state across calls.
+		enc, _ := NewEncoder(bitRate, PackAAL2)
+		var got []byte
+		for i := 0; i < len(pcm); {
+			size := 1 + i%7
+			if i+size > len(pcm) {
+				size = len(pcm) - i
+			}
+			codes := make([]byte, (size*enc.rate.bits+7)/8)
+			got = append(got, codes[:enc.Encode(codes, pcm[i:i+size])]...)
+			i += size
+		}
+		var last [1]byte
+		got = append(got, last[:enc.Flush(last[:])]...)
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%d: codes depend on the chunk size", bitRate)
+		}
+
+		all := decode(t, bitRate, PackAAL2, want)
+		dec, _ := NewDecoder(bitRate, PackAAL2)
+		var parts []int16
+		for i := 0; i < len(want); i++ {
+			part := make([]int16, 4)
+			parts = append(parts, part[:dec.Decode(part, want[i:i+1])]...)
+		}
+		if len(parts) != len(all) {
+			t.Fatalf("%d: got %d samples, want %d", bitRate, len(parts), len(all))
+		}
+		for i := range all {
+			if parts[i] != all[i] {
+				t.Fatalf("%d: sample %d: got %d, want %d", bitRate, i, parts[i], all[i])
+			}
+		}
+
+		// The encoder tracks the decoder: both end in the same state.
+		enc.Reset()
+		dec.Reset()
+		codes := make([]byte, (len(pcm)*enc.rate.bits+7)/8)
+		n := enc.Encode(codes, pcm[:len(pcm)-1])
+		dec.Decode(make([]int16, len(pcm)), codes[:n])
+		if enc.coder != dec.coder {
+			t.Errorf("%d: encoder and decoder states differ", bitRate)
+		}
+	}
+}
+
+func TestSilence(t *testing.T) {
+	for _, bitRate := range bitRates {
+		out := decode(t, bitRate, PackITU, encode(t, bitRate, PackITU, make([]int16, 800)))
+		for i, s := range out {
+			if s < -64 || s > 64 {
+				t.Fatalf("%d: sample %d: got %d", bitRate, i, s)
+			}
+		}
+	}
+}
+
+func TestReaderWriter(t *testing.T) {
+	pcm := speech(3201)
+	var buf bytes.Buffer
+	info := pcm_convertor.StreamInfo{SampleRate: 8000, Format: format.S16, ByteOrder: binary.BigEndian, Channels: 1}
+	w, err := NewWriter(&buf, info, 40000, PackITU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codectest.Write(t, w, codectest.Bytes(pcm, binary.BigEndian))
+	want := encode(t, 40000, PackITU, pcm)
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Fatal("Writer output differs from Encoder")
+	}
+
+	r, err := NewReader(&buf, 40000, PackITU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.StreamInfo() != Info {
+		t.Errorf("got %+v", r.StreamInfo())
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codectest.EqualSamples(t, got, decode(t, 40000, PackITU, want))
+
+	for _, bad := range []pcm_convertor.StreamInfo{
+		{SampleRate: 16000, Format: format.S16, ByteOrder: binary.LittleEndian, Channels: 1},
+		{SampleRate: 8000, Format: format.S16, ByteOrder: binary.LittleEndian, Channels: 2},
+		{SampleRate: 8000, Format: format.F32, ByteOrder: binary.LittleEndian, Channels: 1},
+	} {
+		if _, err := NewWriter(&buf, bad, 32000, PackITU); err == nil {
+			t.Errorf("%+v: no error", bad)
+		}
+	}
+	if _, err := NewWriter(&buf, info, 8000, PackITU); err != model.ErrInvalidParameter {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestConvertor(t *testing.T) {
+	// Convertor pads the last block of 8 samples with silence.
+	pcm := speech(1603)
+	padded := append(append([]int16(nil), pcm...), make([]int16, 5)...)
+	for i, f := range []format.PcmFormat{
+		format.G726R16, format.G726R24, format.G726R32, format.G726R40,
+		format.G726R16AAL2, format.G726R24AAL2, format.G726R32AAL2, format.G726R40AAL2,
+	} {
+		bitRate, packing := bitRates[i%4], Packing(i/4)
+		codes := encode(t, bitRate, packing, padded)
+		codectest.Convertor(t, f, pcm, codes, decode(t, bitRate, packing, codes))
+	}
+}
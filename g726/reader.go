@@ -0,0 +1,61 @@
+package g726
+
+import (
+	"io"
+
+	"github.com/ZhangJYd/pcm_convertor"
+)
+
+// readSize is the number of bytes decoded per read from the source.
+const readSize = 1024
+
+// Reader decodes a G.726 stream into samples described by Info. Put it in front of a
+// Convertor to turn G.726 into any other format and rate.
+type Reader struct {
+	r       io.Reader
+	dec     *Decoder
+	codes   []byte
+	samples []int16
+	out     []byte
+	err     error
+}
+
+// NewReader returns a Reader that decodes the G.726 stream in r, coded at bitRate and
+// packed by packing.
+func NewReader(r io.Reader, bitRate int, packing Packing) (*Reader, error) {
+	dec, err := NewDecoder(bitRate, packing)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{
+		r:       r,
+		dec:     dec,
+		codes:   make([]byte, readSize),
+		samples: make([]int16, 4*readSize),
+	}, nil
+}
+
+// StreamInfo describes the decoded samples.
+func (gr *Reader) StreamInfo() pcm_convertor.StreamInfo {
+	return Info
+}
+
+// Read reads decoded samples. Padding bits at the end of the stream decode as samples.
+func (gr *Reader) Read(p []byte) (int, error) {
+	for len(gr.out) == 0 {
+		if gr.err != nil {
+			return 0, gr.err
+		}
+		var n int
+		n, gr.err = gr.r.Read(gr.codes)
+		n = gr.dec.Decode(gr.samples, gr.codes[:n])
+		out := gr.out[:0]
+		for _, s := range gr.samples[:n] {
+			out = append(out, byte(s), byte(s>>8))
+		}
+		gr.out = out
+	}
+	n := copy(p, gr.out)
+	gr.out = gr.out[n:]
+	return n, nil
+}
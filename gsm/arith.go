@@ -0,0 +1,99 @@
+package gsm
+
+import "math/bits"
+
+// The basic operations of the recommendation on 16-bit words and 32-bit long words,
+// with its saturation and rounding.
+
+const (
+	minWord = -32768
+	maxWord = 32767
+)
+
+func saturate(v int) int {
+	if v < minWord {
+		return minWord
+	}
+	if v > maxWord {
+		return maxWord
+	}
+	return v
+}
+
+// s16 truncates v to a word.
+func s16(v int) int {
+	return int(int16(v))
+}
+
+func add(a, b int) int {
+	return saturate(a + b)
+}
+
+func sub(a, b int) int {
+	return saturate(a - b)
+}
+
+func mult(a, b int) int {
+	if a == minWord && b == minWord {
+		return maxWord
+	}
+	return a * b >> 15
+}
+
+// multR is mult with rounding.
+func multR(a, b int) int {
+	if a == minWord && b == minWord {
+		return maxWord
+	}
+	return (a*b + 16384) >> 15
+}
+
+func abs(a int) int {
+	if a == minWord {
+		return maxWord
+	}
+	if a < 0 {
+		return -a
+	}
+	return a
+}
+
+// lAdd adds long words with saturation.
+func lAdd(a, b int) int {
+	v := a + b
+	if v < -1<<31 {
+		return -1 << 31
+	}
+	if v > 1<<31-1 {
+		return 1<<31 - 1
+	}
+	return v
+}
+
+// norm returns the number of left shifts that normalize the long word a.
+func norm(a int) int {
+	if a < 0 {
+		if a <= -1073741824 {
+			return 0
+		}
+		a = ^a
+	}
+	return bits.LeadingZeros32(uint32(a)) - 1
+}
+
+// div divides num by denum, both positive and num <= denum, into a 15-bit fraction.
+func div(num, denum int) int {
+	if num == 0 {
+		return 0
+	}
+	q := 0
+	for k := 0; k < 15; k++ {
+		q <<= 1
+		num <<= 1
+		if num >= denum {
+			num -= denum
+			q++
+		}
+	}
+	return q
+}
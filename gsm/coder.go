@@ -0,0 +1,473 @@
+package gsm
+
+// frameSamples is the number of samples in a frame, 20 ms at 8 kHz.
+const frameSamples = 160
+
+// params are the coded parameters of a frame: the log area ratios of the short-term
+// filter and, for each 40-sample subframe, the lag and gain of the long-term predictor
+// and the grid, maximum and pulses of the regular pulse excitation.
+type params struct {
+	larc  [8]int
+	nc    [4]int
+	bc    [4]int
+	mc    [4]int
+	xmaxc [4]int
+	xmc   [4][13]int
+}
+
+// fields calls visit on every parameter of p with its size in bits, in the order they
+// are packed.
+func (p *params) fields(visit func(v *int, size uint)) {
+	for i := range p.larc {
+		visit(&p.larc[i], larBits[i])
+	}
+	for j := 0; j < 4; j++ {
+		visit(&p.nc[j], 7)
+		visit(&p.bc[j], 2)
+		visit(&p.mc[j], 2)
+		visit(&p.xmaxc[j], 6)
+		for i := range p.xmc[j] {
+			visit(&p.xmc[j][i], 3)
+		}
+	}
+}
+
+var (
+	larBits = [8]uint{6, 6, 5, 5, 4, 4, 3, 3}
+	// larA, larB and larMIC scale, offset and bound the quantized log area ratios, and
+	// larInvA is the inverse of larA.
+	larA    = [8]int{20480, 20480, 20480, 20480, 13964, 15360, 8534, 9036}
+	larB    = [8]int{0, 0, 2048, -2560, 94, -1792, -341, -1144}
+	larMIC  = [8]int{-32, -32, -16, -16, -8, -8, -4, -4}
+	larInvA = [8]int{13107, 13107, 13107, 13107, 19223, 17476, 31454, 29708}
+
+	// dlb are the decision levels and qlb the reconstruction levels of the LTP gain.
+	dlb = [4]int{6554, 16384, 26214, 32767}
+	qlb = [4]int{3277, 11469, 21299, 32767}
+
+	// h is the weighting filter of the RPE, and nrfac and fac the inverse and direct
+	// mantissas of the APCM.
+	h     = [11]int{-134, -374, 0, 2054, 5741, 8192, 5741, 2054, 0, -374, -134}
+	nrfac = [8]int{29128, 26215, 23832, 21846, 20165, 18725, 17476, 16384}
+	fac   = [8]int{18431, 20479, 22527, 24575, 26623, 28671, 30719, 32767}
+)
+
+// state is the state of the encoder or decoder between frames.
+type state struct {
+	// dp holds the reconstructed short-term residual of the last 120 samples, and room
+	// for a frame.
+	dp [280]int
+	// z1, lz2 and mp are the offset compensation and preemphasis filters.
+	z1, lz2, mp int
+	// u and v are the short-term analysis and synthesis filters, and larpp the decoded
+	// log area ratios of this and the last frame, this one at j.
+	u     [8]int
+	v     [9]int
+	larpp [2][8]int
+	j     int
+	// nrp is the last valid LTP lag and msr the deemphasis filter.
+	nrp int
+	msr int
+}
+
+func (s *state) reset() {
+	*s = state{nrp: 40}
+}
+
+// encode analyses a frame of samples into p.
+func (s *state) encode(p *params, in []int16) {
+	var so [frameSamples]int
+	s.preprocess(&so, in)
+	lpcAnalysis(&p.larc, &so)
+	s.shortTerm(&p.larc, so[:], nil)
+
+	// e is the residual of a subframe with five samples of silence on either side for
+	// the weighting filter.
+	var e [50]int
+	for j := 0; j < 4; j++ {
+		d := so[40*j : 40*j+40]
+		hist := s.dp[40*j : 40*j+160]
+		p.nc[j], p.bc[j] = ltpParams(d, hist)
+
+		// Long-term analysis filter: dpp goes where the residual of the subframe will.
+		dpp := hist[120:]
+		for k := range d {
+			dpp[k] = multR(qlb[p.bc[j]], hist[120+k-p.nc[j]])
+			e[5+k] = sub(d[k], dpp[k])
+		}
+
+		p.mc[j], p.xmaxc[j] = rpeEncode(&p.xmc[j], &e)
+		for k := range dpp {
+			dpp[k] = add(e[5+k], dpp[k])
+		}
+	}
+	copy(s.dp[:120], s.dp[160:])
+}
+
+// decode synthesizes a frame of samples from p.
+func (s *state) decode(out []int16, p *params) {
+	var wt [frameSamples]int
+	for j := 0; j < 4; j++ {
+		var erp [40]int
+		rpeDecode(&erp, p.mc[j], p.xmaxc[j], &p.xmc[j])
+
+		// Long-term synthesis filter; invalid lags repeat the last one.
+		nr := p.nc[j]
+		if nr < 40 || nr > 120 {
+			nr = s.nrp
+		}
+		s.nrp = nr
+		drp := s.dp[120:160]
+		for k := range drp {
+			drp[k] = add(erp[k], multR(qlb[p.bc[j]], s.dp[120+k-nr]))
+		}
+		copy(wt[40*j:], drp)
+		copy(s.dp[:120], s.dp[40:160])
+	}
+
+	var sr [frameSamples]int
+	s.shortTerm(&p.larc, wt[:], sr[:])
+
+	// Deemphasis, truncation to 13 bits and upscaling.
+	for k, v := range sr {
+		s.msr = add(v, multR(s.msr, 28180))
+		out[k] = int16(add(s.msr, s.msr) & 0xfff8)
+	}
+}
+
+// preprocess downscales the input, removes its offset and preemphasizes it.
+func (s *state) preprocess(so *[frameSamples]int, in []int16) {
+	for k := range so {
+		x := int(in[k]) >> 3 << 2
+		s1 := x - s.z1
+		s.z1 = x
+
+		msp := s16(s.lz2 >> 15)
+		lsp := s16(s.lz2 - msp<<15)
+		ls2 := s1<<15 + multR(lsp, 32735)
+		s.lz2 = lAdd(msp*32735, ls2)
+		temp := lAdd(s.lz2, 16384)
+
+		msp = multR(s.mp, -28180)
+		s.mp = s16(temp >> 15)
+		so[k] = add(s.mp, msp)
+	}
+}
+
+// lpcAnalysis computes the quantized log area ratios of a frame. It scales the samples
+// down and back up, rounding them as the recommendation does.
+func lpcAnalysis(larc *[8]int, so *[frameSamples]int) {
+	// Autocorrelation of the dynamically scaled samples.
+	smax := 0
+	for _, v := range so {
+		if a := abs(v); a > smax {
+			smax = a
+		}
+	}
+	scale := 0
+	if smax != 0 {
+		scale = 4 - norm(smax<<16)
+	}
+	if scale > 0 {
+		for k := range so {
+			so[k] = multR(so[k], 16384>>uint(scale-1))
+		}
+	}
+	var acf [9]int
+	for k := range acf {
+		sum := 0
+		for i := k; i < frameSamples; i++ {
+			sum += so[i] * so[i-k]
+		}
+		acf[k] = sum << 1
+	}
+	if scale > 0 {
+		for k := range so {
+			so[k] = s16(so[k] << uint(scale))
+		}
+	}
+
+	// Reflection coefficients by the Schur recursion.
+	var r [8]int
+	if acf[0] != 0 {
+		shift := uint(norm(acf[0]))
+		var p, k [9]int
+		for i := range acf {
+			p[i] = s16(acf[i] << shift >> 16)
+			k[i] = p[i]
+		}
+		for n := 0; n < 8; n++ {
+			temp := abs(p[1])
+			if p[0] < temp {
+				break
+			}
+			r[n] = div(temp, p[0])
+			if p[1] > 0 {
+				r[n] = -r[n]
+			}
+			if n == 7 {
+				break
+			}
+			p[0] = add(p[0], multR(p[1], r[n]))
+			for m := 1; m < 8-n; m++ {
+				p[m] = add(p[m+1], multR(k[m], r[n]))
+				k[m] = add(k[m], multR(p[m+1], r[n]))
+			}
+		}
+	}
+
+	// Transformation to log area ratios, then quantization.
+	for i, v := range r {
+		temp := abs(v)
+		switch {
+		case temp < 22118:
+			temp >>= 1
+		case temp < 31130:
+			temp -= 11059
+		default:
+			temp = (temp - 26112) << 2
+		}
+		if v < 0 {
+			temp = -temp
+		}
+
+		temp = add(mult(larA[i], temp), larB[i])
+		temp = add(temp, 256) >> 9
+		switch mac := -larMIC[i] - 1; {
+		case temp > mac:
+			larc[i] = mac - larMIC[i]
+		case temp < larMIC[i]:
+			larc[i] = 0
+		default:
+			larc[i] = temp - larMIC[i]
+		}
+	}
+}
+
+// shortTerm decodes larc and runs the samples of a frame through the short-term
+// analysis filter in place, or, given out, through the synthesis filter into out. The
+// coefficients are interpolated from those of the last frame over the first 40 samples.
+func (s *state) shortTerm(larc *[8]int, in, out []int) {
+	prev := &s.larpp[s.j^1]
+	cur := &s.larpp[s.j]
+	s.j ^= 1
+	for i, c := range larc {
+		temp := add(c, larMIC[i]) << 10
+		temp = sub(temp, larB[i]<<1)
+		temp = multR(larInvA[i], temp)
+		cur[i] = add(temp, temp)
+	}
+
+	for _, seg := range [...]struct{ start, end int }{{0, 13}, {13, 27}, {27, 40}, {40, frameSamples}} {
+		var rp [8]int
+		for i := range rp {
+			switch seg.start {
+			case 0:
+				rp[i] = add(add(prev[i]>>2, cur[i]>>2), prev[i]>>1)
+			case 13:
+				rp[i] = add(prev[i]>>1, cur[i]>>1)
+			case 27:
+				rp[i] = add(add(prev[i]>>2, cur[i]>>2), cur[i]>>1)
+			default:
+				rp[i] = cur[i]
+			}
+			rp[i] = larToRp(rp[i])
+		}
+		if out == nil {
+			s.analysis(&rp, in[seg.start:seg.end])
+		} else {
+			s.synthesis(&rp, in[seg.start:seg.end], out[seg.start:seg.end])
+		}
+	}
+}
+
+// larToRp converts an interpolated log area ratio to a reflection coefficient.
+func larToRp(lar int) int {
+	temp := abs(lar)
+	switch {
+	case temp < 11059:
+		temp <<= 1
+	case temp < 20070:
+		temp += 11059
+	default:
+		temp = add(temp>>2, 26112)
+	}
+	if lar < 0 {
+		return -temp
+	}
+	return temp
+}
+
+func (s *state) analysis(rp *[8]int, d []int) {
+	for k, di := range d {
+		sav := di
+		for i, r := range rp {
+			ui := s.u[i]
+			s.u[i] = sav
+			sav = add(ui, multR(r, di))
+			di = add(di, multR(r, ui))
+		}
+		d[k] = di
+	}
+}
+
+func (s *state) synthesis(rp *[8]int, wt, sr []int) {
+	for k, sri := range wt {
+		for i := 7; i >= 0; i-- {
+			sri = sub(sri, multR(rp[i], s.v[i]))
+			s.v[i+1] = add(s.v[i], multR(rp[i], sri))
+		}
+		s.v[0] = sri
+		sr[k] = sri
+	}
+}
+
+// ltpParams finds the lag and coded gain of the long-term predictor of a subframe d,
+// given the reconstructed residual hist of the 120 samples before it.
+func ltpParams(d, hist []int) (nc, bc int) {
+	dmax := 0
+	for _, v := range d {
+		if a := abs(v); a > dmax {
+			dmax = a
+		}
+	}
+	temp := 0
+	if dmax != 0 {
+		temp = norm(dmax << 16)
+	}
+	scal := uint(0)
+	if temp <= 6 {
+		scal = uint(6 - temp)
+	}
+	var wt [40]int
+	for k, v := range d {
+		wt[k] = v >> scal
+	}
+
+	// The lag of the largest cross-correlation.
+	lmax := 0
+	nc = 40
+	for lambda := 40; lambda <= 120; lambda++ {
+		sum := 0
+		for k, w := range wt {
+			sum += w * hist[120+k-lambda]
+		}
+		if sum > lmax {
+			nc, lmax = lambda, sum
+		}
+	}
+	lmax = lmax << 1 >> (6 - scal)
+
+	power := 0
+	for k := range wt {
+		v := hist[120+k-nc] >> 3
+		power += v * v
+	}
+	power <<= 1
+
+	if lmax <= 0 {
+		return nc, 0
+	}
+	if lmax >= power {
+		return nc, 3
+	}
+	shift := uint(norm(power))
+	r := s16(lmax << shift >> 16)
+	sp := s16(power << shift >> 16)
+	for bc = 0; bc < 3; bc++ {
+		if r <= mult(sp, dlb[bc]) {
+			break
+		}
+	}
+	return nc, bc
+}
+
+// rpeEncode codes the residual of a subframe, in e[5:45], as regular pulses, and
+// replaces it by its quantized version.
+func rpeEncode(xmc *[13]int, e *[50]int) (mc, xmaxc int) {
+	// Weighting filter.
+	var x [40]int
+	for k := range x {
+		sum := 4096
+		for i, c := range h {
+			sum += e[k+i] * c
+		}
+		x[k] = saturate(sum >> 13)
+	}
+
+	// The grid of every third sample with the most energy.
+	var em int
+	for m := 0; m < 4; m++ {
+		sum := 0
+		for i := 0; i < 13; i++ {
+			v := x[m+3*i] >> 2
+			sum += v * v
+		}
+		if sum <<= 1; sum > em {
+			mc, em = m, sum
+		}
+	}
+	var xm [13]int
+	xmax := 0
+	for i := range xm {
+		xm[i] = x[mc+3*i]
+		if a := abs(xm[i]); a > xmax {
+			xmax = a
+		}
+	}
+
+	// APCM quantization: a block maximum, then each pulse relative to it.
+	exp := 0
+	temp := xmax >> 9
+	small := false
+	for i := 0; i <= 5; i++ {
+		small = small || temp <= 0
+		temp >>= 1
+		if !small {
+			exp++
+		}
+	}
+	xmaxc = add(xmax>>uint(exp+5), exp<<3)
+	exp, mant := expMant(xmaxc)
+	for i, v := range xm {
+		v = s16(v << uint(6-exp))
+		xmc[i] = mult(v, nrfac[mant])>>12 + 4
+	}
+
+	var erp [40]int
+	rpeDecode(&erp, mc, xmaxc, xmc)
+	copy(e[5:45], erp[:])
+	return mc, xmaxc
+}
+
+// rpeDecode places the decoded pulses of a subframe in erp.
+func rpeDecode(erp *[40]int, mc, xmaxc int, xmc *[13]int) {
+	exp, mant := expMant(xmaxc)
+	temp1 := fac[mant]
+	temp2 := uint(sub(6, exp))
+	temp3 := 0
+	if temp2 > 0 {
+		temp3 = 1 << (temp2 - 1)
+	}
+	*erp = [40]int{}
+	for i, c := range xmc {
+		temp := multR(temp1, (c<<1-7)<<12)
+		erp[mc+3*i] = add(temp, temp3) >> temp2
+	}
+}
+
+// expMant splits the decoded block maximum xmaxc into an exponent and a mantissa.
+func expMant(xmaxc int) (exp, mant int) {
+	if xmaxc > 15 {
+		exp = xmaxc>>3 - 1
+	}
+	mant = xmaxc - exp<<3
+	if mant == 0 {
+		return -4, 7
+	}
+	for mant <= 7 {
+		mant = mant<<1 | 1
+		exp--
+	}
+	return exp, mant - 8
+}
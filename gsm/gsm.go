@@ -0,0 +1,223 @@
+// Package gsm encodes and decodes GSM 06.10 full rate speech, which codes 160 samples at
+// 8 kHz, 20 ms, as a frame of 260 bits. The arithmetic follows the fixed-point
+// operations of the recommendation, as libgsm does; apart from the frame of silence it
+// has not been checked against the ETSI test sequences or the output of libgsm.
+//
+// Importing the package makes format.GSM and format.GSMWAV49 usable in a Convertor.
+package gsm
+
+import (
+	"encoding/binary"
+
+	"github.com/ZhangJYd/pcm_convertor"
+	"github.com/ZhangJYd/pcm_convertor/format"
+	"github.com/ZhangJYd/pcm_convertor/model"
+)
+
+// Info describes the samples GSM 06.10 carries: 8 kHz mono S16. Reader produces them in
+// little-endian order.
+var Info = pcm_convertor.StreamInfo{
+	SampleRate: 8000,
+	Format:     format.S16,
+	ByteOrder:  binary.LittleEndian,
+	Channels:   1,
+}
+
+// Framing is the way frames are laid out in bytes.
+type Framing int
+
+const (
+	// Standard frames take 33 bytes each, the 260 bits of a frame after a 4-bit signature,
+	// as libgsm and RTP (RFC 3551) store them.
+	Standard Framing = iota
+	// WAV49 packs two frames into 65 bytes without signatures, as WAV files with the
+	// WAVE_FORMAT_GSM610 tag do.
+	WAV49
+)
+
+func init() {
+	register(format.GSM, Standard)
+	register(format.GSMWAV49, WAV49)
+}
+
+// register makes f the format of GSM 06.10 laid out by framing, a block at a time.
+func register(f format.PcmFormat, framing Framing) {
+	format.RegisterCodec(f, format.Codec{
+		SampleRate:   Info.SampleRate,
+		BlockSamples: framing.Samples(),
+		BlockSize:    framing.Size(),
+		NewEncoder:   func() format.BlockEncoder { return NewEncoder(framing) },
+		NewDecoder:   func() format.BlockDecoder { return NewDecoder(framing) },
+	})
+}
+
+// magic is the signature in the first 4 bits of a Standard frame.
+const magic = 0xd
+
+// Samples returns the number of samples in a block of f: one frame, or two for WAV49.
+func (f Framing) Samples() int {
+	if f == WAV49 {
+		return 2 * frameSamples
+	}
+	return frameSamples
+}
+
+// Size returns the number of bytes in a block of f.
+func (f Framing) Size() int {
+	if f == WAV49 {
+		return 65
+	}
+	return 33
+}
+
+// Encoder encodes 8 kHz samples as GSM 06.10 a block at a time. It keeps the state of
+// the codec between blocks, so a stream is encoded by one Encoder, in order.
+type Encoder struct {
+	state
+	framing Framing
+}
+
+// NewEncoder returns an Encoder at the start of a stream that lays out frames by
+// framing.
+func NewEncoder(framing Framing) *Encoder {
+	e := &Encoder{framing: framing}
+	e.Reset()
+	return e
+}
+
+// Reset returns e to the start of a stream.
+func (e *Encoder) Reset() {
+	e.reset()
+}
+
+// Encode encodes a block of framing.Samples() samples from src into framing.Size()
+// bytes of dst.
+func (e *Encoder) Encode(dst []byte, src []int16) {
+	var p params
+	if e.framing != WAV49 {
+		e.encode(&p, src[:frameSamples])
+		w := bitWriter{buf: dst[:0]}
+		w.write(magic, 4)
+		p.fields(func(v *int, size uint) {
+			w.write(*v, size)
+		})
+		return
+	}
+	w := lsbWriter{buf: dst[:0]}
+	for i := 0; i < 2; i++ {
+		e.encode(&p, src[i*frameSamples:(i+1)*frameSamples])
+		p.fields(func(v *int, size uint) {
+			w.write(*v, size)
+		})
+	}
+}
+
+// Decoder decodes GSM 06.10 into 8 kHz samples a block at a time. It keeps the state of
+// the codec between blocks, so a stream is decoded by one Decoder, in order.
+type Decoder struct {
+	state
+	framing Framing
+}
+
+// NewDecoder returns a Decoder at the start of a stream whose frames are laid out by
+// framing.
+func NewDecoder(framing Framing) *Decoder {
+	d := &Decoder{framing: framing}
+	d.Reset()
+	return d
+}
+
+// Reset returns d to the start of a stream.
+func (d *Decoder) Reset() {
+	d.reset()
+}
+
+// Decode decodes a block of framing.Size() bytes from src into framing.Samples()
+// samples of dst. It returns model.ErrInvalidHeader, leaving dst and the state alone, if a
+// Standard frame lacks its signature.
+func (d *Decoder) Decode(dst []int16, src []byte) error {
+	var p params
+	if d.framing != WAV49 {
+		r := bitReader{buf: src[:33]}
+		if r.read(4) != magic {
+			return model.ErrInvalidHeader
+		}
+		p.fields(func(v *int, size uint) {
+			*v = r.read(size)
+		})
+		d.decode(dst[:frameSamples], &p)
+		return nil
+	}
+	r := lsbReader{buf: src[:65]}
+	for i := 0; i < 2; i++ {
+		p.fields(func(v *int, size uint) {
+			*v = r.read(size)
+		})
+		d.decode(dst[i*frameSamples:(i+1)*frameSamples], &p)
+	}
+	return nil
+}
+
+// bitWriter packs values from the most significant bit of each byte down.
+type bitWriter struct {
+	buf []byte
+	acc uint
+	n   uint
+}
+
+func (w *bitWriter) write(v int, size uint) {
+	w.acc = w.acc<<size | uint(v)&(1<<size-1)
+	for w.n += size; w.n >= 8; w.n -= 8 {
+		w.buf = append(w.buf, byte(w.acc>>(w.n-8)))
+	}
+}
+
+type bitReader struct {
+	buf []byte
+	acc uint
+	n   uint
+}
+
+func (r *bitReader) read(size uint) int {
+	for r.n < size {
+		r.acc = r.acc<<8 | uint(r.buf[0])
+		r.buf = r.buf[1:]
+		r.n += 8
+	}
+	r.n -= size
+	return int(r.acc >> r.n & (1<<size - 1))
+}
+
+// lsbWriter packs values from the least significant bit of each byte up. The last byte
+// is written once complete.
+type lsbWriter struct {
+	buf []byte
+	acc uint
+	n   uint
+}
+
+func (w *lsbWriter) write(v int, size uint) {
+	w.acc |= uint(v) & (1<<size - 1) << w.n
+	for w.n += size; w.n >= 8; w.n -= 8 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc >>= 8
+	}
+}
+
+type lsbReader struct {
+	buf []byte
+	acc uint
+	n   uint
+}
+
+func (r *lsbReader) read(size uint) int {
+	for r.n < size {
+		r.acc |= uint(r.buf[0]) << r.n
+		r.buf = r.buf[1:]
+		r.n += 8
+	}
+	v := int(r.acc & (1<<size - 1))
+	r.acc >>= size
+	r.n -= size
+	return v
+}
@@ -0,0 +1,183 @@
+package gsm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/ZhangJYd/pcm_convertor"
+	"github.com/ZhangJYd/pcm_convertor/format"
+	"github.com/ZhangJYd/pcm_convertor/internal/codectest"
+	"github.com/ZhangJYd/pcm_convertor/model"
+	"github.com/ZhangJYd/pcm_convertor/resample"
+)
+
+// speech returns n samples of two tones with a changing level.
+func speech(n int) []int16 {
+	return codectest.Speech(n, 8000, 1700)
+}
+
+// pad pads pcm with silence to whole blocks of framing.
+func pad(pcm []int16, framing Framing) []int16 {
+	blocks := (len(pcm) + framing.Samples() - 1) / framing.Samples()
+	return append(append([]int16(nil), pcm...), make([]int16, blocks*framing.Samples()-len(pcm))...)
+}
+
+func encode(framing Framing, pcm []int16) []byte {
+	enc := NewEncoder(framing)
+	var out []byte
+	block := make([]byte, framing.Size())
+	for i := 0; i+framing.Samples() <= len(pcm); i += framing.Samples() {
+		enc.Encode(block, pcm[i:])
+		out = append(out, block...)
+	}
+	return out
+}
+
+func decode(t *testing.T, framing Framing, data []byte) []int16 {
+	dec := NewDecoder(framing)
+	var out []int16
+	samples := make([]int16, framing.Samples())
+	for i := 0; i < len(data); i += framing.Size() {
+		if err := dec.Decode(samples, data[i:]); err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, samples...)
+	}
+	return out
+}
+
+func TestSilence(t *testing.T) {
+	// The frame libgsm and others code silence as.
+	want := []byte{
+		0xd8, 0x20, 0xa2, 0xe1, 0x5a,
+		0x50, 0x00, 0x49, 0x24, 0x92, 0x49, 0x24,
+		0x50, 0x00, 0x49, 0x24, 0x92, 0x49, 0x24,
+		0x50, 0x00, 0x49, 0x24, 0x92, 0x49, 0x24,
+		0x50, 0x00, 0x49, 0x24, 0x92, 0x49, 0x24,
+	}
+	got := encode(Standard, make([]int16, 3*frameSamples))
+	for i := 0; i < len(got); i += len(want) {
+		if !bytes.Equal(got[i:i+len(want)], want) {
+			t.Fatalf("frame %d: got % x", i/len(want), got[i:i+len(want)])
+		}
+	}
+	for i, s := range decode(t, Standard, got) {
+		if s < -64 || s > 64 {
+			t.Fatalf("sample %d: got %d", i, s)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	pcm := speech(8000)
+	for _, framing := range []Framing{Standard, WAV49} {
+		data := encode(framing, pcm)
+		if want := len(pcm) / framing.Samples() * framing.Size(); len(data) != want {
+			t.Fatalf("%d: got %d bytes, want %d", framing, len(data), want)
+		}
+		out := decode(t, framing, data)
+		if snr := codectest.SNR(pcm[800:], out[800:], 0); snr < 15 {
+			t.Errorf("%d: SNR %.1f dB", framing, snr)
+		}
+	}
+
+	bad := encode(Standard, pcm[:frameSamples])
+	bad[0] &^= 0xf0
+	if err := NewDecoder(Standard).Decode(make([]int16, frameSamples), bad); err != model.ErrInvalidHeader {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestWAV49(t *testing.T) {
+	// A WAV49 block holds the parameters of two frames from the least significant bit
+	// of each byte up, without signatures.
+	pcm := speech(4 * frameSamples)
+	standard := encode(Standard, pcm)
+	wav49 := encode(WAV49, pcm)
+	for b := 0; b < 2; b++ {
+		r49 := lsbReader{buf: wav49[65*b : 65*b+65]}
+		for f := 2 * b; f < 2*b+2; f++ {
+			r := bitReader{buf: standard[33*f : 33*f+33]}
+			r.read(4)
+			var p params
+			n := 0
+			p.fields(func(_ *int, size uint) {
+				if got, want := r49.read(size), r.read(size); got != want {
+					t.Fatalf("frame %d, field %d: got %d, want %d", f, n, got, want)
+				}
+				n++
+			})
+		}
+	}
+	// LARc[0] is in the low 6 bits of the first byte, under the low 2 bits of LARc[1].
+	larc0 := standard[0]&0xf<<2 | standard[1]>>6
+	larc1 := standard[1] & 0x3f
+	if wav49[0] != larc0|larc1<<6 {
+		t.Errorf("got %#x for LARc %d and %d", wav49[0], larc0, larc1)
+	}
+}
+
+func TestReaderWriter(t *testing.T) {
+	pcm := speech(2000)
+	info := pcm_convertor.StreamInfo{SampleRate: 8000, Format: format.S16, ByteOrder: binary.BigEndian, Channels: 1}
+	for _, framing := range []Framing{Standard, WAV49} {
+		var buf bytes.Buffer
+		w, err := NewWriter(&buf, info, framing)
+		if err != nil {
+			t.Fatal(err)
+		}
+		codectest.Write(t, w, codectest.Bytes(pcm, binary.BigEndian))
+		// The last block is padded with silence.
+		want := encode(framing, pad(pcm, framing))
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Fatalf("%d: Writer output differs from Encoder", framing)
+		}
+
+		r := NewReader(&buf, framing)
+		if r.StreamInfo() != Info {
+			t.Errorf("got %+v", r.StreamInfo())
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		codectest.EqualSamples(t, got, decode(t, framing, want))
+
+		r = NewReader(bytes.NewReader(want[:len(want)-1]), framing)
+		if _, err := ioutil.ReadAll(r); err != io.ErrUnexpectedEOF {
+			t.Errorf("truncated stream: got %v", err)
+		}
+	}
+
+	for _, bad := range []pcm_convertor.StreamInfo{
+		{SampleRate: 16000, Format: format.S16, ByteOrder: binary.LittleEndian, Channels: 1},
+		{SampleRate: 8000, Format: format.S16, ByteOrder: binary.LittleEndian, Channels: 2},
+		{SampleRate: 8000, Format: format.F32, ByteOrder: binary.LittleEndian, Channels: 1},
+	} {
+		if _, err := NewWriter(ioutil.Discard, bad, Standard); err == nil {
+			t.Errorf("%+v: no error", bad)
+		}
+	}
+}
+
+func TestConvertor(t *testing.T) {
+	// Convertor pads the last block with silence.
+	pcm := speech(4*frameSamples + 17)
+	for f, framing := range map[format.PcmFormat]Framing{format.GSM: Standard, format.GSMWAV49: WAV49} {
+		codes := encode(framing, pad(pcm, framing))
+		codectest.Convertor(t, f, pcm, codes, decode(t, framing, codes))
+	}
+
+	// A Standard frame without its signature fails the conversion.
+	coded := pcm_convertor.StreamInfo{SampleRate: 8000, Format: format.GSM, Channels: 1}
+	d, err := pcm_convertor.NewConvertor(&coded, &Info, resample.HighQ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Process(make([]byte, Standard.Size())); err != model.ErrInvalidHeader {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+package gsm
+
+import (
+	"io"
+
+	"github.com/ZhangJYd/pcm_convertor"
+)
+
+// Reader decodes a GSM 06.10 stream into samples described by Info. Put it in front of a
+// Convertor to turn GSM into any other format and rate.
+type Reader struct {
+	r       io.Reader
+	dec     *Decoder
+	block   []byte
+	samples []int16
+	out     []byte
+	err     error
+}
+
+// NewReader returns a Reader that decodes the GSM 06.10 stream in r, laid out by framing.
+func NewReader(r io.Reader, framing Framing) *Reader {
+	return &Reader{
+		r:       r,
+		dec:     NewDecoder(framing),
+		block:   make([]byte, framing.Size()),
+		samples: make([]int16, framing.Samples()),
+	}
+}
+
+// StreamInfo describes the decoded samples.
+func (gr *Reader) StreamInfo() pcm_convertor.StreamInfo {
+	return Info
+}
+
+// Read reads decoded samples. A partial block at the end of the stream is reported as
+// io.ErrUnexpectedEOF, and a frame without its signature as model.ErrInvalidHeader.
+func (gr *Reader) Read(p []byte) (int, error) {
+	for len(gr.out) == 0 {
+		if gr.err != nil {
+			return 0, gr.err
+		}
+		if _, gr.err = io.ReadFull(gr.r, gr.block); gr.err != nil {
+			continue
+		}
+		if gr.err = gr.dec.Decode(gr.samples, gr.block); gr.err != nil {
+			continue
+		}
+		out := gr.out[:0]
+		for _, s := range gr.samples {
+			out = append(out, byte(s), byte(s>>8))
+		}
+		gr.out = out
+	}
+	n := copy(p, gr.out)
+	gr.out = gr.out[n:]
+	return n, nil
+}
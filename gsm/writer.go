@@ -0,0 +1,89 @@
+package gsm
+
+import (
+	"io"
+
+	"github.com/ZhangJYd/pcm_convertor"
+	"github.com/ZhangJYd/pcm_convertor/format"
+	"github.com/ZhangJYd/pcm_convertor/model"
+)
+
+// Writer encodes samples described by Info, in either byte order, as a GSM 06.10 stream.
+// Put it after a Convertor whose output is 8 kHz mono S16.
+type Writer struct {
+	w       io.Writer
+	info    pcm_convertor.StreamInfo
+	enc     *Encoder
+	framing Framing
+	// pending holds the input of an incomplete block.
+	pending []byte
+	samples []int16
+	block   []byte
+	closed  bool
+}
+
+// NewWriter returns a Writer that encodes samples described by info to w, laying out
+// frames by framing.
+func NewWriter(w io.Writer, info pcm_convertor.StreamInfo, framing Framing) (*Writer, error) {
+	if info.SampleRate != Info.SampleRate {
+		return nil, model.ErrInvalidSampleRate
+	}
+	if info.Channels != 1 {
+		return nil, model.ErrInvalidChannels
+	}
+	if info.Format != format.S16 || info.ByteOrder == nil {
+		return nil, model.ErrInvalidFormat
+	}
+	return &Writer{
+		w:       w,
+		info:    info,
+		enc:     NewEncoder(framing),
+		framing: framing,
+		samples: make([]int16, framing.Samples()),
+		block:   make([]byte, framing.Size()),
+	}, nil
+}
+
+// Write encodes samples. Samples that do not fill a block are encoded with the next
+// write.
+func (gw *Writer) Write(p []byte) (int, error) {
+	if gw.closed {
+		return 0, model.ErrClosed
+	}
+	size := 2 * gw.framing.Samples()
+	data := p
+	if len(gw.pending) > 0 {
+		data = append(gw.pending, p...)
+	}
+	for ; len(data) >= size; data = data[size:] {
+		if err := gw.encode(data[:size]); err != nil {
+			return 0, err
+		}
+	}
+	gw.pending = append(gw.pending[:0], data...)
+	return len(p), nil
+}
+
+func (gw *Writer) encode(data []byte) error {
+	for i := range gw.samples {
+		gw.samples[i] = int16(gw.info.ByteOrder.Uint16(data[2*i:]))
+	}
+	gw.enc.Encode(gw.block, gw.samples)
+	_, err := gw.w.Write(gw.block)
+	return err
+}
+
+// Close encodes the samples of an incomplete block padded with silence. A trailing
+// partial sample is dropped. It does not close the destination.
+func (gw *Writer) Close() error {
+	if gw.closed {
+		return model.ErrClosed
+	}
+	gw.closed = true
+	if len(gw.pending) < 2 {
+		return nil
+	}
+	data := make([]byte, 2*gw.framing.Samples())
+	copy(data, gw.pending[:len(gw.pending)&^1])
+	return gw.encode(data)
+}
@@ -0,0 +1,153 @@
+// Package codectest holds what the tests of the codec packages share: a test signal, a
+// measure of the coding noise, and checks that the Writer, Reader and Convertor format
+// of a codec give what its Encoder and Decoder give.
+package codectest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"testing"
+
+	"github.com/ZhangJYd/pcm_convertor"
+	"github.com/ZhangJYd/pcm_convertor/format"
+	"github.com/ZhangJYd/pcm_convertor/model"
+	"github.com/ZhangJYd/pcm_convertor/resample"
+)
+
+// Speech returns n samples at rate of a 440 Hz tone and a weaker one at high Hz, with a
+// level that changes three times a second.
+func Speech(n, rate int, high float64) []int16 {
+	pcm := make([]int16, n)
+	for i := range pcm {
+		x := float64(i) / float64(rate)
+		level := 0.5 + 0.4*math.Sin(2*math.Pi*3*x)
+		pcm[i] = int16(12000 * level * (math.Sin(2*math.Pi*440*x) + 0.3*math.Sin(2*math.Pi*high*x)))
+	}
+	return pcm
+}
+
+// SNR returns the ratio of want to the difference of got from it in dB, where got lags
+// want by delay samples.
+func SNR(want, got []int16, delay int) float64 {
+	var signal, noise float64
+	for i := 0; i+delay < len(got) && i < len(want); i++ {
+		d := float64(got[i+delay]) - float64(want[i])
+		signal += float64(want[i]) * float64(want[i])
+		noise += d * d
+	}
+	return 10 * math.Log10(signal/noise)
+}
+
+// Bytes lays out pcm in order.
+func Bytes(pcm []int16, order binary.ByteOrder) []byte {
+	data := make([]byte, 2*len(pcm))
+	for i, s := range pcm {
+		order.PutUint16(data[2*i:], uint16(s))
+	}
+	return data
+}
+
+// Feed passes data to fn in chunks of size bytes and joins what it returns.
+func Feed(t *testing.T, data []byte, size int, fn func([]byte) ([]byte, error)) []byte {
+	t.Helper()
+	var out []byte
+	for i := 0; i < len(data); i += size {
+		end := i + size
+		if end > len(data) {
+			end = len(data)
+		}
+		got, err := fn(data[i:end])
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, got...)
+	}
+	return out
+}
+
+// EqualSamples fails t unless data holds the little-endian samples of want.
+func EqualSamples(t *testing.T, data []byte, want []int16) {
+	t.Helper()
+	if len(data) != 2*len(want) {
+		t.Fatalf("got %d bytes, want %d", len(data), 2*len(want))
+	}
+	for i, s := range want {
+		if int16(binary.LittleEndian.Uint16(data[2*i:])) != s {
+			t.Fatalf("sample %d differs", i)
+		}
+	}
+}
+
+// Write writes data to w in odd chunks and closes it, checking that a second Close
+// reports model.ErrClosed.
+func Write(t *testing.T, w io.WriteCloser, data []byte) {
+	t.Helper()
+	Feed(t, data, 333, func(p []byte) ([]byte, error) {
+		_, err := w.Write(p)
+		return nil, err
+	})
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != model.ErrClosed {
+		t.Errorf("second Close: got %v", err)
+	}
+}
+
+// Convertor checks that a Convertor encodes the big-endian samples of pcm into f as
+// codes, and decodes codes into decoded. Both are fed in chunks that split blocks.
+func Convertor(t *testing.T, f format.PcmFormat, pcm []int16, codes []byte, decoded []int16) {
+	t.Helper()
+	c, ok := format.CodecOf(f)
+	if !ok {
+		t.Fatalf("%s is not registered", f.String())
+	}
+	in := pcm_convertor.StreamInfo{SampleRate: c.SampleRate, Format: format.S16, ByteOrder: binary.BigEndian, Channels: 1}
+	coded := pcm_convertor.StreamInfo{SampleRate: c.SampleRate, Format: f, Channels: 1}
+	out := pcm_convertor.StreamInfo{SampleRate: c.SampleRate, Format: format.S16, ByteOrder: binary.LittleEndian, Channels: 1}
+
+	enc, err := pcm_convertor.NewConvertor(&in, &coded, resample.HighQ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := Feed(t, Bytes(pcm, binary.BigEndian), 111, enc.Process)
+	tail, err := enc.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got = append(got, tail...); !bytes.Equal(got, codes) {
+		t.Fatalf("%s: Convertor output differs from Encoder", f.String())
+	}
+	if n := enc.ExpectedOutputFrames(int64(len(pcm))); n*int64(c.BlockSize) != int64(len(codes)) {
+		t.Errorf("%s: expected %d blocks, got %d", f.String(), n, len(codes)/c.BlockSize)
+	}
+	if _, err := enc.Snapshot(); err != model.ErrSnapshotUnsupported {
+		t.Errorf("%s: Snapshot: got %v", f.String(), err)
+	}
+
+	dec, err := pcm_convertor.NewConvertor(&coded, &out, resample.HighQ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan := dec.Plan(); len(plan) != 1 || plan[0].Name != "decode "+f.String() {
+		t.Errorf("%s: got plan %+v", f.String(), plan)
+	}
+	EqualSamples(t, Feed(t, codes, 7, dec.Process), decoded)
+	if n := dec.ExpectedOutputFrames(int64(len(codes) / c.BlockSize)); n != int64(len(decoded)) {
+		t.Errorf("%s: expected %d frames, got %d", f.String(), n, len(decoded))
+	}
+
+	for _, bad := range []struct {
+		info pcm_convertor.StreamInfo
+		err  error
+	}{
+		{pcm_convertor.StreamInfo{SampleRate: 2 * c.SampleRate, Format: f, Channels: 1}, model.ErrInvalidSampleRate},
+		{pcm_convertor.StreamInfo{SampleRate: c.SampleRate, Format: f, Channels: 2}, model.ErrInvalidChannels},
+	} {
+		if _, err := pcm_convertor.NewConvertor(&bad.info, &out, resample.HighQ); err != bad.err {
+			t.Errorf("%+v: got %v, want %v", bad.info, err, bad.err)
+		}
+	}
+}
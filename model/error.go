@@ -3,12 +3,19 @@ package model
 import "errors"
 
 var (
-	ErrInvalidFormat     = errors.New("invalid format")
-	ErrInvalidByteOrder  = errors.New("invalid byte order")
-	ErrInvalidSampleRate = errors.New("invalid sample rate")
-	ErrInvalidChannels   = errors.New("invalid channels")
-	ErrFrameSizeError    = errors.New("frame size model")
-	ErrPcmLenError       = errors.New("pcm len model")
-	ErrInvalidParameter  = errors.New("invalid parameter")
-	ErrChannelsConvert   = errors.New("only support multiple channels to mono or mono to multiple channels")
+	ErrInvalidFormat       = errors.New("invalid format")
+	ErrInvalidByteOrder    = errors.New("invalid byte order")
+	ErrInvalidSampleRate   = errors.New("invalid sample rate")
+	ErrInvalidChannels     = errors.New("invalid channels")
+	ErrFrameSizeError      = errors.New("frame size model")
+	ErrPcmLenError         = errors.New("pcm len model")
+	ErrInvalidParameter    = errors.New("invalid parameter")
+	ErrChannelsConvert     = errors.New("only support multiple channels to mono or mono to multiple channels")
+	ErrUnsupportedRatio    = errors.New("unsupported sample rate ratio")
+	ErrSnapshotUnsupported = errors.New("resampler state can not be saved, use the pure-Go resampler")
+	ErrStateMismatch       = errors.New("saved state does not match the configuration")
+	ErrUnderrun            = errors.New("not enough input for the requested frames")
+	ErrClosed              = errors.New("convertor is closed")
+	ErrInvalidHeader       = errors.New("invalid file header")
+	ErrChecksum            = errors.New("checksum mismatch")
 )
@@ -0,0 +1,236 @@
+package mp3
+
+// Versions of the frame header.
+const (
+	mpeg1 = iota
+	mpeg2
+	mpeg25
+)
+
+// Channel modes of the frame header.
+const (
+	modeStereo = iota
+	modeJoint
+	modeDual
+	modeMono
+)
+
+// header is a parsed Layer III frame header.
+type header struct {
+	version   int
+	protected bool
+	bitrate   int
+	// rateIndex indexes sampleRates and the scalefactor band tables.
+	rateIndex int
+	padding   bool
+	mode      int
+	modeExt   int
+}
+
+// parseHeader parses the 4 header bytes of a frame, reporting whether they are the
+// header of a Layer III frame this package decodes. The free format is not supported.
+func parseHeader(b []byte) (header, bool) {
+	var h header
+	if b[0] != 0xff || b[1]&0xe0 != 0xe0 {
+		return h, false
+	}
+	switch b[1] >> 3 & 3 {
+	case 0:
+		h.version = mpeg25
+	case 2:
+		h.version = mpeg2
+	case 3:
+		h.version = mpeg1
+	default:
+		return h, false
+	}
+	if b[1]>>1&3 != 1 {
+		return h, false
+	}
+	h.protected = b[1]&1 == 0
+	index := int(b[2] >> 4)
+	rate := int(b[2] >> 2 & 3)
+	if index == 0 || index == 15 || rate == 3 || b[3]&3 == 2 {
+		return h, false
+	}
+	h.bitrate = bitrates[min(h.version, 1)][index]
+	h.rateIndex = 3*h.version + rate
+	h.padding = b[2]&2 != 0
+	h.mode = int(b[3] >> 6)
+	h.modeExt = int(b[3] >> 4 & 3)
+	return h, true
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func (h header) sampleRate() int {
+	return sampleRates[h.rateIndex]
+}
+
+func (h header) channels() int {
+	if h.mode == modeMono {
+		return 1
+	}
+	return 2
+}
+
+// granules is the number of granules of 576 samples in a frame.
+func (h header) granules() int {
+	if h.version == mpeg1 {
+		return 2
+	}
+	return 1
+}
+
+// frameSize is the length of the frame in bytes, header included.
+func (h header) frameSize() int {
+	size := 144000 * h.bitrate / h.sampleRate()
+	if h.version != mpeg1 {
+		size /= 2
+	}
+	if h.padding {
+		size++
+	}
+	return size
+}
+
+func (h header) sideInfoSize() int {
+	switch {
+	case h.version == mpeg1 && h.channels() == 2:
+		return 32
+	case h.version == mpeg1, h.channels() == 2:
+		return 17
+	}
+	return 9
+}
+
+// Block types of a granule.
+const (
+	blockNormal = iota
+	blockStart
+	blockShort
+	blockStop
+)
+
+// granule is the side information of a granule of a channel.
+type granule struct {
+	part23Length     int
+	bigValues        int
+	globalGain       int
+	scalefacCompress int
+	blockType        int
+	mixed            bool
+	tables           [3]int
+	subblockGain     [3]int
+	region0Count     int
+	region1Count     int
+	preflag          bool
+	scalefacScale    int
+	count1Table      int
+}
+
+type sideInfo struct {
+	mainDataBegin int
+	scfsi         [2][4]bool
+	granules      [2][2]granule
+}
+
+// parseSideInfo parses the side information of a frame with header h, reporting
+// whether it is valid.
+func parseSideInfo(h header, b []byte) (sideInfo, bool) {
+	var si sideInfo
+	br := &bitReader{data: b}
+	channels := h.channels()
+	if h.version == mpeg1 {
+		si.mainDataBegin = int(br.bits(9))
+		if channels == 1 {
+			br.bits(5)
+		} else {
+			br.bits(3)
+		}
+		for ch := 0; ch < channels; ch++ {
+			for band := range si.scfsi[ch] {
+				si.scfsi[ch][band] = br.bit() == 1
+			}
+		}
+	} else {
+		si.mainDataBegin = int(br.bits(8))
+		br.bits(uint(channels))
+	}
+	for gr := 0; gr < h.granules(); gr++ {
+		for ch := 0; ch < channels; ch++ {
+			g := &si.granules[gr][ch]
+			g.part23Length = int(br.bits(12))
+			g.bigValues = int(br.bits(9))
+			g.globalGain = int(br.bits(8))
+			if h.version == mpeg1 {
+				g.scalefacCompress = int(br.bits(4))
+			} else {
+				g.scalefacCompress = int(br.bits(9))
+			}
+			if g.bigValues > 288 {
+				return si, false
+			}
+			if br.bit() == 1 {
+				g.blockType = int(br.bits(2))
+				g.mixed = br.bit() == 1
+				if g.blockType == blockNormal {
+					return si, false
+				}
+				g.tables[0] = int(br.bits(5))
+				g.tables[1] = int(br.bits(5))
+				for w := range g.subblockGain {
+					g.subblockGain[w] = int(br.bits(3))
+				}
+				// The regions are implicit: region 1 covers the rest of the big values.
+				g.region0Count = 7
+				if g.blockType == blockShort && !g.mixed {
+					g.region0Count = 8
+				}
+				g.region1Count = 20 - g.region0Count
+			} else {
+				for i := range g.tables {
+					g.tables[i] = int(br.bits(5))
+				}
+				g.region0Count = int(br.bits(4))
+				g.region1Count = int(br.bits(3))
+			}
+			if h.version == mpeg1 {
+				g.preflag = br.bit() == 1
+			}
+			g.scalefacScale = int(br.bit())
+			g.count1Table = int(br.bit())
+		}
+	}
+	return si, true
+}
+
+// bitReader reads big-endian bit fields of a byte slice. Past the end it reads 0 bits.
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (br *bitReader) bit() uint32 {
+	if br.pos >= len(br.data)*8 {
+		br.pos++
+		return 0
+	}
+	b := br.data[br.pos>>3] >> (7 - uint(br.pos&7)) & 1
+	br.pos++
+	return uint32(b)
+}
+
+// bits reads n <= 32 bits.
+func (br *bitReader) bits(n uint) uint32 {
+	var v uint32
+	for i := uint(0); i < n; i++ {
+		v = v<<1 | br.bit()
+	}
+	return v
+}
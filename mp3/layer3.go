@@ -0,0 +1,598 @@
+package mp3
+
+import "math"
+
+var (
+	// pow43 holds |is|^(4/3) for the largest value a Huffman code with linbits gives.
+	pow43 [8207]float64
+	// imdctWindows are the windows of the long block types and of a short block.
+	imdctWindows [4][36]float64
+	cos36        [36][18]float64
+	cos12        [12][6]float64
+	// aliasCS and aliasCA are the butterfly coefficients of the alias reduction.
+	aliasCS, aliasCA [8]float64
+)
+
+func init() {
+	for i := range pow43 {
+		pow43[i] = math.Pow(float64(i), 4.0/3)
+	}
+	for i := 0; i < 36; i++ {
+		long := math.Sin(math.Pi / 36 * (float64(i) + 0.5))
+		imdctWindows[blockNormal][i] = long
+		switch {
+		case i < 18:
+			imdctWindows[blockStart][i] = long
+		case i < 24:
+			imdctWindows[blockStart][i] = 1
+		case i < 30:
+			imdctWindows[blockStart][i] = math.Sin(math.Pi / 12 * (float64(i-18) + 0.5))
+		}
+		switch {
+		case i < 6:
+		case i < 12:
+			imdctWindows[blockStop][i] = math.Sin(math.Pi / 12 * (float64(i-6) + 0.5))
+		case i < 18:
+			imdctWindows[blockStop][i] = 1
+		default:
+			imdctWindows[blockStop][i] = long
+		}
+		if i < 12 {
+			imdctWindows[blockShort][i] = math.Sin(math.Pi / 12 * (float64(i) + 0.5))
+		}
+		for k := 0; k < 18; k++ {
+			cos36[i][k] = math.Cos(math.Pi / 72 * float64((2*i+1+18)*(2*k+1)))
+		}
+		if i < 12 {
+			for k := 0; k < 6; k++ {
+				cos12[i][k] = math.Cos(math.Pi / 24 * float64((2*i+1+6)*(2*k+1)))
+			}
+		}
+	}
+	for i, c := range [8]float64{-0.6, -0.535, -0.33, -0.185, -0.095, -0.041, -0.0142, -0.0037} {
+		aliasCS[i] = 1 / math.Sqrt(1+c*c)
+		aliasCA[i] = c / math.Sqrt(1+c*c)
+	}
+}
+
+// decoder holds the state of Layer III decoding that carries from frame to frame.
+type decoder struct {
+	// reservoir holds the last bytes of main data, which the next frames may start in.
+	reservoir []byte
+	// scfsi holds the long block scalefactors of granule 0 for reuse in granule 1.
+	scfsi   [2][22]int
+	overlap [2][576]float64
+	synth   [2]synthesis
+}
+
+// channel is a granule of a channel while it is decoded.
+type channel struct {
+	g   granule
+	is  [576]int
+	xr  [576]float64
+	scf [22]int
+	// scfShort are the scalefactors of each window of short blocks.
+	scfShort [13][3]int
+	// illegal are the intensity positions that mark a band as not intensity coded;
+	// scfShort bands follow the 22 long ones.
+	illegal [22 + 13]int
+	// intensityScale selects the MPEG-2 intensity ratios.
+	intensityScale int
+	// nonzero is the index past the last nonzero value.
+	nonzero int
+}
+
+// maxReservoir is the most main data a frame may take from the frames before it.
+const maxReservoir = 511
+
+// decodeFrame decodes a frame with header h, side information si and main data main
+// into interleaved samples appended to out. A frame whose main data starts in frames
+// that were not seen decodes to silence.
+func (d *decoder) decodeFrame(h header, si *sideInfo, main []byte, out []float64) []float64 {
+	channels := h.channels()
+	n := h.granules() * 576 * channels
+	start := len(d.reservoir) - si.mainDataBegin
+	data := append(d.reservoir, main...)
+	if len(data) > maxReservoir {
+		d.reservoir = append(d.reservoir[:0], data[len(data)-maxReservoir:]...)
+	} else {
+		d.reservoir = data
+	}
+	if start < 0 {
+		return append(out, make([]float64, n)...)
+	}
+	data = append([]byte(nil), data[start:]...)
+
+	br := &bitReader{data: data}
+	var chs [2]channel
+	pcm := make([]float64, 576)
+	for gr := 0; gr < h.granules(); gr++ {
+		for ch := 0; ch < channels; ch++ {
+			c := &chs[ch]
+			c.g = si.granules[gr][ch]
+			end := br.pos + c.g.part23Length
+			if h.version == mpeg1 {
+				d.scalefactors1(br, c, gr, ch, si.scfsi[ch])
+			} else {
+				scalefactors2(br, c, ch == 1 && h.mode == modeJoint && h.modeExt&1 != 0)
+			}
+			c.huffman(br, h, end)
+			br.pos = end
+			c.requantize(h)
+		}
+		if h.mode == modeJoint {
+			stereo(h, &chs[0], &chs[1])
+		}
+		base := len(out)
+		out = append(out, make([]float64, 576*channels)...)
+		for ch := 0; ch < channels; ch++ {
+			c := &chs[ch]
+			c.reorder(h)
+			c.antialias(h)
+			d.hybrid(c, h, ch)
+			var slot [32]float64
+			for t := 0; t < 18; t++ {
+				for sb := range slot {
+					slot[sb] = c.xr[18*sb+t]
+				}
+				d.synth[ch].filter(&slot, pcm[32*t:])
+			}
+			for i, s := range pcm {
+				out[base+i*channels+ch] = s
+			}
+		}
+	}
+	return out
+}
+
+// scalefactors1 reads the MPEG-1 scalefactors of a granule.
+func (d *decoder) scalefactors1(br *bitReader, c *channel, gr, ch int, scfsi [4]bool) {
+	g := &c.g
+	s1, s2 := slen[0][g.scalefacCompress], slen[1][g.scalefacCompress]
+	for i := range c.illegal {
+		c.illegal[i] = 7
+	}
+	if g.blockType == blockShort {
+		sfb := 0
+		if g.mixed {
+			for ; sfb < 8; sfb++ {
+				c.scf[sfb] = int(br.bits(s1))
+			}
+			sfb = 3
+		}
+		for ; sfb < 12; sfb++ {
+			n := s1
+			if sfb >= 6 {
+				n = s2
+			}
+			for w := 0; w < 3; w++ {
+				c.scfShort[sfb][w] = int(br.bits(n))
+			}
+		}
+		return
+	}
+	groups := [5]int{0, 6, 11, 16, 21}
+	for group := 0; group < 4; group++ {
+		n := s1
+		if group >= 2 {
+			n = s2
+		}
+		for sfb := groups[group]; sfb < groups[group+1]; sfb++ {
+			if gr == 1 && scfsi[group] {
+				c.scf[sfb] = d.scfsi[ch][sfb]
+			} else {
+				c.scf[sfb] = int(br.bits(n))
+			}
+		}
+	}
+	c.scf[21] = 0
+	d.scfsi[ch] = c.scf
+}
+
+// scalefactors2 reads the MPEG-2 scalefactors of a granule; intensity is set for the
+// right channel of intensity stereo.
+func scalefactors2(br *bitReader, c *channel, intensity bool) {
+	g := &c.g
+	sfc := g.scalefacCompress
+	var lens [4]int
+	var table int
+	switch {
+	case intensity:
+		c.intensityScale = sfc & 1
+		sfc >>= 1
+		switch {
+		case sfc < 180:
+			lens, table = [4]int{sfc / 36, sfc % 36 / 6, sfc % 6, 0}, 3
+		case sfc < 244:
+			sfc -= 180
+			lens, table = [4]int{sfc % 64 >> 4, sfc % 16 >> 2, sfc % 4, 0}, 4
+		default:
+			sfc -= 244
+			lens, table = [4]int{sfc / 3, sfc % 3, 0, 0}, 5
+		}
+	case sfc < 400:
+		lens, table = [4]int{sfc >> 4 / 5, sfc >> 4 % 5, sfc % 16 >> 2, sfc % 4}, 0
+	case sfc < 500:
+		sfc -= 400
+		lens, table = [4]int{sfc >> 2 / 5, sfc >> 2 % 5, sfc % 4, 0}, 1
+	default:
+		sfc -= 500
+		lens, table = [4]int{sfc / 3, sfc % 3, 0, 0}, 2
+		g.preflag = true
+	}
+	block := 0
+	if g.blockType == blockShort {
+		block = 1
+		if g.mixed {
+			block = 2
+		}
+	}
+
+	// Read the scalefactors in order, with the intensity position that is illegal
+	// for each.
+	var values, illegal []int
+	for i, count := range nrOfSfb[table][block] {
+		for j := 0; j < count; j++ {
+			values = append(values, int(br.bits(uint(lens[i]))))
+			illegal = append(illegal, 1<<uint(lens[i])-1)
+		}
+	}
+	c.scf = [22]int{}
+	c.scfShort = [13][3]int{}
+	for i := range c.illegal {
+		c.illegal[i] = -1
+	}
+	long := len(values)
+	if block == 1 {
+		long = 0
+	} else if block == 2 {
+		long = 6
+	}
+	for i := 0; i < long && i < 21; i++ {
+		c.scf[i] = values[i]
+		c.illegal[i] = illegal[i]
+	}
+	first := 0
+	if block == 2 {
+		first = 3
+	}
+	for i := long; i < len(values); i++ {
+		sfb := first + (i-long)/3
+		if sfb < 12 {
+			c.scfShort[sfb][(i-long)%3] = values[i]
+			c.illegal[22+sfb] = illegal[i]
+		}
+	}
+}
+
+// huffman reads the Huffman coded values of a granule that end at bit end.
+func (c *channel) huffman(br *bitReader, h header, end int) {
+	g := &c.g
+	r := h.rateIndex
+	var region1, region2 int
+	if g.blockType != blockNormal {
+		region1 = sfbLong[r][8]
+		if g.blockType == blockShort && !g.mixed {
+			region1 = sfbShort[r][3] * 3
+		}
+		region2 = 576
+	} else {
+		region1 = sfbLong[r][min(g.region0Count+1, 22)]
+		region2 = sfbLong[r][min(g.region0Count+g.region1Count+2, 22)]
+	}
+
+	c.is = [576]int{}
+	c.nonzero = 0
+	big := g.bigValues * 2
+	for i := 0; i < big; i += 2 {
+		region := 0
+		if i >= region2 {
+			region = 2
+		} else if i >= region1 {
+			region = 1
+		}
+		ts := tableSelect[g.tables[region]]
+		if ts.table == 0 {
+			continue
+		}
+		size := huffmanSizes[ts.table]
+		sym := huffmanTrees[ts.table].decode(br)
+		x, y := sym/size, sym%size
+		c.is[i] = value(br, x, ts.linbits)
+		c.is[i+1] = value(br, y, ts.linbits)
+		if x != 0 || y != 0 {
+			c.nonzero = i + 2
+		}
+	}
+
+	for i := big; i+4 <= 576 && br.pos < end; i += 4 {
+		var sym int
+		if g.count1Table == 0 {
+			sym = count1Tree.decode(br)
+		} else {
+			sym = int(15 - br.bits(4))
+		}
+		var quad [4]int
+		for j := range quad {
+			quad[j] = value(br, sym>>uint(3-j)&1, 0)
+		}
+		if br.pos > end {
+			// The last code ran past the granule; it is stuffing.
+			break
+		}
+		copy(c.is[i:], quad[:])
+		if sym != 0 {
+			c.nonzero = i + 4
+		}
+	}
+}
+
+// value reads the linbits and sign bit of a decoded magnitude v.
+func value(br *bitReader, v int, linbits uint) int {
+	if linbits > 0 && v == 15 {
+		v += int(br.bits(linbits))
+	}
+	if v != 0 && br.bit() == 1 {
+		return -v
+	}
+	return v
+}
+
+// mixedEnd is the end of the long block part of a mixed block.
+func mixedEnd(h header) int {
+	return sfbShort[h.rateIndex][3] * 3
+}
+
+// requantize scales the decoded values by the global gain and scalefactors.
+func (c *channel) requantize(h header) {
+	g := &c.g
+	r := h.rateIndex
+	mult := 0.5 * float64(1+g.scalefacScale)
+	base := float64(g.globalGain-210) / 4
+	scale := func(i int, exp float64) {
+		v := c.is[i]
+		switch {
+		case v == 0:
+			c.xr[i] = 0
+		case v < 0:
+			c.xr[i] = -pow43[-v] * math.Exp2(exp)
+		default:
+			c.xr[i] = pow43[v] * math.Exp2(exp)
+		}
+	}
+	longEnd := 576
+	if g.blockType == blockShort {
+		longEnd = 0
+		if g.mixed {
+			longEnd = mixedEnd(h)
+		}
+	}
+	for sfb := 0; sfb < 22 && sfbLong[r][sfb] < longEnd; sfb++ {
+		sf := c.scf[sfb]
+		if g.preflag {
+			sf += pretab[sfb]
+		}
+		exp := base - mult*float64(sf)
+		for i := sfbLong[r][sfb]; i < sfbLong[r][sfb+1]; i++ {
+			scale(i, exp)
+		}
+	}
+	if longEnd == 576 {
+		return
+	}
+	for sfb := firstShort(c.g); sfb < 13; sfb++ {
+		width := sfbShort[r][sfb+1] - sfbShort[r][sfb]
+		for w := 0; w < 3; w++ {
+			exp := base - 2*float64(g.subblockGain[w]) - mult*float64(c.scfShort[sfb][w])
+			start := sfbShort[r][sfb]*3 + w*width
+			for i := start; i < start+width; i++ {
+				scale(i, exp)
+			}
+		}
+	}
+}
+
+// firstShort is the first short scalefactor band of a short block.
+func firstShort(g granule) int {
+	if g.mixed {
+		return 3
+	}
+	return 0
+}
+
+// stereo undoes the mid/side and intensity stereo coding of a granule.
+func stereo(h header, left, right *channel) {
+	ms := h.modeExt&2 != 0
+	var intensity [576]bool
+	var kl, kr [576]float64
+	if h.modeExt&1 != 0 {
+		intensityBands(h, right, func(start, end, pos, illegal int) {
+			if pos == illegal {
+				return
+			}
+			l, r := intensityRatio(h, pos, right.intensityScale)
+			for i := start; i < end; i++ {
+				intensity[i], kl[i], kr[i] = true, l, r
+			}
+		})
+	}
+	for i := 0; i < 576; i++ {
+		m, s := left.xr[i], right.xr[i]
+		switch {
+		case intensity[i]:
+			left.xr[i], right.xr[i] = m*kl[i], m*kr[i]
+		case ms:
+			left.xr[i], right.xr[i] = (m+s)/math.Sqrt2, (m-s)/math.Sqrt2
+		}
+	}
+}
+
+// intensityBands calls f with the bands of the right channel above its last nonzero
+// value, which are intensity coded unless pos is illegal.
+func intensityBands(h header, c *channel, f func(start, end, pos, illegal int)) {
+	r := h.rateIndex
+	g := &c.g
+	long := func(from int) {
+		for sfb := from; sfb < 22 && sfbLong[r][sfb] < 576; sfb++ {
+			// The last band takes the position of the band before it.
+			p := min(sfb, 20)
+			f(sfbLong[r][sfb], sfbLong[r][sfb+1], c.scf[p], c.illegal[p])
+		}
+	}
+	if g.blockType != blockShort {
+		sfb := 0
+		for sfb < 22 && sfbLong[r][sfb+1] <= c.nonzero-1 {
+			sfb++
+		}
+		if c.nonzero > 0 {
+			sfb++
+		}
+		long(sfb)
+		return
+	}
+
+	first := firstShort(c.g)
+	allZero := true
+	for w := 0; w < 3; w++ {
+		// The first band of the window above its last nonzero value.
+		from := first
+		for sfb := first; sfb < 13; sfb++ {
+			width := sfbShort[r][sfb+1] - sfbShort[r][sfb]
+			start := sfbShort[r][sfb]*3 + w*width
+			for i := start; i < start+width; i++ {
+				if c.is[i] != 0 {
+					from = sfb + 1
+				}
+			}
+		}
+		if from != first {
+			allZero = false
+		}
+		for sfb := from; sfb < 13; sfb++ {
+			width := sfbShort[r][sfb+1] - sfbShort[r][sfb]
+			start := sfbShort[r][sfb]*3 + w*width
+			p := min(sfb, 11)
+			f(start, start+width, c.scfShort[p][w], c.illegal[22+p])
+		}
+	}
+	if g.mixed && allZero {
+		end := mixedEnd(h)
+		sfb := 0
+		for i := 0; i < end; i++ {
+			if c.is[i] != 0 {
+				for sfbLong[r][sfb+1] <= i {
+					sfb++
+				}
+				sfb++
+				i = sfbLong[r][sfb] - 1
+			}
+		}
+		for ; sfbLong[r][sfb] < end; sfb++ {
+			f(sfbLong[r][sfb], sfbLong[r][sfb+1], c.scf[sfb], c.illegal[sfb])
+		}
+	}
+}
+
+// intensityRatio returns the factors of the left and right channel for an intensity
+// position.
+func intensityRatio(h header, pos, scale int) (float64, float64) {
+	if h.version == mpeg1 {
+		if pos == 6 {
+			return 1, 0
+		}
+		k := math.Tan(float64(pos) * math.Pi / 12)
+		return k / (1 + k), 1 / (1 + k)
+	}
+	io := math.Pow(2, -0.25*float64(scale+1))
+	switch {
+	case pos == 0:
+		return 1, 1
+	case pos%2 == 1:
+		return math.Pow(io, float64(pos+1)/2), 1
+	}
+	return 1, math.Pow(io, float64(pos)/2)
+}
+
+// reorder puts the values of short blocks in the order of the subbands.
+func (c *channel) reorder(h header) {
+	if c.g.blockType != blockShort {
+		return
+	}
+	r := h.rateIndex
+	var tmp [576]float64
+	for sfb := firstShort(c.g); sfb < 13; sfb++ {
+		start := sfbShort[r][sfb] * 3
+		width := sfbShort[r][sfb+1] - sfbShort[r][sfb]
+		for w := 0; w < 3; w++ {
+			for j := 0; j < width; j++ {
+				tmp[start+3*j+w] = c.xr[start+w*width+j]
+			}
+		}
+	}
+	from := 0
+	if c.g.mixed {
+		from = mixedEnd(h)
+	}
+	copy(c.xr[from:], tmp[from:])
+}
+
+// antialias reduces the aliasing between the subbands of long blocks.
+func (c *channel) antialias(h header) {
+	bands := 32
+	if c.g.blockType == blockShort {
+		if !c.g.mixed {
+			return
+		}
+		bands = mixedEnd(h) / 18
+	}
+	for sb := 1; sb < bands; sb++ {
+		for i := 0; i < 8; i++ {
+			lo, hi := 18*sb-1-i, 18*sb+i
+			bu, bd := c.xr[lo], c.xr[hi]
+			c.xr[lo] = bu*aliasCS[i] - bd*aliasCA[i]
+			c.xr[hi] = bd*aliasCS[i] + bu*aliasCA[i]
+		}
+	}
+}
+
+// hybrid turns the frequency lines of each subband into its 18 time samples with the
+// IMDCT, windowing and overlap-adding them with the previous granule.
+func (d *decoder) hybrid(c *channel, h header, ch int) {
+	overlap := &d.overlap[ch]
+	for sb := 0; sb < 32; sb++ {
+		in := c.xr[18*sb : 18*sb+18]
+		blockType := c.g.blockType
+		if c.g.mixed && 18*sb < mixedEnd(h) {
+			blockType = blockNormal
+		}
+		var out [36]float64
+		if blockType == blockShort {
+			for w := 0; w < 3; w++ {
+				for i := 0; i < 12; i++ {
+					var sum float64
+					for k := 0; k < 6; k++ {
+						sum += in[3*k+w] * cos12[i][k]
+					}
+					out[6+6*w+i] += sum * imdctWindows[blockShort][i]
+				}
+			}
+		} else {
+			for i := 0; i < 36; i++ {
+				var sum float64
+				for k, x := range in {
+					sum += x * cos36[i][k]
+				}
+				out[i] = sum * imdctWindows[blockType][i]
+			}
+		}
+		for i := 0; i < 18; i++ {
+			v := out[i] + overlap[18*sb+i]
+			overlap[18*sb+i] = out[18+i]
+			// Undo the frequency inversion of the odd subbands.
+			if sb%2 == 1 && i%2 == 1 {
+				v = -v
+			}
+			c.xr[18*sb+i] = v
+		}
+	}
+}
@@ -0,0 +1,984 @@
+package mp3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"strconv"
+	"testing"
+
+	"github.com/ZhangJYd/pcm_convertor/format"
+	"github.com/ZhangJYd/pcm_convertor/model"
+)
+
+// analysis is the polyphase analysis filterbank of ISO/IEC 11172-3, whose window is
+// the synthesis window scaled down by 32.
+type analysis struct{ x [512]float64 }
+
+func (a *analysis) filter(in []float64, out *[32]float64) {
+	copy(a.x[32:], a.x[:480])
+	for i := 0; i < 32; i++ {
+		a.x[31-i] = in[i]
+	}
+	var y [64]float64
+	for i := range y {
+		for j := 0; j < 8; j++ {
+			y[i] += a.x[i+64*j] * window[i+64*j] / 32
+		}
+	}
+	for k := range out {
+		var sum float64
+		for i, v := range y {
+			sum += v * math.Cos(float64((2*k+1)*(i-16))*math.Pi/64)
+		}
+		out[k] = sum
+	}
+}
+
+type bitWriter struct {
+	buf []byte
+	n   int
+}
+
+func (bw *bitWriter) write(v uint32, n uint) {
+	for i := int(n) - 1; i >= 0; i-- {
+		if bw.n == len(bw.buf)*8 {
+			bw.buf = append(bw.buf, 0)
+		}
+		if v>>uint(i)&1 != 0 {
+			bw.buf[bw.n>>3] |= 0x80 >> uint(bw.n&7)
+		}
+		bw.n++
+	}
+}
+
+// config describes the stream the test encoder writes.
+type config struct {
+	version    int
+	sampleRate int
+	bitrate    int
+	channels   int
+	ms         bool
+	crc        bool
+	// blocks gives the block type of each granule and whether it is mixed; nil
+	// means long blocks only.
+	blocks func(gr int) (int, bool)
+}
+
+// encoder is a Layer III encoder for the tests. Instead of a psychoacoustic model it
+// draws scalefactors, gains and regions at random, so that decoding exercises every
+// part of the bitstream, and picks the finest global gain that fits the bits it gives
+// each granule. Every other frame leaves room that the next one takes from the bit
+// reservoir.
+type encoder struct {
+	config
+	h       header
+	rnd     *rand.Rand
+	filters [2]analysis
+	prev    [2][32][18]float64
+	granule int
+	// scf holds the long block scalefactors of granule 0 for scfsi.
+	scf     [2][22]int
+	longGr0 [2]bool
+	// space holds the main data slots of all frames one after the other.
+	space  []byte
+	cursor int
+	// frames holds the header and side information of each frame and slots the start
+	// of its main data slot in space.
+	frames [][]byte
+	slots  []int
+	// borrowed counts the frames whose main data starts in an earlier frame.
+	borrowed int
+}
+
+func newEncoder(c config) *encoder {
+	e := &encoder{config: c, rnd: rand.New(rand.NewSource(1))}
+	e.h = header{version: c.version, bitrate: c.bitrate, protected: c.crc, mode: modeStereo}
+	for i, rate := range sampleRates {
+		if rate == c.sampleRate && i/3 == c.version {
+			e.h.rateIndex = i
+		}
+	}
+	switch {
+	case c.channels == 1:
+		e.h.mode = modeMono
+	case c.ms:
+		e.h.mode, e.h.modeExt = modeJoint, 2
+	}
+	if e.blocks == nil {
+		e.blocks = func(int) (int, bool) { return blockNormal, false }
+	}
+	return e
+}
+
+func (e *encoder) samplesPerFrame() int {
+	return 576 * e.h.granules()
+}
+
+// encode encodes the whole frames of pcm, given by channel.
+func (e *encoder) encode(pcm [][]float64) {
+	spf := e.samplesPerFrame()
+	for off := 0; off+spf <= len(pcm[0]); off += spf {
+		e.frame(pcm, off)
+	}
+}
+
+func (e *encoder) frame(pcm [][]float64, off int) {
+	h := e.h
+	h.padding = len(e.frames)%2 == 1
+	size := h.frameSize()
+	head := 4 + h.sideInfoSize()
+	if h.protected {
+		head += 2
+	}
+	slot := size - head
+	start := len(e.space)
+	e.space = append(e.space, make([]byte, slot)...)
+	maxBegin := 511
+	if h.version != mpeg1 {
+		maxBegin = 255
+	}
+	if start-e.cursor > maxBegin {
+		e.cursor = start - maxBegin
+	}
+	var si sideInfo
+	si.mainDataBegin = start - e.cursor
+	if si.mainDataBegin > 0 {
+		e.borrowed++
+	}
+	budget := (start + slot - e.cursor) * 8
+	if len(e.frames)%2 == 0 && budget > slot*6 {
+		budget = slot * 6
+	}
+
+	bw := &bitWriter{}
+	units := h.granules() * e.channels
+	for gr := 0; gr < h.granules(); gr++ {
+		blockType, mixed := e.blocks(e.granule)
+		e.granule++
+		var xr [2][576]float64
+		for ch := 0; ch < e.channels; ch++ {
+			xr[ch] = e.hybrid(ch, pcm[ch][off+576*gr:], blockType, mixed)
+		}
+		if e.ms {
+			for i := range xr[0] {
+				l, r := xr[0][i], xr[1][i]
+				xr[0][i], xr[1][i] = (l+r)/math.Sqrt2, (l-r)/math.Sqrt2
+			}
+		}
+		for ch := 0; ch < e.channels; ch++ {
+			g := &si.granules[gr][ch]
+			g.blockType, g.mixed = blockType, mixed
+			bits := (budget - bw.n) / units
+			if bits > 4095 {
+				bits = 4095
+			}
+			units--
+			e.encodeGranule(bw, &si, gr, ch, &xr[ch], bits)
+		}
+	}
+	copy(e.space[e.cursor:], bw.buf)
+	e.cursor += len(bw.buf)
+
+	b := make([]byte, head)
+	b[0] = 0xff
+	b[1] = 0xe0 | [3]byte{3, 2, 0}[h.version]<<3 | 1<<1
+	if !h.protected {
+		b[1] |= 1
+	}
+	for i, rate := range bitrates[min(h.version, 1)] {
+		if rate == h.bitrate {
+			b[2] = byte(i) << 4
+		}
+	}
+	b[2] |= byte(h.rateIndex%3) << 2
+	if h.padding {
+		b[2] |= 2
+	}
+	b[3] = byte(h.mode)<<6 | byte(h.modeExt)<<4
+	copy(b[head-h.sideInfoSize():], e.sideInfo(h, &si))
+	e.frames = append(e.frames, b)
+	e.slots = append(e.slots, start)
+}
+
+// hybrid runs the analysis filterbank and the MDCT over a granule of a channel,
+// returning its frequency lines in subband order.
+func (e *encoder) hybrid(ch int, in []float64, blockType int, mixed bool) [576]float64 {
+	var cur [32][18]float64
+	var sb [32]float64
+	for t := 0; t < 18; t++ {
+		e.filters[ch].filter(in[32*t:], &sb)
+		for k, v := range sb {
+			if k%2 == 1 && t%2 == 1 {
+				v = -v
+			}
+			cur[k][t] = v
+		}
+	}
+	long := 32
+	if blockType == blockShort {
+		long = 0
+		if mixed {
+			long = mixedEnd(e.h) / 18
+		}
+	}
+	var xr [576]float64
+	for k := 0; k < 32; k++ {
+		var z [36]float64
+		copy(z[:], e.prev[ch][k][:])
+		copy(z[18:], cur[k][:])
+		x := xr[18*k : 18*k+18]
+		if k >= long {
+			for w := 0; w < 3; w++ {
+				for j := 0; j < 6; j++ {
+					var sum float64
+					for n := 0; n < 12; n++ {
+						sum += z[6+6*w+n] * imdctWindows[blockShort][n] * cos12[n][j]
+					}
+					x[3*j+w] = sum / 3
+				}
+			}
+			continue
+		}
+		bt := blockType
+		if mixed {
+			bt = blockNormal
+		}
+		for j := range x {
+			var sum float64
+			for n, v := range z {
+				sum += v * imdctWindows[bt][n] * cos36[n][j]
+			}
+			x[j] = sum / 9
+		}
+	}
+	e.prev[ch] = cur
+	for k := 1; k < long; k++ {
+		for i := 0; i < 8; i++ {
+			lo, hi := 18*k-1-i, 18*k+i
+			a, b := xr[lo], xr[hi]
+			xr[lo] = a*aliasCS[i] + b*aliasCA[i]
+			xr[hi] = b*aliasCS[i] - a*aliasCA[i]
+		}
+	}
+	return xr
+}
+
+// encodeGranule writes the scalefactors and Huffman codes of a granule of a channel in
+// at most budget bits.
+func (e *encoder) encodeGranule(bw *bitWriter, si *sideInfo, gr, ch int, sub *[576]float64, budget int) {
+	h := e.h
+	r := h.rateIndex
+	c := &channel{g: si.granules[gr][ch]}
+	g := &c.g
+	xr := *sub
+	if g.blockType == blockShort {
+		for sfb := firstShort(*g); sfb < 13; sfb++ {
+			start := sfbShort[r][sfb] * 3
+			width := sfbShort[r][sfb+1] - sfbShort[r][sfb]
+			for w := 0; w < 3; w++ {
+				for j := 0; j < width; j++ {
+					xr[start+w*width+j] = sub[start+3*j+w]
+				}
+			}
+		}
+		for w := range g.subblockGain {
+			g.subblockGain[w] = e.rnd.Intn(3)
+		}
+	} else {
+		g.region0Count = e.rnd.Intn(16)
+		g.region1Count = e.rnd.Intn(min(8, 21-g.region0Count))
+	}
+	g.scalefacScale = e.rnd.Intn(2)
+	var writeScf func(*bitWriter)
+	if h.version == mpeg1 {
+		writeScf = e.scalefactors1(si, c, gr, ch)
+	} else {
+		writeScf = e.scalefactors2(c)
+	}
+
+	// Requantizing ones at a global gain of 210 gives the scale of each line.
+	for i := range c.is {
+		c.is[i] = 1
+	}
+	g.globalGain = 210
+	c.requantize(h)
+	exp := c.xr
+	try := func(gain int) *bitWriter {
+		g.globalGain = gain
+		step := math.Exp2(float64(gain-210) / 4)
+		for i, x := range xr {
+			v := int(math.Round(math.Pow(math.Abs(x)/(step*exp[i]), 0.75)))
+			if v > 8206 {
+				return nil
+			}
+			if x < 0 {
+				v = -v
+			}
+			c.is[i] = v
+		}
+		out := &bitWriter{}
+		writeScf(out)
+		e.values(out, g, &c.is)
+		if out.n > budget {
+			return nil
+		}
+		return out
+	}
+	lo, hi := 0, 255
+	for lo < hi {
+		if mid := (lo + hi) / 2; try(mid) != nil {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	out := try(lo)
+	g.part23Length = out.n
+	for i := 0; i < out.n; i++ {
+		bw.write(uint32(out.buf[i>>3]>>(7-uint(i&7))&1), 1)
+	}
+	si.granules[gr][ch] = *g
+}
+
+// scalefactors1 draws the MPEG-1 scalefactors of a granule, returning the function that
+// writes them.
+func (e *encoder) scalefactors1(si *sideInfo, c *channel, gr, ch int) func(*bitWriter) {
+	g := &c.g
+	g.scalefacCompress = e.rnd.Intn(16)
+	s1, s2 := slen[0][g.scalefacCompress], slen[1][g.scalefacCompress]
+	pick := func(n uint) int {
+		return e.rnd.Intn(min(1<<n, 4))
+	}
+	if g.blockType == blockShort {
+		e.longGr0[ch] = false
+		if g.mixed {
+			for sfb := 0; sfb < 8; sfb++ {
+				c.scf[sfb] = pick(s1)
+			}
+		}
+		for sfb := firstShort(*g); sfb < 12; sfb++ {
+			for w := 0; w < 3; w++ {
+				if sfb < 6 {
+					c.scfShort[sfb][w] = pick(s1)
+				} else {
+					c.scfShort[sfb][w] = pick(s2)
+				}
+			}
+		}
+		return func(bw *bitWriter) {
+			if g.mixed {
+				for sfb := 0; sfb < 8; sfb++ {
+					bw.write(uint32(c.scf[sfb]), s1)
+				}
+			}
+			for sfb := firstShort(*g); sfb < 12; sfb++ {
+				for w := 0; w < 3; w++ {
+					if sfb < 6 {
+						bw.write(uint32(c.scfShort[sfb][w]), s1)
+					} else {
+						bw.write(uint32(c.scfShort[sfb][w]), s2)
+					}
+				}
+			}
+		}
+	}
+
+	groups := [5]int{0, 6, 11, 16, 21}
+	for group := 0; group < 4; group++ {
+		reuse := gr == 1 && e.longGr0[ch] && e.rnd.Intn(2) == 0
+		si.scfsi[ch][group] = reuse
+		for sfb := groups[group]; sfb < groups[group+1]; sfb++ {
+			switch {
+			case reuse:
+				c.scf[sfb] = e.scf[ch][sfb]
+			case group < 2:
+				c.scf[sfb] = pick(s1)
+			default:
+				c.scf[sfb] = pick(s2)
+			}
+		}
+	}
+	g.preflag = e.rnd.Intn(2) == 0
+	e.scf[ch], e.longGr0[ch] = c.scf, gr == 0
+	scfsi := si.scfsi[ch]
+	return func(bw *bitWriter) {
+		for group := 0; group < 4; group++ {
+			if scfsi[group] {
+				continue
+			}
+			n := s1
+			if group >= 2 {
+				n = s2
+			}
+			for sfb := groups[group]; sfb < groups[group+1]; sfb++ {
+				bw.write(uint32(c.scf[sfb]), n)
+			}
+		}
+	}
+}
+
+// scalefactors2 draws the MPEG-2 scalefactors of a granule from one of the three
+// partitions of scalefac_compress, returning the function that writes them.
+func (e *encoder) scalefactors2(c *channel) func(*bitWriter) {
+	g := &c.g
+	var lens [4]int
+	table := e.rnd.Intn(3)
+	switch table {
+	case 0:
+		lens = [4]int{e.rnd.Intn(5), e.rnd.Intn(5), e.rnd.Intn(4), e.rnd.Intn(4)}
+		g.scalefacCompress = (lens[0]*5+lens[1])<<4 | lens[2]<<2 | lens[3]
+	case 1:
+		lens = [4]int{e.rnd.Intn(5), e.rnd.Intn(5), e.rnd.Intn(4), 0}
+		g.scalefacCompress = 400 + ((lens[0]*5+lens[1])<<2 | lens[2])
+	case 2:
+		lens = [4]int{e.rnd.Intn(4), e.rnd.Intn(3), 0, 0}
+		g.scalefacCompress = 500 + lens[0]*3 + lens[1]
+		g.preflag = true
+	}
+	block := 0
+	if g.blockType == blockShort {
+		block = 1
+		if g.mixed {
+			block = 2
+		}
+	}
+	var values []int
+	var bits []uint
+	for i, count := range nrOfSfb[table][block] {
+		for j := 0; j < count; j++ {
+			values = append(values, e.rnd.Intn(min(1<<uint(lens[i]), 4)))
+			bits = append(bits, uint(lens[i]))
+		}
+	}
+	long := len(values)
+	if block == 1 {
+		long = 0
+	} else if block == 2 {
+		long = 6
+	}
+	copy(c.scf[:long], values)
+	for i := long; i < len(values); i++ {
+		c.scfShort[firstShort(*g)+(i-long)/3][(i-long)%3] = values[i]
+	}
+	return func(bw *bitWriter) {
+		for i, v := range values {
+			bw.write(uint32(v), bits[i])
+		}
+	}
+}
+
+// values writes the Huffman codes of the quantized values of a granule, choosing the
+// cheapest table for each region.
+func (e *encoder) values(bw *bitWriter, g *granule, is *[576]int) {
+	n := 576
+	for n >= 2 && is[n-1] == 0 && is[n-2] == 0 {
+		n -= 2
+	}
+	big := n
+	for big >= 4 && abs(is[big-1]) <= 1 && abs(is[big-2]) <= 1 && abs(is[big-3]) <= 1 && abs(is[big-4]) <= 1 {
+		big -= 4
+	}
+	g.bigValues = big / 2
+
+	r := e.h.rateIndex
+	region1, region2 := sfbLong[r][8], 576
+	if g.blockType == blockShort && !g.mixed {
+		region1 = sfbShort[r][3] * 3
+	}
+	if g.blockType == blockNormal {
+		region1 = sfbLong[r][g.region0Count+1]
+		region2 = sfbLong[r][g.region0Count+g.region1Count+2]
+	}
+	bounds := [4]int{0, min(region1, big), min(region2, big), big}
+	for i := range g.tables {
+		g.tables[i] = bestTable(is[bounds[i]:bounds[i+1]])
+	}
+	for i := 0; i < big; i += 2 {
+		region := 0
+		if i >= region2 {
+			region = 2
+		} else if i >= region1 {
+			region = 1
+		}
+		if g.tables[region] != 0 {
+			writePair(bw, g.tables[region], is[i], is[i+1])
+		}
+	}
+
+	var a, b int
+	for i := big; i < n; i += 4 {
+		a += int(count1Codes.lens[quad(is[i:])])
+		b += 4
+	}
+	g.count1Table = 0
+	if b < a {
+		g.count1Table = 1
+	}
+	for i := big; i < n; i += 4 {
+		q := quad(is[i:])
+		if g.count1Table == 0 {
+			bw.write(uint32(count1Codes.codes[q]), uint(count1Codes.lens[q]))
+		} else {
+			bw.write(uint32(15-q), 4)
+		}
+		for _, v := range is[i : i+4] {
+			if v != 0 {
+				bw.write(sign(v), 1)
+			}
+		}
+	}
+}
+
+func quad(is []int) int {
+	return abs(is[0])<<3 | abs(is[1])<<2 | abs(is[2])<<1 | abs(is[3])
+}
+
+// bestTable returns the table_select that codes values in the fewest bits.
+func bestTable(values []int) int {
+	max := 0
+	for _, v := range values {
+		if abs(v) > max {
+			max = abs(v)
+		}
+	}
+	if max == 0 {
+		return 0
+	}
+	best, bestBits := 0, 0
+	for sel, ts := range tableSelect {
+		if ts.table == 0 {
+			continue
+		}
+		limit := huffmanSizes[ts.table] - 1
+		if ts.linbits > 0 {
+			limit = 15 + 1<<ts.linbits - 1
+		}
+		if max > limit {
+			continue
+		}
+		bw := &bitWriter{}
+		for i := 0; i < len(values); i += 2 {
+			writePair(bw, sel, values[i], values[i+1])
+		}
+		if best == 0 || bw.n < bestBits {
+			best, bestBits = sel, bw.n
+		}
+	}
+	return best
+}
+
+func writePair(bw *bitWriter, sel, x, y int) {
+	ts := tableSelect[sel]
+	c := huffmanCodes[ts.table]
+	cx, cy := abs(x), abs(y)
+	if ts.linbits > 0 {
+		cx, cy = min(cx, 15), min(cy, 15)
+	}
+	sym := cx*c.size + cy
+	bw.write(uint32(c.codes[sym]), uint(c.lens[sym]))
+	for _, v := range [2]int{x, y} {
+		if ts.linbits > 0 && abs(v) >= 15 {
+			bw.write(uint32(abs(v)-15), ts.linbits)
+		}
+		if v != 0 {
+			bw.write(sign(v), 1)
+		}
+	}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func sign(v int) uint32 {
+	return flag(v < 0)
+}
+
+func flag(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// sideInfo writes the side information of a frame.
+func (e *encoder) sideInfo(h header, si *sideInfo) []byte {
+	bw := &bitWriter{}
+	if h.version == mpeg1 {
+		bw.write(uint32(si.mainDataBegin), 9)
+		if e.channels == 1 {
+			bw.write(0, 5)
+		} else {
+			bw.write(0, 3)
+		}
+		for ch := 0; ch < e.channels; ch++ {
+			for _, reuse := range si.scfsi[ch] {
+				bw.write(flag(reuse), 1)
+			}
+		}
+	} else {
+		bw.write(uint32(si.mainDataBegin), 8)
+		bw.write(0, uint(e.channels))
+	}
+	for gr := 0; gr < h.granules(); gr++ {
+		for ch := 0; ch < e.channels; ch++ {
+			g := &si.granules[gr][ch]
+			bw.write(uint32(g.part23Length), 12)
+			bw.write(uint32(g.bigValues), 9)
+			bw.write(uint32(g.globalGain), 8)
+			if h.version == mpeg1 {
+				bw.write(uint32(g.scalefacCompress), 4)
+			} else {
+				bw.write(uint32(g.scalefacCompress), 9)
+			}
+			if g.blockType != blockNormal {
+				bw.write(1, 1)
+				bw.write(uint32(g.blockType), 2)
+				bw.write(flag(g.mixed), 1)
+				bw.write(uint32(g.tables[0]), 5)
+				bw.write(uint32(g.tables[1]), 5)
+				for _, gain := range g.subblockGain {
+					bw.write(uint32(gain), 3)
+				}
+			} else {
+				bw.write(0, 1)
+				for _, t := range g.tables {
+					bw.write(uint32(t), 5)
+				}
+				bw.write(uint32(g.region0Count), 4)
+				bw.write(uint32(g.region1Count), 3)
+			}
+			if h.version == mpeg1 {
+				bw.write(flag(g.preflag), 1)
+			}
+			bw.write(uint32(g.scalefacScale), 1)
+			bw.write(uint32(g.count1Table), 1)
+		}
+	}
+	b := make([]byte, h.sideInfoSize())
+	copy(b, bw.buf)
+	return b
+}
+
+// bytes returns the encoded stream.
+func (e *encoder) bytes() []byte {
+	var out []byte
+	for i, f := range e.frames {
+		end := len(e.space)
+		if i+1 < len(e.slots) {
+			end = e.slots[i+1]
+		}
+		out = append(out, f...)
+		out = append(out, e.space[e.slots[i]:end]...)
+	}
+	return out
+}
+
+// infoFrame returns an Info frame for a stream of frames audio frames with a LAME tag
+// giving the encoder delay and padding.
+func (e *encoder) infoFrame(frames, delay, padding int) []byte {
+	h := e.h
+	h.padding, h.protected = false, false
+	b := make([]byte, h.frameSize())
+	b[0], b[1] = 0xff, 0xe0|[3]byte{3, 2, 0}[h.version]<<3|1<<1|1
+	for i, rate := range bitrates[min(h.version, 1)] {
+		if rate == h.bitrate {
+			b[2] = byte(i) << 4
+		}
+	}
+	b[2] |= byte(h.rateIndex%3) << 2
+	b[3] = byte(h.mode)<<6 | byte(h.modeExt)<<4
+	at := 4 + h.sideInfoSize()
+	copy(b[at:], "Info")
+	binary.BigEndian.PutUint32(b[at+4:], 1|8)
+	binary.BigEndian.PutUint32(b[at+8:], uint32(frames))
+	at += 16
+	copy(b[at:], "LAME3.100")
+	b[at+21] = byte(delay >> 4)
+	b[at+22] = byte(delay<<4 | padding>>8)
+	b[at+23] = byte(padding)
+	return b
+}
+
+// filterDelay is the delay of the analysis and synthesis filterbanks; the MDCT adds
+// a granule.
+const filterDelay = 481
+
+// signal returns channels of n samples of three tones at fractions of the sample rate.
+func signal(n, channels int) [][]float64 {
+	pcm := make([][]float64, channels)
+	for c := range pcm {
+		pcm[c] = make([]float64, n)
+		for i := range pcm[c] {
+			x := float64(i)
+			pcm[c][i] = 0.3*math.Sin(2*math.Pi*0.011*x+float64(c)) +
+				0.2*math.Sin(2*math.Pi*(0.07+0.01*float64(c))*x) +
+				0.05*math.Sin(2*math.Pi*0.21*x)
+		}
+	}
+	return pcm
+}
+
+// snr returns the signal to noise ratio in dB of out, interleaved, against pcm delayed
+// by delay, leaving out the first granules while the filterbanks fill.
+func snr(pcm [][]float64, out []float64, delay int) float64 {
+	channels := len(pcm)
+	var signal, noise float64
+	for c := range pcm {
+		for i := 1152; i < len(pcm[c]) && (i+delay)*channels < len(out); i++ {
+			d := out[(i+delay)*channels+c] - pcm[c][i]
+			signal += pcm[c][i] * pcm[c][i]
+			noise += d * d
+		}
+	}
+	return 10 * math.Log10(signal/noise)
+}
+
+// decode reads all samples of an MP3 stream as F32.
+func decode(t *testing.T, b []byte) (*Reader, []float64) {
+	t.Helper()
+	r, err := NewReader(bytes.NewReader(b), format.F32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make([]float64, len(data)/4)
+	for i := range out {
+		out[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:])))
+	}
+	return r, out
+}
+
+func TestHuffmanTables(t *testing.T) {
+	check := func(name string, c huffmanCode) {
+		var kraft float64
+		for sym, code := range c.codes {
+			n := uint(c.lens[sym])
+			kraft += math.Exp2(-float64(n))
+			for other, code2 := range c.codes {
+				m := uint(c.lens[other])
+				if other != sym && m >= n && uint(code2)>>(m-n) == uint(code) {
+					t.Errorf("table %s: code of %d is a prefix of %d", name, sym, other)
+				}
+			}
+		}
+		if math.Abs(kraft-1) > 1e-9 {
+			t.Errorf("table %s: Kraft sum %v", name, kraft)
+		}
+	}
+	for n, c := range huffmanCodes {
+		if len(c.codes) != c.size*c.size || len(c.lens) != len(c.codes) {
+			t.Fatalf("table %d: %d codes for size %d", n, len(c.codes), c.size)
+		}
+		check(strconv.Itoa(n), c)
+	}
+	check("A", count1Codes)
+}
+
+func TestFilterbank(t *testing.T) {
+	pcm := signal(32*300, 1)[0]
+	var a analysis
+	var s synthesis
+	out := make([]float64, len(pcm))
+	var sb [32]float64
+	for i := 0; i < len(pcm); i += 32 {
+		a.filter(pcm[i:], &sb)
+		s.filter(&sb, out[i:])
+	}
+	if got := snr([][]float64{pcm}, out, filterDelay); got < 60 {
+		t.Errorf("SNR %.1f dB", got)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	// Long blocks switch to short ones and back through start and stop blocks.
+	switching := func(gr int) (int, bool) {
+		return [8]int{blockNormal, blockNormal, blockStart, blockShort, blockShort, blockStop, blockNormal, blockNormal}[gr%8], false
+	}
+	short := func(int) (int, bool) { return blockShort, false }
+	mixed := func(int) (int, bool) { return blockShort, true }
+	tests := []struct {
+		name string
+		config
+	}{
+		{"mpeg1 stereo", config{version: mpeg1, sampleRate: 44100, bitrate: 320, channels: 2}},
+		{"mpeg1 joint", config{version: mpeg1, sampleRate: 48000, bitrate: 256, channels: 2, ms: true, blocks: switching}},
+		{"mpeg1 short", config{version: mpeg1, sampleRate: 32000, bitrate: 128, channels: 1, blocks: short}},
+		{"mpeg1 mixed", config{version: mpeg1, sampleRate: 44100, bitrate: 192, channels: 1, blocks: mixed, crc: true}},
+		{"mpeg2 stereo", config{version: mpeg2, sampleRate: 22050, bitrate: 160, channels: 2, blocks: switching}},
+		{"mpeg2 mixed", config{version: mpeg2, sampleRate: 24000, bitrate: 96, channels: 1, blocks: mixed}},
+		{"mpeg2.5", config{version: mpeg25, sampleRate: 11025, bitrate: 64, channels: 1, blocks: switching}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newEncoder(tt.config)
+			pcm := signal(40*e.samplesPerFrame(), tt.channels)
+			e.encode(pcm)
+			if e.borrowed == 0 {
+				t.Error("no frame uses the bit reservoir")
+			}
+			r, out := decode(t, e.bytes())
+			info := r.StreamInfo()
+			if info.SampleRate != tt.sampleRate || info.Channels != tt.channels || info.Format != format.F32 {
+				t.Errorf("got %+v", info)
+			}
+			if len(out) != len(pcm[0])*tt.channels {
+				t.Fatalf("got %d samples, want %d", len(out), len(pcm[0])*tt.channels)
+			}
+			if got := snr(pcm, out, filterDelay+576); got < 45 {
+				t.Errorf("SNR %.1f dB", got)
+			}
+		})
+	}
+}
+
+// frameOffsets returns where each frame of an encoded stream starts.
+func (e *encoder) frameOffsets() []int {
+	var offsets []int
+	pos := 0
+	for i, f := range e.frames {
+		offsets = append(offsets, pos)
+		end := len(e.space)
+		if i+1 < len(e.slots) {
+			end = e.slots[i+1]
+		}
+		pos += len(f) + end - e.slots[i]
+	}
+	return offsets
+}
+
+func TestGapless(t *testing.T) {
+	e := newEncoder(config{version: mpeg1, sampleRate: 44100, bitrate: 320, channels: 2})
+	n := 10000
+	spf := e.samplesPerFrame()
+	delay := filterDelay + 576 - decoderDelay
+	frames := (n + delay + decoderDelay + spf - 1) / spf
+	pcm := signal(frames*spf, 2)
+	for c := range pcm {
+		for i := n; i < len(pcm[c]); i++ {
+			pcm[c][i] = 0
+		}
+	}
+	e.encode(pcm)
+
+	// An ID3v2 tag with 10 bytes of padding in front and an ID3v1 tag at the end.
+	stream := append([]byte("ID3\x04\x00\x00\x00\x00\x00\x0a"), make([]byte, 10)...)
+	stream = append(stream, e.infoFrame(frames, delay, frames*spf-delay-n)...)
+	stream = append(stream, e.bytes()...)
+	stream = append(stream, append([]byte("TAG"), make([]byte, 125)...)...)
+	r, out := decode(t, stream)
+	if r.TotalFrames() != int64(n) {
+		t.Errorf("got %d total frames, want %d", r.TotalFrames(), n)
+	}
+	if len(out) != 2*n {
+		t.Fatalf("got %d samples, want %d", len(out), 2*n)
+	}
+	if got := snr([][]float64{pcm[0][:n], pcm[1][:n]}, out, 0); got < 45 {
+		t.Errorf("SNR %.1f dB", got)
+	}
+}
+
+// TestLAMEFiles decodes streams written by LAME. music.mp3 comes from the testdata of
+// github.com/go-playground/validator (MIT) and holds four frames of "Impact Moderato" by
+// Kevin MacLeod behind an Info frame whose LAME tag gives no delay and no padding.
+// silent_1frame.mp3 comes from github.com/tcolgate/mp3 and holds one frame of silence.
+func TestLAMEFiles(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/music.mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, out := decode(t, data)
+	if info := r.StreamInfo(); info.SampleRate != 32000 || info.Channels != 2 {
+		t.Errorf("got %+v", info)
+	}
+	// Four frames less the samples still in the filterbanks, as LAME and FFmpeg give.
+	want := 4*1152 - decoderDelay
+	if r.TotalFrames() != int64(want) || len(out) != 2*want {
+		t.Fatalf("got %d total frames and %d samples, want %d", r.TotalFrames(), len(out), 2*want)
+	}
+	var peak float64
+	for _, v := range out {
+		peak = math.Max(peak, math.Abs(v))
+	}
+	if peak < 0.2 || peak > 1 {
+		t.Errorf("peak %v", peak)
+	}
+
+	data, err = ioutil.ReadFile("testdata/silent_1frame.mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, out = decode(t, data)
+	if info := r.StreamInfo(); info.SampleRate != 44100 || info.Channels != 2 {
+		t.Errorf("got %+v", info)
+	}
+	if len(out) != 2*1152 {
+		t.Fatalf("got %d samples, want %d", len(out), 2*1152)
+	}
+	for i, v := range out {
+		if v != 0 {
+			t.Fatalf("sample %d: got %v", i, v)
+		}
+	}
+}
+
+func TestFormats(t *testing.T) {
+	e := newEncoder(config{version: mpeg2, sampleRate: 16000, bitrate: 64, channels: 1})
+	e.encode(signal(20*e.samplesPerFrame(), 1))
+	stream := e.bytes()
+	_, want := decode(t, stream)
+
+	r, err := NewReader(bytes.NewReader(stream), format.S16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info := r.StreamInfo(); info.Format != format.S16 || info.ByteOrder != binary.LittleEndian {
+		t.Errorf("got %+v", info)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 2*len(want) {
+		t.Fatalf("got %d bytes, want %d", len(data), 2*len(want))
+	}
+	for i, f := range want {
+		s := int16(binary.LittleEndian.Uint16(data[2*i:]))
+		if math.Abs(float64(s)-f*32768) > 0.5 {
+			t.Fatalf("sample %d: got %d for %v", i, s, f)
+		}
+	}
+
+	if _, err := NewReader(bytes.NewReader(stream), format.S24); err != model.ErrInvalidFormat {
+		t.Errorf("S24: got %v", err)
+	}
+	if _, err := NewReader(bytes.NewReader(make([]byte, 4096)), format.F32); err != model.ErrInvalidHeader {
+		t.Errorf("no frames: got %v", err)
+	}
+}
+
+func TestStartMidStream(t *testing.T) {
+	e := newEncoder(config{version: mpeg1, sampleRate: 44100, bitrate: 128, channels: 1})
+	spf := e.samplesPerFrame()
+	pcm := signal(30*spf, 1)
+	e.encode(pcm)
+	// Start in the middle of the first frame, so that the decoder has to find the next
+	// one and lacks the main data that frames borrow from before.
+	cut := e.frameOffsets()[3]
+	_, out := decode(t, e.bytes()[cut-100:])
+	if len(out) != len(pcm[0])-3*spf {
+		t.Fatalf("got %d samples, want %d", len(out), len(pcm[0])-3*spf)
+	}
+	if got := snr([][]float64{pcm[0][3*spf:]}, out, filterDelay+576); got < 45 {
+		t.Errorf("SNR %.1f dB", got)
+	}
+}
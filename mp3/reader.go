@@ -0,0 +1,294 @@
+// Package mp3 decodes MPEG-1, MPEG-2 and MPEG-2.5 Layer III streams in pure Go,
+// describing their samples with pcm_convertor.StreamInfo.
+package mp3
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math"
+
+	"github.com/ZhangJYd/pcm_convertor"
+	"github.com/ZhangJYd/pcm_convertor/format"
+	"github.com/ZhangJYd/pcm_convertor/model"
+)
+
+// decoderDelay is the delay of the Layer III filterbanks, which gapless info leaves out.
+const decoderDelay = 529
+
+// Reader decodes an MP3 stream into little-endian F32 or S16 samples.
+//
+// When the first frame carries a Xing or Info header with a LAME tag, the encoder delay
+// and padding are trimmed so the output has exactly the samples that were encoded.
+type Reader struct {
+	r    *bufio.Reader
+	info pcm_convertor.StreamInfo
+	// first is the header of the first frame, which the following ones must match.
+	first  header
+	synced bool
+	dec    decoder
+	// frame holds a frame read but not yet decoded.
+	frame []byte
+	// skip is the number of frames still to drop from the start of the output.
+	skip int64
+	// remaining is the number of frames still to output, -1 if it is unknown.
+	remaining int64
+	total     int64
+	pcm       []float64
+	out       []byte
+	err       error
+}
+
+// NewReader reads the first frame of the MP3 stream in r and decodes it into samples
+// of format f, F32 or S16. An ID3v2 tag in front of the stream is skipped, as is any
+// junk between frames.
+func NewReader(r io.Reader, f format.PcmFormat) (*Reader, error) {
+	if f != format.F32 && f != format.S16 {
+		return nil, model.ErrInvalidFormat
+	}
+	mr := &Reader{r: bufio.NewReader(r), remaining: -1}
+	if err := mr.skipID3(); err != nil {
+		return nil, err
+	}
+	h, frame, err := mr.readFrame()
+	if err != nil {
+		return nil, model.ErrInvalidHeader
+	}
+	mr.first = h
+	mr.info = pcm_convertor.StreamInfo{
+		SampleRate: h.sampleRate(),
+		Format:     f,
+		ByteOrder:  binary.LittleEndian,
+		Channels:   h.channels(),
+	}
+	if !mr.parseInfoFrame(h, frame) {
+		mr.frame = frame
+	}
+	return mr, nil
+}
+
+// skipID3 skips an ID3v2 tag at the start of the stream.
+func (mr *Reader) skipID3() error {
+	hdr, err := mr.r.Peek(10)
+	if err != nil || string(hdr[:3]) != "ID3" {
+		return nil
+	}
+	// Version, flags, then a 28-bit size in 7-bit bytes.
+	size := int64(hdr[6])<<21 | int64(hdr[7])<<14 | int64(hdr[8])<<7 | int64(hdr[9])
+	if hdr[5]&0x10 != 0 {
+		size += 10
+	}
+	if _, err := io.CopyN(ioutil.Discard, mr.r, 10+size); err != nil {
+		return model.ErrInvalidHeader
+	}
+	return nil
+}
+
+// readFrame reads the next frame, skipping bytes until a frame header that matches the
+// first frame. The first frame itself must be followed by a matching header, if any,
+// so that junk in front of the stream is not taken for a frame. It returns io.EOF at
+// the end of the stream or of a truncated last frame.
+func (mr *Reader) readFrame() (header, []byte, error) {
+	for {
+		b, err := mr.r.Peek(4)
+		if err != nil {
+			return header{}, nil, io.EOF
+		}
+		if h, ok := parseHeader(b); ok && (!mr.synced || mr.matches(h)) {
+			size := h.frameSize()
+			// Frames are at most 1441 bytes, well within the buffer.
+			b, _ = mr.r.Peek(size + 4)
+			if len(b) < size {
+				return header{}, nil, io.EOF
+			}
+			if mr.synced || len(b) < size+4 || mr.continues(h, b[size:]) {
+				frame := append([]byte(nil), b[:size]...)
+				mr.r.Discard(size)
+				mr.synced = true
+				return h, frame, nil
+			}
+		}
+		mr.r.Discard(1)
+	}
+}
+
+// matches reports whether h continues the stream of the first frame.
+func (mr *Reader) matches(h header) bool {
+	return sameStream(h, mr.first)
+}
+
+// continues reports whether b starts with a frame header of the same stream as h.
+func (mr *Reader) continues(h header, b []byte) bool {
+	next, ok := parseHeader(b)
+	return ok && sameStream(h, next)
+}
+
+func sameStream(a, b header) bool {
+	return a.version == b.version && a.rateIndex == b.rateIndex && a.channels() == b.channels()
+}
+
+// parseInfoFrame reads the Xing, Info or VBRI header of the first frame, reporting
+// whether the frame is one, which holds no audio.
+func (mr *Reader) parseInfoFrame(h header, frame []byte) bool {
+	spf := int64(h.granules() * 576)
+	at := 4 + h.sideInfoSize()
+	if h.protected {
+		at += 2
+	}
+	if len(frame) >= 4+32+18 && string(frame[4+32:4+32+4]) == "VBRI" {
+		mr.total = int64(binary.BigEndian.Uint32(frame[4+32+14:])) * spf
+		return true
+	}
+	if len(frame) < at+8 {
+		return false
+	}
+	if tag := string(frame[at : at+4]); tag != "Xing" && tag != "Info" {
+		return false
+	}
+	flags := binary.BigEndian.Uint32(frame[at+4:])
+	at += 8
+	var frames int64
+	if flags&1 != 0 && len(frame) >= at+4 {
+		frames = int64(binary.BigEndian.Uint32(frame[at:]))
+		at += 4
+	}
+	if flags&2 != 0 {
+		at += 4
+	}
+	if flags&4 != 0 {
+		at += 100
+	}
+	if flags&8 != 0 {
+		at += 4
+	}
+	mr.total = frames * spf
+	// The LAME tag, also written by FFmpeg, holds the encoder delay and padding in two
+	// 12-bit fields.
+	if len(frame) < at+24 {
+		return true
+	}
+	switch string(frame[at : at+4]) {
+	case "LAME", "Lavf", "Lavc":
+	default:
+		return true
+	}
+	b := frame[at+21:]
+	delay := int64(b[0])<<4 | int64(b[1])>>4
+	padding := int64(b[1]&0xf)<<8 | int64(b[2])
+	// The last decoderDelay samples never leave the filterbanks, so a padding shorter
+	// than that cannot be kept to.
+	trim := padding
+	if trim < decoderDelay {
+		trim = decoderDelay
+	}
+	if frames > 0 && delay+trim < mr.total {
+		mr.skip = delay + decoderDelay
+		mr.total -= delay + trim
+		mr.remaining = mr.total
+	}
+	return true
+}
+
+// StreamInfo describes the decoded samples.
+func (mr *Reader) StreamInfo() pcm_convertor.StreamInfo {
+	return mr.info
+}
+
+// TotalFrames returns the number of frames of the stream as given by its Xing or VBRI
+// header, 0 if it is unknown.
+func (mr *Reader) TotalFrames() int64 {
+	return mr.total
+}
+
+// Read reads decoded samples.
+func (mr *Reader) Read(p []byte) (int, error) {
+	for len(mr.out) == 0 {
+		if mr.err != nil {
+			return 0, mr.err
+		}
+		mr.err = mr.decodeFrame()
+	}
+	n := copy(p, mr.out)
+	mr.out = mr.out[n:]
+	return n, nil
+}
+
+// decodeFrame decodes the next frame into mr.out.
+func (mr *Reader) decodeFrame() error {
+	if mr.remaining == 0 {
+		return io.EOF
+	}
+	frame := mr.frame
+	mr.frame = nil
+	h, ok := header{}, false
+	if frame != nil {
+		h, _ = parseHeader(frame)
+	} else {
+		var err error
+		if h, frame, err = mr.readFrame(); err != nil {
+			return err
+		}
+	}
+
+	channels := h.channels()
+	body := frame[4:]
+	if h.protected {
+		body = body[2:]
+	}
+	var si sideInfo
+	if len(body) >= h.sideInfoSize() {
+		si, ok = parseSideInfo(h, body)
+	}
+	if ok {
+		mr.pcm = mr.dec.decodeFrame(h, &si, body[h.sideInfoSize():], mr.pcm[:0])
+	} else {
+		// Keep the timing of a damaged frame with silence.
+		mr.pcm = append(mr.pcm[:0], make([]float64, h.granules()*576*channels)...)
+	}
+
+	pcm := mr.pcm
+	n := int64(len(pcm) / channels)
+	if mr.skip > 0 {
+		drop := mr.skip
+		if drop > n {
+			drop = n
+		}
+		mr.skip -= drop
+		pcm = pcm[drop*int64(channels):]
+		n -= drop
+	}
+	if mr.remaining >= 0 {
+		if n > mr.remaining {
+			n = mr.remaining
+			pcm = pcm[:n*int64(channels)]
+		}
+		mr.remaining -= n
+	}
+	mr.out = mr.encode(pcm)
+	return nil
+}
+
+// encode converts samples to the output format.
+func (mr *Reader) encode(pcm []float64) []byte {
+	size := mr.info.Format.FrameSize()
+	out := mr.out[:0]
+	if cap(out) < len(pcm)*size {
+		out = make([]byte, 0, len(pcm)*size)
+	}
+	out = out[:len(pcm)*size]
+	for i, s := range pcm {
+		if mr.info.Format == format.F32 {
+			binary.LittleEndian.PutUint32(out[4*i:], math.Float32bits(float32(s)))
+			continue
+		}
+		v := math.Round(s * 32768)
+		if v > math.MaxInt16 {
+			v = math.MaxInt16
+		} else if v < math.MinInt16 {
+			v = math.MinInt16
+		}
+		binary.LittleEndian.PutUint16(out[2*i:], uint16(int16(v)))
+	}
+	return out
+}
@@ -0,0 +1,59 @@
+package mp3
+
+// bitrates are the Layer III bit rates in kbit/s of MPEG-1 and of MPEG-2 and 2.5 by
+// bitrate index; index 0 is the free format.
+var bitrates = [2][15]int{
+	{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+}
+
+// sampleRates are the sample rates of MPEG-1, MPEG-2 and MPEG-2.5, three each. Their
+// position is the index into the scalefactor band tables.
+var sampleRates = [9]int{44100, 48000, 32000, 22050, 24000, 16000, 11025, 12000, 8000}
+
+// sfbLong are the starts of the scalefactor bands of long blocks by sample rate.
+var sfbLong = [9][23]int{
+	{0, 4, 8, 12, 16, 20, 24, 30, 36, 44, 52, 62, 74, 90, 110, 134, 162, 196, 238, 288, 342, 418, 576},
+	{0, 4, 8, 12, 16, 20, 24, 30, 36, 42, 50, 60, 72, 88, 106, 128, 156, 190, 230, 276, 330, 384, 576},
+	{0, 4, 8, 12, 16, 20, 24, 30, 36, 44, 54, 66, 82, 102, 126, 156, 194, 240, 296, 364, 448, 550, 576},
+	{0, 6, 12, 18, 24, 30, 36, 44, 54, 66, 80, 96, 116, 140, 168, 200, 238, 284, 336, 396, 464, 522, 576},
+	{0, 6, 12, 18, 24, 30, 36, 44, 54, 66, 80, 96, 114, 136, 162, 194, 232, 278, 332, 394, 464, 540, 576},
+	{0, 6, 12, 18, 24, 30, 36, 44, 54, 66, 80, 96, 116, 140, 168, 200, 238, 284, 336, 396, 464, 522, 576},
+	{0, 6, 12, 18, 24, 30, 36, 44, 54, 66, 80, 96, 116, 140, 168, 200, 238, 284, 336, 396, 464, 522, 576},
+	{0, 6, 12, 18, 24, 30, 36, 44, 54, 66, 80, 96, 116, 140, 168, 200, 238, 284, 336, 396, 464, 522, 576},
+	{0, 12, 24, 36, 48, 60, 72, 88, 108, 132, 160, 192, 232, 280, 336, 400, 476, 566, 568, 570, 572, 574, 576},
+}
+
+// sfbShort are the starts of the scalefactor bands of each window of short blocks by
+// sample rate.
+var sfbShort = [9][14]int{
+	{0, 4, 8, 12, 16, 22, 30, 40, 52, 66, 84, 106, 136, 192},
+	{0, 4, 8, 12, 16, 22, 28, 38, 50, 64, 80, 100, 126, 192},
+	{0, 4, 8, 12, 16, 22, 30, 42, 58, 78, 104, 138, 180, 192},
+	{0, 4, 8, 12, 18, 24, 32, 42, 56, 74, 100, 132, 174, 192},
+	{0, 4, 8, 12, 18, 26, 36, 48, 62, 80, 104, 136, 180, 192},
+	{0, 4, 8, 12, 18, 26, 36, 48, 62, 80, 104, 134, 174, 192},
+	{0, 4, 8, 12, 18, 26, 36, 48, 62, 80, 104, 134, 174, 192},
+	{0, 4, 8, 12, 18, 26, 36, 48, 62, 80, 104, 134, 174, 192},
+	{0, 8, 16, 24, 36, 52, 72, 96, 124, 160, 162, 164, 166, 192},
+}
+
+// pretab is added to the long block scalefactors when preflag is set.
+var pretab = [22]int{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 3, 3, 3, 2, 0}
+
+// slen are the scalefactor lengths of MPEG-1 by scalefac_compress.
+var slen = [2][16]uint{
+	{0, 0, 0, 0, 3, 1, 1, 1, 2, 2, 2, 3, 3, 3, 4, 4},
+	{0, 1, 2, 3, 0, 1, 2, 3, 1, 2, 3, 1, 2, 3, 2, 3},
+}
+
+// nrOfSfb are the number of scalefactors in each of the four MPEG-2 groups, by
+// scalefac_compress range and by long, short and mixed blocks.
+var nrOfSfb = [6][3][4]int{
+	{{6, 5, 5, 5}, {9, 9, 9, 9}, {6, 9, 9, 9}},
+	{{6, 5, 7, 3}, {9, 9, 12, 6}, {6, 9, 12, 6}},
+	{{11, 10, 0, 0}, {18, 18, 0, 0}, {15, 18, 0, 0}},
+	{{7, 7, 7, 0}, {12, 12, 12, 0}, {6, 15, 12, 0}},
+	{{6, 6, 6, 3}, {12, 9, 9, 6}, {6, 12, 9, 6}},
+	{{8, 8, 5, 0}, {15, 12, 9, 0}, {6, 18, 9, 0}},
+}
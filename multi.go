@@ -0,0 +1,160 @@
+package pcm_convertor
+
+import (
+	"sync"
+
+	"github.com/ZhangJYd/pcm_convertor/model"
+)
+
+// MultiConvertor runs the conversions of many independent streams on a fixed number of
+// worker goroutines. The chunks of each stream are converted one at a time and in the
+// order they were submitted, while different streams run in parallel.
+type MultiConvertor struct {
+	mu     sync.RWMutex
+	closed bool
+	tasks  chan func()
+	wg     sync.WaitGroup
+}
+
+func NewMultiConvertor(workers int) (*MultiConvertor, error) {
+	if workers <= 0 {
+		return nil, model.ErrInvalidParameter
+	}
+	m := &MultiConvertor{
+		tasks: make(chan func(), workers),
+	}
+	m.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer m.wg.Done()
+			for task := range m.tasks {
+				task()
+			}
+		}()
+	}
+	return m, nil
+}
+
+// NewStream adds a stream converted by a Convertor created with the given parameters.
+func (m *MultiConvertor) NewStream(in, out *StreamInfo, resampleQuality int, opts ...Option) (*Stream, error) {
+	c, err := NewConvertor(in, out, resampleQuality, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Stream{m: m, c: c}, nil
+}
+
+// Close waits for the submitted work to finish and stops the workers. Streams can't
+// submit work afterwards, but still have to be closed themselves.
+func (m *MultiConvertor) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return model.ErrClosed
+	}
+	m.closed = true
+	close(m.tasks)
+	m.mu.Unlock()
+	m.wg.Wait()
+	return nil
+}
+
+func (m *MultiConvertor) schedule(task func()) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return model.ErrClosed
+	}
+	m.tasks <- task
+	return nil
+}
+
+// Stream is a conversion run by a MultiConvertor.
+type Stream struct {
+	m *MultiConvertor
+	c *Convertor
+
+	mu      sync.Mutex
+	queue   []func()
+	running bool
+}
+
+// ProcessAsync queues data for conversion and returns at once. done is called from a
+// worker with the result, in submission order. data must not be changed until then.
+func (s *Stream) ProcessAsync(data []byte, done func([]byte, error)) error {
+	return s.submit(func() {
+		done(s.c.Process(data))
+	})
+}
+
+// Process converts data on one of the workers and waits for the result.
+func (s *Stream) Process(data []byte) ([]byte, error) {
+	return s.wait(s.c.Process, data)
+}
+
+// Flush returns the end of the stream held by the resampler, see Convertor.Flush.
+func (s *Stream) Flush() ([]byte, error) {
+	return s.wait(func([]byte) ([]byte, error) {
+		return s.c.Flush()
+	}, nil)
+}
+
+// Close releases the Convertor of the stream after the work queued for it.
+func (s *Stream) Close() error {
+	errCh := make(chan error, 1)
+	if err := s.submit(func() { errCh <- s.c.Close() }); err != nil {
+		// The workers are gone, so nothing is using the Convertor any more.
+		return s.c.Close()
+	}
+	return <-errCh
+}
+
+func (s *Stream) wait(fn func([]byte) ([]byte, error), data []byte) ([]byte, error) {
+	type result struct {
+		out []byte
+		err error
+	}
+	resultCh := make(chan result, 1)
+	err := s.submit(func() {
+		out, err := fn(data)
+		resultCh <- result{out, err}
+	})
+	if err != nil {
+		return nil, err
+	}
+	r := <-resultCh
+	return r.out, r.err
+}
+
+// submit appends task to the queue of the stream, and hands the stream to a worker
+// unless one is already working through its queue.
+func (s *Stream) submit(task func()) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.running {
+		// No worker holds the stream, so waiting for a free one with the lock held
+		// can't block the workers.
+		if err := s.m.schedule(s.run); err != nil {
+			return err
+		}
+		s.running = true
+	}
+	s.queue = append(s.queue, task)
+	return nil
+}
+
+// run works through the queue of the stream on a worker.
+func (s *Stream) run() {
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			s.running = false
+			s.mu.Unlock()
+			return
+		}
+		task := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+		task()
+	}
+}
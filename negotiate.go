@@ -0,0 +1,229 @@
+package pcm_convertor
+
+import (
+	"encoding/binary"
+
+	"github.com/ZhangJYd/pcm_convertor/format"
+	"github.com/ZhangJYd/pcm_convertor/model"
+)
+
+// Capabilities describes the audio a sink accepts. An empty list accepts any value.
+type Capabilities struct {
+	// SampleRates lists the accepted sample rates. When it is empty, any rate between
+	// MinSampleRate and MaxSampleRate is accepted, where 0 leaves that end open.
+	SampleRates   []int
+	MinSampleRate int
+	MaxSampleRate int
+	Formats       []format.PcmFormat
+	Channels      []int
+	ByteOrders    []binary.ByteOrder
+}
+
+// Accepts tells whether the sink takes info as it is.
+func (c *Capabilities) Accepts(info StreamInfo) bool {
+	return c.acceptsRate(info.SampleRate) && c.acceptsFormat(info.Format) &&
+		c.acceptsChannels(info.Channels) && c.acceptsByteOrder(info.ByteOrder)
+}
+
+func (c *Capabilities) acceptsRate(rate int) bool {
+	if len(c.SampleRates) > 0 {
+		for _, r := range c.SampleRates {
+			if r == rate {
+				return true
+			}
+		}
+		return false
+	}
+	return (c.MinSampleRate == 0 || rate >= c.MinSampleRate) && (c.MaxSampleRate == 0 || rate <= c.MaxSampleRate)
+}
+
+func (c *Capabilities) acceptsFormat(f format.PcmFormat) bool {
+	if len(c.Formats) == 0 {
+		return true
+	}
+	for _, v := range c.Formats {
+		if v == f {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Capabilities) acceptsChannels(channels int) bool {
+	if len(c.Channels) == 0 {
+		return true
+	}
+	for _, v := range c.Channels {
+		if v == channels {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Capabilities) acceptsByteOrder(order binary.ByteOrder) bool {
+	if len(c.ByteOrders) == 0 {
+		return true
+	}
+	for _, v := range c.ByteOrders {
+		if v == order {
+			return true
+		}
+	}
+	return false
+}
+
+// Target returns the StreamInfo the sink accepts that src converts to with the least loss.
+// Every property src already has in an accepted form is kept. Otherwise the lowest rate
+// not below the source one is chosen, the narrowest format that holds the source samples
+// exactly, and the smallest channel count not below the source one; when there is no such
+// value the closest one below it is used.
+func (c *Capabilities) Target(src StreamInfo) (StreamInfo, error) {
+	if c.MinSampleRate < 0 || c.MaxSampleRate < 0 || (c.MaxSampleRate != 0 && c.MinSampleRate > c.MaxSampleRate) {
+		return StreamInfo{}, model.ErrInvalidParameter
+	}
+	target := src
+	var err error
+	if target.SampleRate, err = c.targetRate(src.SampleRate); err != nil {
+		return StreamInfo{}, err
+	}
+	if target.Format, err = c.targetFormat(src.Format); err != nil {
+		return StreamInfo{}, err
+	}
+	if target.Channels, err = c.targetChannels(src.Channels); err != nil {
+		return StreamInfo{}, err
+	}
+	if !c.acceptsByteOrder(src.ByteOrder) {
+		target.ByteOrder = c.ByteOrders[0]
+	}
+	return target, nil
+}
+
+func (c *Capabilities) targetRate(rate int) (int, error) {
+	if c.acceptsRate(rate) {
+		return rate, nil
+	}
+	if len(c.SampleRates) == 0 {
+		if c.MinSampleRate != 0 && rate < c.MinSampleRate {
+			return c.MinSampleRate, nil
+		}
+		return c.MaxSampleRate, nil
+	}
+	return closestAbove(c.SampleRates, rate, model.ErrInvalidSampleRate)
+}
+
+func (c *Capabilities) targetChannels(channels int) (int, error) {
+	if c.acceptsChannels(channels) {
+		return channels, nil
+	}
+	// Only conversions from and to mono are supported.
+	var convertible []int
+	for _, v := range c.Channels {
+		if channels == 1 || v == 1 {
+			convertible = append(convertible, v)
+		}
+	}
+	return closestAbove(convertible, channels, model.ErrChannelsConvert)
+}
+
+// closestAbove returns the smallest positive value not below v, or else the largest one.
+func closestAbove(values []int, v int, errNone error) (int, error) {
+	best := 0
+	for _, x := range values {
+		switch {
+		case x <= 0:
+		case best == 0:
+			best = x
+		case best < v:
+			if x > best {
+				best = x
+			}
+		case x >= v && x < best:
+			best = x
+		}
+	}
+	if best == 0 {
+		return 0, errNone
+	}
+	return best, nil
+}
+
+func (c *Capabilities) targetFormat(f format.PcmFormat) (format.PcmFormat, error) {
+	if c.acceptsFormat(f) {
+		return f, nil
+	}
+	var best format.PcmFormat
+	found := false
+	for _, v := range c.Formats {
+		if v.FrameSize() < 0 || isCodec(v) {
+			continue
+		}
+		switch {
+		case !found:
+			best, found = v, true
+		case holdsExactly(v, f) != holdsExactly(best, f):
+			if holdsExactly(v, f) {
+				best = v
+			}
+		case holdsExactly(v, f):
+			if precision(v) < precision(best) {
+				best = v
+			}
+		case precision(v) > precision(best):
+			best = v
+		}
+	}
+	if !found {
+		return 0, model.ErrInvalidFormat
+	}
+	return best, nil
+}
+
+// precision is the number of significant bits of a format.
+func precision(f format.PcmFormat) int {
+	switch f {
+	case format.F32:
+		return 24
+	case format.F64:
+		return 53
+	case format.ULaw:
+		return 14
+	case format.ALaw:
+		return 13
+	}
+	return f.FrameSize() * 8
+}
+
+// holdsExactly tells whether every sample of from can be written as to without loss.
+func holdsExactly(to, from format.PcmFormat) bool {
+	if to == from {
+		return true
+	}
+	if to == format.ULaw || to == format.ALaw {
+		return false
+	}
+	toFloat := to == format.F32 || to == format.F64
+	fromFloat := from == format.F32 || from == format.F64
+	if fromFloat && !toFloat {
+		return false
+	}
+	return precision(to) >= precision(from)
+}
+
+// Negotiate picks the format sink accepts that src converts to with the least loss, see
+// Capabilities.Target, and creates the Convertor for it with the quality set by WithQuality.
+func Negotiate(src StreamInfo, sink *Capabilities, opts ...Option) (*Convertor, StreamInfo, error) {
+	target, err := sink.Target(src)
+	if err != nil {
+		return nil, StreamInfo{}, err
+	}
+	o, err := newOptions(opts, qualityOption)
+	if err != nil {
+		return nil, StreamInfo{}, err
+	}
+	c, err := newConvertor(&src, &target, o.quality, o)
+	if err != nil {
+		return nil, StreamInfo{}, err
+	}
+	return c, target, nil
+}
@@ -0,0 +1,99 @@
+package pcm_convertor
+
+import (
+	"runtime"
+	"time"
+
+	"github.com/ZhangJYd/pcm_convertor/model"
+	"github.com/ZhangJYd/pcm_convertor/resample"
+)
+
+// Option configures a Convertor. Functions given an Option that doesn't apply to them,
+// such as WithWorkers for NewConvertor, return model.ErrInvalidParameter.
+type Option func(*options)
+
+type options struct {
+	pureGo  bool
+	quality int
+	workers int
+	segment time.Duration
+	stages  []userStage
+	// given tells which of the options only some functions take were given.
+	given optionKind
+}
+
+// optionKind is a set of the options only some functions take.
+type optionKind uint
+
+const (
+	qualityOption optionKind = 1 << iota
+	workersOption
+	segmentOption
+)
+
+type userStage struct {
+	point    StagePoint
+	newStage StageFunc
+}
+
+// newOptions applies opts to the defaults. It fails if opts has options other than the
+// allowed ones and those every function takes.
+func newOptions(opts []Option, allowed optionKind) (options, error) {
+	o := options{
+		quality: resample.MediumQ,
+		workers: runtime.NumCPU(),
+		segment: 30 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.given&^allowed != 0 {
+		return o, model.ErrInvalidParameter
+	}
+	return o, nil
+}
+
+// WithPureGoResampler resamples with resample.PolyphaseResampler instead of soxr.
+// It is slower, but the Convertor state can then be saved with Snapshot.
+func WithPureGoResampler() Option {
+	return func(o *options) {
+		o.pureGo = true
+	}
+}
+
+// WithQuality sets the resample quality for the functions that create their Convertors
+// themselves, such as NewReader. It is one of the resample quality settings; the default
+// is resample.MediumQ.
+func WithQuality(quality int) Option {
+	return func(o *options) {
+		o.quality = quality
+		o.given |= qualityOption
+	}
+}
+
+// WithWorkers sets the number of goroutines ConvertReaderAt converts segments on.
+// The default is the number of CPUs.
+func WithWorkers(workers int) Option {
+	return func(o *options) {
+		o.workers = workers
+		o.given |= workersOption
+	}
+}
+
+// WithSegmentDuration sets the length of the input segments ConvertReaderAt splits the
+// audio into. The default is 30 seconds.
+func WithSegmentDuration(d time.Duration) Option {
+	return func(o *options) {
+		o.segment = d
+		o.given |= segmentOption
+	}
+}
+
+// WithStage adds the stage created by newStage at point to the Convertor. Stages added
+// at the same point run in the order they were given. A stage that implements io.Closer
+// is closed along with the Convertor.
+func WithStage(point StagePoint, newStage StageFunc) Option {
+	return func(o *options) {
+		o.stages = append(o.stages, userStage{point: point, newStage: newStage})
+	}
+}
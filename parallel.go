@@ -0,0 +1,165 @@
+package pcm_convertor
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/ZhangJYd/pcm_convertor/model"
+	"github.com/ZhangJYd/pcm_convertor/resample"
+)
+
+// warmup is how much input before and after a segment ConvertReaderAt feeds the resampler,
+// so its filters are settled at the segment boundaries. It is far longer than any filter.
+const warmup = time.Second
+
+// ConvertFile converts the raw audio in the file srcPath into the file dstPath,
+// see ConvertReaderAt.
+func ConvertFile(dstPath, srcPath string, in, out *StreamInfo, opts ...Option) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	dst, err := os.Create(dstPath)
+	if err != nil {
+		return err
+	}
+	if err = ConvertReaderAt(dst, src, fi.Size(), in, out, opts...); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// ConvertReaderAt converts the first size bytes of src and writes the result to dst.
+// The input is split into segments that are converted in parallel, each with its own
+// Convertor, and written in order. Every segment is converted together with some
+// input on either side and cut out of the result afterwards, so the joins match a
+// single pass through Convertor.Process and Flush. For that the Convertors always
+// resample in pure Go, as if created WithPureGoResampler: soxr's output depends on where
+// its input starts, so its segments wouldn't join up.
+func ConvertReaderAt(dst io.Writer, src io.ReaderAt, size int64, in, out *StreamInfo, opts ...Option) error {
+	o, err := newOptions(opts, qualityOption|workersOption|segmentOption)
+	if err != nil {
+		return err
+	}
+	if o.workers <= 0 || o.segment <= 0 {
+		return model.ErrInvalidParameter
+	}
+	o.pureGo = true
+	if in != nil && out != nil && (isCodec(in.Format) || isCodec(out.Format)) {
+		return model.ErrInvalidFormat
+	}
+	c, err := newConvertor(in, out, o.quality, o)
+	if err != nil {
+		return err
+	}
+	c.Close()
+
+	frameSize := int64(in.Format.FrameSize() * in.Channels)
+	frames := size / frameSize
+	// Cutting at multiples of period keeps every segment on the output sample grid.
+	period := int64(in.SampleRate / resample.GCD(in.SampleRate, out.SampleRate))
+	roundUp := func(d time.Duration) int64 {
+		n := int64(in.SampleRate) * int64(d) / int64(time.Second)
+		if n < 1 {
+			n = 1
+		}
+		return (n + period - 1) / period * period
+	}
+	segment := roundUp(o.segment)
+	pad := roundUp(warmup)
+	segments := int((frames + segment - 1) / segment)
+
+	type result struct {
+		data []byte
+		err  error
+	}
+	results := make([]chan result, segments)
+	for k := range results {
+		results[k] = make(chan result, 1)
+	}
+	// A slot is taken before a segment starts and given back once it is written,
+	// which bounds both the goroutines and the memory held by finished segments.
+	slots := make(chan struct{}, o.workers)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for k := 0; k < segments; k++ {
+			select {
+			case slots <- struct{}{}:
+			case <-done:
+				return
+			}
+			go func(k int) {
+				data, err := convertSegment(src, in, out, o, frames, int64(k)*segment, segment, pad)
+				results[k] <- result{data, err}
+			}(k)
+		}
+	}()
+
+	for k := 0; k < segments; k++ {
+		r := <-results[k]
+		if r.err != nil {
+			return r.err
+		}
+		if _, err = dst.Write(r.data); err != nil {
+			return err
+		}
+		<-slots
+	}
+	return nil
+}
+
+// convertSegment converts the input frames [start, start+length) with pad frames of
+// context on both sides, and returns the output that belongs to the segment itself.
+func convertSegment(src io.ReaderAt, in, out *StreamInfo, o options, frames, start, length, pad int64) ([]byte, error) {
+	end := start + length
+	if end > frames {
+		end = frames
+	}
+	from := start - pad
+	if from < 0 {
+		from = 0
+	}
+	to := end + pad
+	if to > frames {
+		to = frames
+	}
+
+	frameSize := int64(in.Format.FrameSize() * in.Channels)
+	data := make([]byte, (to-from)*frameSize)
+	if _, err := src.ReadAt(data, from*frameSize); err != nil && err != io.EOF {
+		return nil, err
+	}
+	c, err := newConvertor(in, out, o.quality, o)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	converted, err := c.Process(data)
+	if err != nil {
+		return nil, err
+	}
+	tail, err := c.Flush()
+	if err != nil {
+		return nil, err
+	}
+	converted = append(converted, tail...)
+
+	// from is a multiple of the period, so the output of this Convertor starts exactly at
+	// output frame from*out/in of the whole stream.
+	outFrameSize := int64(out.Format.FrameSize() * out.Channels)
+	outFrom := from * int64(out.SampleRate) / int64(in.SampleRate)
+	first := (start*int64(out.SampleRate)/int64(in.SampleRate) - outFrom) * outFrameSize
+	last := (end*int64(out.SampleRate)/int64(in.SampleRate) - outFrom) * outFrameSize
+	if last > int64(len(converted)) {
+		last = int64(len(converted))
+	}
+	return converted[first:last], nil
+}
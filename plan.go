@@ -0,0 +1,412 @@
+package pcm_convertor
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/ZhangJYd/pcm_convertor/format"
+	"github.com/ZhangJYd/pcm_convertor/resample"
+)
+
+// PlanStep describes one stage of a Convertor, see Convertor.Plan.
+type PlanStep struct {
+	Name string
+	In   StreamInfo
+	Out  StreamInfo
+}
+
+// resampler is implemented by resample.Resampler, resample.IntegerResampler and
+// resample.PolyphaseResampler. They all work on little-endian samples.
+type resampler interface {
+	Process(data []byte) ([]byte, error)
+	Flush() ([]byte, error)
+	ExpectedOutputFrames(totalIn int64) int64
+	Reset() error
+	Close() error
+}
+
+type stageKind int
+
+const (
+	downmixKind stageKind = iota
+	upmixKind
+	byteOrderKind
+	formatKind
+	soxrKind
+	polyphaseKind
+	integerKind
+	userKind
+	decodeKind
+	encodeKind
+)
+
+func (k stageKind) resamples() bool {
+	return k == soxrKind || k == polyphaseKind || k == integerKind
+}
+
+// stageWeights is the rough cost of every kind of stage per byte it reads or writes.
+// Only the ratios matter. They are estimates from the work each stage does per sample,
+// not measurements, and only need to rank the candidate chains sensibly.
+var stageWeights = map[stageKind]float64{
+	downmixKind:   1,
+	upmixKind:     1,
+	byteOrderKind: 1,
+	formatKind:    3,
+	soxrKind:      6,
+	polyphaseKind: 16,
+	integerKind:   2,
+	userKind:      0,
+}
+
+// stageSpec is a stage the planner has decided on but not created yet.
+type stageSpec struct {
+	kind     stageKind
+	in       StreamInfo
+	out      StreamInfo
+	newStage StageFunc
+}
+
+func (s stageSpec) cost() float64 {
+	bytesPerSecond := func(info StreamInfo) float64 {
+		return float64(info.SampleRate * info.Channels * info.Format.FrameSize())
+	}
+	return stageWeights[s.kind] * (bytesPerSecond(s.in) + bytesPerSecond(s.out))
+}
+
+// planner lays out candidate stage chains, keeping track of what the audio looks like
+// at the end of the chain so far.
+type planner struct {
+	opts    options
+	quality int
+	info    StreamInfo
+	specs   []stageSpec
+}
+
+func (b *planner) add(kind stageKind, out StreamInfo) {
+	b.specs = append(b.specs, stageSpec{kind: kind, in: b.info, out: out})
+	b.info = out
+}
+
+func (b *planner) addUserStages(point StagePoint) {
+	for _, us := range b.opts.stages {
+		if us.point == point {
+			b.specs = append(b.specs, stageSpec{kind: userKind, in: b.info, out: b.info, newStage: us.newStage})
+		}
+	}
+}
+
+func (b *planner) setChannels(channels int) {
+	if b.info.Channels == channels {
+		return
+	}
+	out := b.info
+	out.Channels = channels
+	if channels < b.info.Channels {
+		b.add(downmixKind, out)
+	} else {
+		b.add(upmixKind, out)
+	}
+}
+
+func (b *planner) setByteOrder(order binary.ByteOrder) {
+	if b.info.ByteOrder == order || b.info.Format.FrameSize() == 1 {
+		return
+	}
+	out := b.info
+	out.ByteOrder = order
+	b.add(byteOrderKind, out)
+}
+
+func (b *planner) convertFormat(f format.PcmFormat, order binary.ByteOrder) {
+	if b.info.Format == f {
+		b.setByteOrder(order)
+		return
+	}
+	out := b.info
+	out.Format = f
+	out.ByteOrder = order
+	b.add(formatKind, out)
+}
+
+// resample adds a resampler from rin to rout, with the user stages around it.
+// The resamplers work in little-endian.
+func (b *planner) resample(rate int, rin, rout format.PcmFormat) {
+	b.convertFormat(rin, binary.LittleEndian)
+	b.addUserStages(BeforeResample)
+	kind := soxrKind
+	switch {
+	case useInteger(rin, rout, b.info.SampleRate, rate, b.quality):
+		kind = integerKind
+	case b.opts.pureGo:
+		kind = polyphaseKind
+	}
+	out := b.info
+	out.SampleRate = rate
+	out.Format = rout
+	b.add(kind, out)
+	b.addUserStages(AfterResample)
+}
+
+func (b *planner) cost() float64 {
+	var cost float64
+	for _, s := range b.specs {
+		cost += s.cost()
+	}
+	return cost
+}
+
+// useInteger tells whether the integer resampler does for rin to rout at the given rates
+// and quality.
+func useInteger(rin, rout format.PcmFormat, inRate, outRate, quality int) bool {
+	return rin == format.S16 && rout == format.S16 && resample.IntegerRatio(inRate, outRate) != 0 &&
+		quality <= resample.IntegerQuality
+}
+
+// canResample tells whether a resampler can read rin and write rout at the given rates
+// and quality.
+func canResample(rin, rout format.PcmFormat, inRate, outRate, quality int) bool {
+	if useInteger(rin, rout, inRate, outRate, quality) {
+		return true
+	}
+	return rin.ToSoxrDatatype() >= 0 && rout.ToSoxrDatatype() >= 0
+}
+
+// intermediateFormat is the narrowest format the resamplers take that holds f exactly.
+func intermediateFormat(f format.PcmFormat) format.PcmFormat {
+	switch f {
+	case format.U8, format.ULaw, format.ALaw:
+		return format.S16
+	case format.S24:
+		return format.S32
+	}
+	return f
+}
+
+// planStages decodes in and encodes out if they are formats coded in blocks, and plans
+// the chain between the samples with planPCMStages.
+func planStages(in, out *StreamInfo, quality int, o options, keep *stageSpec) []stageSpec {
+	var head, tail []stageSpec
+	if pcm, ok := decoded(in); ok {
+		head = []stageSpec{{kind: decodeKind, in: *in, out: pcm}}
+		in = &pcm
+	}
+	if pcm, ok := decoded(out); ok {
+		tail = []stageSpec{{kind: encodeKind, in: pcm, out: *out}}
+		out = &pcm
+	}
+	specs := planPCMStages(in, out, quality, o, keep)
+	return append(append(head, specs...), tail...)
+}
+
+// isCodec tells whether f is a format coded in blocks, see format.RegisterCodec.
+func isCodec(f format.PcmFormat) bool {
+	_, ok := format.CodecOf(f)
+	return ok
+}
+
+// decoded describes the samples a stream in a codec format codes, and reports whether
+// info is in one.
+func decoded(info *StreamInfo) (StreamInfo, bool) {
+	if !isCodec(info.Format) {
+		return StreamInfo{}, false
+	}
+	return StreamInfo{SampleRate: info.SampleRate, Format: format.S16, ByteOrder: binary.LittleEndian, Channels: 1}, true
+}
+
+// planPCMStages picks the cheapest chain of stages that turns in into out according to
+// stageWeights. Channels are always reduced first and added last, so the stages in
+// between see as few of them as possible, and identity steps are left out. When the rate
+// changes, the candidates resample in the input format, in the output format, or from
+// one to the other in one pass, so e.g. S16 to F64 is resampled at S16 and widened after.
+// With keep, the chain is built around that resampler instead, see canKeep.
+func planPCMStages(in, out *StreamInfo, quality int, o options, keep *stageSpec) []stageSpec {
+	channels := minChannels(in, out)
+	if keep != nil {
+		channels = keep.in.Channels
+	}
+	candidate := func(middle func(b *planner)) *planner {
+		b := &planner{opts: o, quality: quality, info: *in}
+		b.addUserStages(AtInput)
+		b.setChannels(channels)
+		middle(b)
+		b.convertFormat(out.Format, out.ByteOrder)
+		b.setChannels(out.Channels)
+		b.addUserStages(AtOutput)
+		return b
+	}
+
+	if in.SampleRate == out.SampleRate {
+		return candidate(func(b *planner) {
+			b.addUserStages(BeforeResample)
+			b.convertFormat(out.Format, out.ByteOrder)
+			b.addUserStages(AfterResample)
+		}).specs
+	}
+	if keep != nil {
+		return candidate(func(b *planner) {
+			b.convertFormat(keep.in.Format, binary.LittleEndian)
+			b.addUserStages(BeforeResample)
+			b.add(keep.kind, keep.out)
+			b.addUserStages(AfterResample)
+		}).specs
+	}
+
+	pairs := [][2]format.PcmFormat{
+		{in.Format, out.Format},
+		{in.Format, in.Format},
+		{out.Format, out.Format},
+		{intermediateFormat(in.Format), intermediateFormat(in.Format)},
+		{intermediateFormat(out.Format), intermediateFormat(out.Format)},
+	}
+	var best *planner
+	for _, pair := range pairs {
+		if !canResample(pair[0], pair[1], in.SampleRate, out.SampleRate, quality) {
+			continue
+		}
+		b := candidate(func(b *planner) {
+			b.resample(out.SampleRate, pair[0], pair[1])
+		})
+		if best == nil || b.cost() < best.cost() {
+			best = b
+		}
+	}
+	if best == nil {
+		// Nothing can resample these formats; let the resampler report it.
+		return candidate(func(b *planner) {
+			b.resample(out.SampleRate, out.Format, out.Format)
+		}).specs
+	}
+	return best.specs
+}
+
+// canKeep tells whether a chain from in to out can be built around the resampler of p.
+// The rates must stay the same, the channels must convert to and from the ones the
+// resampler works with, and the resampler must be the one a new chain would pick, so
+// that e.g. one working in S16 isn't kept for F32 audio.
+func canKeep(in, out *StreamInfo, quality int, o options, p *pipeline) bool {
+	if p == nil || p.resampler == nil || in.SampleRate != p.spec.in.SampleRate || out.SampleRate != p.spec.out.SampleRate {
+		return false
+	}
+	convertible := func(a, b int) bool {
+		return a == b || a == 1 || b == 1
+	}
+	if !convertible(in.Channels, p.spec.in.Channels) || !convertible(p.spec.in.Channels, out.Channels) {
+		return false
+	}
+	for _, s := range planStages(in, out, quality, o, nil) {
+		if s.kind.resamples() {
+			return s.kind == p.spec.kind && s.in.Format == p.spec.in.Format && s.out.Format == p.spec.out.Format
+		}
+	}
+	return false
+}
+
+// pipeline is the stage chain of a Convertor created from the planned stageSpecs.
+type pipeline struct {
+	stages []Stage
+	plan   []PlanStep
+	// resampler is the resampler among the stages, nil if the rate doesn't change.
+	resampler resampler
+	// spec and at describe the resampler and where it is in stages.
+	spec stageSpec
+	at   int
+}
+
+// buildPipeline creates the stages from in to out. With keep, the new pipeline shares the
+// resampler of keep rather than creating one, see canKeep.
+func buildPipeline(in, out *StreamInfo, resampleQuality int, o options, keep *pipeline) (b *pipeline, err error) {
+	b = &pipeline{at: -1}
+	defer func() {
+		if err != nil {
+			b.closeExcept(keep)
+			b = nil
+		}
+	}()
+	var keepSpec *stageSpec
+	if keep != nil {
+		keepSpec = &keep.spec
+	}
+	for _, spec := range planStages(in, out, resampleQuality, o, keepSpec) {
+		var s Stage
+		switch spec.kind {
+		case downmixKind:
+			s = newDownmixStage(spec.in.Format, spec.in.Channels, spec.in.ByteOrder)
+		case upmixKind:
+			s = newUpmixStage(spec.out.Format, spec.out.Channels)
+		case byteOrderKind:
+			s = newByteOrderStage(spec.in.Format, spec.in.ByteOrder, spec.out.ByteOrder)
+		case formatKind:
+			var c *format.Convertor
+			if c, err = format.NewFormatConvertor(spec.in.Format, spec.out.Format, spec.in.ByteOrder, spec.out.ByteOrder); err != nil {
+				return
+			}
+			s = &formatStage{c: c}
+		case integerKind, polyphaseKind, soxrKind:
+			if s, err = b.newResampleStage(spec, resampleQuality, keep); err != nil {
+				return
+			}
+		case userKind:
+			if s, err = spec.newStage(spec.in); err != nil {
+				return
+			}
+		case decodeKind:
+			c, _ := format.CodecOf(spec.in.Format)
+			s = newDecodeStage(spec.in.Format, c)
+		case encodeKind:
+			c, _ := format.CodecOf(spec.out.Format)
+			s = newEncodeStage(spec.out.Format, c)
+		}
+		b.stages = append(b.stages, s)
+		b.plan = append(b.plan, PlanStep{Name: s.Name(), In: spec.in, Out: spec.out})
+	}
+	return
+}
+
+func (b *pipeline) newResampleStage(spec stageSpec, resampleQuality int, keep *pipeline) (Stage, error) {
+	b.spec = spec
+	b.at = len(b.stages)
+	if keep != nil {
+		b.resampler = keep.resampler
+		return keep.stages[keep.at], nil
+	}
+	var err error
+	switch spec.kind {
+	case integerKind:
+		b.resampler, err = resample.NewIntegerResampler(spec.in.SampleRate, spec.out.SampleRate, spec.in.Channels)
+	case polyphaseKind:
+		b.resampler, err = resample.NewPolyphaseResampler(spec.in.SampleRate, spec.out.SampleRate, spec.in.Channels,
+			resampleQuality, spec.in.Format, spec.out.Format)
+	default:
+		b.resampler, err = resample.NewResampler(spec.in.SampleRate, spec.out.SampleRate, spec.in.Channels,
+			resampleQuality, spec.in.Format, spec.out.Format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &resampleStage{name: "resample " + [...]string{integerKind: "integer", polyphaseKind: "polyphase", soxrKind: "soxr"}[spec.kind], r: b.resampler}, nil
+}
+
+// closeExcept closes the stages of b that implement io.Closer, except the ones it shares with keep.
+func (b *pipeline) closeExcept(keep *pipeline) error {
+	var err error
+	for _, s := range b.stages {
+		if keep != nil && keep.shares(s) {
+			continue
+		}
+		if c, ok := s.(io.Closer); ok {
+			if cerr := c.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	}
+	return err
+}
+
+func (b *pipeline) shares(s Stage) bool {
+	for _, v := range b.stages {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+package pcm_convertor
+
+import (
+	"io"
+
+	"github.com/ZhangJYd/pcm_convertor/model"
+)
+
+// SourceFunc adapts a callback to the io.Reader a PullConvertor reads from.
+// Returning 0 and a nil error means no input is available right now.
+type SourceFunc func(p []byte) (int, error)
+
+func (f SourceFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
+
+// PullConvertor produces a fixed number of output frames per call, fetching as much
+// input as that takes, e.g. for a playback callback that needs 320 frames every 20 ms.
+type PullConvertor struct {
+	src     io.Reader
+	c       *Convertor
+	in      *StreamInfo
+	out     *StreamInfo
+	pending []byte
+	eof     bool
+}
+
+func NewPullConvertor(src io.Reader, in, out *StreamInfo, opts ...Option) (*PullConvertor, error) {
+	o, err := newOptions(opts, qualityOption)
+	if err != nil {
+		return nil, err
+	}
+	if in != nil && out != nil && (isCodec(in.Format) || isCodec(out.Format)) {
+		return nil, model.ErrInvalidFormat
+	}
+	c, err := newConvertor(in, out, o.quality, o)
+	if err != nil {
+		return nil, err
+	}
+	return &PullConvertor{
+		src: src,
+		c:   c,
+		in:  in,
+		out: out,
+	}, nil
+}
+
+// ReadFrames fills dst with exactly n output frames and returns n.
+// When the source has no input available before n frames are ready, the frames that are
+// ready are followed by silence and model.ErrUnderrun is returned with their count.
+// At the end of the source the same happens with io.EOF.
+func (p *PullConvertor) ReadFrames(dst []byte, n int) (int, error) {
+	outFrameSize := p.out.Format.FrameSize() * p.out.Channels
+	if n < 0 || len(dst) < n*outFrameSize {
+		return 0, model.ErrInvalidParameter
+	}
+	need := n * outFrameSize
+	var err error
+	for len(p.pending) < need && err == nil {
+		err = p.fill(need - len(p.pending))
+	}
+
+	got := copy(dst[:need], p.pending)
+	p.pending = p.pending[got:]
+	silence := p.out.Format.Silence()
+	for i := got; i < need; i++ {
+		dst[i] = silence
+	}
+	if got == need {
+		return n, nil
+	}
+	return got / outFrameSize, err
+}
+
+// fill converts enough input for about missing more output bytes.
+func (p *PullConvertor) fill(missing int) error {
+	if p.eof {
+		return io.EOF
+	}
+	outFrames := (missing + p.out.Format.FrameSize()*p.out.Channels - 1) / (p.out.Format.FrameSize() * p.out.Channels)
+	inFrames := (outFrames*p.in.SampleRate + p.out.SampleRate - 1) / p.out.SampleRate
+	buf := make([]byte, inFrames*p.in.Format.FrameSize()*p.in.Channels)
+
+	n, err := p.src.Read(buf)
+	if n > 0 {
+		out, perr := p.c.Process(buf[:n])
+		if perr != nil {
+			return perr
+		}
+		p.pending = append(p.pending, out...)
+	}
+	if err == io.EOF {
+		p.eof = true
+		tail, ferr := p.c.Flush()
+		if ferr != nil {
+			return ferr
+		}
+		p.pending = append(p.pending, tail...)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return model.ErrUnderrun
+	}
+	return nil
+}
+
+// Close releases the Convertor. It does not close the source.
+func (p *PullConvertor) Close() error {
+	return p.c.Close()
+}
@@ -0,0 +1,323 @@
+package resample
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"sync"
+
+	"github.com/ZhangJYd/pcm_convertor/model"
+)
+
+const (
+	// zeroCrossings is the number of sinc zero crossings on each side of the filter centre.
+	zeroCrossings = 12
+	// kaiserBeta gives roughly 70 dB of stopband attenuation.
+	kaiserBeta = 7.0
+	// integerZeroCrossings and integerBeta give the filters of IntegerResampler roughly
+	// 96 dB of stopband attenuation, the range of S16 audio.
+	integerZeroCrossings = 16
+	integerBeta          = 9.6
+)
+
+// IntegerQuality is the highest quality setting IntegerResampler lives up to: 16 bits,
+// like MediumQ. Higher settings call for soxr.
+const IntegerQuality = MediumQ
+
+// decimationStages and interpolationStages split every supported ratio into a cascade
+// of 2x half-band and 3x polyphase stages, with the half-band stage at the high rate.
+var (
+	decimationStages    = map[int][]int{2: {2}, 3: {3}, 4: {2, 2}, 6: {2, 3}}
+	interpolationStages = map[int][]int{2: {2}, 3: {3}, 4: {2, 2}, 6: {3, 2}}
+)
+
+// IntegerRatio returns the factor between inRate and outRate when one of them is 2, 3, 4
+// or 6 times the other, and 0 otherwise.
+func IntegerRatio(inRate, outRate int) int {
+	if inRate <= 0 || outRate <= 0 {
+		return 0
+	}
+	factor := 0
+	if inRate > outRate && inRate%outRate == 0 {
+		factor = inRate / outRate
+	} else if outRate > inRate && outRate%inRate == 0 {
+		factor = outRate / inRate
+	}
+	if _, ok := decimationStages[factor]; !ok {
+		return 0
+	}
+	return factor
+}
+
+// IntegerResampler resamples little-endian S16 audio by the integer ratios accepted by
+// IntegerRatio, such as the telephony conversions 48k->16k, 16k->8k and 8k->16k, in pure
+// Go fixed point. Each stage of the cascade is a Kaiser-windowed Nyquist filter whose
+// zero taps are skipped and that only computes the output frames it keeps.
+// BenchmarkResample compares its cost with soxr's.
+//
+// Its filters are only good for IntegerQuality: they reach 96 dB of attenuation but are
+// 6 dB down at the output Nyquist frequency, so a little aliasing remains right below it.
+// At HighQ and above the Convertor resamples with soxr, whatever the ratio.
+type IntegerResampler struct {
+	mu       sync.Mutex
+	inRate   int
+	outRate  int
+	channels int
+	stages   []*firStage
+	cache    *bytes.Buffer
+}
+
+func NewIntegerResampler(inRate, outRate, channels int) (*IntegerResampler, error) {
+	if inRate <= 0 || outRate <= 0 {
+		return nil, model.ErrInvalidSampleRate
+	}
+	if channels <= 0 {
+		return nil, model.ErrInvalidChannels
+	}
+	factor := IntegerRatio(inRate, outRate)
+	if factor == 0 {
+		return nil, model.ErrUnsupportedRatio
+	}
+	r := &IntegerResampler{
+		inRate:   inRate,
+		outRate:  outRate,
+		channels: channels,
+		cache:    new(bytes.Buffer),
+	}
+	if inRate > outRate {
+		for _, f := range decimationStages[factor] {
+			r.stages = append(r.stages, newFirStage(1, f, channels))
+		}
+	} else {
+		for _, f := range interpolationStages[factor] {
+			r.stages = append(r.stages, newFirStage(f, 1, channels))
+		}
+	}
+	return r, nil
+}
+
+func (r *IntegerResampler) Process(data []byte) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(data) == 0 {
+		return data, nil
+	}
+	// Partial frames wait in the cache until the rest of the frame arrives.
+	r.cache.Write(data)
+	framesLen := r.cache.Len() / 2 / r.channels
+	if framesLen == 0 {
+		return []byte{}, nil
+	}
+	samples := bytesToS16(r.cache.Next(framesLen * 2 * r.channels))
+	for _, s := range r.stages {
+		samples = s.process(samples, false)
+	}
+	return s16ToBytes(samples), nil
+}
+
+// Flush returns the remaining output for the input seen so far, treating the signal as
+// silent after its end, and resets the resampler so it can start a new stream.
+func (r *IntegerResampler) Flush() ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var samples []int16
+	for _, s := range r.stages {
+		samples = s.process(samples, true)
+	}
+	r.reset()
+	return s16ToBytes(samples), nil
+}
+
+// ExpectedOutputFrames returns the number of output frames totalIn input frames resample to.
+func (r *IntegerResampler) ExpectedOutputFrames(totalIn int64) int64 {
+	return totalIn * int64(r.outRate) / int64(r.inRate)
+}
+
+// Reset drops the buffered input and the filter history, so the resampler can start a
+// new stream without being created again.
+func (r *IntegerResampler) Reset() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reset()
+	return nil
+}
+
+func (r *IntegerResampler) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reset()
+	return nil
+}
+
+func (r *IntegerResampler) reset() {
+	r.cache.Reset()
+	for _, s := range r.stages {
+		s.reset()
+	}
+}
+
+type firTap struct {
+	// back is how many input frames before the newest one involved the tap applies to.
+	back int
+	coef int64
+}
+
+// firStage interpolates by up or decimates by down, one of them being 1, with a
+// linear-phase Nyquist filter in Q30. Its group delay is compensated, so output frame k
+// lines up with input frame k*down/up like soxr's output does.
+type firStage struct {
+	up       int
+	down     int
+	channels int
+	delay    int
+	// phases holds the non-zero taps for every position of an output frame between
+	// two input frames; the half-band and third-band zeros are skipped this way.
+	phases  [][]firTap
+	maxBack int
+
+	// hist holds the interleaved input frames from frame index base onward.
+	hist      []int16
+	base      int64
+	inFrames  int64
+	outFrames int64
+}
+
+func newFirStage(up, down, channels int) *firStage {
+	h, delay := designFilter(up, down, integerZeroCrossings, integerBeta)
+	s := &firStage{
+		up:       up,
+		down:     down,
+		channels: channels,
+		delay:    delay,
+		phases:   make([][]firTap, up),
+	}
+	for p := 0; p < up; p++ {
+		for j := 0; p+j*up < len(h); j++ {
+			coef := int64(math.Round(h[p+j*up] * (1 << 30)))
+			if coef == 0 {
+				continue
+			}
+			s.phases[p] = append(s.phases[p], firTap{back: j, coef: coef})
+			if j > s.maxBack {
+				s.maxBack = j
+			}
+		}
+	}
+	return s
+}
+
+// designFilter returns a Kaiser-windowed sinc lowpass for resampling by up/down, at the
+// rate of the input upsampled by up, along with its group delay. The cutoff sits at the
+// lower of the two Nyquist frequencies, and beta sets the Kaiser window. The gain is up,
+// since each polyphase branch only sees one in up of the taps.
+func designFilter(up, down, zeroCrossings int, beta float64) ([]float64, int) {
+	factor := up
+	if down > up {
+		factor = down
+	}
+	delay := factor * zeroCrossings
+	h := make([]float64, 2*delay+1)
+	var sum float64
+	for n := range h {
+		x := float64(n-delay) / float64(factor)
+		w := besselI0(beta*math.Sqrt(1-math.Pow(float64(n-delay)/float64(delay), 2))) / besselI0(beta)
+		h[n] = sinc(x) * w
+		sum += h[n]
+	}
+	for n := range h {
+		h[n] *= float64(up) / sum
+	}
+	return h, delay
+}
+
+func (s *firStage) reset() {
+	s.hist = s.hist[:0]
+	s.base = 0
+	s.inFrames = 0
+	s.outFrames = 0
+}
+
+// process appends the interleaved frames in to the history and returns every output
+// frame that can be computed. With flush set the input is taken to be silent past its
+// end and all the output owed for it is returned.
+func (s *firStage) process(in []int16, flush bool) []int16 {
+	s.hist = append(s.hist, in...)
+	s.inFrames += int64(len(in) / s.channels)
+
+	expected := s.inFrames * int64(s.up) / int64(s.down)
+	out := make([]int16, 0, int(expected-s.outFrames)*s.channels)
+	for ; s.outFrames < expected; s.outFrames++ {
+		t := s.outFrames*int64(s.down) + int64(s.delay)
+		newest := t / int64(s.up)
+		if newest >= s.inFrames && !flush {
+			break
+		}
+		taps := s.phases[t%int64(s.up)]
+		for c := 0; c < s.channels; c++ {
+			var acc int64
+			for _, tap := range taps {
+				i := newest - int64(tap.back)
+				if i < s.base || i >= s.inFrames {
+					// Silence before the start and after the end of the stream.
+					continue
+				}
+				acc += tap.coef * int64(s.hist[int(i-s.base)*s.channels+c])
+			}
+			out = append(out, saturateS16((acc+1<<29)>>30))
+		}
+	}
+
+	// Drop the history the next output frame no longer needs.
+	next := (s.outFrames*int64(s.down)+int64(s.delay))/int64(s.up) - int64(s.maxBack)
+	if drop := next - s.base; drop > 0 {
+		if drop > int64(len(s.hist)/s.channels) {
+			drop = int64(len(s.hist) / s.channels)
+		}
+		s.hist = append(s.hist[:0], s.hist[int(drop)*s.channels:]...)
+		s.base += drop
+	}
+	return out
+}
+
+func saturateS16(v int64) int16 {
+	if v > math.MaxInt16 {
+		return math.MaxInt16
+	}
+	if v < math.MinInt16 {
+		return math.MinInt16
+	}
+	return int16(v)
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+// besselI0 is the zeroth order modified Bessel function of the first kind.
+func besselI0(x float64) float64 {
+	sum, term := 1.0, 1.0
+	for k := 1; term > 1e-12*sum; k++ {
+		term *= (x / 2 / float64(k)) * (x / 2 / float64(k))
+		sum += term
+	}
+	return sum
+}
+
+func bytesToS16(data []byte) []int16 {
+	samples := make([]int16, len(data)/2)
+	for i := range samples {
+		samples[i] = int16(binary.LittleEndian.Uint16(data[2*i:]))
+	}
+	return samples
+}
+
+func s16ToBytes(samples []int16) []byte {
+	data := make([]byte, 2*len(samples))
+	for i, v := range samples {
+		binary.LittleEndian.PutUint16(data[2*i:], uint16(v))
+	}
+	return data
+}
@@ -0,0 +1,249 @@
+package resample
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"sync"
+
+	"github.com/ZhangJYd/pcm_convertor/format"
+	"github.com/ZhangJYd/pcm_convertor/model"
+)
+
+// PolyphaseResampler is a pure-Go rational-ratio resampler. It is slower than soxr,
+// but unlike soxr its whole state can be saved with Snapshot and brought back with Restore.
+// Like Resampler it reads native-endian inFormat samples and writes outFormat ones.
+type PolyphaseResampler struct {
+	mu        sync.Mutex
+	inRate    int
+	outRate   int
+	channels  int
+	inFormat  format.PcmFormat
+	outFormat format.PcmFormat
+	stage     *floatStage
+	cache     *bytes.Buffer
+}
+
+func NewPolyphaseResampler(inRate, outRate, channels, quality int, inFormat, outFormat format.PcmFormat) (*PolyphaseResampler, error) {
+	if inRate <= 0 || outRate <= 0 {
+		return nil, model.ErrInvalidSampleRate
+	}
+	if inFormat.ToSoxrDatatype() < 0 || outFormat.ToSoxrDatatype() < 0 {
+		return nil, model.ErrInvalidFormat
+	}
+	if channels <= 0 {
+		return nil, model.ErrInvalidChannels
+	}
+	g := GCD(inRate, outRate)
+	return &PolyphaseResampler{
+		inRate:    inRate,
+		outRate:   outRate,
+		channels:  channels,
+		inFormat:  inFormat,
+		outFormat: outFormat,
+		stage:     newFloatStage(outRate/g, inRate/g, channels, qualityZeroCrossings(quality)),
+		cache:     new(bytes.Buffer),
+	}, nil
+}
+
+func (r *PolyphaseResampler) Process(data []byte) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(data) == 0 {
+		return data, nil
+	}
+	// Partial frames wait in the cache until the rest of the frame arrives.
+	r.cache.Write(data)
+	framesLen := r.cache.Len() / r.inFormat.FrameSize() / r.channels
+	if framesLen == 0 {
+		return []byte{}, nil
+	}
+	samples := decodeSamples(r.cache.Next(framesLen*r.inFormat.FrameSize()*r.channels), r.inFormat)
+	return encodeSamples(r.stage.process(samples, false), r.outFormat), nil
+}
+
+// Flush returns the remaining output for the input seen so far, treating the signal as
+// silent after its end, and resets the resampler so it can start a new stream.
+func (r *PolyphaseResampler) Flush() ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := encodeSamples(r.stage.process(nil, true), r.outFormat)
+	r.reset()
+	return out, nil
+}
+
+// ExpectedOutputFrames returns the number of output frames totalIn input frames resample to.
+func (r *PolyphaseResampler) ExpectedOutputFrames(totalIn int64) int64 {
+	return totalIn * int64(r.outRate) / int64(r.inRate)
+}
+
+// Reset drops the buffered input and the filter history, so the resampler can start a
+// new stream without being created again.
+func (r *PolyphaseResampler) Reset() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reset()
+	return nil
+}
+
+func (r *PolyphaseResampler) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reset()
+	return nil
+}
+
+func (r *PolyphaseResampler) reset() {
+	r.cache.Reset()
+	r.stage.reset()
+}
+
+// qualityZeroCrossings maps the soxr quality settings onto filter lengths.
+func qualityZeroCrossings(quality int) int {
+	switch {
+	case quality <= Quick:
+		return 4
+	case quality <= LowQ:
+		return 8
+	case quality <= MediumQ:
+		return zeroCrossings
+	case quality <= HighQ:
+		return 24
+	}
+	return 32
+}
+
+type floatTap struct {
+	back int
+	coef float64
+}
+
+// floatStage is the floating-point counterpart of firStage, resampling by up/down with
+// both of them allowed to be greater than 1.
+type floatStage struct {
+	up       int
+	down     int
+	channels int
+	delay    int
+	phases   [][]floatTap
+	maxBack  int
+
+	hist      []float64
+	base      int64
+	inFrames  int64
+	outFrames int64
+}
+
+func newFloatStage(up, down, channels, zeroCrossings int) *floatStage {
+	h, delay := designFilter(up, down, zeroCrossings, kaiserBeta)
+	s := &floatStage{
+		up:       up,
+		down:     down,
+		channels: channels,
+		delay:    delay,
+		phases:   make([][]floatTap, up),
+	}
+	for p := 0; p < up; p++ {
+		for j := 0; p+j*up < len(h); j++ {
+			if math.Abs(h[p+j*up]) < 1e-9 {
+				continue
+			}
+			s.phases[p] = append(s.phases[p], floatTap{back: j, coef: h[p+j*up]})
+			if j > s.maxBack {
+				s.maxBack = j
+			}
+		}
+	}
+	return s
+}
+
+func (s *floatStage) reset() {
+	s.hist = s.hist[:0]
+	s.base = 0
+	s.inFrames = 0
+	s.outFrames = 0
+}
+
+// process works like firStage.process.
+func (s *floatStage) process(in []float64, flush bool) []float64 {
+	s.hist = append(s.hist, in...)
+	s.inFrames += int64(len(in) / s.channels)
+
+	expected := s.inFrames * int64(s.up) / int64(s.down)
+	out := make([]float64, 0, int(expected-s.outFrames)*s.channels)
+	for ; s.outFrames < expected; s.outFrames++ {
+		t := s.outFrames*int64(s.down) + int64(s.delay)
+		newest := t / int64(s.up)
+		if newest >= s.inFrames && !flush {
+			break
+		}
+		taps := s.phases[t%int64(s.up)]
+		for c := 0; c < s.channels; c++ {
+			var acc float64
+			for _, tap := range taps {
+				i := newest - int64(tap.back)
+				if i < s.base || i >= s.inFrames {
+					continue
+				}
+				acc += tap.coef * s.hist[int(i-s.base)*s.channels+c]
+			}
+			out = append(out, acc)
+		}
+	}
+
+	next := (s.outFrames*int64(s.down)+int64(s.delay))/int64(s.up) - int64(s.maxBack)
+	if drop := next - s.base; drop > 0 {
+		if drop > int64(len(s.hist)/s.channels) {
+			drop = int64(len(s.hist) / s.channels)
+		}
+		s.hist = append(s.hist[:0], s.hist[int(drop)*s.channels:]...)
+		s.base += drop
+	}
+	return out
+}
+
+// GCD returns the greatest common divisor of a and b.
+func GCD(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// decodeSamples reads little-endian samples, scaled to [-1, 1) the way soxr does.
+func decodeSamples(data []byte, f format.PcmFormat) []float64 {
+	samples := make([]float64, len(data)/f.FrameSize())
+	for i := range samples {
+		b := data[i*f.FrameSize():]
+		switch f {
+		case format.S16:
+			samples[i] = float64(int16(binary.LittleEndian.Uint16(b))) / (1 << 15)
+		case format.S32:
+			samples[i] = float64(int32(binary.LittleEndian.Uint32(b))) / (1 << 31)
+		case format.F32:
+			samples[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+		case format.F64:
+			samples[i] = math.Float64frombits(binary.LittleEndian.Uint64(b))
+		}
+	}
+	return samples
+}
+
+// encodeSamples writes little-endian samples, clipping the integer formats.
+func encodeSamples(samples []float64, f format.PcmFormat) []byte {
+	data := make([]byte, len(samples)*f.FrameSize())
+	for i, v := range samples {
+		b := data[i*f.FrameSize():]
+		switch f {
+		case format.S16:
+			binary.LittleEndian.PutUint16(b, uint16(int16(math.Round(math.Max(math.Min(v*(1<<15), math.MaxInt16), math.MinInt16)))))
+		case format.S32:
+			binary.LittleEndian.PutUint32(b, uint32(int32(math.Round(math.Max(math.Min(v*(1<<31), math.MaxInt32), math.MinInt32)))))
+		case format.F32:
+			binary.LittleEndian.PutUint32(b, math.Float32bits(float32(v)))
+		case format.F64:
+			binary.LittleEndian.PutUint64(b, math.Float64bits(v))
+		}
+	}
+	return data
+}
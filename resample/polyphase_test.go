@@ -0,0 +1,42 @@
+package resample
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ZhangJYd/pcm_convertor/format"
+)
+
+func TestPolyphaseResampler(t *testing.T) {
+	cases := []struct {
+		inRate, outRate, freq int
+		wantRms               float64
+	}{
+		{16000, 44100, 1000, 0.5 / math.Sqrt2},
+		{44100, 48000, 5000, 0.5 / math.Sqrt2},
+		{48000, 22050, 16000, 0},
+		{44100, 16000, 1000, 0.5 / math.Sqrt2},
+		{44100, 16000, 10000, 0},
+	}
+	for _, c := range cases {
+		r, err := NewPolyphaseResampler(c.inRate, c.outRate, 1, MediumQ, format.S16, format.S16)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := r.Process(sineS16(c.inRate, c.freq, c.inRate, 0.5))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tail, err := r.Flush()
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, tail...)
+		if len(out) != 2*c.outRate {
+			t.Errorf("%d->%d: got %d bytes, want %d", c.inRate, c.outRate, len(out), 2*c.outRate)
+		}
+		if got := rms(out); math.Abs(got-c.wantRms) > 0.01 {
+			t.Errorf("%d->%d, %d Hz: got rms %.4f, want %.4f", c.inRate, c.outRate, c.freq, got, c.wantRms)
+		}
+	}
+}
@@ -11,7 +11,7 @@ import (
 	"bytes"
 	"errors"
 	"runtime"
-	"unsafe"
+	"sync"
 
 	"github.com/ZhangJYd/pcm_convertor/format"
 	"github.com/ZhangJYd/pcm_convertor/model"
@@ -26,13 +26,20 @@ const (
 	VeryHighQ = 6 // Very high quality
 )
 
+// Resampler wraps a soxr resampler. Its methods may be called from several goroutines;
+// Close waits for a Process or Flush in progress before it frees the soxr memory.
 type Resampler struct {
-	soxr     C.soxr_t
-	inRate   int
-	outRate  int
-	channels int
-	format   format.PcmFormat
-	cache    *bytes.Buffer
+	mu        sync.Mutex
+	soxr      C.soxr_t
+	inRate    int
+	outRate   int
+	channels  int
+	inFormat  format.PcmFormat
+	outFormat format.PcmFormat
+	cache     *bytes.Buffer
+	// inFrames and outFrames count the frames consumed and produced since the last reset.
+	inFrames  int64
+	outFrames int64
 }
 
 var threads int
@@ -41,21 +48,23 @@ func init() {
 	threads = runtime.NumCPU()
 }
 
-func NewResampler(inRate, outRate, channels, quality int, format format.PcmFormat) (*Resampler, error) {
+// NewResampler creates a soxr resampler which also converts inFormat samples to outFormat.
+// Both sides are native-endian.
+func NewResampler(inRate, outRate, channels, quality int, inFormat, outFormat format.PcmFormat) (*Resampler, error) {
 	if inRate <= 0 || outRate <= 0 {
 		return nil, model.ErrInvalidSampleRate
 	}
-	if format.ToSoxrDatatype() < 0 {
+	if inFormat.ToSoxrDatatype() < 0 || outFormat.ToSoxrDatatype() < 0 {
 		return nil, model.ErrInvalidFormat
 	}
-	if format > 6 || format < 0 {
-		return nil, model.ErrInvalidParameter
+	if channels <= 0 {
+		return nil, model.ErrInvalidChannels
 	}
 	var soxr C.soxr_t
 	var soxErr C.soxr_error_t
 	ioSpec := C.soxr_io_spec(
-		C.soxr_datatype_t(format.ToSoxrDatatype()),
-		C.soxr_datatype_t(format.ToSoxrDatatype()),
+		C.soxr_datatype_t(inFormat.ToSoxrDatatype()),
+		C.soxr_datatype_t(outFormat.ToSoxrDatatype()),
 	)
 	qSpec := C.soxr_quality_spec(C.ulong(quality), 0)
 	runtimeSpec := C.soxr_runtime_spec(C.uint(threads))
@@ -64,19 +73,18 @@ func NewResampler(inRate, outRate, channels, quality int, format format.PcmForma
 		C.uint(channels),
 		&soxErr, &ioSpec, &qSpec, &runtimeSpec,
 	)
+	// soxErr points to a static string of soxr, which must not be freed.
 	if C.GoString(soxErr) != "" && C.GoString(soxErr) != "0" {
-		err := errors.New(C.GoString(soxErr))
-		C.free(unsafe.Pointer(soxErr))
-		return nil, err
+		return nil, errors.New(C.GoString(soxErr))
 	}
-	C.free(unsafe.Pointer(soxErr))
 	return &Resampler{
-		soxr:     soxr,
-		inRate:   inRate,
-		outRate:  outRate,
-		channels: channels,
-		format:   format,
-		cache:    new(bytes.Buffer),
+		soxr:      soxr,
+		inRate:    inRate,
+		outRate:   outRate,
+		channels:  channels,
+		inFormat:  inFormat,
+		outFormat: outFormat,
+		cache:     new(bytes.Buffer),
 	}, nil
 }
 
@@ -85,11 +93,23 @@ func (r *Resampler) reset() (err error) {
 		return errors.New("soxr resampler is nil")
 	}
 	r.cache.Reset()
+	r.inFrames = 0
+	r.outFrames = 0
 	C.soxr_clear(r.soxr)
 	return
 }
 
+// Reset drops the buffered input and the filter history, so the resampler can start a
+// new stream without being created again.
+func (r *Resampler) Reset() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reset()
+}
+
 func (r *Resampler) Close() (err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	if r.soxr == nil {
 		return errors.New("soxr resampler is nil")
 	}
@@ -100,59 +120,74 @@ func (r *Resampler) Close() (err error) {
 }
 
 func (r *Resampler) Process(data []byte) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	if r.soxr == nil {
 		return nil, errors.New("soxr resampler is nil")
 	}
 	if len(data) == 0 {
 		return data, nil
 	}
-	if fragment := len(data) % (r.format.FrameSize() * r.channels); fragment != 0 {
-		data = data[:len(data)-fragment]
-	}
-	framesLen := len(data) / r.format.FrameSize() / r.channels
+	// Partial frames wait in the cache until the rest of the frame arrives.
+	r.cache.Write(data)
+	framesLen := r.cache.Len() / r.inFormat.FrameSize() / r.channels
 	if framesLen == 0 {
-		return nil, model.ErrFrameSizeError
-	}
-	framesOutLen := int(float64(framesLen) * (float64(r.outRate) / float64(r.inRate)))
-	if framesOutLen == 0 {
 		return []byte{}, nil
 	}
+	data = r.cache.Next(framesLen * r.inFormat.FrameSize() * r.channels)
+	r.inFrames += int64(framesLen)
+	// Only hand out what the input so far accounts for; soxr keeps the rest buffered,
+	// so the fractional part carries over to the next call instead of being dropped.
+	framesOutLen := int(r.ExpectedOutputFrames(r.inFrames) - r.outFrames)
 
 	dataIn := C.CBytes(data)
-	dataOut := C.malloc(C.size_t(framesOutLen * r.channels * r.format.FrameSize()))
-	var soxErr C.soxr_error_t
-	var read, done C.size_t = 0, 0
+	dataOut := C.malloc(C.size_t((framesOutLen + 1) * r.channels * r.outFormat.FrameSize()))
+	var done C.size_t = 0
 	defer func() {
 		C.free(dataIn)
 		C.free(dataOut)
-		C.free(unsafe.Pointer(soxErr))
 	}()
 
-	for int(done) < framesOutLen {
-		soxErr = C.soxr_process(r.soxr, C.soxr_in_t(dataIn), C.size_t(framesLen), &read, C.soxr_out_t(dataOut), C.size_t(framesOutLen), &done)
-		if C.GoString(soxErr) != "" && C.GoString(soxErr) != "0" {
-			err := errors.New(C.GoString(soxErr))
-			if err != nil {
-				return nil, err
+	// A nil idone makes soxr take the whole input regardless of olen.
+	soxErr := C.soxr_process(r.soxr, C.soxr_in_t(dataIn), C.size_t(framesLen), nil, C.soxr_out_t(dataOut), C.size_t(framesOutLen), &done)
+	if soxErr != nil {
+		return nil, errors.New(C.GoString(soxErr))
+	}
+	r.outFrames += int64(done)
+	return C.GoBytes(dataOut, C.int(int(done)*r.channels*r.outFormat.FrameSize())), nil
+}
+
+// Flush drains the output soxr still holds for the input seen so far and resets the
+// resampler, so it can start a new stream.
+func (r *Resampler) Flush() ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.soxr == nil {
+		return nil, errors.New("soxr resampler is nil")
+	}
+	framesOutLen := int(r.ExpectedOutputFrames(r.inFrames) - r.outFrames)
+	out := make([]byte, 0, framesOutLen*r.channels*r.outFormat.FrameSize())
+	if framesOutLen > 0 {
+		dataOut := C.malloc(C.size_t(framesOutLen * r.channels * r.outFormat.FrameSize()))
+		defer C.free(dataOut)
+		for produced := 0; produced < framesOutLen; {
+			var done C.size_t = 0
+			// Indicate end of input to the resampler
+			soxErr := C.soxr_process(r.soxr, C.soxr_in_t(nil), C.size_t(0), nil, C.soxr_out_t(dataOut), C.size_t(framesOutLen-produced), &done)
+			if soxErr != nil {
+				return nil, errors.New(C.GoString(soxErr))
 			}
-			if int(read) == framesLen && int(done) < framesOutLen {
-				// Indicate end of input to the resampler
-				var d C.size_t = 0
-				soxErr = C.soxr_process(r.soxr, C.soxr_in_t(nil), C.size_t(0), nil, C.soxr_out_t(dataOut), C.size_t(framesOutLen), &d)
-				if C.GoString(soxErr) != "" && C.GoString(soxErr) != "0" {
-					err = errors.New(C.GoString(soxErr))
-					return nil, err
-				}
-				done += d
+			if done == 0 {
 				break
 			}
+			out = append(out, C.GoBytes(dataOut, C.int(int(done)*r.channels*r.outFormat.FrameSize()))...)
+			produced += int(done)
 		}
 	}
-	r.cache.Write(C.GoBytes(dataOut, C.int(int(done)*r.channels*r.format.FrameSize())))
-	out := make([]byte, int(done)*r.channels*r.format.FrameSize())
-	_, err := r.cache.Read(out)
-	if err != nil {
-		return nil, err
-	}
-	return out, nil
+	return out, r.reset()
+}
+
+// ExpectedOutputFrames returns the number of output frames totalIn input frames resample to.
+func (r *Resampler) ExpectedOutputFrames(totalIn int64) int64 {
+	return totalIn * int64(r.outRate) / int64(r.inRate)
 }
@@ -0,0 +1,124 @@
+package resample
+
+import (
+	"bytes"
+	"encoding/gob"
+
+	"github.com/ZhangJYd/pcm_convertor/format"
+	"github.com/ZhangJYd/pcm_convertor/model"
+)
+
+// resamplerState is the serialized form of the pure-Go resamplers. The configuration
+// is stored too, so a snapshot can't be restored into a different resampler.
+type resamplerState struct {
+	InRate    int
+	OutRate   int
+	Channels  int
+	InFormat  format.PcmFormat
+	OutFormat format.PcmFormat
+	Cache     []byte
+	Stages    []stageState
+}
+
+type stageState struct {
+	Hist      []int16
+	FloatHist []float64
+	Base      int64
+	InFrames  int64
+	OutFrames int64
+}
+
+// Snapshot returns the filter history, the cached partial frame and the position counters.
+func (r *IntegerResampler) Snapshot() ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	state := resamplerState{
+		InRate:    r.inRate,
+		OutRate:   r.outRate,
+		Channels:  r.channels,
+		InFormat:  format.S16,
+		OutFormat: format.S16,
+		Cache:     r.cache.Bytes(),
+	}
+	for _, s := range r.stages {
+		state.Stages = append(state.Stages, stageState{Hist: s.hist, Base: s.base, InFrames: s.inFrames, OutFrames: s.outFrames})
+	}
+	return encodeState(&state)
+}
+
+// Restore brings back the state saved by Snapshot.
+func (r *IntegerResampler) Restore(data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	state, err := decodeState(data)
+	if err != nil {
+		return err
+	}
+	if state.InRate != r.inRate || state.OutRate != r.outRate || state.Channels != r.channels ||
+		state.InFormat != format.S16 || state.OutFormat != format.S16 || len(state.Stages) != len(r.stages) {
+		return model.ErrStateMismatch
+	}
+	r.cache.Reset()
+	r.cache.Write(state.Cache)
+	for i, s := range r.stages {
+		s.hist = append(s.hist[:0], state.Stages[i].Hist...)
+		s.base = state.Stages[i].Base
+		s.inFrames = state.Stages[i].InFrames
+		s.outFrames = state.Stages[i].OutFrames
+	}
+	return nil
+}
+
+// Snapshot returns the filter history, the cached partial frame and the position counters.
+func (r *PolyphaseResampler) Snapshot() ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.stage
+	return encodeState(&resamplerState{
+		InRate:    r.inRate,
+		OutRate:   r.outRate,
+		Channels:  r.channels,
+		InFormat:  r.inFormat,
+		OutFormat: r.outFormat,
+		Cache:     r.cache.Bytes(),
+		Stages:    []stageState{{FloatHist: s.hist, Base: s.base, InFrames: s.inFrames, OutFrames: s.outFrames}},
+	})
+}
+
+// Restore brings back the state saved by Snapshot.
+func (r *PolyphaseResampler) Restore(data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	state, err := decodeState(data)
+	if err != nil {
+		return err
+	}
+	if state.InRate != r.inRate || state.OutRate != r.outRate || state.Channels != r.channels ||
+		state.InFormat != r.inFormat || state.OutFormat != r.outFormat || len(state.Stages) != 1 {
+		return model.ErrStateMismatch
+	}
+	r.cache.Reset()
+	r.cache.Write(state.Cache)
+	s := r.stage
+	s.hist = append(s.hist[:0], state.Stages[0].FloatHist...)
+	s.base = state.Stages[0].Base
+	s.inFrames = state.Stages[0].InFrames
+	s.outFrames = state.Stages[0].OutFrames
+	return nil
+}
+
+func encodeState(state *resamplerState) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(state); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeState(data []byte) (*resamplerState, error) {
+	state := new(resamplerState)
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
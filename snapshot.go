@@ -0,0 +1,105 @@
+package pcm_convertor
+
+import (
+	"bytes"
+	"encoding/gob"
+
+	"github.com/ZhangJYd/pcm_convertor/format"
+	"github.com/ZhangJYd/pcm_convertor/model"
+)
+
+type snapshotter interface {
+	Snapshot() ([]byte, error)
+	Restore(data []byte) error
+}
+
+// convertorState is the serialized form of a Convertor, see Snapshot.
+type convertorState struct {
+	InRate      int
+	OutRate     int
+	InFormat    format.PcmFormat
+	OutFormat   format.PcmFormat
+	InChannels  int
+	OutChannels int
+	Carry       []byte
+	Resampler   []byte
+}
+
+// Snapshot saves the carried partial frame, the filter history and the position counters,
+// so a conversion can be resumed with Restore on a Convertor built the same way and give
+// the same output as an uninterrupted run.
+// The state of soxr can't be exported, so for rate changes that aren't handled by the
+// integer-ratio resampler the Convertor has to be created WithPureGoResampler. Nor can
+// the state of a codec, so streams in codec formats can't be saved at all.
+func (p *Convertor) Snapshot() ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, model.ErrClosed
+	}
+	if isCodec(p.in.Format) || isCodec(p.out.Format) {
+		return nil, model.ErrSnapshotUnsupported
+	}
+	state := p.state()
+	state.Carry = p.carry
+	if p.in.SampleRate != p.out.SampleRate {
+		s, ok := p.pipe.resampler.(snapshotter)
+		if !ok {
+			return nil, model.ErrSnapshotUnsupported
+		}
+		data, err := s.Snapshot()
+		if err != nil {
+			return nil, err
+		}
+		state.Resampler = data
+	}
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(state); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Restore continues the stream saved by Snapshot.
+func (p *Convertor) Restore(data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return model.ErrClosed
+	}
+	state := new(convertorState)
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(state); err != nil {
+		return err
+	}
+	want := p.state()
+	if state.InRate != want.InRate || state.OutRate != want.OutRate ||
+		state.InFormat != want.InFormat || state.OutFormat != want.OutFormat ||
+		state.InChannels != want.InChannels || state.OutChannels != want.OutChannels {
+		return model.ErrStateMismatch
+	}
+	if isCodec(p.in.Format) || isCodec(p.out.Format) {
+		return model.ErrSnapshotUnsupported
+	}
+	if p.in.SampleRate != p.out.SampleRate {
+		s, ok := p.pipe.resampler.(snapshotter)
+		if !ok {
+			return model.ErrSnapshotUnsupported
+		}
+		if err := s.Restore(state.Resampler); err != nil {
+			return err
+		}
+	}
+	p.carry = state.Carry
+	return nil
+}
+
+func (p *Convertor) state() *convertorState {
+	return &convertorState{
+		InRate:      p.in.SampleRate,
+		OutRate:     p.out.SampleRate,
+		InFormat:    p.in.Format,
+		OutFormat:   p.out.Format,
+		InChannels:  p.in.Channels,
+		OutChannels: p.out.Channels,
+	}
+}
@@ -0,0 +1,192 @@
+package pcm_convertor
+
+import (
+	"encoding/binary"
+
+	"github.com/ZhangJYd/pcm_convertor/format"
+)
+
+// Stage is one step of the chain a Convertor runs the audio through.
+// A Stage only ever sees whole frames.
+type Stage interface {
+	// Name describes the stage in Convertor.Plan.
+	Name() string
+	// Process converts data and returns the result. The result may be shorter or longer
+	// than data, e.g. when the stage holds samples back.
+	Process(data []byte) ([]byte, error)
+	// Flush returns what the stage still holds at the end of a stream and prepares it
+	// for a new one.
+	Flush() ([]byte, error)
+}
+
+// StagePoint is a place in the chain where WithStage adds a stage.
+type StagePoint int
+
+const (
+	// AtInput is before any conversion, in the input StreamInfo. For a format coded in
+	// blocks, see format.RegisterCodec, it is after decoding.
+	AtInput StagePoint = iota
+	// BeforeResample is the last point at the input sample rate, after downmixing.
+	BeforeResample
+	// AfterResample is the first point at the output sample rate, before upmixing.
+	AfterResample
+	// AtOutput is after all conversions, in the output StreamInfo, or before encoding.
+	AtOutput
+)
+
+// StageFunc creates a stage for the audio described by info, see WithStage.
+type StageFunc func(info StreamInfo) (Stage, error)
+
+// stageFunc adapts a stateless conversion to Stage.
+type stageFunc struct {
+	name string
+	fn   func(data []byte) ([]byte, error)
+}
+
+func (s *stageFunc) Name() string {
+	return s.name
+}
+
+func (s *stageFunc) Process(data []byte) ([]byte, error) {
+	return s.fn(data)
+}
+
+func (s *stageFunc) Flush() ([]byte, error) {
+	return []byte{}, nil
+}
+
+func newDownmixStage(f format.PcmFormat, channels int, order binary.ByteOrder) Stage {
+	return &stageFunc{name: "downmix", fn: func(data []byte) ([]byte, error) {
+		return StereoToMono(data, f, channels, order)
+	}}
+}
+
+func newUpmixStage(f format.PcmFormat, channels int) Stage {
+	return &stageFunc{name: "upmix", fn: func(data []byte) ([]byte, error) {
+		return MonoToStereo(data, f, channels)
+	}}
+}
+
+func newByteOrderStage(f format.PcmFormat, from, to binary.ByteOrder) Stage {
+	return &stageFunc{name: "byte order", fn: func(data []byte) ([]byte, error) {
+		return format.BigEndianLittleEndianConvert(data, f, from, to)
+	}}
+}
+
+type formatStage struct {
+	c *format.Convertor
+}
+
+func (s *formatStage) Name() string {
+	return "format"
+}
+
+func (s *formatStage) Process(data []byte) ([]byte, error) {
+	return s.c.Convert(data)
+}
+
+func (s *formatStage) Flush() ([]byte, error) {
+	s.c.Reset()
+	return []byte{}, nil
+}
+
+type resampleStage struct {
+	name string
+	r    resampler
+}
+
+func (s *resampleStage) Name() string {
+	return s.name
+}
+
+func (s *resampleStage) Process(data []byte) ([]byte, error) {
+	return s.r.Process(data)
+}
+
+func (s *resampleStage) Flush() ([]byte, error) {
+	return s.r.Flush()
+}
+
+func (s *resampleStage) Close() error {
+	return s.r.Close()
+}
+
+// decodeStage decodes the blocks of a codec format into S16 little-endian samples.
+type decodeStage struct {
+	name    string
+	codec   format.Codec
+	dec     format.BlockDecoder
+	samples []int16
+}
+
+func newDecodeStage(f format.PcmFormat, c format.Codec) Stage {
+	return &decodeStage{name: "decode " + f.String(), codec: c, dec: c.NewDecoder(), samples: make([]int16, c.BlockSamples)}
+}
+
+func (s *decodeStage) Name() string {
+	return s.name
+}
+
+func (s *decodeStage) Process(data []byte) ([]byte, error) {
+	blocks := len(data) / s.codec.BlockSize
+	out := make([]byte, 0, 2*blocks*s.codec.BlockSamples)
+	for i := 0; i < blocks; i++ {
+		if err := s.dec.Decode(s.samples, data[i*s.codec.BlockSize:(i+1)*s.codec.BlockSize]); err != nil {
+			return nil, err
+		}
+		for _, v := range s.samples {
+			out = append(out, byte(v), byte(v>>8))
+		}
+	}
+	return out, nil
+}
+
+func (s *decodeStage) Flush() ([]byte, error) {
+	s.dec = s.codec.NewDecoder()
+	return []byte{}, nil
+}
+
+// encodeStage encodes S16 little-endian samples in the blocks of a codec format. It
+// holds back the samples of a partial block, and Flush encodes them padded with silence.
+type encodeStage struct {
+	name    string
+	codec   format.Codec
+	enc     format.BlockEncoder
+	samples []int16
+}
+
+func newEncodeStage(f format.PcmFormat, c format.Codec) Stage {
+	return &encodeStage{name: "encode " + f.String(), codec: c, enc: c.NewEncoder()}
+}
+
+func (s *encodeStage) Name() string {
+	return s.name
+}
+
+func (s *encodeStage) Process(data []byte) ([]byte, error) {
+	for i := 0; i+1 < len(data); i += 2 {
+		s.samples = append(s.samples, int16(binary.LittleEndian.Uint16(data[i:])))
+	}
+	return s.encode(), nil
+}
+
+// encode encodes the whole blocks of the samples held.
+func (s *encodeStage) encode() []byte {
+	blocks := len(s.samples) / s.codec.BlockSamples
+	out := make([]byte, blocks*s.codec.BlockSize)
+	for i := 0; i < blocks; i++ {
+		s.enc.Encode(out[i*s.codec.BlockSize:], s.samples[i*s.codec.BlockSamples:(i+1)*s.codec.BlockSamples])
+	}
+	s.samples = append(s.samples[:0], s.samples[blocks*s.codec.BlockSamples:]...)
+	return out
+}
+
+func (s *encodeStage) Flush() ([]byte, error) {
+	out := []byte{}
+	if len(s.samples) > 0 {
+		s.samples = append(s.samples, make([]int16, s.codec.BlockSamples-len(s.samples))...)
+		out = s.encode()
+	}
+	s.enc = s.codec.NewEncoder()
+	return out, nil
+}
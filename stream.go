@@ -0,0 +1,113 @@
+package pcm_convertor
+
+import "io"
+
+// readFrames is the number of input frames a Reader asks its source for at a time.
+const readFrames = 1024
+
+// Reader converts the audio read from src. Partial frames and the samples the
+// resampler holds back at the end of the stream are taken care of.
+type Reader struct {
+	src io.Reader
+	c   *Convertor
+	buf []byte
+	out []byte
+	err error
+}
+
+func NewReader(src io.Reader, in, out *StreamInfo, opts ...Option) (*Reader, error) {
+	o, err := newOptions(opts, qualityOption)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newConvertor(in, out, o.quality, o)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{
+		src: src,
+		c:   c,
+		buf: make([]byte, readFrames*in.Format.FrameSize()*in.Channels),
+	}, nil
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		n, err := r.src.Read(r.buf)
+		if n > 0 {
+			out, perr := r.c.Process(r.buf[:n])
+			if perr != nil {
+				r.err = perr
+				return 0, perr
+			}
+			r.out = out
+		}
+		if err == io.EOF {
+			tail, ferr := r.c.Flush()
+			if ferr != nil {
+				r.err = ferr
+				return 0, ferr
+			}
+			r.out = append(r.out, tail...)
+		}
+		r.err = err
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// Close releases the Convertor. It does not close src.
+func (r *Reader) Close() error {
+	return r.c.Close()
+}
+
+// Writer converts the audio written to it and writes the result to dst.
+type Writer struct {
+	dst io.Writer
+	c   *Convertor
+}
+
+func NewWriter(dst io.Writer, in, out *StreamInfo, opts ...Option) (*Writer, error) {
+	o, err := newOptions(opts, qualityOption)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newConvertor(in, out, o.quality, o)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{
+		dst: dst,
+		c:   c,
+	}, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	out, err := w.c.Process(p)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = w.dst.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close writes the end of the stream still held by the resampler to dst and releases
+// the Convertor. It does not close dst.
+func (w *Writer) Close() error {
+	tail, err := w.c.Flush()
+	if err != nil {
+		w.c.Close()
+		return err
+	}
+	if _, err = w.dst.Write(tail); err != nil {
+		w.c.Close()
+		return err
+	}
+	return w.c.Close()
+}
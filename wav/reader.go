@@ -0,0 +1,233 @@
+package wav
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+
+	"github.com/ZhangJYd/pcm_convertor"
+	"github.com/ZhangJYd/pcm_convertor/gsm"
+	"github.com/ZhangJYd/pcm_convertor/model"
+)
+
+// Reader reads the samples of a WAV stream, starting right after the header.
+type Reader struct {
+	r    io.Reader
+	info pcm_convertor.StreamInfo
+	// size is the length of the data chunk, -1 if the stream was written without knowing it.
+	size int64
+	left int64
+	// gsm decodes GSM 06.10 data, read through dataReader.
+	gsm *gsm.Reader
+}
+
+// NewReader parses the header of the WAV stream in r up to the start of the samples.
+// PCM, IEEE float, mu-law and A-law data is supported, also in WAVE_FORMAT_EXTENSIBLE,
+// and files over 4 GB in the RF64 and BW64 forms. GSM 06.10 data is decoded into the
+// S16 samples of gsm.Info.
+func NewReader(r io.Reader) (*Reader, error) {
+	var hdr [12]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, model.ErrInvalidHeader
+	}
+	id := string(hdr[0:4])
+	if (id != "RIFF" && id != "RF64" && id != "BW64") || string(hdr[8:12]) != "WAVE" {
+		return nil, model.ErrInvalidHeader
+	}
+	wr := &Reader{r: r}
+	var sizes *ds64
+	if id != "RIFF" {
+		var err error
+		if sizes, err = readDS64(r); err != nil {
+			return nil, err
+		}
+	}
+	haveFormat := false
+	for {
+		id, size32, err := readChunkHeader(r)
+		if err != nil {
+			return nil, err
+		}
+		size := int64(size32)
+		if sizes != nil && size32 == unknownSize {
+			size = sizes.chunkSize(id)
+		}
+		switch id {
+		case "fmt ":
+			if err := wr.readFormat(r, size); err != nil {
+				return nil, err
+			}
+			haveFormat = true
+		case "data":
+			if !haveFormat {
+				return nil, model.ErrInvalidHeader
+			}
+			// An empty data chunk is 0 bytes long; only the marker or a ds64 size that
+			// doesn't fit leaves the length open.
+			wr.size = size
+			if (sizes == nil && size32 == unknownSize) || size < 0 {
+				wr.size = -1
+			}
+			wr.left = wr.size
+			return wr, nil
+		default:
+			if size < 0 {
+				return nil, model.ErrInvalidHeader
+			}
+			if err := skipChunk(r, size); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func readChunkHeader(r io.Reader) (string, uint32, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return "", 0, model.ErrInvalidHeader
+	}
+	return string(hdr[0:4]), le.Uint32(hdr[4:]), nil
+}
+
+// skipChunk skips a chunk body of size bytes and its pad byte.
+func skipChunk(r io.Reader, size int64) error {
+	if _, err := io.CopyN(ioutil.Discard, r, size+size%2); err != nil {
+		return model.ErrInvalidHeader
+	}
+	return nil
+}
+
+// ds64 holds the 64-bit sizes of an RF64 or BW64 file.
+type ds64 struct {
+	data   int64
+	chunks map[string]int64
+}
+
+// readDS64 reads the ds64 chunk that starts RF64 and BW64 files.
+func readDS64(r io.Reader) (*ds64, error) {
+	id, size32, err := readChunkHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	size := int64(size32)
+	if id != "ds64" || size < ds64Size || size > maxHeaderChunk {
+		return nil, model.ErrInvalidHeader
+	}
+	body := make([]byte, size+size%2)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, model.ErrInvalidHeader
+	}
+	d := &ds64{data: int64(le.Uint64(body[8:])), chunks: map[string]int64{}}
+	table := body[ds64Size:size]
+	for n := int(le.Uint32(body[24:])); n > 0 && len(table) >= 12; n-- {
+		d.chunks[string(table[0:4])] = int64(le.Uint64(table[4:]))
+		table = table[12:]
+	}
+	return d, nil
+}
+
+// chunkSize is the size of a chunk whose header says it is in the ds64 chunk, -1 if it
+// isn't there either.
+func (d *ds64) chunkSize(id string) int64 {
+	if id == "data" {
+		return d.data
+	}
+	if size, ok := d.chunks[id]; ok {
+		return size
+	}
+	return -1
+}
+
+func (wr *Reader) readFormat(r io.Reader, size int64) error {
+	if size < 16 || size > maxHeaderChunk {
+		return model.ErrInvalidHeader
+	}
+	body := make([]byte, size+size%2)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return model.ErrInvalidHeader
+	}
+	tag := le.Uint16(body[0:])
+	channels := int(le.Uint16(body[2:]))
+	rate := int(le.Uint32(body[4:]))
+	blockAlign := int(le.Uint16(body[12:]))
+	bits := int(le.Uint16(body[14:]))
+	if tag == tagExtensible {
+		if size < 40 || !bytes.Equal(body[26:40], subFormatSuffix) {
+			return model.ErrInvalidFormat
+		}
+		tag = le.Uint16(body[24:])
+	}
+	if tag == tagGSM610 {
+		if channels != 1 || blockAlign != gsm.WAV49.Size() {
+			return model.ErrInvalidFormat
+		}
+		wr.info = gsm.Info
+		wr.info.SampleRate = rate
+		wr.gsm = gsm.NewReader(dataReader{wr}, gsm.WAV49)
+		return nil
+	}
+	if channels == 0 || blockAlign != channels*((bits+7)/8) {
+		return model.ErrInvalidHeader
+	}
+	f, err := pcmFormat(tag, bits)
+	if err != nil {
+		return err
+	}
+	wr.info = pcm_convertor.StreamInfo{
+		SampleRate: rate,
+		Format:     f,
+		ByteOrder:  binary.LittleEndian,
+		Channels:   channels,
+	}
+	return nil
+}
+
+// StreamInfo describes the samples of the stream.
+func (wr *Reader) StreamInfo() pcm_convertor.StreamInfo {
+	return wr.info
+}
+
+// DataSize returns the length of the samples in bytes, or -1 if the header doesn't say,
+// in which case the samples run to the end of the stream.
+func (wr *Reader) DataSize() int64 {
+	if wr.gsm != nil && wr.size >= 0 {
+		return wr.size / int64(gsm.WAV49.Size()) * int64(2*gsm.WAV49.Samples())
+	}
+	return wr.size
+}
+
+// Read reads the samples, returning io.EOF at the end of the data chunk.
+func (wr *Reader) Read(p []byte) (int, error) {
+	if wr.gsm != nil {
+		return wr.gsm.Read(p)
+	}
+	return wr.readData(p)
+}
+
+// dataReader reads the data chunk of a Reader as it is stored.
+type dataReader struct {
+	wr *Reader
+}
+
+func (d dataReader) Read(p []byte) (int, error) {
+	return d.wr.readData(p)
+}
+
+func (wr *Reader) readData(p []byte) (int, error) {
+	if wr.size < 0 {
+		return wr.r.Read(p)
+	}
+	if wr.left == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > wr.left {
+		p = p[:wr.left]
+	}
+	n, err := wr.r.Read(p)
+	wr.left -= int64(n)
+	if err == io.EOF && wr.left > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
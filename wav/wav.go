@@ -0,0 +1,82 @@
+// Package wav reads and writes RIFF/WAVE files, describing their samples with
+// pcm_convertor.StreamInfo.
+package wav
+
+import (
+	"encoding/binary"
+
+	"github.com/ZhangJYd/pcm_convertor/format"
+	"github.com/ZhangJYd/pcm_convertor/model"
+)
+
+// Format tags of the fmt chunk.
+const (
+	tagPCM        = 0x0001
+	tagFloat      = 0x0003
+	tagALaw       = 0x0006
+	tagULaw       = 0x0007
+	tagGSM610     = 0x0031
+	tagExtensible = 0xfffe
+)
+
+// unknownSize marks the sizes of a stream whose length was not known when the header
+// was written.
+const unknownSize = 0xffffffff
+
+// ds64Size is the size of a ds64 chunk without a table: the RIFF, data and frame counts.
+const ds64Size = 28
+
+// maxHeaderChunk bounds the fmt and ds64 chunks, which are read into memory whole. Real
+// ones take tens of bytes.
+const maxHeaderChunk = 1 << 16
+
+// subFormatSuffix follows the format tag in the SubFormat GUID of WAVE_FORMAT_EXTENSIBLE.
+var subFormatSuffix = []byte{0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0x80, 0x00, 0x00, 0xaa, 0x00, 0x38, 0x9b, 0x71}
+
+// channelMasks are the speaker positions written for the usual channel counts.
+var channelMasks = map[int]uint32{
+	1: 0x4,
+	2: 0x3,
+	3: 0x7,
+	4: 0x33,
+	6: 0x3f,
+	8: 0x63f,
+}
+
+// pcmFormat maps a format tag and sample size to a PcmFormat.
+func pcmFormat(tag uint16, bits int) (format.PcmFormat, error) {
+	switch {
+	case tag == tagPCM && bits == 8:
+		return format.U8, nil
+	case tag == tagPCM && bits == 16:
+		return format.S16, nil
+	case tag == tagPCM && bits == 24:
+		return format.S24, nil
+	case tag == tagPCM && bits == 32:
+		return format.S32, nil
+	case tag == tagFloat && bits == 32:
+		return format.F32, nil
+	case tag == tagFloat && bits == 64:
+		return format.F64, nil
+	case tag == tagULaw && bits == 8:
+		return format.ULaw, nil
+	case tag == tagALaw && bits == 8:
+		return format.ALaw, nil
+	}
+	return 0, model.ErrInvalidFormat
+}
+
+// formatTag is the format tag f is written with.
+func formatTag(f format.PcmFormat) uint16 {
+	switch f {
+	case format.F32, format.F64:
+		return tagFloat
+	case format.ULaw:
+		return tagULaw
+	case format.ALaw:
+		return tagALaw
+	}
+	return tagPCM
+}
+
+var le = binary.LittleEndian
@@ -0,0 +1,415 @@
+package wav
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ZhangJYd/pcm_convertor"
+	"github.com/ZhangJYd/pcm_convertor/format"
+	"github.com/ZhangJYd/pcm_convertor/gsm"
+	"github.com/ZhangJYd/pcm_convertor/model"
+)
+
+func samples(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func TestRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	formats := []format.PcmFormat{format.U8, format.S16, format.S24, format.S32, format.F32, format.F64, format.ULaw, format.ALaw}
+	for _, f := range formats {
+		for _, channels := range []int{1, 3} {
+			info := pcm_convertor.StreamInfo{SampleRate: 22050, Format: f, ByteOrder: binary.LittleEndian, Channels: channels}
+			data := samples(f.FrameSize() * channels * 101)
+
+			path := filepath.Join(dir, "out.wav")
+			out, err := os.Create(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w, err := NewWriter(out, info)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write(data); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			out.Close()
+
+			file, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size := binary.LittleEndian.Uint32(file[4:]); int(size) != len(file)-8 {
+				t.Errorf("%v x %d: RIFF size %d for a %d byte file", f.String(), channels, size, len(file))
+			}
+			r, err := NewReader(bytes.NewReader(file))
+			if err != nil {
+				t.Fatalf("%v x %d: %v", f.String(), channels, err)
+			}
+			if r.StreamInfo() != info {
+				t.Errorf("got %+v, want %+v", r.StreamInfo(), info)
+			}
+			if r.DataSize() != int64(len(data)) {
+				t.Errorf("%v x %d: got data size %d, want %d", f.String(), channels, r.DataSize(), len(data))
+			}
+			got, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("%v x %d: samples differ", f.String(), channels)
+			}
+		}
+	}
+}
+
+func TestStreaming(t *testing.T) {
+	info := pcm_convertor.StreamInfo{SampleRate: 8000, Format: format.S16, ByteOrder: binary.BigEndian, Channels: 1}
+	buf := new(bytes.Buffer)
+	w, err := NewWriter(buf, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Split a sample across writes.
+	w.Write([]byte{0x12, 0x34, 0x56})
+	w.Write([]byte{0x78})
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if size := binary.LittleEndian.Uint32(buf.Bytes()[4:]); size != unknownSize {
+		t.Errorf("got RIFF size %#x", size)
+	}
+
+	r, err := NewReader(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.DataSize() != -1 {
+		t.Errorf("got data size %d", r.DataSize())
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, []byte{0x34, 0x12, 0x78, 0x56}) {
+		t.Errorf("got %x", got)
+	}
+}
+
+// shortWriter takes n bytes and fails after that.
+type shortWriter struct {
+	n int
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		n := w.n
+		w.n = 0
+		return n, io.ErrShortWrite
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestShortWrite(t *testing.T) {
+	info := pcm_convertor.StreamInfo{SampleRate: 8000, Format: format.S16, ByteOrder: binary.BigEndian, Channels: 1}
+	w, err := NewWriter(&shortWriter{n: 1 << 10}, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := w.w.(*shortWriter)
+	// Two bytes go out and one is held back, then the held byte and two more do.
+	if n, err := w.Write([]byte{1, 2, 3}); n != 3 || err != nil {
+		t.Fatalf("got %d, %v", n, err)
+	}
+	dst.n = 3
+	if n, err := w.Write([]byte{4, 5, 6, 7, 8}); n != 2 || err != io.ErrShortWrite {
+		t.Errorf("got %d, %v", n, err)
+	}
+	if w.data != 5 {
+		t.Errorf("counted %d bytes", w.data)
+	}
+}
+
+func TestReaderSkipsChunks(t *testing.T) {
+	var file []byte
+	file = append(file, "RIFF\x00\x00\x00\x00WAVE"...)
+	file = appendChunk(file, "LIST", []byte("odd"))
+	file = append(file, 0)
+	fmtChunk := make([]byte, 40)
+	binary.LittleEndian.PutUint16(fmtChunk[0:], tagExtensible)
+	binary.LittleEndian.PutUint16(fmtChunk[2:], 2)
+	binary.LittleEndian.PutUint32(fmtChunk[4:], 48000)
+	binary.LittleEndian.PutUint32(fmtChunk[8:], 48000*8)
+	binary.LittleEndian.PutUint16(fmtChunk[12:], 8)
+	binary.LittleEndian.PutUint16(fmtChunk[14:], 32)
+	binary.LittleEndian.PutUint16(fmtChunk[16:], 22)
+	binary.LittleEndian.PutUint16(fmtChunk[24:], tagFloat)
+	copy(fmtChunk[26:], subFormatSuffix)
+	file = appendChunk(file, "fmt ", fmtChunk)
+	file = appendChunk(file, "data", samples(16))
+	file = appendChunk(file, "id3 ", samples(10))
+
+	r, err := NewReader(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := pcm_convertor.StreamInfo{SampleRate: 48000, Format: format.F32, ByteOrder: binary.LittleEndian, Channels: 2}
+	if r.StreamInfo() != want {
+		t.Errorf("got %+v, want %+v", r.StreamInfo(), want)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(got, samples(16)) {
+		t.Errorf("got %x, %v", got, err)
+	}
+
+	if _, err := NewReader(bytes.NewReader(file[:30])); err == nil {
+		t.Error("truncated header was accepted")
+	}
+	if _, err := r.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("got %v after the data chunk", err)
+	}
+}
+
+func TestReadEmptyData(t *testing.T) {
+	fmtChunk := make([]byte, 16)
+	binary.LittleEndian.PutUint16(fmtChunk[0:], tagPCM)
+	binary.LittleEndian.PutUint16(fmtChunk[2:], 1)
+	binary.LittleEndian.PutUint32(fmtChunk[4:], 8000)
+	binary.LittleEndian.PutUint32(fmtChunk[8:], 16000)
+	binary.LittleEndian.PutUint16(fmtChunk[12:], 2)
+	binary.LittleEndian.PutUint16(fmtChunk[14:], 16)
+	file := []byte("RIFF\x00\x00\x00\x00WAVE")
+	file = appendChunk(file, "fmt ", fmtChunk)
+	file = appendChunk(file, "data", nil)
+	file = appendChunk(file, "LIST", samples(10))
+
+	r, err := NewReader(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.DataSize() != 0 {
+		t.Errorf("got data size %d, want 0", r.DataSize())
+	}
+	if got, err := ioutil.ReadAll(r); err != nil || len(got) != 0 {
+		t.Errorf("got %x, %v", got, err)
+	}
+}
+
+func TestG711(t *testing.T) {
+	for _, f := range []format.PcmFormat{format.ULaw, format.ALaw} {
+		for i := 0; i < 256; i++ {
+			b := byte(i)
+			if f == format.ULaw && b == 0x7f {
+				// Negative zero.
+				continue
+			}
+			if got := format.Int16ToG711(format.G711ToInt16(b, f), f); got != b {
+				t.Errorf("%v: %#x decodes to %d and encodes to %#x", f.String(), b, format.G711ToInt16(b, f), got)
+			}
+		}
+	}
+	if v := format.G711ToInt16(format.Int16ToG711(1000, format.ULaw), format.ULaw); v < 960 || v > 1040 {
+		t.Errorf("mu-law 1000 came back as %d", v)
+	}
+	if v := format.G711ToInt16(format.Int16ToG711(-1000, format.ALaw), format.ALaw); v < -1040 || v > -960 {
+		t.Errorf("A-law -1000 came back as %d", v)
+	}
+}
+
+func TestRF64(t *testing.T) {
+	defer func(size int64) { maxRIFFSize = size }(maxRIFFSize)
+	maxRIFFSize = 1000
+
+	f, err := ioutil.TempFile("", "rf64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	info := pcm_convertor.StreamInfo{SampleRate: 48000, Format: format.S24, ByteOrder: binary.LittleEndian, Channels: 4}
+	w, err := NewWriter(f, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := samples(12 * 100)
+	for i := 0; i < len(data); i += 120 {
+		if _, err := w.Write(data[i : i+120]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(file[0:4]) != "RF64" || string(file[12:16]) != "ds64" {
+		t.Fatalf("got %q and %q, want an RF64 header", file[0:4], file[12:16])
+	}
+	if riff := binary.LittleEndian.Uint64(file[20:]); int(riff) != len(file)-8 {
+		t.Errorf("ds64 RIFF size %d for a %d byte file", riff, len(file))
+	}
+	if frames := binary.LittleEndian.Uint64(file[36:]); frames != 100 {
+		t.Errorf("ds64 frame count %d, want 100", frames)
+	}
+	r, err := NewReader(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.StreamInfo() != info || r.DataSize() != int64(len(data)) {
+		t.Errorf("got %+v with %d bytes", r.StreamInfo(), r.DataSize())
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("samples differ: %v", err)
+	}
+
+	// Below the limit the ds64 room stays a JUNK chunk of a plain RIFF file.
+	maxRIFFSize = 0xffffffff
+	small, err := os.Create(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err = NewWriter(small, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(data)
+	w.Close()
+	small.Close()
+	if file, err = ioutil.ReadFile(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if string(file[0:4]) != "RIFF" || string(file[12:16]) != "JUNK" {
+		t.Errorf("got %q and %q, want a RIFF header", file[0:4], file[12:16])
+	}
+}
+
+func TestReadBW64(t *testing.T) {
+	ds64 := make([]byte, ds64Size+12)
+	binary.LittleEndian.PutUint64(ds64[8:], 8)
+	binary.LittleEndian.PutUint32(ds64[24:], 1)
+	copy(ds64[28:], "axml")
+	binary.LittleEndian.PutUint64(ds64[32:], 2)
+	fmtChunk := make([]byte, 16)
+	binary.LittleEndian.PutUint16(fmtChunk[0:], tagPCM)
+	binary.LittleEndian.PutUint16(fmtChunk[2:], 1)
+	binary.LittleEndian.PutUint32(fmtChunk[4:], 8000)
+	binary.LittleEndian.PutUint32(fmtChunk[8:], 16000)
+	binary.LittleEndian.PutUint16(fmtChunk[12:], 2)
+	binary.LittleEndian.PutUint16(fmtChunk[14:], 16)
+
+	file := []byte("BW64\xff\xff\xff\xffWAVE")
+	file = appendChunk(file, "ds64", ds64)
+	file = appendChunk(file, "fmt ", fmtChunk)
+	file = append(file, "axml\xff\xff\xff\xff<>"...)
+	file = append(file, "data\xff\xff\xff\xff"...)
+	file = append(file, samples(10)...)
+
+	r, err := NewReader(bytes.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(got, samples(8)) {
+		t.Errorf("got %x, %v", got, err)
+	}
+}
+
+func TestReadHugeHeaderChunks(t *testing.T) {
+	fmtChunk := make([]byte, 16)
+	binary.LittleEndian.PutUint16(fmtChunk[0:], tagPCM)
+	binary.LittleEndian.PutUint16(fmtChunk[2:], 1)
+	binary.LittleEndian.PutUint32(fmtChunk[4:], 8000)
+	binary.LittleEndian.PutUint32(fmtChunk[8:], 16000)
+	binary.LittleEndian.PutUint16(fmtChunk[12:], 2)
+	binary.LittleEndian.PutUint16(fmtChunk[14:], 16)
+	files := map[string][]byte{
+		// The pad byte once overflowed the size to 0.
+		"ds64":       append([]byte("RF64\xff\xff\xff\xffWAVEds64\xff\xff\xff\xff"), samples(64)...),
+		"fmt":        append([]byte("RIFF\xff\xff\xff\xffWAVEfmt \xff\xff\xff\xff"), fmtChunk...),
+		"short ds64": appendChunk([]byte("RF64\xff\xff\xff\xffWAVE"), "ds64", samples(ds64Size-2)),
+	}
+	for name, file := range files {
+		if _, err := NewReader(bytes.NewReader(file)); err != model.ErrInvalidHeader {
+			t.Errorf("%s: got %v, want %v", name, err, model.ErrInvalidHeader)
+		}
+	}
+}
+
+func TestReadGSM(t *testing.T) {
+	pcm := make([]int16, 3*2*160)
+	for i := range pcm {
+		pcm[i] = int16(i * 37 % 8000)
+	}
+	var data []byte
+	enc := gsm.NewEncoder(gsm.WAV49)
+	block := make([]byte, 65)
+	for i := 0; i < len(pcm); i += 320 {
+		enc.Encode(block, pcm[i:])
+		data = append(data, block...)
+	}
+	file := func(blockAlign uint16) []byte {
+		fmtChunk := make([]byte, 20)
+		binary.LittleEndian.PutUint16(fmtChunk[0:], tagGSM610)
+		binary.LittleEndian.PutUint16(fmtChunk[2:], 1)
+		binary.LittleEndian.PutUint32(fmtChunk[4:], 8000)
+		binary.LittleEndian.PutUint32(fmtChunk[8:], 1625)
+		binary.LittleEndian.PutUint16(fmtChunk[12:], blockAlign)
+		binary.LittleEndian.PutUint16(fmtChunk[16:], 2)
+		binary.LittleEndian.PutUint16(fmtChunk[18:], 320)
+		file := []byte("RIFF\x00\x00\x00\x00WAVE")
+		file = appendChunk(file, "fmt ", fmtChunk)
+		file = appendChunk(file, "fact", []byte{0xc0, 0x03, 0, 0})
+		file = appendChunk(file, "data", data)
+		return append(file, "LIST\x02\x00\x00\x00ab"...)
+	}
+
+	r, err := NewReader(bytes.NewReader(file(65)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.StreamInfo() != gsm.Info {
+		t.Errorf("got %+v", r.StreamInfo())
+	}
+	if r.DataSize() != int64(2*len(pcm)) {
+		t.Errorf("got data size %d, want %d", r.DataSize(), 2*len(pcm))
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ioutil.ReadAll(gsm.NewReader(bytes.NewReader(data), gsm.WAV49))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %d bytes of samples differing from the decoder", len(got))
+	}
+
+	if _, err := NewReader(bytes.NewReader(file(33))); err != model.ErrInvalidFormat {
+		t.Errorf("block align 33: got %v", err)
+	}
+}
@@ -0,0 +1,236 @@
+package wav
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/ZhangJYd/pcm_convertor"
+	"github.com/ZhangJYd/pcm_convertor/format"
+	"github.com/ZhangJYd/pcm_convertor/model"
+)
+
+// Writer writes samples described by a StreamInfo as a WAV stream.
+//
+// When the destination is seekable, the header is written with empty sizes that Close
+// fills in, and with room for a ds64 chunk: once the file passes the 4 GB RIFF limit it is
+// turned into RF64. Otherwise the sizes are marked unknown, which Reader and most players
+// take as data running to the end of the stream.
+type Writer struct {
+	w    io.Writer
+	ws   io.WriteSeeker
+	info pcm_convertor.StreamInfo
+	// start is the offset of the header in ws.
+	start      int64
+	junkOffset int64
+	factOffset int64
+	dataOffset int64
+	data       int64
+	rf64       bool
+	// swap turns big-endian samples little-endian, nil if they need no swapping.
+	swap   *format.Swapper
+	closed bool
+}
+
+// maxRIFFSize is the largest RIFF size a plain WAV file can record.
+var maxRIFFSize int64 = 0xffffffff
+
+// NewWriter writes the header for info to w. Big-endian samples are swapped to the
+// little-endian order of WAV.
+func NewWriter(w io.Writer, info pcm_convertor.StreamInfo) (*Writer, error) {
+	if info.SampleRate <= 0 {
+		return nil, model.ErrInvalidSampleRate
+	}
+	if info.Channels <= 0 || info.Channels > 0xffff {
+		return nil, model.ErrInvalidChannels
+	}
+	if _, coded := format.CodecOf(info.Format); coded || info.Format.FrameSize() < 0 {
+		return nil, model.ErrInvalidFormat
+	}
+	wr := &Writer{w: w, info: info}
+	if info.ByteOrder == binary.BigEndian {
+		wr.swap = format.NewSwapper(info.Format)
+	}
+	if ws, ok := w.(io.WriteSeeker); ok {
+		// Files can be pipes; only a working Seek tells.
+		if start, err := ws.Seek(0, io.SeekCurrent); err == nil {
+			wr.ws = ws
+			wr.start = start
+		}
+	}
+	hdr := wr.header()
+	if _, err := w.Write(hdr); err != nil {
+		return nil, err
+	}
+	return wr, nil
+}
+
+// header lays out the RIFF header, fmt and fact chunks and the data chunk header.
+// Extensible is used for more than two channels or more than 16 bits, as Windows asks.
+func (wr *Writer) header() []byte {
+	size := uint32(0)
+	if wr.ws == nil {
+		size = unknownSize
+	}
+	info := wr.info
+	tag := formatTag(info.Format)
+	bits := info.Format.FrameSize() * 8
+	blockAlign := info.Format.FrameSize() * info.Channels
+	extensible := (info.Channels > 2 || bits > 16) && (tag == tagPCM || tag == tagFloat)
+
+	fmtChunk := make([]byte, 16, 40)
+	le.PutUint16(fmtChunk[0:], tag)
+	le.PutUint16(fmtChunk[2:], uint16(info.Channels))
+	le.PutUint32(fmtChunk[4:], uint32(info.SampleRate))
+	le.PutUint32(fmtChunk[8:], uint32(info.SampleRate*blockAlign))
+	le.PutUint16(fmtChunk[12:], uint16(blockAlign))
+	le.PutUint16(fmtChunk[14:], uint16(bits))
+	switch {
+	case extensible:
+		le.PutUint16(fmtChunk[0:], tagExtensible)
+		var ext [24]byte
+		le.PutUint16(ext[0:], 22)
+		le.PutUint16(ext[2:], uint16(bits))
+		le.PutUint32(ext[4:], channelMasks[info.Channels])
+		le.PutUint16(ext[8:], tag)
+		copy(ext[10:], subFormatSuffix)
+		fmtChunk = append(fmtChunk, ext[:]...)
+	case tag != tagPCM:
+		fmtChunk = append(fmtChunk, 0, 0)
+	}
+
+	hdr := []byte("RIFF\x00\x00\x00\x00WAVE")
+	le.PutUint32(hdr[4:], size)
+	if wr.ws != nil {
+		// Room for the ds64 chunk, in case the file grows into RF64.
+		wr.junkOffset = int64(len(hdr))
+		hdr = appendChunk(hdr, "JUNK", make([]byte, ds64Size))
+	}
+	hdr = appendChunk(hdr, "fmt ", fmtChunk)
+	if tag != tagPCM {
+		// Frame count of the data, required for everything but PCM.
+		var fact [4]byte
+		le.PutUint32(fact[:], size)
+		hdr = appendChunk(hdr, "fact", fact[:])
+		wr.factOffset = int64(len(hdr)) - 4
+	}
+	hdr = append(hdr, "data\x00\x00\x00\x00"...)
+	le.PutUint32(hdr[len(hdr)-4:], size)
+	wr.dataOffset = int64(len(hdr)) - 4
+	return hdr
+}
+
+func appendChunk(dst []byte, id string, body []byte) []byte {
+	dst = append(dst, id...)
+	dst = append(dst, 0, 0, 0, 0)
+	le.PutUint32(dst[len(dst)-4:], uint32(len(body)))
+	return append(dst, body...)
+}
+
+// Write writes samples in the format given to NewWriter.
+func (wr *Writer) Write(p []byte) (int, error) {
+	if wr.closed {
+		return 0, model.ErrClosed
+	}
+	data, held := p, 0
+	if wr.swap != nil {
+		held = wr.swap.Held()
+		data = wr.swap.Swap(p)
+	}
+	n, err := wr.w.Write(data)
+	wr.data += int64(n)
+	if err != nil {
+		// The bytes held back from the last call went out first.
+		if n -= held; n < 0 {
+			n = 0
+		}
+		return n, err
+	}
+	if wr.ws != nil && !wr.rf64 && wr.riffSize() > maxRIFFSize {
+		if err := wr.upgrade(); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+func (wr *Writer) riffSize() int64 {
+	return wr.dataOffset + 4 + wr.data + wr.data%2 - 8
+}
+
+// upgrade turns the header into an RF64 one whose sizes are in the ds64 chunk. Close
+// fills them in.
+func (wr *Writer) upgrade() error {
+	wr.rf64 = true
+	unknown := le32(unknownSize)
+	patches := []patch{
+		{0, []byte("RF64")},
+		{4, unknown},
+		{wr.junkOffset, []byte("ds64")},
+		{wr.dataOffset, unknown},
+	}
+	if wr.factOffset != 0 {
+		patches = append(patches, patch{wr.factOffset, unknown})
+	}
+	return wr.rewrite(patches)
+}
+
+// Close pads the data chunk to an even length and fills in the sizes of the header if
+// the destination is seekable. It does not close the destination.
+func (wr *Writer) Close() error {
+	if wr.closed {
+		return model.ErrClosed
+	}
+	wr.closed = true
+	if wr.data%2 == 1 {
+		if _, err := wr.w.Write([]byte{0}); err != nil {
+			return err
+		}
+	}
+	if wr.ws == nil {
+		return nil
+	}
+	frames := wr.data / int64(wr.info.Format.FrameSize()*wr.info.Channels)
+	var patches []patch
+	if wr.rf64 {
+		ds64 := make([]byte, ds64Size)
+		le.PutUint64(ds64[0:], uint64(wr.riffSize()))
+		le.PutUint64(ds64[8:], uint64(wr.data))
+		le.PutUint64(ds64[16:], uint64(frames))
+		patches = append(patches, patch{wr.junkOffset + 8, ds64})
+	} else {
+		patches = append(patches, patch{4, le32(uint32(wr.riffSize()))}, patch{wr.dataOffset, le32(uint32(wr.data))})
+		if wr.factOffset != 0 {
+			patches = append(patches, patch{wr.factOffset, le32(uint32(frames))})
+		}
+	}
+	return wr.rewrite(patches)
+}
+
+type patch struct {
+	offset int64
+	data   []byte
+}
+
+// rewrite writes the patches over the header and goes back to the end of the data.
+func (wr *Writer) rewrite(patches []patch) error {
+	end, err := wr.ws.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	for _, p := range patches {
+		if _, err := wr.ws.Seek(wr.start+p.offset, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := wr.ws.Write(p.data); err != nil {
+			return err
+		}
+	}
+	_, err = wr.ws.Seek(end, io.SeekStart)
+	return err
+}
+
+func le32(v uint32) []byte {
+	b := make([]byte, 4)
+	le.PutUint32(b, v)
+	return b
+}